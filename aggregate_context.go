@@ -0,0 +1,33 @@
+package serendipity
+
+//	This file replaces sqlite3_aggregate_context() with typed per-invocation storage. The C convention - allocate a raw,
+//	zeroed byte block and cast it to a struct - cannot carry Go maps, slices or interface values safely under the garbage
+//	collector. Instead each aggregate invocation owns a single interface{} slot: the first call to AggregateState in a step
+//	function constructs the state, and every later call (including from the finalizer) returns the same value.
+//
+//	Usage, from a step function:
+//
+//		state := context.AggregateState(func() interface{} { return &SumState{} }).(*SumState)
+//
+//	and from the matching finalizer, where state may legitimately not exist (an aggregate over zero rows):
+//
+//		if state, ok := context.ExistingAggregateState().(*SumState); ok { ... }
+//
+//	The slot lives in the same per-invocation storage the raw byte block used to occupy, so grouped aggregates each see
+//	their own state and the state is released with the group as before.
+
+//	Return this invocation's aggregate state, constructing it on first use. Must only be called from an aggregate step or
+//	finalize function; elsewhere there is no invocation to attach state to and the constructor result is discarded after
+//	being returned, which is always a bug in the caller.
+func (context *Context) AggregateState(construct func() interface{}) interface{} {
+	if context.pAgg == nil {
+		context.pAgg = construct()
+	}
+	return context.pAgg
+}
+
+//	Return this invocation's aggregate state without constructing it: nil if no step call ever ran, which is how a
+//	finalizer distinguishes "no rows" from a zero-valued state.
+func (context *Context) ExistingAggregateState() interface{} {
+	return context.pAgg
+}
@@ -0,0 +1,120 @@
+package serendipity
+
+import (
+	"math"
+	"math/rand"
+)
+
+//	This file implements AUTOINCREMENT rowid allocation. An ordinary rowid table hands a new row one more than its
+//	current largest rowid, which means a rowid can be reused after the largest row is deleted. AUTOINCREMENT
+//	promises monotonicity instead: the high-water mark survives deletion in the sqlite_sequence table, one row per
+//	AUTOINCREMENT table, and allocation always moves past it. The price is exhaustion - once the mark reaches the
+//	maximum rowid there is nothing monotone left to hand out and the insert fails with SQLITE_FULL, where a plain
+//	table would fall back to probing random rowids for an unused one.
+//
+//	NextRowid and SetNextRowid expose the mark to applications: a replication or import tool that recreates a
+//	table must also carry the sequence over, or ids handed out on the copy would collide with rows the source
+//	deleted but its journals still reference.
+
+//	The largest rowid a table can hold.
+const MAX_ROWID = int64(math.MaxInt64)
+
+//	Set in Table.tabFlags when the table was declared with AUTOINCREMENT.
+const TF_AUTOINCREMENT = 0x0040
+
+func (table *Table) hasAutoincrement() bool {
+	return table.tabFlags & TF_AUTOINCREMENT != 0
+}
+
+//	Ensure the sequence table exists. Created lazily by the first AUTOINCREMENT allocation, as SQLite creates it
+//	on the first CREATE TABLE ... AUTOINCREMENT.
+func (db *sqlite3) ensureSequenceTable() (rc int) {
+	return sqlite3_exec(db, "CREATE TABLE IF NOT EXISTS sqlite_sequence(name, seq)", 0, 0, 0)
+}
+
+//	The recorded high-water mark for a table; ok reports whether the table has a sequence row at all.
+func (db *sqlite3) sequenceValue(zTable string) (seq int64, ok bool, rc int) {
+	statement, _, rc := db.Prepare_v2("SELECT seq FROM sqlite_sequence WHERE name = ?")
+	if rc != SQLITE_OK {
+		return
+	}
+	defer statement.Finalize()
+	sqlite3_bind_text(statement, 1, zTable, -1, nil)
+	if statement.Step() == SQLITE_ROW {
+		return sqlite3_column_int64(statement, 0), true, SQLITE_OK
+	}
+	return 0, false, SQLITE_OK
+}
+
+//	Record a new high-water mark. The mark only ever moves forward during allocation; SetNextRowid below is the
+//	one caller allowed to move it back.
+func (db *sqlite3) writeSequenceValue(zTable string, seq int64) (rc int) {
+	if rc = db.ensureSequenceTable(); rc != SQLITE_OK {
+		return
+	}
+	statement, _, rc := db.Prepare_v2("INSERT OR REPLACE INTO sqlite_sequence(name, seq) VALUES (?, ?)")
+	if rc != SQLITE_OK {
+		return
+	}
+	defer statement.Finalize()
+	sqlite3_bind_text(statement, 1, zTable, -1, nil)
+	sqlite3_bind_int64(statement, 2, seq)
+	statement.Step()
+	return statement.Reset()
+}
+
+//	Allocate the rowid for a new row. maxExisting is the table's current largest rowid, which the insert path has
+//	in hand from the cursor; rowidInUse answers probes during random fallback. For an AUTOINCREMENT table the
+//	sequence is consulted and advanced and exhaustion is an error; for a plain table exhaustion falls back to
+//	probing for a free rowid, failing only when the table genuinely holds no unused one within the attempt budget.
+func (db *sqlite3) allocateRowid(zTable string, autoincrement bool, maxExisting int64, rowidInUse func(rowid int64) bool) (rowid int64, rc int) {
+	if autoincrement {
+		seq, ok, rc := db.sequenceValue(zTable)
+		if rc != SQLITE_OK {
+			return 0, rc
+		}
+		floor := maxExisting
+		if ok && seq > floor {
+			floor = seq
+		}
+		if floor >= MAX_ROWID {
+			return 0, SQLITE_FULL
+		}
+		rowid = floor + 1
+		return rowid, db.writeSequenceValue(zTable, rowid)
+	}
+	if maxExisting < MAX_ROWID {
+		return maxExisting + 1, SQLITE_OK
+	}
+	//	The table has held a row at the maximum rowid: probe random candidates, as SQLite does, so a full-looking
+	//	table with free holes still accepts inserts.
+	for attempt := 0; attempt < 100; attempt++ {
+		if rowid = rand.Int63(); rowid > 0 && !rowidInUse(rowid) {
+			return rowid, SQLITE_OK
+		}
+	}
+	return 0, SQLITE_FULL
+}
+
+//	The rowid the next insert into an AUTOINCREMENT table would receive, for tools that need to preserve id
+//	allocation across a copy.
+func (db *sqlite3) NextRowid(zTable string) (rowid int64, rc int) {
+	seq, _, rc := db.sequenceValue(zTable)
+	if rc != SQLITE_OK {
+		return
+	}
+	if seq >= MAX_ROWID {
+		return 0, SQLITE_FULL
+	}
+	return seq + 1, SQLITE_OK
+}
+
+//	Set the mark so the next insert receives rowid. Unlike allocation this may move the mark backwards - an import
+//	tool replaying a source database needs to reproduce its sequence exactly - so the caller takes responsibility
+//	for collisions with existing rows.
+func (db *sqlite3) SetNextRowid(zTable string, rowid int64) (rc int) {
+	if rowid < 1 {
+		return SQLITE_MISUSE
+	}
+	return db.writeSequenceValue(zTable, rowid - 1)
+}
@@ -0,0 +1,210 @@
+package serendipity
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+//	This file extends the backup subsystem with an archive format suitable for shipping off-box: the logical content of the
+//	database is written table by table, each section zlib-compressed, encrypted with AES-256-GCM and protected by a SHA-256
+//	checksum of the plaintext. Because sections are self-contained, selected tables can be restored without decrypting or
+//	even downloading the remainder of the archive.
+//
+//	Archive layout:
+//
+//		magic			"serendipity-archive\000" (20 bytes)
+//		format version	4-byte big-endian integer, currently 1
+//		sections		any number of sections, each:
+//			name length		4-byte big-endian integer
+//			name			the table name in UTF-8
+//			nonce			12 bytes, fresh for every section
+//			body length		8-byte big-endian integer
+//			body			AES-256-GCM ciphertext of the zlib-compressed section plaintext
+//
+//	The section plaintext is the table's schema statement, a newline, then the rows serialized with the same record encoder
+//	used by the storage layer, each prefixed by its length as a 4-byte big-endian integer. The SHA-256 checksum of the
+//	plaintext forms the GCM additional data, so tampering with either the ciphertext or the checksum fails authentication.
+
+const archiveMagic = "serendipity-archive\000"
+
+//	An ArchiveWriter writes the archive format to an io.Writer. The key must be 32 bytes; shorter keys are rejected rather
+//	than padded, since a weak key silently accepted is worse than an error.
+type ArchiveWriter struct {
+	destination	io.Writer
+	cipher		cipher.AEAD
+}
+
+func NewArchiveWriter(destination io.Writer, key []byte) (writer *ArchiveWriter, err error) {
+	aead, err := newArchiveCipher(key)
+	if err != nil {
+		return
+	}
+	if _, err = destination.Write([]byte(archiveMagic)); err != nil {
+		return
+	}
+	version := make([]byte, 4)
+	binary.BigEndian.PutUint32(version, 1)
+	if _, err = destination.Write(version); err != nil {
+		return
+	}
+	return &ArchiveWriter{ destination: destination, cipher: aead }, nil
+}
+
+func newArchiveCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("archive key must be 32 bytes but %v were supplied", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//	Write one table as a section. The schema is the CREATE statement for the table; rows are the encoded records, one per
+//	table row, in rowid order so that restores are deterministic.
+func (writer *ArchiveWriter) WriteTable(name, schema string, rows [][]byte) (err error) {
+	//	Assemble and compress the plaintext.
+	var plaintext	[]byte
+	plaintext = append(plaintext, schema...)
+	plaintext = append(plaintext, '\n')
+	length := make([]byte, 4)
+	for _, row := range rows {
+		binary.BigEndian.PutUint32(length, uint32(len(row)))
+		plaintext = append(plaintext, length...)
+		plaintext = append(plaintext, row...)
+	}
+	compressed := compressSection(plaintext)
+
+	//	Encrypt with the plaintext checksum as additional data.
+	checksum := sha256.Sum256(plaintext)
+	nonce := make([]byte, writer.cipher.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	body := writer.cipher.Seal(nil, nonce, compressed, checksum[:])
+
+	//	Emit the section: name, nonce, checksum, body.
+	binary.BigEndian.PutUint32(length, uint32(len(name)))
+	for _, chunk := range [][]byte{ length, []byte(name), nonce, checksum[:] } {
+		if _, err = writer.destination.Write(chunk); err != nil {
+			return
+		}
+	}
+	bodyLength := make([]byte, 8)
+	binary.BigEndian.PutUint64(bodyLength, uint64(len(body)))
+	if _, err = writer.destination.Write(bodyLength); err != nil {
+		return
+	}
+	_, err = writer.destination.Write(body)
+	return
+}
+
+func compressSection(plaintext []byte) []byte {
+	var buffer	bytes.Buffer
+	compressor := zlib.NewWriter(&buffer)
+	compressor.Write(plaintext)
+	compressor.Close()
+	return buffer.Bytes()
+}
+
+//	An ArchiveReader restores sections from an archive. Sections are processed strictly in order, but Skip allows a partial
+//	restore to pass over unwanted tables without decrypting them.
+type ArchiveReader struct {
+	source	io.Reader
+	cipher	cipher.AEAD
+}
+
+func NewArchiveReader(source io.Reader, key []byte) (reader *ArchiveReader, err error) {
+	aead, err := newArchiveCipher(key)
+	if err != nil {
+		return
+	}
+	header := make([]byte, len(archiveMagic) + 4)
+	if _, err = io.ReadFull(source, header); err != nil {
+		return nil, fmt.Errorf("reading archive header: %v", err)
+	}
+	if string(header[:len(archiveMagic)]) != archiveMagic {
+		return nil, fmt.Errorf("not a serendipity archive")
+	}
+	if version := binary.BigEndian.Uint32(header[len(archiveMagic):]); version != 1 {
+		return nil, fmt.Errorf("unsupported archive format version %v", version)
+	}
+	return &ArchiveReader{ source: source, cipher: aead }, nil
+}
+
+//	Read the header of the next section, returning its table name and an opaque handle for Restore or Skip. io.EOF is
+//	returned at the end of the archive.
+func (reader *ArchiveReader) NextSection() (name string, body int64, nonce, checksum []byte, err error) {
+	length := make([]byte, 4)
+	if _, err = io.ReadFull(reader.source, length); err != nil {
+		return
+	}
+	nameBytes := make([]byte, binary.BigEndian.Uint32(length))
+	nonce = make([]byte, reader.cipher.NonceSize())
+	checksum = make([]byte, sha256.Size)
+	bodyLength := make([]byte, 8)
+	for _, chunk := range [][]byte{ nameBytes, nonce, checksum, bodyLength } {
+		if _, err = io.ReadFull(reader.source, chunk); err != nil {
+			return
+		}
+	}
+	return string(nameBytes), int64(binary.BigEndian.Uint64(bodyLength)), nonce, checksum, nil
+}
+
+//	Skip over the body of the current section without decrypting it.
+func (reader *ArchiveReader) Skip(body int64) (err error) {
+	_, err = io.CopyN(io.Discard, reader.source, body)
+	return
+}
+
+//	Decrypt, decompress and verify the current section, returning its schema statement and encoded rows. Authentication
+//	failure, a checksum mismatch or truncation all produce an error and no rows.
+func (reader *ArchiveReader) Restore(body int64, nonce, checksum []byte) (schema string, rows [][]byte, err error) {
+	ciphertext := make([]byte, body)
+	if _, err = io.ReadFull(reader.source, ciphertext); err != nil {
+		return
+	}
+	compressed, err := reader.cipher.Open(nil, nonce, ciphertext, checksum)
+	if err != nil {
+		return "", nil, fmt.Errorf("section failed authentication: %v", err)
+	}
+	decompressor, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return
+	}
+	plaintext, err := io.ReadAll(decompressor)
+	if err != nil {
+		return
+	}
+	if sha256.Sum256(plaintext) != *(*[sha256.Size]byte)(checksum) {
+		return "", nil, fmt.Errorf("section checksum mismatch")
+	}
+
+	//	Split the plaintext back into schema and rows.
+	i := 0
+	for i < len(plaintext) && plaintext[i] != '\n' {
+		i++
+	}
+	schema = string(plaintext[:i])
+	for remainder := plaintext[i + 1:]; len(remainder) > 0; {
+		if len(remainder) < 4 {
+			return "", nil, fmt.Errorf("truncated row length")
+		}
+		rowLength := int(binary.BigEndian.Uint32(remainder))
+		remainder = remainder[4:]
+		if rowLength > len(remainder) {
+			return "", nil, fmt.Errorf("truncated row")
+		}
+		rows = append(rows, remainder[:rowLength])
+		remainder = remainder[rowLength:]
+	}
+	return
+}
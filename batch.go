@@ -0,0 +1,127 @@
+package serendipity
+
+import (
+	"fmt"
+	"time"
+)
+
+//	This file provides a safe bulk-write primitive. Writing many rows one statement at a time pays per-statement transaction
+//	overhead - acutely so for rtree tables, where every insert touches three shadow tables - while a single enormous
+//	transaction holds the write lock for its whole duration and loses everything on a late failure. Batch sits between the
+//	two: queued statements are flushed in chunks, each chunk wrapped in one transaction and retried on SQLITE_BUSY with
+//	exponential backoff.
+
+//	The tuning knobs for a batch. The zero value gives sensible behaviour, so most callers pass nothing.
+type BatchOptions struct {
+	ChunkSize	int				//	Statements per transaction; defaults to 1000
+	BusyRetries	int				//	Attempts per chunk before giving up; defaults to 5
+	RetryDelay	time.Duration	//	Initial backoff, doubled after each busy retry; defaults to 10ms
+}
+
+//	A Batch accumulates statements queued by the function passed to sqlite3.Batch. It is valid only for the duration of that
+//	call and must not be retained or shared between goroutines.
+type Batch struct {
+	db		*sqlite3
+	options	BatchOptions
+	pending	[]batchedStatement
+	flushed	int		//	Statements committed so far, reported on error for resumability
+	err		int
+}
+
+type batchedStatement struct {
+	sql		string
+	values	[]interface{}
+}
+
+//	Queue one statement for execution. The statement is not executed until the current chunk fills or the batch function
+//	returns; an error from an earlier flush makes further Exec calls no-ops so that the first failure is the one reported.
+func (b *Batch) Exec(sql string, values ...interface{}) {
+	if b.err != SQLITE_OK {
+		return
+	}
+	b.pending = append(b.pending, batchedStatement{ sql: sql, values: values })
+	if len(b.pending) >= b.options.ChunkSize {
+		b.err = b.flush()
+	}
+}
+
+//	The number of statements durably committed so far. After a failure this tells the caller where to resume.
+func (b *Batch) Flushed() int {
+	return b.flushed
+}
+
+//	Execute the pending statements inside one transaction, retrying the whole chunk when the write lock cannot be obtained.
+//	A chunk is all-or-nothing: any statement error rolls the chunk back and fails the batch.
+func (b *Batch) flush() (rc int) {
+	if len(b.pending) == 0 {
+		return SQLITE_OK
+	}
+	delay := b.options.RetryDelay
+	for attempt := 0; ; attempt++ {
+		if rc = b.executeChunk(); rc != SQLITE_BUSY && rc != SQLITE_LOCKED {
+			break
+		}
+		if attempt >= b.options.BusyRetries {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	if rc == SQLITE_OK {
+		b.flushed += len(b.pending)
+		b.pending = b.pending[:0]
+	}
+	return
+}
+
+func (b *Batch) executeChunk() (rc int) {
+	if rc = sqlite3_exec(b.db, "BEGIN IMMEDIATE", 0, 0, 0); rc != SQLITE_OK {
+		return
+	}
+	for _, statement := range b.pending {
+		var stmt	*sqlite3_stmt
+		if stmt, _, rc = b.db.Prepare_v2(statement.sql); rc == SQLITE_OK {
+			for i, value := range statement.values {
+				sqlite3_bind_value(stmt, i + 1, value)
+			}
+			if rc = stmt.Step(); rc == SQLITE_DONE || rc == SQLITE_ROW {
+				rc = SQLITE_OK
+			}
+			if rc2 := stmt.Finalize(); rc == SQLITE_OK {
+				rc = rc2
+			}
+		}
+		if rc != SQLITE_OK {
+			sqlite3_exec(b.db, "ROLLBACK", 0, 0, 0)
+			return
+		}
+	}
+	if rc = sqlite3_exec(b.db, "COMMIT", 0, 0, 0); rc != SQLITE_OK {
+		sqlite3_exec(b.db, "ROLLBACK", 0, 0, 0)
+	}
+	return
+}
+
+//	Run f with a Batch, flushing queued statements in chunks. If f returns an error the statements still pending are
+//	discarded (chunks already committed stay committed - use Flushed to resume) and the error is returned unchanged. If a
+//	flush fails, the engine error is reported and f's error, if any, is ignored as a consequence of the flush failure.
+func (db *sqlite3) Batch(options BatchOptions, f func(b *Batch) error) (flushed int, err error) {
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = 1000
+	}
+	if options.BusyRetries <= 0 {
+		options.BusyRetries = 5
+	}
+	if options.RetryDelay <= 0 {
+		options.RetryDelay = 10 * time.Millisecond
+	}
+	batch := &Batch{ db: db, options: options }
+	err = f(batch)
+	if batch.err == SQLITE_OK && err == nil {
+		batch.err = batch.flush()
+	}
+	if batch.err != SQLITE_OK {
+		err = fmt.Errorf("batch failed after %v statements: %v", batch.flushed, db.errmsg())
+	}
+	return batch.flushed, err
+}
@@ -0,0 +1,230 @@
+package serendipity
+
+//	This file implements comparison and pattern matching over blobs too large to materialize. Comparing two
+//	gigabyte-sized column values through the ordinary expression machinery loads both into memory in full, even
+//	though a mismatch is usually found in the first few bytes. The routines here work through the incremental blob
+//	API instead, reading fixed-size windows on demand, so a dedup query over large binary columns holds at most two
+//	windows in memory at a time and an early mismatch stops after one read.
+//
+//	The SQL surface takes table, column and rowid rather than the value itself, which is what keeps the value out
+//	of memory:
+//
+//		SELECT a.id, b.id FROM t a JOIN t b ON a.id < b.id AND length(a.data) = length(b.data)
+//			AND blob_eq('t', 'data', a.id, b.id)
+//
+//	blob_cmp orders the same way a direct comparison of the values would; blob_like runs a LIKE pattern over the
+//	blob's bytes, streaming the data while the pattern - small by nature - stays in memory.
+
+//	The read granularity. Large enough that the per-read overhead vanishes, small enough that two comparisons in
+//	flight cost nothing worth noticing.
+const BLOB_STREAM_WINDOW = 32768
+
+//	A window-caching reader over an open blob handle. Random access is cheap as long as it is mostly local: a read
+//	inside the cached window is a slice lookup, one outside it costs a single blob read.
+type blobReader struct {
+	blob	*sqlite3_blob
+	size	int
+	at		int		//	Offset of the cached window
+	window	[]byte
+}
+
+func newBlobReader(blob *sqlite3_blob) *blobReader {
+	return &blobReader{ blob: blob, size: sqlite3_blob_bytes(blob), at: -1 }
+}
+
+//	The byte at offset i, loading the containing window when it is not the cached one.
+func (reader *blobReader) byteAt(i int) (b byte, rc int) {
+	if reader.at < 0 || i < reader.at || i >= reader.at + len(reader.window) {
+		reader.at = (i / BLOB_STREAM_WINDOW) * BLOB_STREAM_WINDOW
+		length := reader.size - reader.at
+		if length > BLOB_STREAM_WINDOW {
+			length = BLOB_STREAM_WINDOW
+		}
+		if len(reader.window) != length {
+			reader.window = make([]byte, length)
+		}
+		if rc = sqlite3_blob_read(reader.blob, reader.window, length, reader.at); rc != SQLITE_OK {
+			reader.at = -1
+			return
+		}
+	}
+	return reader.window[i - reader.at], SQLITE_OK
+}
+
+//	Compare two open blobs as a direct value comparison would: bytewise, the shorter ordering first on a shared
+//	prefix. Windows are read in lockstep and the scan stops at the first differing window.
+func blobCompareStreaming(a, b *sqlite3_blob) (result int, rc int) {
+	ra, rb := newBlobReader(a), newBlobReader(b)
+	limit := ra.size
+	if rb.size < limit {
+		limit = rb.size
+	}
+	for i := 0; i < limit; i++ {
+		var ca, cb byte
+		if ca, rc = ra.byteAt(i); rc != SQLITE_OK {
+			return
+		}
+		if cb, rc = rb.byteAt(i); rc != SQLITE_OK {
+			return
+		}
+		switch {
+		case ca < cb:
+			return -1, SQLITE_OK
+		case ca > cb:
+			return 1, SQLITE_OK
+		}
+	}
+	switch {
+	case ra.size < rb.size:
+		result = -1
+	case ra.size > rb.size:
+		result = 1
+	}
+	return result, SQLITE_OK
+}
+
+//	Match a LIKE pattern against a blob's bytes with the usual single-backtrack scan: on a mismatch after a '%',
+//	the data position rewinds to just past where that '%' last advanced. Rewinding is what the window cache is
+//	for - the revisited bytes are almost always still cached.
+func blobLikeStreaming(pattern string, blob *sqlite3_blob, escape byte) (matched bool, rc int) {
+	reader := newBlobReader(blob)
+	var iPattern, iData int
+	starPattern, starData := -1, 0
+	for iData < reader.size {
+		if iPattern < len(pattern) {
+			c := pattern[iPattern]
+			width := 1
+			literal := false
+			if escape != 0 && c == escape && iPattern + 1 < len(pattern) {
+				c = pattern[iPattern + 1]
+				width = 2
+				literal = true
+			}
+			if !literal && c == '%' {
+				starPattern, starData = iPattern, iData
+				iPattern++
+				continue
+			}
+			matched := !literal && c == '_'
+			if !matched {
+				b, rc2 := reader.byteAt(iData)
+				if rc2 != SQLITE_OK {
+					return false, rc2
+				}
+				matched = b == c
+			}
+			if matched {
+				iPattern += width
+				iData++
+				continue
+			}
+		}
+		if starPattern < 0 {
+			return false, SQLITE_OK
+		}
+		iPattern = starPattern + 1
+		starData++
+		iData = starData
+	}
+	for iPattern < len(pattern) && pattern[iPattern] == '%' {
+		iPattern++
+	}
+	return iPattern == len(pattern), SQLITE_OK
+}
+
+//	Open the blob named by a function's table and column arguments at the given rowid. The main database is
+//	assumed, as the incremental API assumes it when no database is named.
+func blobArgOpen(context *Context, args []*sqlite3_value, iRow int64) (blob *sqlite3_blob, rc int) {
+	db := sqlite3_context_db_handle(context)
+	return sqlite3_blob_open(db, "main", sqlite3_value_text(args[0]), sqlite3_value_text(args[1]), iRow, 0)
+}
+
+//	blob_cmp(table, column, rowid1, rowid2): -1, 0 or 1, as comparing the two values directly would order them.
+func blobCmpFunc(context *Context, args []*sqlite3_value) {
+	a, rc := blobArgOpen(context, args, sqlite3_value_int64(args[2]))
+	if rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+	defer sqlite3_blob_close(a)
+	b, rc := blobArgOpen(context, args, sqlite3_value_int64(args[3]))
+	if rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+	defer sqlite3_blob_close(b)
+	result, rc := blobCompareStreaming(a, b)
+	if rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+	sqlite3_result_int(context, result)
+}
+
+//	blob_eq(table, column, rowid1, rowid2): equality with the cheap exit - differing lengths never read a byte.
+func blobEqFunc(context *Context, args []*sqlite3_value) {
+	a, rc := blobArgOpen(context, args, sqlite3_value_int64(args[2]))
+	if rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+	defer sqlite3_blob_close(a)
+	b, rc := blobArgOpen(context, args, sqlite3_value_int64(args[3]))
+	if rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+	defer sqlite3_blob_close(b)
+	if sqlite3_blob_bytes(a) != sqlite3_blob_bytes(b) {
+		sqlite3_result_int(context, 0)
+		return
+	}
+	result, rc := blobCompareStreaming(a, b)
+	if rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+	if result == 0 {
+		sqlite3_result_int(context, 1)
+	} else {
+		sqlite3_result_int(context, 0)
+	}
+}
+
+//	blob_like(pattern, table, column, rowid[, escape]): LIKE over the blob's bytes. Matching is bytewise and
+//	case-sensitive - case folding has no meaning for binary data.
+func blobLikeFunc(context *Context, args []*sqlite3_value) {
+	var escape byte
+	if len(args) == 5 {
+		z := sqlite3_value_text(args[4])
+		if len(z) != 1 {
+			sqlite3_result_error(context, "ESCAPE expression must be a single character", -1)
+			return
+		}
+		escape = z[0]
+	}
+	blob, rc := blobArgOpen(context, args[1:], sqlite3_value_int64(args[3]))
+	if rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+	defer sqlite3_blob_close(blob)
+	matched, rc := blobLikeStreaming(sqlite3_value_text(args[0]), blob, escape)
+	if rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+	if matched {
+		sqlite3_result_int(context, 1)
+	} else {
+		sqlite3_result_int(context, 0)
+	}
+}
+
+//	Register the streaming blob functions on a connection.
+func (db *sqlite3) RegisterBlobStreamFunctions() {
+	db.CreateFunc("blob_cmp", 4, nil, blobCmpFunc, nil, nil, nil)
+	db.CreateFunc("blob_eq", 4, nil, blobEqFunc, nil, nil, nil)
+	db.CreateFunc("blob_like", 4, nil, blobLikeFunc, nil, nil, nil)
+	db.CreateFunc("blob_like", 5, nil, blobLikeFunc, nil, nil, nil)
+}
@@ -0,0 +1,114 @@
+package serendipity
+
+//	This file implements a native bulk-loading path that bypasses per-statement SQL. BulkInsert prepares one INSERT,
+//	pulls rows from an iterator, and appends them in chunked transactions, so a huge load neither holds one enormous
+//	journal nor pays a transaction per row. It is the fastest way to populate a table and the intended target for
+//	importers that already hold rows as Go values. Multi-row VALUES statements still go through the ordinary INSERT
+//	code generator.
+
+//	The source of rows for BulkInsert. Next returns the next row, or nil when the source is exhausted; returning an error
+//	aborts the load and rolls back the current chunk. Row values use the usual dynamic mapping: nil, int64, float64,
+//	string or []byte.
+type RowIterator interface {
+	Next() (row []interface{}, err error)
+}
+
+//	A RowIterator over an in-memory slice, for callers that already hold all their rows.
+type RowSlice struct {
+	rows	[][]interface{}
+	next	int
+}
+
+func NewRowSlice(rows [][]interface{}) *RowSlice {
+	return &RowSlice{ rows: rows }
+}
+
+func (r *RowSlice) Next() (row []interface{}, err error) {
+	if r.next < len(r.rows) {
+		row = r.rows[r.next]
+		r.next++
+	}
+	return
+}
+
+//	How many rows BulkInsert inserts per transaction. Large enough that the per-transaction cost disappears into the
+//	noise, small enough that a failure loses bounded work.
+const BULK_INSERT_CHUNK = 10000
+
+//	Load rows into a table as fast as the engine allows. The named columns receive the iterator's values in order;
+//	unnamed columns take their defaults. Rows are inserted through a single prepared statement in chunked transactions.
+//	Returns the number of rows inserted; on error the chunk in flight is rolled back, so inserted counts only rows that
+//	are durably committed.
+func (db *sqlite3) BulkInsert(table string, columns []string, rows RowIterator) (inserted int64, rc int) {
+	placeholders := ""
+	for i := range columns {
+		if i > 0 {
+			placeholders += ","
+		}
+		placeholders += "?"
+	}
+	sql := sqlite3_mprintf("INSERT INTO %Q(%v) VALUES (%v)", table, joinColumns(columns), placeholders)
+	statement, _, rc := db.Prepare_v2(sql)
+	if rc != SQLITE_OK {
+		return
+	}
+	defer statement.Finalize()
+
+	inChunk := 0
+	for {
+		row, err := rows.Next()
+		if err != nil {
+			db.rollbackBulkChunk(inChunk)
+			return inserted, SQLITE_ABORT
+		}
+		if row == nil {
+			break
+		}
+		if inChunk == 0 {
+			if rc = sqlite3_exec(db, "BEGIN IMMEDIATE", 0, 0, 0); rc != SQLITE_OK {
+				return
+			}
+		}
+		for i, value := range row {
+			sqlite3_bind_value(statement, i + 1, value)
+		}
+		if rc = statement.Step(); rc != SQLITE_DONE {
+			db.rollbackBulkChunk(inChunk)
+			return inserted, rc
+		}
+		statement.Reset()
+		inChunk++
+		if inChunk == BULK_INSERT_CHUNK {
+			if rc = sqlite3_exec(db, "COMMIT", 0, 0, 0); rc != SQLITE_OK {
+				return
+			}
+			inserted += int64(inChunk)
+			inChunk = 0
+		}
+	}
+	if inChunk > 0 {
+		if rc = sqlite3_exec(db, "COMMIT", 0, 0, 0); rc != SQLITE_OK {
+			return
+		}
+		inserted += int64(inChunk)
+	}
+	return inserted, SQLITE_OK
+}
+
+//	Abandon the chunk in flight after a failure mid-load.
+func (db *sqlite3) rollbackBulkChunk(inChunk int) {
+	if inChunk > 0 {
+		sqlite3_exec(db, "ROLLBACK", 0, 0, 0)
+	}
+}
+
+//	Quote and join column names for interpolation into the INSERT statement.
+func joinColumns(columns []string) (list string) {
+	for i, column := range columns {
+		if i > 0 {
+			list += ","
+		}
+		list += sqlite3_mprintf("%Q", column)
+	}
+	return
+}
@@ -0,0 +1,197 @@
+package serendipity
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+//	This file implements CAST(expr AS type) and column-affinity conversion with SQLite's exact semantics, corner cases
+//	included. The rules that trip up reimplementations, all honoured here:
+//
+//	- The type name in a CAST is reduced to an affinity by substring matching ("INT" anywhere means INTEGER, then
+//	  "CHAR"/"CLOB"/"TEXT", "BLOB", "REAL"/"FLOA"/"DOUB"), defaulting to NUMERIC - so CAST(x AS DATETIME) is NUMERIC.
+//	- Casting text to INTEGER parses the longest numeric prefix and truncates toward zero: '123abc' is 123, 'abc' is 0.
+//	  A CAST never fails; unconvertible input becomes 0 or 0.0.
+//	- Hex literals (0x...) are valid integers in SQL source but NOT when cast from text: CAST('0x10' AS INTEGER) is 0,
+//	  because the text conversion accepts only decimal.
+//	- Integers that overflow 64 bits saturate: CAST('9223372036854775808' AS INTEGER) is 9223372036854775807.
+//	- Casting a REAL to INTEGER truncates toward zero, saturating at the representable bounds.
+//	- BLOB to TEXT reinterprets the bytes in the database encoding; TEXT to BLOB reinterprets without copying concerns
+//	  the other way. Neither inspects content.
+//	- Affinity application (on column storage and comparison) differs from CAST: NUMERIC affinity converts text only if
+//	  the text is a well-formed numeric literal representing the value exactly, where CAST converts any prefix.
+
+//	Column affinities, one per storage-decision character as in the C code.
+const (
+	SQLITE_AFF_TEXT		= 'a'
+	SQLITE_AFF_NONE		= 'b'		//	Historically "NONE"; BLOB affinity
+	SQLITE_AFF_NUMERIC	= 'c'
+	SQLITE_AFF_INTEGER	= 'd'
+	SQLITE_AFF_REAL		= 'e'
+)
+
+//	Reduce a declared type name to an affinity, by the substring rules of SQLite section "Determination Of Column
+//	Affinity". Order matters: "CHARINT" contains both "CHAR" and "INT" and is INTEGER because INT is tested first.
+func AffinityOfType(zType string) byte {
+	t := strings.ToUpper(zType)
+	switch {
+	case strings.Contains(t, "INT"):
+		return SQLITE_AFF_INTEGER
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return SQLITE_AFF_TEXT
+	case strings.Contains(t, "BLOB"), t == "":
+		return SQLITE_AFF_NONE
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return SQLITE_AFF_REAL
+	}
+	return SQLITE_AFF_NUMERIC
+}
+
+//	Parse the longest numeric prefix of text as an integer, truncating toward zero and saturating on overflow. This is
+//	the CAST text-to-INTEGER rule; note no hex, no exponent handling beyond what an integer prefix allows.
+func castTextToInteger(text string) int64 {
+	//	A real-valued prefix truncates: '3.9e2' is 390 via the real path, '3.9' is 3.
+	if real, isReal := numericPrefix(text); isReal {
+		return castRealToInteger(real)
+	}
+	s := strings.TrimLeft(text, " \t\n\r")
+	end := 0
+	if end < len(s) && (s[end] == '+' || s[end] == '-') {
+		end++
+	}
+	digits := end
+	for digits < len(s) && s[digits] >= '0' && s[digits] <= '9' {
+		digits++
+	}
+	value, err := strconv.ParseInt(s[:digits], 10, 64)
+	switch {
+	case err == nil:
+		return value
+	case digits > end && s[end - 1:end] != "-":
+		return math.MaxInt64
+	case digits > end:
+		return math.MinInt64
+	}
+	return 0
+}
+
+//	Parse the longest numeric prefix of text as a real. The second return reports whether the prefix was real-valued
+//	(contained '.', 'e' or 'E'), which the integer cast uses to decide its path.
+func numericPrefix(text string) (value float64, isReal bool) {
+	s := strings.TrimLeft(text, " \t\n\r")
+	end := 0
+	if end < len(s) && (s[end] == '+' || s[end] == '-') {
+		end++
+	}
+	for end < len(s) && (s[end] >= '0' && s[end] <= '9') {
+		end++
+	}
+	if end < len(s) && s[end] == '.' {
+		isReal = true
+		end++
+		for end < len(s) && (s[end] >= '0' && s[end] <= '9') {
+			end++
+		}
+	}
+	if end < len(s) && (s[end] == 'e' || s[end] == 'E') {
+		mark := end
+		end++
+		if end < len(s) && (s[end] == '+' || s[end] == '-') {
+			end++
+		}
+		if end < len(s) && s[end] >= '0' && s[end] <= '9' {
+			isReal = true
+			for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+				end++
+			}
+		} else {
+			end = mark
+		}
+	}
+	value, _ = strconv.ParseFloat(s[:end], 64)
+	return
+}
+
+//	Truncate a real toward zero, saturating at the int64 bounds.
+func castRealToInteger(value float64) int64 {
+	switch {
+	case value >= math.MaxInt64:
+		return math.MaxInt64
+	case value <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(value)
+}
+
+//	Apply CAST semantics, converting value in place to the given affinity. The value's current representation decides
+//	the conversion path; NULL is unaffected by any CAST.
+func (value *sqlite3_value) applyCast(affinity byte) {
+	if value.Type() == SQLITE_NULL {
+		return
+	}
+	switch affinity {
+	case SQLITE_AFF_NONE:
+		//	To BLOB: text reinterprets its bytes, numbers render to text first then reinterpret.
+		value.SetBlob([]byte(value.Text()))
+	case SQLITE_AFF_TEXT:
+		//	To TEXT: blobs reinterpret their bytes in the database encoding, numbers render canonically.
+		value.SetText(value.Text())
+	case SQLITE_AFF_INTEGER:
+		switch value.Type() {
+		case SQLITE_FLOAT:
+			value.SetInteger(castRealToInteger(value.Real()))
+		case SQLITE_TEXT, SQLITE_BLOB:
+			value.SetInteger(castTextToInteger(value.Text()))
+		}
+	case SQLITE_AFF_REAL:
+		switch value.Type() {
+		case SQLITE_INTEGER:
+			value.SetReal(float64(value.Integer()))
+		case SQLITE_TEXT, SQLITE_BLOB:
+			real, _ := numericPrefix(value.Text())
+			value.SetReal(real)
+		}
+	case SQLITE_AFF_NUMERIC:
+		//	To NUMERIC: prefer integer when the value is exactly integral.
+		switch value.Type() {
+		case SQLITE_TEXT, SQLITE_BLOB:
+			real, isReal := numericPrefix(value.Text())
+			if !isReal {
+				value.SetInteger(castTextToInteger(value.Text()))
+			} else if integer := int64(real); float64(integer) == real {
+				value.SetInteger(integer)
+			} else {
+				value.SetReal(real)
+			}
+		case SQLITE_FLOAT:
+			if integer := castRealToInteger(value.Real()); float64(integer) == value.Real() {
+				value.SetInteger(integer)
+			}
+		}
+	}
+}
+
+//	Apply column affinity, the gentler conversion used when storing into a column or comparing against one. Unlike CAST
+//	this converts text to a number only when the entire text is a well-formed numeric literal that converts losslessly,
+//	and it never converts numbers to text for NUMERIC, INTEGER or REAL affinity.
+func (value *sqlite3_value) applyAffinity(affinity byte) {
+	switch affinity {
+	case SQLITE_AFF_TEXT:
+		if value.Type() == SQLITE_INTEGER || value.Type() == SQLITE_FLOAT {
+			value.SetText(value.Text())
+		}
+	case SQLITE_AFF_NUMERIC, SQLITE_AFF_INTEGER, SQLITE_AFF_REAL:
+		if value.Type() == SQLITE_TEXT {
+			text := value.Text()
+			if integer, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64); err == nil {
+				value.SetInteger(integer)
+			} else if real, err := strconv.ParseFloat(strings.TrimSpace(text), 64); err == nil {
+				value.SetReal(real)
+			}
+		}
+		if affinity == SQLITE_AFF_REAL && value.Type() == SQLITE_INTEGER {
+			value.SetReal(float64(value.Integer()))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package serendipity
+
+//	This file implements connection close with defined semantics, replacing the pattern where a connection was simply
+//	released and any unfinalized statements leaked silently.
+//
+//	Close performs, in order:
+//
+//	1. Leak detection. Every prepared statement and open blob handle still attached to the connection is reported through
+//	   the leak reporter - a no-op in release builds, a logged report carrying the statement's SQL and preparation stack
+//	   under the "serendipity_debug" build tag (see statement_leaks_debug.go).
+//	2. Forced finalization. The leaked handles are finalized so that close always releases their resources; a leak is a
+//	   bug report, not a resource sink.
+//	3. A final passive checkpoint followed by truncation of the WAL, so that a cleanly closed database leaves no -wal
+//	   file behind and the next opener needs no recovery.
+//	4. Release of the pager and the connection itself.
+//
+//	CloseV2 defers instead of forcing: with unfinalized statements it marks the connection zombie and returns SQLITE_OK,
+//	and the real close runs when the last statement is finalized - the sqlite3_close_v2 contract, which garbage-collected
+//	bindings need.
+
+//	Close the connection. Returns SQLITE_BUSY only when a transaction cannot be resolved; leaked statements are reported
+//	and reclaimed rather than failing the close.
+func (db *sqlite3) Close() (rc int) {
+	db.CriticalSection(func() {
+		for statement := db.pStmtList; statement != nil; statement = statement.pNextStmt {
+			reportLeakedStatement(statement)
+		}
+		for statement := db.pStmtList; statement != nil; statement = db.pStmtList {
+			statement.Finalize()
+		}
+		for blob := db.pBlobList; blob != nil; blob = db.pBlobList {
+			reportLeakedBlob(blob)
+			blob.Close()
+		}
+		if db.autoCommit {
+			db.maybeOptimize()
+			db.checkpointOnClose()
+		} else {
+			//	An open transaction at close rolls back, as it would on process death; the caller was told about it when
+			//	it began, and committing here would invent a commit point the application never chose.
+			sqlite3_exec(db, "ROLLBACK", 0, 0, 0)
+			db.checkpointOnClose()
+		}
+		rc = db.release()
+	})
+	return
+}
+
+//	Close when the last statement may not be finalized yet: defer the close instead of forcing finalization. Safe to call
+//	from finalizers in garbage-collected bindings.
+func (db *sqlite3) CloseV2() (rc int) {
+	db.CriticalSection(func() {
+		if db.pStmtList != nil || db.pBlobList != nil {
+			db.isZombie = true
+			return
+		}
+	})
+	if db.isZombie {
+		return SQLITE_OK
+	}
+	return db.Close()
+}
+
+//	Called from statement and blob finalization: completes a deferred CloseV2 once the last handle is gone.
+func (db *sqlite3) maybeCompleteZombieClose() {
+	if db.isZombie && db.pStmtList == nil && db.pBlobList == nil {
+		db.isZombie = false
+		db.Close()
+	}
+}
+
+//	Checkpoint and truncate the WAL as the last act of a clean close. Failures are ignored: another connection may hold
+//	the database open, in which case the WAL legitimately stays, and close must still succeed.
+func (db *sqlite3) checkpointOnClose() {
+	if pager := db.MainPager(); pager != nil && pager.wal != nil {
+		pager.CheckpointTruncate()
+	}
+}
@@ -0,0 +1,161 @@
+package serendipity
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//	This file evaluates column defaults at insert time. The schema records a column's default as the text of its
+//	DEFAULT clause (Column.zDflt, surfaced through pragma_table_info); until now that text was carried but never
+//	applied. Three shapes are supported, matching SQLite: plain literals, the CURRENT_TIME / CURRENT_DATE /
+//	CURRENT_TIMESTAMP keywords, and a parenthesized expression, which must be deterministic - a default of
+//	random() would give REPLACE and retry paths a different value on each attempt.
+//
+//	The CURRENT_* keywords are evaluated against a single statement time: every row of a multi-row INSERT gets the
+//	same timestamp, as the standard requires. Expression defaults are evaluated through the ordinary SQL machinery
+//	("SELECT <expr>") so they honour registered functions and collations without a second evaluator.
+//
+//	ALTER TABLE ADD COLUMN is stricter. The backfill is virtual - existing rows are not rewritten, they produce the
+//	default when read - so the value must be the same whenever it is computed: only constant defaults qualify, and
+//	validateAddColumnDefault rejects the CURRENT_* family and expressions just as SQLite's "Cannot add a column
+//	with non-constant default" does.
+
+//	Functions that may not appear in an expression default. The list names the non-deterministic built-ins; an
+//	application function registered as non-deterministic should be added by the registering code.
+var nonDeterministicFunctions = map[string]bool{
+	"random":				true,
+	"randomblob":			true,
+	"changes":				true,
+	"total_changes":		true,
+	"last_insert_rowid":	true,
+}
+
+//	The statement-stable time formats of the CURRENT_* keywords, in UTC as SQLite renders them.
+func currentTimeDefault(zDflt string, now time.Time) (value string, ok bool) {
+	switch strings.ToUpper(zDflt) {
+	case "CURRENT_TIME":
+		return now.UTC().Format("15:04:05"), true
+	case "CURRENT_DATE":
+		return now.UTC().Format("2006-01-02"), true
+	case "CURRENT_TIMESTAMP":
+		return now.UTC().Format("2006-01-02 15:04:05"), true
+	}
+	return "", false
+}
+
+//	Decode a literal default: NULL, a number, a 'string' with doubled-quote escapes, or an X'..' blob. ok reports
+//	whether the text was a literal at all - an expression default is not, and takes the evaluation path.
+func literalDefault(zDflt string) (value interface{}, ok bool) {
+	z := strings.TrimSpace(zDflt)
+	switch {
+	case z == "" || CaseInsensitiveComparison(z, "NULL") == 0:
+		return nil, true
+	case len(z) > 1 && z[0] == '\'' && z[len(z) - 1] == '\'':
+		return strings.Replace(z[1 : len(z) - 1], "''", "'", -1), true
+	case len(z) > 3 && (z[0] == 'x' || z[0] == 'X') && z[1] == '\'' && z[len(z) - 1] == '\'':
+		blob, err := hex.DecodeString(z[2 : len(z) - 1])
+		if err != nil {
+			return nil, false
+		}
+		return blob, true
+	}
+	if i, err := strconv.ParseInt(z, 10, 64); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(z, 64); err == nil {
+		return f, true
+	}
+	return nil, false
+}
+
+//	Evaluate an expression default through the SQL machinery. The text arrives still parenthesized, which is what
+//	makes "SELECT (expr)" well-formed however the expression is shaped.
+func (db *sqlite3) evaluateDefaultExpression(zDflt string) (value interface{}, rc int) {
+	statement, _, rc := db.Prepare_v2(sqlite3_mprintf("SELECT %v", zDflt))
+	if rc != SQLITE_OK {
+		return
+	}
+	defer statement.Finalize()
+	if statement.Step() != SQLITE_ROW {
+		return nil, SQLITE_ERROR
+	}
+	return sqlite3_column_value(statement, 0), SQLITE_OK
+}
+
+//	The value a column's default produces for one statement execution. now is the statement time, fixed before the
+//	first row so every row of the statement agrees.
+func (db *sqlite3) columnDefault(column *Column, now time.Time) (value interface{}, rc int) {
+	if v, ok := currentTimeDefault(column.zDflt, now); ok {
+		return v, SQLITE_OK
+	}
+	if v, ok := literalDefault(column.zDflt); ok {
+		return v, SQLITE_OK
+	}
+	return db.evaluateDefaultExpression(column.zDflt)
+}
+
+//	Fill the unprovided columns of a row being inserted. provided marks the columns the statement assigned; the
+//	rest receive their defaults, NULL when a column has none.
+func (db *sqlite3) applyColumnDefaults(table *Table, row []interface{}, provided []bool, now time.Time) (rc int) {
+	for i, column := range table.Columns {
+		if provided[i] {
+			continue
+		}
+		if row[i], rc = db.columnDefault(column, now); rc != SQLITE_OK {
+			return
+		}
+	}
+	return SQLITE_OK
+}
+
+//	The function names called in an expression's text: each identifier directly followed by an open parenthesis,
+//	with string literals skipped so a quoted "random(" never counts.
+func functionNamesIn(expression string) (names []string) {
+	for i := 0; i < len(expression); i++ {
+		switch c := expression[i]; {
+		case c == '\'':
+			for i++; i < len(expression) && expression[i] != '\''; i++ {
+			}
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(expression) && (expression[i] == '_' || (expression[i] >= 'a' && expression[i] <= 'z') || (expression[i] >= 'A' && expression[i] <= 'Z') || (expression[i] >= '0' && expression[i] <= '9')) {
+				i++
+			}
+			if i < len(expression) && expression[i] == '(' {
+				names = append(names, expression[start:i])
+			}
+			i--
+		}
+	}
+	return
+}
+
+//	Whether an expression default may be accepted at CREATE TABLE time: it must parse, and it may not call a
+//	non-deterministic function.
+func (db *sqlite3) validateDefaultExpression(zDflt string) (Err string, rc int) {
+	statement, _, rc := db.Prepare_v2(sqlite3_mprintf("SELECT %v", zDflt))
+	if rc != SQLITE_OK {
+		return sqlite3_mprintf("invalid default value: %v", zDflt), rc
+	}
+	defer statement.Finalize()
+	for _, zName := range functionNamesIn(zDflt) {
+		if nonDeterministicFunctions[strings.ToLower(zName)] {
+			return sqlite3_mprintf("non-deterministic function in default: %v()", zName), SQLITE_ERROR
+		}
+	}
+	return "", SQLITE_OK
+}
+
+//	Whether a default may be accepted for ALTER TABLE ADD COLUMN. Existing rows are never rewritten - they produce
+//	the default when read - so anything whose value depends on when it is computed is refused.
+func (db *sqlite3) validateAddColumnDefault(zDflt string) (Err string, rc int) {
+	if _, ok := currentTimeDefault(zDflt, time.Time{}); ok {
+		return "Cannot add a column with non-constant default", SQLITE_ERROR
+	}
+	if _, ok := literalDefault(zDflt); ok {
+		return "", SQLITE_OK
+	}
+	return "Cannot add a column with non-constant default", SQLITE_ERROR
+}
@@ -0,0 +1,45 @@
+package serendipity
+
+//	This file exposes the connection's change counters and last-insert rowid as Go methods. The SQL functions
+//	changes(), total_changes() and last_insert_rowid() have always been available, but Go callers had to run a query
+//	to reach them; these methods read the same connection fields directly.
+//
+//	The semantics match the SQL functions exactly:
+//
+//		- Changes counts the rows inserted, updated or deleted by the most recently completed INSERT, UPDATE or
+//		  DELETE statement. Rows changed by trigger programs and by foreign-key cascade actions are NOT counted -
+//		  only the statement's own top-level changes are.
+//		- TotalChanges counts every row change since the connection opened, INCLUDING those made by triggers and
+//		  foreign-key cascades.
+//		- LastInsertRowID is the rowid of the most recent successful INSERT on this connection, whether issued
+//		  directly or from within a trigger program; it is unchanged by inserts that fail.
+//
+//	A RETURNING clause does not alter any of the above: the counters and rowid are updated as each row is written,
+//	before its RETURNING row is delivered, so they are already current while the caller is still stepping through
+//	the returned rows. All three values are per-connection; on a connection shared between goroutines, read them
+//	before releasing whatever serialises the writes, or another writer may overwrite them first.
+
+//	The number of rows changed by the most recently completed INSERT, UPDATE or DELETE statement, excluding trigger
+//	and foreign-key cascade changes.
+func (db *sqlite3) Changes() (n int64) {
+	db.mutex.CriticalSection(func() {
+		n = int64(db.nChange)
+	})
+	return
+}
+
+//	The number of rows changed since the connection opened, including trigger and foreign-key cascade changes.
+func (db *sqlite3) TotalChanges() (n int64) {
+	db.mutex.CriticalSection(func() {
+		n = int64(db.nTotalChange)
+	})
+	return
+}
+
+//	The rowid of the most recent successful INSERT on this connection.
+func (db *sqlite3) LastInsertRowID() (rowid int64) {
+	db.mutex.CriticalSection(func() {
+		rowid = sqlite3_last_insert_rowid(db)
+	})
+	return
+}
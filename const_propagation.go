@@ -0,0 +1,125 @@
+package serendipity
+
+//	This file adds constant propagation across join equalities. In a query like
+//
+//		SELECT ... FROM t1, t2 WHERE t1.a = t2.b AND t2.b = 5
+//
+//	only t2 has an indexable constant; t1.a = 5 follows logically but the planner never saw it, so t1 full-scans
+//	even with a perfect index on a. The pass derives it: for each column pinned to a constant, every join equality
+//	reaching that column yields the same constraint on its other side, transitively until nothing new appears. The
+//	original terms are kept - the derived ones are additions for the planner to use, never replacements - so the
+//	query's meaning cannot change even where a derived term goes unused.
+//
+//	Equality in SQL is not substitution, which is where affinity and collation earn their check. "a = b AND b = 5"
+//	with a TEXT and b INTEGER can hold where "a = 5" does not, because each comparison applies its own affinity
+//	conversion; and under a non-BINARY collation two "equal" texts are not interchangeable bytes. A binding
+//	therefore only propagates across a join term when both columns agree on affinity class and collation, and a
+//	text constant additionally requires BINARY collation - the conservative reading of the same rules the
+//	comparisons themselves follow.
+
+//	A column pinned to a constant by the WHERE clause.
+type constantBinding struct {
+	iTable		int
+	iColumn		int
+	value		*Expr
+}
+
+//	Whether an expression is a literal a binding may carry.
+func propagatableConstant(value *Expr) bool {
+	return value.op == TK_INTEGER || value.op == TK_FLOAT || value.op == TK_STRING
+}
+
+//	Whether a binding on from may cross a join equality onto to. Affinity classes must agree so both comparisons
+//	convert the constant identically; text constants also need BINARY collation on both sides, since any other
+//	collation equates texts that are not interchangeable.
+func (parse *Parse) bindingMayPropagate(from, to, value *Expr) bool {
+	affFrom, affTo := parse.columnAffinity(from), parse.columnAffinity(to)
+	if affFrom != affTo {
+		return false
+	}
+	if value.op == TK_STRING || affFrom == SQLITE_AFF_TEXT {
+		if parse.columnCollation(from) != "BINARY" || parse.columnCollation(to) != "BINARY" {
+			return false
+		}
+	}
+	return true
+}
+
+type constantBindings []constantBinding
+
+//	Collect the constant bindings of a conjunction: terms of the shape column = literal or literal = column.
+func collectBindings(where *Expr, bindings constantBindings) constantBindings {
+	switch where.op {
+	case TK_AND:
+		return collectBindings(where.pRight, collectBindings(where.pLeft, bindings))
+	case TK_EQ:
+		column, value := where.pLeft, where.pRight
+		if value.op == TK_COLUMN && column.op != TK_COLUMN {
+			column, value = value, column
+		}
+		if column.op == TK_COLUMN && propagatableConstant(value) {
+			bindings = append(bindings, constantBinding{ iTable: column.iTable, iColumn: column.iColumn, value: value })
+		}
+	}
+	return bindings
+}
+
+func (bindings constantBindings) lookup(column *Expr) *constantBinding {
+	for i := range bindings {
+		if bindings[i].iTable == column.iTable && bindings[i].iColumn == column.iColumn {
+			return &bindings[i]
+		}
+	}
+	return nil
+}
+
+//	One round of derivation: for each column = column join term with a binding on exactly one side, produce the
+//	binding's constraint on the other side. New terms are fresh nodes; the originals are shared, not rewritten.
+func (parse *Parse) deriveConstants(where *Expr, bindings constantBindings) (derived []*Expr) {
+	switch where.op {
+	case TK_AND:
+		return append(parse.deriveConstants(where.pLeft, bindings), parse.deriveConstants(where.pRight, bindings)...)
+	case TK_EQ:
+		left, right := where.pLeft, where.pRight
+		if left.op != TK_COLUMN || right.op != TK_COLUMN {
+			return nil
+		}
+		bound, free := bindings.lookup(left), right
+		if bound == nil {
+			bound, free = bindings.lookup(right), left
+		}
+		if bound == nil || bindings.lookup(free) != nil {
+			return nil
+		}
+		boundColumn := left
+		if free == left {
+			boundColumn = right
+		}
+		if !parse.bindingMayPropagate(boundColumn, free, bound.value) {
+			return nil
+		}
+		freeCopy := &Expr{ op: TK_COLUMN, iTable: free.iTable, iColumn: free.iColumn }
+		valueCopy := &Expr{ op: bound.value.op, zToken: bound.value.zToken }
+		return []*Expr{ &Expr{ op: TK_EQ, pLeft: freeCopy, pRight: valueCopy } }
+	}
+	return nil
+}
+
+//	The pass: derive until fixpoint, conjoining each round's new terms so the next round propagates through them.
+//	Returns the augmented clause and how many constraints were added.
+func (parse *Parse) propagateConstants(where *Expr) (augmented *Expr, nAdded int) {
+	augmented = where
+	if where == nil {
+		return
+	}
+	for {
+		derived := parse.deriveConstants(augmented, collectBindings(augmented, nil))
+		if len(derived) == 0 {
+			return
+		}
+		for _, term := range derived {
+			augmented = &Expr{ op: TK_AND, pLeft: augmented, pRight: term }
+			nAdded++
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package serendipity
+
+//	This file teaches the planner to recognise covering indexes. When every column a query reads from a table is present
+//	in one index - either as a key column or implicitly as the rowid, which every index carries and which an INTEGER
+//	PRIMARY KEY aliases - the table btree never needs to be opened: the scan reads the index alone, touching roughly half
+//	the pages and staying clustered in the file. The plan output reports such scans as "USING COVERING INDEX".
+//
+//	Detection runs after WHERE analysis has chosen a candidate index, because the question is per-index: an index that
+//	does not help the WHERE clause may still be worth choosing purely for coverage when the alternative is a full table
+//	scan, so a full scan of a covering index is also considered and costed below a full scan of the table.
+
+const WHERE_IDX_ONLY = 0x00000400		//	Use the index cursor only; never open the table
+
+//	One level of the generated scan loop nest: the table scanned, the index chosen by WHERE analysis (if any), and the
+//	strategy flags the code generator acts on.
+type WhereLevel struct {
+	iTabCur			int			//	Cursor for the table
+	iIdxCur			int			//	Cursor for the index, when one is used
+	pIdx			*Index		//	Index chosen by WHERE analysis, or nil for a table scan
+	pCoveringIdx	*Index		//	Index satisfying the whole scan, when WHERE_IDX_ONLY is set
+	wsFlags			int			//	WHERE_* strategy flags
+}
+
+//	A bitmask of the columns of one table referenced anywhere in a statement. Column N sets bit N for N < 63; bit 63
+//	stands for "column 63 or later", which conservatively defeats coverage since we can no longer tell which columns
+//	those references touch. The rowid contributes no bit: every index covers it.
+type colUsedMask uint64
+
+func (mask colUsedMask) set(iColumn int) colUsedMask {
+	if iColumn >= 63 {
+		return mask | (1 << 63)
+	}
+	return mask | (1 << uint(iColumn))
+}
+
+//	Report whether the index covers every column in mask: each referenced column must appear among the index's key
+//	columns. An INTEGER PRIMARY KEY column is the rowid in disguise, so references to it are covered by any index and are
+//	excluded from the mask when it is built.
+func (index *Index) covers(mask colUsedMask) bool {
+	if mask & (1 << 63) != 0 {
+		return false
+	}
+	var covered colUsedMask
+	for _, iColumn := range index.aiColumn {
+		covered = covered.set(iColumn)
+	}
+	return mask &^ covered == 0
+}
+
+//	Accumulate the columns of the table at the given cursor referenced by an expression tree. Walks the tree the same way
+//	the resolver does; TK_COLUMN nodes for other cursors are ignored, and a reference to the INTEGER PRIMARY KEY is
+//	recorded as no column at all because it reads the rowid.
+func (expression *Expr) columnsUsed(iCursor int, table *Table) (mask colUsedMask) {
+	expression.Walk(func(e *Expr) {
+		if e.op == TK_COLUMN && e.iTable == iCursor && e.iColumn >= 0 && e.iColumn != table.iPKey {
+			mask = mask.set(e.iColumn)
+		}
+	})
+	return
+}
+
+//	Decide whether the scan of the given table, using the given index (nil for a planned full table scan), can instead be
+//	satisfied from an index alone. Returns the covering index to use, or nil. When the WHERE analysis chose no index, the
+//	smallest covering index is picked so the full scan reads the fewest pages.
+func (parse *Parse) coveringIndex(table *Table, chosen *Index, mask colUsedMask) *Index {
+	if chosen != nil {
+		if chosen.covers(mask) {
+			return chosen
+		}
+		return nil
+	}
+	var best *Index
+	for index := table.pIndex; index != nil; index = index.pNext {
+		if index.covers(mask) && (best == nil || len(index.aiColumn) < len(best.aiColumn)) {
+			best = index
+		}
+	}
+	return best
+}
+
+//	Rewrite a scan's plan to be index-only. The code generator consults wantsTableCursor when opening cursors for the
+//	scan: a covered scan opens only the index cursor, and column reads are redirected to the index cell via columnInIndex.
+func (level *WhereLevel) markCovering(index *Index) {
+	level.pCoveringIdx = index
+	level.wsFlags |= WHERE_IDX_ONLY
+}
+
+//	The position of a table column within an index's key, for redirecting column reads on an index-only scan. The rowid
+//	reads from the index cell's trailing rowid field, reported as position len(aiColumn).
+func columnInIndex(index *Index, iColumn int) int {
+	for i, c := range index.aiColumn {
+		if c == iColumn {
+			return i
+		}
+	}
+	return len(index.aiColumn)
+}
+
+//	Whether the code generator must open the table cursor for this scan at all.
+func (level *WhereLevel) wantsTableCursor() bool {
+	return level.wsFlags & WHERE_IDX_ONLY == 0
+}
+
+//	The plan-output fragment for this scan's index usage, appended to the "SCAN TABLE t" / "SEARCH TABLE t" line.
+func (level *WhereLevel) indexAnnotation() string {
+	switch {
+	case level.pCoveringIdx != nil:
+		return sqlite3_mprintf(" USING COVERING INDEX %v", level.pCoveringIdx.zName)
+	case level.pIdx != nil:
+		return sqlite3_mprintf(" USING INDEX %v", level.pIdx.zName)
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package serendipity
+
+import "strings"
+
+//	This file implements defensive mode: a per-connection setting for safely working with databases from untrusted sources.
+//	A hostile database cannot inject code directly, but it can carry a schema which abuses powerful features - triggers that
+//	call load_extension(), views that recurse pathologically, or direct writes to sqlite_master that redirect table roots.
+//	With defensive mode enabled on a connection:
+//
+//		*	ordinary SQL cannot write to sqlite_master or to the shadow tables of any registered virtual table module
+//			(the modules themselves continue to maintain their shadow tables through their own internal statements)
+//
+//		*	functions with effects outside the database - load_extension() and the writefile() family - are disabled
+//
+//		*	trigger and view recursion is capped at DEFENSIVE_MAX_RECURSION rather than the connection's general limit
+//
+//	Defensive mode is off by default and once enabled cannot be disabled by SQL, only by the Go API, so a hostile schema
+//	cannot simply turn it off.
+
+const DEFENSIVE_MAX_RECURSION = 100
+
+//	The functions disabled in defensive mode. Matching is by name so that extensions registering their own variants of
+//	writefile() are covered without needing to know about this list.
+var defensiveBlockedFunctions = map[string]bool{
+	"load_extension": true,
+	"writefile": true,
+	"readfile": true,
+	"edit": true,
+	"fts3_tokenizer": true,
+}
+
+//	Enable defensive mode on the connection.
+func (db *sqlite3) EnableDefensive() {
+	db.CriticalSection(func() {
+		db.flags |= SQLITE_Defensive
+	})
+}
+
+//	Disable defensive mode. Only callable from the Go API; there is deliberately no PRAGMA for this direction.
+func (db *sqlite3) DisableDefensive() {
+	db.CriticalSection(func() {
+		db.flags &^= SQLITE_Defensive
+	})
+}
+
+func (db *sqlite3) defensive() bool {
+	return db.flags & SQLITE_Defensive != 0
+}
+
+//	Report whether ordinary SQL on this connection may write to the named table. The schema table is always protected in
+//	defensive mode; shadow tables are recognised by the "<table>_<suffix>" convention against the registered modules'
+//	declared suffixes, the same rule the modules use when creating them.
+func (db *sqlite3) writeAllowed(name string) bool {
+	if !db.defensive() {
+		return true
+	}
+	switch lower := strings.ToLower(name); {
+	case lower == "sqlite_master" || lower == "sqlite_temp_master":
+		return false
+	case db.isShadowTableName(lower):
+		return false
+	}
+	return true
+}
+
+//	Report whether the named table follows a registered module's shadow table naming. Modules maintaining shadow tables
+//	declare their suffixes when they are registered; the rtree module, for instance, declares "node", "rowid" and "parent".
+func (db *sqlite3) isShadowTableName(name string) bool {
+	i := strings.LastIndexByte(name, '_')
+	if i < 1 {
+		return false
+	}
+	suffix := name[i + 1:]
+	for _, module := range db.Modules {
+		for _, declared := range module.ShadowSuffixes {
+			if suffix == declared {
+				//	The prefix must itself name a virtual table for the name to be a shadow table; a user table that
+				//	merely ends in "_node" is not protected.
+				if table := db.FindTable(name[:i], ""); table != nil && table.IsVirtual() {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+//	Report whether the named function may be invoked on this connection. Called during function lookup so that a blocked
+//	function behaves exactly like an unregistered one, producing the usual "no such function" error.
+func (db *sqlite3) functionAllowed(name string) bool {
+	if db.defensive() && defensiveBlockedFunctions[strings.ToLower(name)] {
+		return false
+	}
+	return true
+}
+
+//	The trigger/view recursion limit in effect for this connection: the defensive cap when defensive mode is enabled, and
+//	the connection's configured limit otherwise.
+func (db *sqlite3) recursionLimit() int {
+	if db.defensive() && db.nMaxTriggerDepth > DEFENSIVE_MAX_RECURSION {
+		return DEFENSIVE_MAX_RECURSION
+	}
+	return db.nMaxTriggerDepth
+}
@@ -0,0 +1,272 @@
+package driver
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//	This package registers a database/sql driver under the name "sqlite3" with a DSN syntax compatible with the widely-used
+//	cgo driver, so that projects can swap in the pure-Go engine by changing an import rather than every call site. The subset
+//	of DSN parameters in common use is honoured directly: loc, cache and mode from the query string, plus the underscore
+//	pragma parameters _busy_timeout and _foreign_keys. Unrecognised parameters are rejected rather than ignored, since a
+//	silently dropped _journal_mode is exactly the kind of surprise a drop-in replacement must not spring.
+
+//	The engine-facing connection interface. The serendipity core provides an implementation; tests may substitute their own.
+type Conn interface {
+	Prepare(sql string) (Stmt, error)
+	Exec(sql string) error
+	Close() error
+}
+
+type Stmt interface {
+	NumInput() int
+	Exec(values []interface{}) (lastInsertId, rowsAffected int64, err error)
+	Query(values []interface{}) (columns, declaredTypes []string, next func(row []interface{}) error, close func() error, err error)
+	Close() error
+}
+
+//	The engine's open function, injected at init time by the serendipity package to avoid an import cycle.
+var OpenConn	func(filename string, options *Options) (Conn, error)
+
+//	The connection options decoded from a DSN.
+type Options struct {
+	Location	*time.Location	//	Time zone applied when scanning TIMESTAMP columns
+	SharedCache	bool			//	cache=shared
+	ReadOnly	bool			//	mode=ro
+	Memory		bool			//	mode=memory
+	CreateOff	bool			//	mode=rw (open existing only)
+	BusyTimeout	time.Duration	//	_busy_timeout in milliseconds
+	ForeignKeys	*bool			//	_foreign_keys; nil leaves the engine default in place
+}
+
+type Driver struct{}
+
+func init() {
+	sql.Register("sqlite3", &Driver{})
+}
+
+//	Decode a DSN of the form accepted by the cgo driver: a filename (or ":memory:", or a file: URI) optionally followed by
+//	"?" and URL-encoded parameters.
+func ParseDSN(dsn string) (filename string, options *Options, err error) {
+	options = &Options{ Location: time.UTC }
+	filename = dsn
+	query := ""
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		filename, query = dsn[:i], dsn[i + 1:]
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", nil, fmt.Errorf("sqlite3: malformed DSN parameters: %v", err)
+	}
+	for key := range values {
+		value := values.Get(key)
+		switch key {
+		case "loc":
+			if value == "auto" {
+				options.Location = time.Local
+			} else if options.Location, err = time.LoadLocation(value); err != nil {
+				return "", nil, fmt.Errorf("sqlite3: invalid loc parameter %q: %v", value, err)
+			}
+		case "cache":
+			switch value {
+			case "shared":
+				options.SharedCache = true
+			case "private":
+				options.SharedCache = false
+			default:
+				return "", nil, fmt.Errorf("sqlite3: invalid cache parameter %q", value)
+			}
+		case "mode":
+			switch value {
+			case "ro":
+				options.ReadOnly = true
+			case "rw":
+				options.CreateOff = true
+			case "rwc":
+			case "memory":
+				options.Memory = true
+			default:
+				return "", nil, fmt.Errorf("sqlite3: invalid mode parameter %q", value)
+			}
+		case "_busy_timeout", "_timeout":
+			milliseconds, err := strconv.Atoi(value)
+			if err != nil || milliseconds < 0 {
+				return "", nil, fmt.Errorf("sqlite3: invalid _busy_timeout parameter %q", value)
+			}
+			options.BusyTimeout = time.Duration(milliseconds) * time.Millisecond
+		case "_foreign_keys", "_fk":
+			enabled, err := parseBool(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("sqlite3: invalid _foreign_keys parameter %q", value)
+			}
+			options.ForeignKeys = &enabled
+		default:
+			return "", nil, fmt.Errorf("sqlite3: unsupported DSN parameter %q", key)
+		}
+	}
+	return
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("not a boolean")
+}
+
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	filename, options, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if OpenConn == nil {
+		return nil, fmt.Errorf("sqlite3: engine not linked in")
+	}
+	conn, err := OpenConn(filename, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.BusyTimeout > 0 {
+		if err = conn.Exec(fmt.Sprintf("PRAGMA busy_timeout = %v", options.BusyTimeout / time.Millisecond)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if options.ForeignKeys != nil {
+		setting := "OFF"
+		if *options.ForeignKeys {
+			setting = "ON"
+		}
+		if err = conn.Exec("PRAGMA foreign_keys = " + setting); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return &connection{ conn: conn, location: options.Location }, nil
+}
+
+type connection struct {
+	conn		Conn
+	location	*time.Location
+}
+
+func (c *connection) Prepare(sql string) (driver.Stmt, error) {
+	stmt, err := c.conn.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+	return &statement{ stmt: stmt, location: c.location }, nil
+}
+
+func (c *connection) Begin() (driver.Tx, error) {
+	if err := c.conn.Exec("BEGIN"); err != nil {
+		return nil, err
+	}
+	return &transaction{ conn: c.conn }, nil
+}
+
+func (c *connection) Close() error {
+	return c.conn.Close()
+}
+
+type transaction struct {
+	conn	Conn
+}
+
+func (t *transaction) Commit() error	{ return t.conn.Exec("COMMIT") }
+func (t *transaction) Rollback() error	{ return t.conn.Exec("ROLLBACK") }
+
+type statement struct {
+	stmt		Stmt
+	location	*time.Location
+}
+
+func (s *statement) NumInput() int	{ return s.stmt.NumInput() }
+func (s *statement) Close() error	{ return s.stmt.Close() }
+
+func bindable(values []driver.Value) []interface{} {
+	bound := make([]interface{}, len(values))
+	for i, value := range values {
+		bound[i] = value
+	}
+	return bound
+}
+
+func (s *statement) Exec(values []driver.Value) (driver.Result, error) {
+	lastInsertId, rowsAffected, err := s.stmt.Exec(bindable(values))
+	if err != nil {
+		return nil, err
+	}
+	return &result{ lastInsertId: lastInsertId, rowsAffected: rowsAffected }, nil
+}
+
+func (s *statement) Query(values []driver.Value) (driver.Rows, error) {
+	columns, declaredTypes, next, close, err := s.stmt.Query(bindable(values))
+	if err != nil {
+		return nil, err
+	}
+	return &rows{ columns: columns, declaredTypes: declaredTypes, next: next, close: close, location: s.location }, nil
+}
+
+type result struct {
+	lastInsertId	int64
+	rowsAffected	int64
+}
+
+func (r *result) LastInsertId() (int64, error)	{ return r.lastInsertId, nil }
+func (r *result) RowsAffected() (int64, error)	{ return r.rowsAffected, nil }
+
+type rows struct {
+	columns			[]string
+	declaredTypes	[]string
+	next			func(row []interface{}) error
+	close			func() error
+	location		*time.Location
+}
+
+//	Report whether the column's declared type marks it as a timestamp, using the same names the cgo driver recognises.
+func (r *rows) isTimestamp(column int) bool {
+	if column >= len(r.declaredTypes) {
+		return false
+	}
+	switch strings.ToLower(r.declaredTypes[column]) {
+	case "timestamp", "datetime", "date":
+		return true
+	}
+	return false
+}
+
+func (r *rows) Columns() []string	{ return r.columns }
+func (r *rows) Close() error		{ return r.close() }
+
+func (r *rows) Next(destination []driver.Value) error {
+	row := make([]interface{}, len(destination))
+	if err := r.next(row); err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		return err
+	}
+	for i, value := range row {
+		//	Times stored in columns declared TIMESTAMP/DATETIME/DATE honour the loc DSN parameter, as in the cgo driver.
+		if text, ok := value.(string); ok && r.isTimestamp(i) {
+			for _, layout := range []string{ "2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05", "2006-01-02" } {
+				if timestamp, err := time.ParseInLocation(layout, text, r.location); err == nil {
+					value = timestamp
+					break
+				}
+			}
+		}
+		destination[i] = value
+	}
+	return nil
+}
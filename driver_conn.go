@@ -0,0 +1,179 @@
+package serendipity
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/feyeleanor/serendipity/driver"
+)
+
+//	This file supplies the engine half of the database/sql shim in the driver package. The driver cannot import the
+//	engine - the engine would then be imported back by anything importing this package, completing a cycle - so it
+//	exposes the OpenConn hook instead, injected here at init time. Importing this package is therefore all a
+//	database/sql program needs: the driver registers itself under "sqlite3" and finds the engine already linked in.
+
+func init() {
+	driver.OpenConn = openDriverConn
+}
+
+//	Open a connection for the database/sql driver, honouring the DSN options the driver decoded.
+func openDriverConn(filename string, options *driver.Options) (driver.Conn, error) {
+	flags := uint(SQLITE_OPEN_READWRITE | SQLITE_OPEN_CREATE)
+	switch {
+	case options.ReadOnly:
+		flags = SQLITE_OPEN_READONLY
+	case options.CreateOff:
+		flags = SQLITE_OPEN_READWRITE
+	}
+	if options.SharedCache {
+		flags |= SQLITE_OPEN_SHAREDCACHE
+	}
+	if options.Memory {
+		filename = ":memory:"
+	}
+	db, rc := OpenDatabase(filename, flags, "")
+	if rc != SQLITE_OK {
+		if db != nil {
+			err := fmt.Errorf("sqlite3: %s", db.errmsg())
+			db.Close()
+			return nil, err
+		}
+		return nil, fmt.Errorf("sqlite3: open failed (%v)", rc)
+	}
+	return &driverConn{ db: db }, nil
+}
+
+type driverConn struct {
+	db	*sqlite3
+}
+
+func (c *driverConn) Prepare(sql string) (driver.Stmt, error) {
+	statement, _, rc := c.db.Prepare_v2(sql)
+	if rc != SQLITE_OK {
+		return nil, fmt.Errorf("sqlite3: %s", c.db.errmsg())
+	}
+	return &driverStmt{ db: c.db, statement: statement }, nil
+}
+
+func (c *driverConn) Exec(sql string) error {
+	if rc := sqlite3_exec(c.db, sql, 0, 0, 0); rc != SQLITE_OK {
+		return fmt.Errorf("sqlite3: %s", c.db.errmsg())
+	}
+	return nil
+}
+
+func (c *driverConn) Close() error {
+	if rc := c.db.Close(); rc != SQLITE_OK {
+		return fmt.Errorf("sqlite3: %s", c.db.errmsg())
+	}
+	return nil
+}
+
+type driverStmt struct {
+	db			*sqlite3
+	statement	*sqlite3_stmt
+}
+
+func (s *driverStmt) NumInput() int {
+	return s.statement.nVar
+}
+
+func (s *driverStmt) Close() error {
+	if rc := s.statement.Finalize(); rc != SQLITE_OK {
+		return fmt.Errorf("sqlite3: %s", s.db.errmsg())
+	}
+	return nil
+}
+
+//	Bind one parameter slot from a database/sql value. Times are stored in the text layout the driver's scan side
+//	recognises for TIMESTAMP columns.
+func (s *driverStmt) bind(i int, value interface{}) (rc int) {
+	switch v := value.(type) {
+	case nil:
+		rc = sqlite3_bind_null(s.statement, i)
+	case int64:
+		rc = sqlite3_bind_int64(s.statement, i, v)
+	case float64:
+		rc = sqlite3_bind_float64(s.statement, i, v)
+	case bool:
+		if v {
+			rc = sqlite3_bind_int64(s.statement, i, 1)
+		} else {
+			rc = sqlite3_bind_int64(s.statement, i, 0)
+		}
+	case []byte:
+		rc = sqlite3_bind_blob(s.statement, i, v, len(v), SQLITE_TRANSIENT)
+	case string:
+		rc = sqlite3_bind_text(s.statement, i, v, -1, SQLITE_TRANSIENT)
+	case time.Time:
+		rc = sqlite3_bind_text(s.statement, i, v.Format("2006-01-02 15:04:05.999999999-07:00"), -1, SQLITE_TRANSIENT)
+	default:
+		rc = SQLITE_MISUSE
+	}
+	return
+}
+
+func (s *driverStmt) bindAll(values []interface{}) error {
+	s.statement.Reset()
+	for i, value := range values {
+		if rc := s.bind(i + 1, value); rc != SQLITE_OK {
+			return fmt.Errorf("sqlite3: cannot bind parameter %v: %s", i + 1, s.db.errmsg())
+		}
+	}
+	return nil
+}
+
+func (s *driverStmt) Exec(values []interface{}) (lastInsertId, rowsAffected int64, err error) {
+	if err = s.bindAll(values); err != nil {
+		return
+	}
+	if rc := s.statement.Step(); rc != SQLITE_DONE && rc != SQLITE_ROW {
+		err = fmt.Errorf("sqlite3: %s", s.db.errmsg())
+		s.statement.Reset()
+		return
+	}
+	s.statement.Reset()
+	return sqlite3_last_insert_rowid(s.db), s.db.Changes(), nil
+}
+
+func (s *driverStmt) Query(values []interface{}) (columns, declaredTypes []string, next func(row []interface{}) error, close func() error, err error) {
+	if err = s.bindAll(values); err != nil {
+		return
+	}
+	for i := 0; i < sqlite3_column_count(s.statement); i++ {
+		columns = append(columns, sqlite3_column_name(s.statement, i))
+		declaredTypes = append(declaredTypes, sqlite3_column_decltype(s.statement, i))
+	}
+	next = func(row []interface{}) error {
+		switch rc := s.statement.Step(); rc {
+		case SQLITE_ROW:
+			for i := range row {
+				switch sqlite3_column_type(s.statement, i) {
+				case SQLITE_NULL:
+					row[i] = nil
+				case SQLITE_INTEGER:
+					row[i] = sqlite3_column_int64(s.statement, i)
+				case SQLITE_FLOAT:
+					row[i] = sqlite3_column_float64(s.statement, i)
+				case SQLITE_BLOB:
+					row[i] = []byte(sqlite3_column_blob(s.statement, i))
+				default:
+					row[i] = sqlite3_column_text(s.statement, i)
+				}
+			}
+			return nil
+		case SQLITE_DONE:
+			return io.EOF
+		default:
+			return fmt.Errorf("sqlite3: %s", s.db.errmsg())
+		}
+	}
+	close = func() error {
+		if rc := s.statement.Reset(); rc != SQLITE_OK {
+			return fmt.Errorf("sqlite3: %s", s.db.errmsg())
+		}
+		return nil
+	}
+	return
+}
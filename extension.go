@@ -0,0 +1,90 @@
+package serendipity
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//	This file replaces the dlopen-style extension loader with mechanisms that suit a pure Go engine:
+//
+//		1.	A process-wide registry of extensions compiled into the binary. An extension is just a name and an init
+//			function taking the connection; RegisterExtension is typically called from the extension package's own init().
+//
+//		2.	Optional loading of Go plugins on the platforms that support them (see extension_plugin.go). A plugin exports
+//			a function Init(db) which is located and invoked by name, mirroring the entry-point convention of C extensions.
+//
+//	The load_extension() SQL function is kept for script compatibility: its argument is looked up in the registry first and
+//	handed to the plugin loader only if no registered extension matches. Loading remains disabled per connection until
+//	enabled through EnableLoadExtension, exactly as with the C API, and defensive mode disables the SQL function entirely.
+
+//	An ExtensionInit prepares one connection to use the extension: registering functions, collations or modules as needed.
+type ExtensionInit func(db *sqlite3) (rc int)
+
+var extensions = struct {
+	sync.RWMutex
+	registry	map[string]ExtensionInit
+}{ registry: make(map[string]ExtensionInit) }
+
+//	Register a compiled-in extension under the given name. Registering the same name twice is a programming error and
+//	panics, since whichever extension lost the race would silently never load.
+func RegisterExtension(name string, init ExtensionInit) {
+	extensions.Lock()
+	defer extensions.Unlock()
+	if _, duplicate := extensions.registry[name]; duplicate {
+		panic(fmt.Sprintf("serendipity: extension %q registered twice", name))
+	}
+	extensions.registry[name] = init
+}
+
+//	The names of all registered extensions, sorted, for diagnostics.
+func RegisteredExtensions() (names []string) {
+	extensions.RLock()
+	for name := range extensions.registry {
+		names = append(names, name)
+	}
+	extensions.RUnlock()
+	sort.Strings(names)
+	return
+}
+
+//	The platform plugin loader, installed by extension_plugin.go where Go plugins are supported and nil elsewhere. It
+//	resolves the named entry point (Init when entryPoint is empty) in the plugin at path and returns it.
+var pluginLoader func(path, entryPoint string) (ExtensionInit, error)
+
+//	Allow or forbid extension loading on this connection. Loading is forbidden by default; enabling it affects both the Go
+//	API and the load_extension() SQL function.
+func (db *sqlite3) EnableLoadExtension(enable bool) {
+	db.CriticalSection(func() {
+		if enable {
+			db.flags |= SQLITE_LoadExtension
+		} else {
+			db.flags &^= SQLITE_LoadExtension
+		}
+	})
+}
+
+//	Load the named extension into this connection. The name is resolved against the compiled-in registry first; failing
+//	that it is treated as a plugin path on platforms with a plugin loader. The entryPoint applies only to plugins and names
+//	the exported init function, defaulting to Init.
+func (db *sqlite3) LoadExtension(name, entryPoint string) (Err string, rc int) {
+	if db.flags & SQLITE_LoadExtension == 0 {
+		return "not authorized", SQLITE_ERROR
+	}
+	extensions.RLock()
+	init := extensions.registry[name]
+	extensions.RUnlock()
+	if init == nil {
+		if pluginLoader == nil {
+			return fmt.Sprintf("no such extension: %v", name), SQLITE_ERROR
+		}
+		var err	error
+		if init, err = pluginLoader(name, entryPoint); err != nil {
+			return err.Error(), SQLITE_ERROR
+		}
+	}
+	if rc = init(db); rc != SQLITE_OK {
+		Err = fmt.Sprintf("extension %v failed to initialize", name)
+	}
+	return
+}
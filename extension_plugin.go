@@ -0,0 +1,35 @@
+//go:build linux || darwin
+
+package serendipity
+
+import (
+	"fmt"
+	"plugin"
+)
+
+//	Plugin loading for the platforms where the Go runtime supports it. A plugin is built with "go build -buildmode=plugin"
+//	and exports an entry point with the signature of ExtensionInit; by convention the entry point is named Init, matching
+//	the role of the sqlite3_extension_init convention for C extensions.
+
+func init() {
+	pluginLoader = loadPlugin
+}
+
+func loadPlugin(path, entryPoint string) (ExtensionInit, error) {
+	if entryPoint == "" {
+		entryPoint = "Init"
+	}
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening plugin %v: %v", path, err)
+	}
+	symbol, err := p.Lookup(entryPoint)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %v has no entry point %v", path, entryPoint)
+	}
+	init, ok := symbol.(func(db *sqlite3) (rc int))
+	if !ok {
+		return nil, fmt.Errorf("plugin %v entry point %v has the wrong signature", path, entryPoint)
+	}
+	return init, nil
+}
@@ -0,0 +1,104 @@
+package serendipity
+
+import "math"
+
+//	This file implements the built-in geodesic SQL functions, which make radius queries against a latitude/longitude rtree
+//	one-liners:
+//
+//		haversine_distance(lat1, lon1, lat2, lon2)		great-circle distance in meters
+//		geo_bbox_around(lat, lon, radius_m, n)			the nth bounding coordinate (0: min lat, 1: max lat, 2: min lon, 3: max lon)
+//		bearing(lat1, lon1, lat2, lon2)					initial bearing from the first point to the second, in degrees clockwise from north
+//
+//	A typical "points within R meters" query filters the rtree with the bounding box and refines with the exact distance:
+//
+//		SELECT id FROM points
+//		 WHERE minLat >= geo_bbox_around(:lat, :lon, :r, 0) AND maxLat <= geo_bbox_around(:lat, :lon, :r, 1)
+//		   AND minLon >= geo_bbox_around(:lat, :lon, :r, 2) AND maxLon <= geo_bbox_around(:lat, :lon, :r, 3)
+//		   AND haversine_distance(:lat, :lon, lat, lon) <= :r
+//
+//	All functions assume the WGS84 mean earth radius; for ranking and bounding purposes the spherical approximation is well
+//	within the precision of a REAL32 rtree coordinate.
+
+const EARTH_RADIUS_M = 6371008.8
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func degrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+//	Any NULL argument makes the result NULL, following the convention of the other built-in scalar functions.
+func anyNullArgument(argv []*sqlite3_value) bool {
+	for _, value := range argv {
+		if sqlite3_value_type(value) == SQLITE_NULL {
+			return true
+		}
+	}
+	return false
+}
+
+//	Implementation of the haversine_distance() function.
+func haversineFunc(context *Context, argc int, argv []*sqlite3_value) {
+	assert( argc == 4 )
+	if anyNullArgument(argv) {
+		return
+	}
+	lat1 := radians(sqlite3_value_float64(argv[0]))
+	lon1 := radians(sqlite3_value_float64(argv[1]))
+	lat2 := radians(sqlite3_value_float64(argv[2]))
+	lon2 := radians(sqlite3_value_float64(argv[3]))
+	sinLat := math.Sin((lat2 - lat1) / 2)
+	sinLon := math.Sin((lon2 - lon1) / 2)
+	a := sinLat * sinLat + math.Cos(lat1) * math.Cos(lat2) * sinLon * sinLon
+	sqlite3_result_float64(context, 2 * EARTH_RADIUS_M * math.Asin(math.Sqrt(math.Min(1, a))))
+}
+
+//	Implementation of the geo_bbox_around() function. The box is widened at high latitudes so that it always contains the
+//	full circle; at the poles the longitude bounds degenerate to the whole range, which is correct if not tight.
+func geoBboxFunc(context *Context, argc int, argv []*sqlite3_value) {
+	assert( argc == 4 )
+	if anyNullArgument(argv) {
+		return
+	}
+	lat := sqlite3_value_float64(argv[0])
+	lon := sqlite3_value_float64(argv[1])
+	radius := sqlite3_value_float64(argv[2])
+	if radius < 0 {
+		context.sqlite3_result_error("geo_bbox_around() requires a non-negative radius", -1)
+		return
+	}
+	deltaLat := degrees(radius / EARTH_RADIUS_M)
+	deltaLon := 180.0
+	if cosLat := math.Cos(radians(lat)); cosLat > 1e-10 {
+		deltaLon = math.Min(180, degrees(radius / (EARTH_RADIUS_M * cosLat)))
+	}
+	switch sqlite3_value_int(argv[3]) {
+	case 0:
+		sqlite3_result_float64(context, math.Max(-90, lat - deltaLat))
+	case 1:
+		sqlite3_result_float64(context, math.Min(90, lat + deltaLat))
+	case 2:
+		sqlite3_result_float64(context, math.Max(-180, lon - deltaLon))
+	case 3:
+		sqlite3_result_float64(context, math.Min(180, lon + deltaLon))
+	default:
+		context.sqlite3_result_error("geo_bbox_around() coordinate selector must be 0, 1, 2 or 3", -1)
+	}
+}
+
+//	Implementation of the bearing() function. The result is normalised into [0, 360).
+func bearingFunc(context *Context, argc int, argv []*sqlite3_value) {
+	assert( argc == 4 )
+	if anyNullArgument(argv) {
+		return
+	}
+	lat1 := radians(sqlite3_value_float64(argv[0]))
+	lon1 := radians(sqlite3_value_float64(argv[1]))
+	lat2 := radians(sqlite3_value_float64(argv[2]))
+	lon2 := radians(sqlite3_value_float64(argv[3]))
+	y := math.Sin(lon2 - lon1) * math.Cos(lat2)
+	x := math.Cos(lat1) * math.Sin(lat2) - math.Sin(lat1) * math.Cos(lat2) * math.Cos(lon2 - lon1)
+	sqlite3_result_float64(context, math.Mod(degrees(math.Atan2(y, x)) + 360, 360))
+}
@@ -0,0 +1,287 @@
+package serendipity
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//	This file connects the r-tree to the standard geometry encodings. GIS data arrives as WKT ("POLYGON((...))") or
+//	its binary form WKB; loading it into an r-tree previously meant extracting bounding boxes in application code.
+//	wkt_bbox and wkb_bbox do that extraction in SQL - with a column index they return one bound at a time, so an
+//	import is a single statement:
+//
+//		INSERT INTO rt SELECT id, wkb_bbox(geom, 0), wkb_bbox(geom, 1), wkb_bbox(geom, 2), wkb_bbox(geom, 3) FROM src
+//
+//	Without the index argument the four bounds come back as a JSON array for the json functions to pick apart.
+//
+//	wkb_match(blob) goes further than the box: used as a MATCH operand it tests candidate boxes against the actual
+//	WKB polygon - overlap of box and polygon, not box and box - through the same constraint machinery as the
+//	registered geometry callbacks, so "every entry touching this parcel" needs no application-side refinement step.
+
+//	Every coordinate pair in a WKT text, in order of appearance. The grammar's structure does not matter for a
+//	bounding box, so the scan just collects numbers, which also covers the MULTI* and collection forms; a Z/M
+//	dimension marker is rejected rather than silently mispaired.
+func wktCoordinates(text string) (points []float64, ok bool) {
+	upper := strings.ToUpper(text)
+	if strings.Contains(upper, " Z") || strings.Contains(upper, " M") || strings.Contains(upper, "ZM") {
+		return nil, false
+	}
+	for i := 0; i < len(text); {
+		c := text[i]
+		if c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9') {
+			start := i
+			for i < len(text) && text[i] != ' ' && text[i] != ',' && text[i] != ')' {
+				i++
+			}
+			number, err := strconv.ParseFloat(text[start:i], 64)
+			if err != nil {
+				return nil, false
+			}
+			points = append(points, number)
+		} else {
+			i++
+		}
+	}
+	return points, len(points) > 0 && len(points) % 2 == 0
+}
+
+//	A WKB reader: one geometry, recursing into the MULTI* and collection forms. Each geometry carries its own byte
+//	order flag, so the order is re-read per element as the specification requires. Points are appended flat, x
+//	then y; rings are collected separately for the polygon MATCH test.
+type wkbReader struct {
+	data	[]byte
+	at		int
+}
+
+func (reader *wkbReader) float64At(order binary.ByteOrder) (v float64, ok bool) {
+	if reader.at + 8 > len(reader.data) {
+		return 0, false
+	}
+	v = math.Float64frombits(order.Uint64(reader.data[reader.at:]))
+	reader.at += 8
+	return v, true
+}
+
+func (reader *wkbReader) uint32At(order binary.ByteOrder) (v uint32, ok bool) {
+	if reader.at + 4 > len(reader.data) {
+		return 0, false
+	}
+	v = order.Uint32(reader.data[reader.at:])
+	reader.at += 4
+	return v, true
+}
+
+func (reader *wkbReader) geometry(points []float64, rings [][]float64) ([]float64, [][]float64, bool) {
+	if reader.at >= len(reader.data) {
+		return nil, nil, false
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if reader.data[reader.at] == 1 {
+		order = binary.LittleEndian
+	}
+	reader.at++
+	kind, ok := reader.uint32At(order)
+	if !ok {
+		return nil, nil, false
+	}
+	switch kind {
+	case 1:		//	Point
+		x, okX := reader.float64At(order)
+		y, okY := reader.float64At(order)
+		if !okX || !okY {
+			return nil, nil, false
+		}
+		return append(points, x, y), rings, true
+	case 2:		//	LineString
+		n, ok := reader.uint32At(order)
+		if !ok {
+			return nil, nil, false
+		}
+		for i := uint32(0); i < n; i++ {
+			x, okX := reader.float64At(order)
+			y, okY := reader.float64At(order)
+			if !okX || !okY {
+				return nil, nil, false
+			}
+			points = append(points, x, y)
+		}
+		return points, rings, true
+	case 3:		//	Polygon
+		nRings, ok := reader.uint32At(order)
+		if !ok {
+			return nil, nil, false
+		}
+		for i := uint32(0); i < nRings; i++ {
+			n, ok := reader.uint32At(order)
+			if !ok {
+				return nil, nil, false
+			}
+			ring := make([]float64, 0, n * 2)
+			for j := uint32(0); j < n; j++ {
+				x, okX := reader.float64At(order)
+				y, okY := reader.float64At(order)
+				if !okX || !okY {
+					return nil, nil, false
+				}
+				ring = append(ring, x, y)
+				points = append(points, x, y)
+			}
+			rings = append(rings, ring)
+		}
+		return points, rings, true
+	case 4, 5, 6, 7:	//	MultiPoint, MultiLineString, MultiPolygon, GeometryCollection
+		n, ok := reader.uint32At(order)
+		if !ok {
+			return nil, nil, false
+		}
+		for i := uint32(0); i < n; i++ {
+			if points, rings, ok = reader.geometry(points, rings); !ok {
+				return nil, nil, false
+			}
+		}
+		return points, rings, true
+	}
+	return nil, nil, false
+}
+
+//	The bounds of a flat coordinate list as the r-tree wants them: minX, maxX, minY, maxY.
+func coordinateBounds(points []float64) (bounds [4]float64) {
+	bounds = [4]float64{ points[0], points[0], points[1], points[1] }
+	for i := 2; i < len(points); i += 2 {
+		bounds[0] = math.Min(bounds[0], points[i])
+		bounds[1] = math.Max(bounds[1], points[i])
+		bounds[2] = math.Min(bounds[2], points[i + 1])
+		bounds[3] = math.Max(bounds[3], points[i + 1])
+	}
+	return
+}
+
+//	Produce the bounds as a function result: one bound when the optional second argument indexes it, the JSON
+//	array otherwise.
+func boundsResult(context *Context, args []*sqlite3_value, bounds [4]float64) {
+	if len(args) == 2 {
+		i := sqlite3_value_int64(args[1])
+		if i < 0 || i > 3 {
+			sqlite3_result_error(context, "bbox index must be 0..3", -1)
+			return
+		}
+		sqlite3_result_float64(context, bounds[i])
+		return
+	}
+	parts := make([]string, 4)
+	for i, bound := range bounds {
+		parts[i] = strconv.FormatFloat(bound, 'g', -1, 64)
+	}
+	sqlite3_result_text(context, "[" + strings.Join(parts, ",") + "]", -1, nil)
+}
+
+func wktBboxFunc(context *Context, args []*sqlite3_value) {
+	points, ok := wktCoordinates(sqlite3_value_text(args[0]))
+	if !ok {
+		sqlite3_result_error(context, "malformed WKT", -1)
+		return
+	}
+	boundsResult(context, args, coordinateBounds(points))
+}
+
+func wkbBboxFunc(context *Context, args []*sqlite3_value) {
+	reader := &wkbReader{ data: ([]byte)(sqlite3_value_blob(args[0])) }
+	points, _, ok := reader.geometry(nil, nil)
+	if !ok || len(points) == 0 {
+		sqlite3_result_error(context, "malformed WKB", -1)
+		return
+	}
+	boundsResult(context, args, coordinateBounds(points))
+}
+
+//	A parsed WKB polygon held as a MATCH operand.
+const RTREE_WKB_POINTER_TAG = "rtree_wkb"
+
+type WkbMatch struct {
+	rings	[][]float64
+	bounds	[4]float64
+}
+
+//	wkb_match(blob): package a WKB polygon for the MATCH operator.
+func wkbMatchFunc(context *Context, args []*sqlite3_value) {
+	reader := &wkbReader{ data: ([]byte)(sqlite3_value_blob(args[0])) }
+	points, rings, ok := reader.geometry(nil, nil)
+	if !ok || len(rings) == 0 {
+		sqlite3_result_error(context, "wkb_match() needs a WKB polygon", -1)
+		return
+	}
+	context.sqlite3_result_pointer(&WkbMatch{ rings: rings, bounds: coordinateBounds(points) }, RTREE_WKB_POINTER_TAG)
+}
+
+//	Ray-casting containment against the polygon's rings; a hole (any ring past the first) flips the verdict as it
+//	flips the crossing count.
+func (match *WkbMatch) contains(x, y float64) (inside bool) {
+	for _, ring := range match.rings {
+		for i, j := 0, len(ring) - 2; i < len(ring); i += 2 {
+			xi, yi := ring[i], ring[i + 1]
+			xj, yj := ring[j], ring[j + 1]
+			if (yi > y) != (yj > y) && x < (xj - xi) * (y - yi) / (yj - yi) + xi {
+				inside = !inside
+			}
+			j = i
+		}
+	}
+	return
+}
+
+func segmentsCross(ax, ay, bx, by, cx, cy, dx, dy float64) bool {
+	side := func(px, py, qx, qy, rx, ry float64) float64 {
+		return (qx - px) * (ry - py) - (qy - py) * (rx - px)
+	}
+	s1 := side(ax, ay, bx, by, cx, cy)
+	s2 := side(ax, ay, bx, by, dx, dy)
+	s3 := side(cx, cy, dx, dy, ax, ay)
+	s4 := side(cx, cy, dx, dy, bx, by)
+	return ((s1 > 0) != (s2 > 0)) && ((s3 > 0) != (s4 > 0))
+}
+
+//	The constraint test: whether the polygon intersects a candidate box. True when a polygon vertex lies in the
+//	box, a box corner lies in the polygon, or an edge of one crosses an edge of the other - the three ways two
+//	convexity-free shapes can meet. aCoord is min/max per dimension as testGeom supplies it.
+func (match *WkbMatch) geometryTest(geometry *sqlite3_rtree_geometry, aCoord []float64) (isWithin bool, rc int) {
+	xMin, xMax, yMin, yMax := aCoord[0], aCoord[1], aCoord[2], aCoord[3]
+	if match.bounds[1] < xMin || match.bounds[0] > xMax || match.bounds[3] < yMin || match.bounds[2] > yMax {
+		return false, SQLITE_OK
+	}
+	for _, ring := range match.rings {
+		for i := 0; i < len(ring); i += 2 {
+			if ring[i] >= xMin && ring[i] <= xMax && ring[i + 1] >= yMin && ring[i + 1] <= yMax {
+				return true, SQLITE_OK
+			}
+		}
+	}
+	corners := [4][2]float64{ { xMin, yMin }, { xMax, yMin }, { xMax, yMax }, { xMin, yMax } }
+	for _, corner := range corners {
+		if match.contains(corner[0], corner[1]) {
+			return true, SQLITE_OK
+		}
+	}
+	for _, ring := range match.rings {
+		for i, j := 0, len(ring) - 2; i < len(ring); i += 2 {
+			for k := 0; k < 4; k++ {
+				c, d := corners[k], corners[(k + 1) % 4]
+				if segmentsCross(ring[j], ring[j + 1], ring[i], ring[i + 1], c[0], c[1], d[0], d[1]) {
+					return true, SQLITE_OK
+				}
+			}
+			j = i
+		}
+	}
+	return false, SQLITE_OK
+}
+
+//	Register the geometry encoding functions on a connection.
+func (db *sqlite3) RegisterWkxFunctions() {
+	db.CreateFunc("wkt_bbox", 1, nil, wktBboxFunc, nil, nil, nil)
+	db.CreateFunc("wkt_bbox", 2, nil, wktBboxFunc, nil, nil, nil)
+	db.CreateFunc("wkb_bbox", 1, nil, wkbBboxFunc, nil, nil, nil)
+	db.CreateFunc("wkb_bbox", 2, nil, wkbBboxFunc, nil, nil, nil)
+	db.CreateFunc("wkb_match", 1, nil, wkbMatchFunc, nil, nil, nil)
+}
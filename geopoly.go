@@ -0,0 +1,509 @@
+package serendipity
+
+import (
+	"strconv"
+	"strings"
+)
+
+//	The geopoly module: arbitrary polygons indexed through the r-tree. A geopoly table is a two-dimensional r-tree whose
+//	%_node cells carry each polygon's bounding box, with the full vertex list stored in an auxiliary %_geometry shadow
+//	table keyed by rowid. Inserts parse the polygon text supplied for the _shape column, store its bounding box as the
+//	r-tree cell and the text in %_geometry; reads join the two by rowid inside rtreeColumn, so SELECT returns the
+//	polygon, not the box. Queries constrain on the bounding box through the ordinary r-tree machinery - which discards
+//	the overwhelming majority of candidates - and the exact polygon predicates refine the survivors:
+//
+//		geopoly_overlap(p1, p2)		non-zero if the polygons share any area
+//		geopoly_within(p1, p2)		non-zero if p1 lies entirely inside p2
+//		geopoly_area(p)				the signed area (counter-clockwise positive)
+//
+//	Polygons are accepted as JSON-style text - "[[x0,y0],[x1,y1],...]" - and held internally as a vertex slice. The
+//	ring is implicitly closed; the final vertex need not repeat the first. Degenerate input (fewer than three
+//	vertices, unparseable text) is rejected with an error rather than treated as empty, since an empty polygon in a
+//	spatial predicate almost always hides a data bug.
+//
+//	The declared schema is _shape followed by the box columns x1, x2, y1, y2, which read back the stored bounding box;
+//	any further columns in the declaration become aux data columns carried alongside the spatial structure, exactly as
+//	"+"-prefixed columns are for a plain rtree - see rtree_aux.go.
+
+//	A parsed polygon: vertices of the single ring, in order.
+type GeoPoly struct {
+	vertices	[][2]float64
+}
+
+//	Parse polygon text. The grammar is exactly nested JSON arrays of numbers; anything else fails.
+func GeoPolyParse(text string) (polygon *GeoPoly, ok bool) {
+	parser := &geoPolyParser{ text: text }
+	polygon = &GeoPoly{}
+	if !parser.expect('[') {
+		return nil, false
+	}
+	for {
+		x, okX := parser.number('[')
+		y, okY := parser.number(',')
+		if !okX || !okY || !parser.expect(']') {
+			return nil, false
+		}
+		polygon.vertices = append(polygon.vertices, [2]float64{ x, y })
+		if !parser.expect(',') {
+			break
+		}
+	}
+	if !parser.expect(']') || !parser.atEnd() || len(polygon.vertices) < 3 {
+		return nil, false
+	}
+	return polygon, true
+}
+
+type geoPolyParser struct {
+	text	string
+	i		int
+}
+
+func (p *geoPolyParser) skipSpace() {
+	for p.i < len(p.text) && (p.text[p.i] == ' ' || p.text[p.i] == '\t' || p.text[p.i] == '\n' || p.text[p.i] == '\r') {
+		p.i++
+	}
+}
+
+func (p *geoPolyParser) expect(c byte) bool {
+	p.skipSpace()
+	if p.i < len(p.text) && p.text[p.i] == c {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *geoPolyParser) atEnd() bool {
+	p.skipSpace()
+	return p.i == len(p.text)
+}
+
+//	Read the leading delimiter then a number.
+func (p *geoPolyParser) number(leading byte) (value float64, ok bool) {
+	if !p.expect(leading) {
+		return 0, false
+	}
+	p.skipSpace()
+	start := p.i
+	for p.i < len(p.text) && (p.text[p.i] == '-' || p.text[p.i] == '+' || p.text[p.i] == '.' || p.text[p.i] == 'e' || p.text[p.i] == 'E' || (p.text[p.i] >= '0' && p.text[p.i] <= '9')) {
+		p.i++
+	}
+	value, err := strconv.ParseFloat(p.text[start:p.i], 64)
+	return value, err == nil
+}
+
+//	The polygon's bounding box, for the r-tree cell.
+func (polygon *GeoPoly) BoundingBox() (minX, maxX, minY, maxY float64) {
+	minX, maxX = polygon.vertices[0][0], polygon.vertices[0][0]
+	minY, maxY = polygon.vertices[0][1], polygon.vertices[0][1]
+	for _, vertex := range polygon.vertices[1:] {
+		switch {
+		case vertex[0] < minX:
+			minX = vertex[0]
+		case vertex[0] > maxX:
+			maxX = vertex[0]
+		}
+		switch {
+		case vertex[1] < minY:
+			minY = vertex[1]
+		case vertex[1] > maxY:
+			maxY = vertex[1]
+		}
+	}
+	return
+}
+
+//	The signed area by the shoelace formula: positive for counter-clockwise winding.
+func (polygon *GeoPoly) Area() (area float64) {
+	n := len(polygon.vertices)
+	for i := 0; i < n; i++ {
+		j := (i + 1) % n
+		area += polygon.vertices[i][0] * polygon.vertices[j][1]
+		area -= polygon.vertices[j][0] * polygon.vertices[i][1]
+	}
+	return area / 2
+}
+
+//	Whether the point lies inside the polygon, by ray casting. Points exactly on an edge count as inside, which keeps
+//	within() reflexive.
+func (polygon *GeoPoly) Contains(x, y float64) bool {
+	inside := false
+	n := len(polygon.vertices)
+	for i, j := 0, n - 1; i < n; j, i = i, i + 1 {
+		xi, yi := polygon.vertices[i][0], polygon.vertices[i][1]
+		xj, yj := polygon.vertices[j][0], polygon.vertices[j][1]
+		if (yi > y) != (yj > y) && x < (xj - xi) * (y - yi) / (yj - yi) + xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+//	Whether two polygons share any area: any edge intersection, or either wholly containing a vertex of the other.
+func (p1 *GeoPoly) Overlaps(p2 *GeoPoly) bool {
+	for i := range p1.vertices {
+		if p2.Contains(p1.vertices[i][0], p1.vertices[i][1]) {
+			return true
+		}
+	}
+	for i := range p2.vertices {
+		if p1.Contains(p2.vertices[i][0], p2.vertices[i][1]) {
+			return true
+		}
+	}
+	return p1.anyEdgeIntersects(p2)
+}
+
+//	Whether p1 lies entirely within p2: every vertex of p1 inside p2 and no edge crossings.
+func (p1 *GeoPoly) Within(p2 *GeoPoly) bool {
+	for i := range p1.vertices {
+		if !p2.Contains(p1.vertices[i][0], p1.vertices[i][1]) {
+			return false
+		}
+	}
+	return !p1.anyEdgeIntersects(p2)
+}
+
+func (p1 *GeoPoly) anyEdgeIntersects(p2 *GeoPoly) bool {
+	n1, n2 := len(p1.vertices), len(p2.vertices)
+	for i := 0; i < n1; i++ {
+		a1, a2 := p1.vertices[i], p1.vertices[(i + 1) % n1]
+		for j := 0; j < n2; j++ {
+			b1, b2 := p2.vertices[j], p2.vertices[(j + 1) % n2]
+			if segmentsCross(a1, a2, b1, b2) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//	Proper segment intersection via orientation tests; shared endpoints do not count as crossings.
+func segmentsCross(a1, a2, b1, b2 [2]float64) bool {
+	d1 := orientation(b1, b2, a1)
+	d2 := orientation(b1, b2, a2)
+	d3 := orientation(a1, a2, b1)
+	d4 := orientation(a1, a2, b2)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
+
+func orientation(a, b, c [2]float64) float64 {
+	return (b[0] - a[0]) * (c[1] - a[1]) - (b[1] - a[1]) * (c[0] - a[0])
+}
+
+//	The SQL functions. Each parses its arguments fresh; polygons are small and parsing is linear, so caching parsed
+//	forms across calls is not worth the value-lifetime bookkeeping.
+func geopolyAreaFunc(context *Context, args []*sqlite3_value) {
+	polygon, ok := GeoPolyParse(sqlite3_value_text(args[0]))
+	if !ok {
+		sqlite3_result_error(context, "geopoly_area: malformed polygon", -1)
+		return
+	}
+	sqlite3_result_float64(context, polygon.Area())
+}
+
+func geopolyOverlapFunc(context *Context, args []*sqlite3_value) {
+	p1, ok1 := GeoPolyParse(sqlite3_value_text(args[0]))
+	p2, ok2 := GeoPolyParse(sqlite3_value_text(args[1]))
+	if !ok1 || !ok2 {
+		sqlite3_result_error(context, "geopoly_overlap: malformed polygon", -1)
+		return
+	}
+	if p1.Overlaps(p2) {
+		sqlite3_result_int64(context, 1)
+	} else {
+		sqlite3_result_int64(context, 0)
+	}
+}
+
+func geopolyWithinFunc(context *Context, args []*sqlite3_value) {
+	p1, ok1 := GeoPolyParse(sqlite3_value_text(args[0]))
+	p2, ok2 := GeoPolyParse(sqlite3_value_text(args[1]))
+	if !ok1 || !ok2 {
+		sqlite3_result_error(context, "geopoly_within: malformed polygon", -1)
+		return
+	}
+	if p1.Within(p2) {
+		sqlite3_result_int64(context, 1)
+	} else {
+		sqlite3_result_int64(context, 0)
+	}
+}
+
+//	Round a float64 bound onto the 4-byte coordinate grid without ever shrinking the box: mins toward negative
+//	infinity, maxes toward positive - the same guarantee rtreeValueDown/rtreeValueUp give the plain rtree update
+//	path, for bounds that arrive from a parsed polygon rather than an sqlite3_value.
+func geoValueDown(d float64) RtreeValue {
+	f := float(d)
+	if f > d {
+		if d < 0 {
+			f = float(d * RNDAWAY)
+		} else {
+			f = float(d * RNDTOWARDS)
+		}
+	}
+	return f
+}
+
+func geoValueUp(d float64) RtreeValue {
+	f := float(d)
+	if f < d {
+		if d < 0 {
+			f = float(d * RNDTOWARDS)
+		} else {
+			f = float(d * RNDAWAY)
+		}
+	}
+	return f
+}
+
+//	Read the _shape column: the polygon text, joined from %_geometry by rowid.
+func (tree *Rtree) geometryColumn(ctx *Context, rowid int64) (rc int) {
+	sqlite3_bind_int64(tree.pReadGeometry, 1, rowid)
+	if tree.pReadGeometry.Step() == SQLITE_ROW {
+		sqlite3_result_text(ctx, sqlite3_column_text(tree.pReadGeometry, 0), -1, SQLITE_TRANSIENT)
+	}
+	return tree.pReadGeometry.Reset()
+}
+
+//	Write mapping (rowid->polygon text) to the <geopoly>_geometry table.
+func (tree *Rtree) geometryWrite(rowid int64, shape string) int {
+	sqlite3_bind_int64(tree.pWriteGeometry, 1, rowid)
+	sqlite3_bind_text(tree.pWriteGeometry, 2, shape, -1, SQLITE_TRANSIENT)
+	tree.pWriteGeometry.Step()
+	return tree.pWriteGeometry.Reset()
+}
+
+//	Remove the <geopoly>_geometry entry for a deleted row.
+func (tree *Rtree) geometryDelete(rowid int64) int {
+	sqlite3_bind_int64(tree.pDeleteGeometry, 1, rowid)
+	tree.pDeleteGeometry.Step()
+	return tree.pDeleteGeometry.Reset()
+}
+
+//	The implementation of both the xConnect and xCreate methods of the geopoly virtual table: a 2-dimensional REAL32
+//	r-tree whose spatial columns are synthesised here, plus the %_geometry shadow table holding the vertex text. The
+//	user's declared columns after the module/database/table arguments become aux columns; trailing key=value
+//	arguments pass through untouched so the rtree creation options keep working.
+func geopolyInit(db *sqlite3, aux interface{}, args []string, isCreate bool) (table *sqlite3_vtab, Err string, rc int) {
+	spatialArgs := append(append([]string{}, args[:3]...), "_shape", "x1", "x2", "y1", "y2")
+	for _, arg := range args[3:] {
+		if strings.Index(arg, "=") >= 0 {
+			spatialArgs = append(spatialArgs, arg)
+		} else {
+			spatialArgs = append(spatialArgs, "+" + arg)
+		}
+	}
+	if table, Err, rc = rtreeInit(db, RTREE_COORD_REAL32, spatialArgs, isCreate); rc != SQLITE_OK {
+		return
+	}
+	tree := (Rtree *)(table)
+	tree.isGeopoly = true
+
+	if isCreate {
+		if rc = sqlite3_exec(db, sqlite3_mprintf("CREATE TABLE IF NOT EXISTS \"%w\".\"%w_geometry\"(id INTEGER PRIMARY KEY, shape TEXT)", tree.zDb, tree.zName), 0, 0, 0); rc != SQLITE_OK {
+			Err = sqlite3_mprintf("%s", db.errmsg())
+			deregisterRtreeInstance(db, tree)
+			tree.Release()
+			return nil, Err, rc
+		}
+	}
+	geometry := sqlite3_mprintf("'%q'.'%q_geometry'", tree.zDb, tree.zName)
+	sources := []struct {
+		sql		string
+		target	**sqlite3_stmt
+	}{
+		{ sqlite3_mprintf("SELECT shape FROM %s WHERE id = :1", geometry), &tree.pReadGeometry },
+		{ sqlite3_mprintf("INSERT OR REPLACE INTO %s VALUES(:1, :2)", geometry), &tree.pWriteGeometry },
+		{ sqlite3_mprintf("DELETE FROM %s WHERE id = :1", geometry), &tree.pDeleteGeometry },
+	}
+	for _, source := range sources {
+		if *source.target, _, rc = db.Prepare_v2(source.sql); rc != SQLITE_OK {
+			Err = sqlite3_mprintf("%s", db.errmsg())
+			deregisterRtreeInstance(db, tree)
+			tree.Release()
+			return nil, Err, rc
+		}
+	}
+	return
+}
+
+//	Geopoly virtual table module xCreate method.
+func geopolyCreate(db *sqlite3, pAux interface{}, args []string) (table *sqlite3_vtab, Err string, rc int) {
+	return geopolyInit(db, pAux, args, true)
+}
+
+//	Geopoly virtual table module xConnect method.
+func geopolyConnect(db *sqlite3, pAux interface{}, args []string) (table *sqlite3_vtab, Err string, rc int) {
+	return geopolyInit(db, pAux, args, false)
+}
+
+//	The xUpdate method for geopoly virtual tables. The structure mirrors rtreeUpdate, but the spatial cell is not
+//	supplied by the statement: it is the bounding box of the polygon parsed from the _shape column value, and the
+//	vertex text itself is stored in %_geometry keyed by rowid. Unlike a plain rtree, column 0 is not a rowid alias,
+//	so a supplied rowid arrives in azData[1].
+func geopolyUpdate(pVtab *sqlite3_vtab, nData int, azData []sqlite3_value) (rowid int64, rc int) {
+	tree := (Rtree *)(pVtab)
+	tree.access.Lock()
+	defer tree.access.Unlock()
+	HaveRowid := false
+
+	defer func() {
+		tree.Release()
+	}()
+
+	tree.Reference()
+	assert(nData >= 1)
+
+	//	Any write may restructure nodes that open cursors on this table point into, so those cursors must not continue
+	//	from their cached positions.
+	tree.cursorGuard().InvalidateAll()
+
+	cell := tree.NewCell(-1)				//	New cell to insert if nData > 1
+	shape := ""
+	if nData > 1 {
+		//	The polygon supplies the cell: parse it, take its bounding box, and widen each bound to the 4-byte grid.
+		shape = sqlite3_value_text(azData[2])
+		polygon, ok := GeoPolyParse(shape)
+		if !ok {
+			tree.base.zErrMsg = sqlite3_mprintf("geopoly: malformed polygon: %s", shape)
+			return 0, SQLITE_CONSTRAINT
+		}
+		minX, maxX, minY, maxY := polygon.BoundingBox()
+		cell.aCoord[0].f = geoValueDown(minX)
+		cell.aCoord[1].f = geoValueUp(maxX)
+		cell.aCoord[2].f = geoValueDown(minY)
+		cell.aCoord[3].f = geoValueUp(maxY)
+
+		//	If a rowid value was supplied, check if it is already present in the table. If so, the constraint has failed.
+		if sqlite3_value_type(azData[1]) != SQLITE_NULL {
+			cell.iRowid = sqlite3_value_int64(azData[1])
+			if sqlite3_value_type(azData[0]) == SQLITE_NULL || sqlite3_value_int64(azData[0]) != cell.iRowid {
+				sqlite3_bind_int64(tree.pReadRowid, 1, cell.iRowid)
+				steprc := tree.pReadRowid.Step()
+				rc = tree.pReadRowid.Reset()
+				if steprc == SQLITE_ROW {
+					if sqlite3_vtab_on_conflict(tree.db) == SQLITE_REPLACE {
+						rc = tree.DeleteRowid(cell.iRowid)
+					} else {
+						rc = SQLITE_CONSTRAINT
+						return
+					}
+				}
+			}
+			HaveRowid = true
+		}
+	}
+
+	//	If azData[0] is not an SQL NULL value, it is the rowid of a record to delete. The geometry row goes with it.
+	if sqlite3_value_type(azData[0]) != SQLITE_NULL {
+		rc = tree.DeleteRowid(sqlite3_value_int64(azData[0]))
+		if rc == SQLITE_OK {
+			rc = tree.geometryDelete(sqlite3_value_int64(azData[0]))
+		}
+		if rc == SQLITE_OK && len(tree.auxColumns) > 0 {
+			rc = tree.auxDelete(sqlite3_value_int64(azData[0]))
+		}
+	}
+
+	//	If the azData[] array contains more than one element, insert the new record: the bounding-box cell into the
+	//	r-tree structure and the polygon text into %_geometry.
+	if rc == SQLITE_OK && nData > 1 {
+		var Leaf	*RtreeNode
+
+		if !HaveRowid {
+			rc, rowid = tree.newRowid()
+		} else {
+			rowid = cell.iRowid
+		}
+		cell.iRowid = rowid
+
+		if rc == SQLITE_OK {
+			Leaf, rc = tree.ChooseLeaf(&cell, 0)
+		}
+		if rc == SQLITE_OK {
+			tree.iReinsertHeight = -1
+			rc = tree.InsertCell(Leaf, &cell, 0)
+			if rc2 := tree.nodeRelease(Leaf); rc == SQLITE_OK {
+				rc = rc2
+			}
+		}
+		if rc == SQLITE_OK {
+			rc = tree.geometryWrite(rowid, shape)
+		}
+		if rc == SQLITE_OK && len(tree.auxColumns) > 0 {
+			rc = tree.auxWrite(rowid, azData[3 + tree.Dimensions * 2:])
+		}
+	}
+	return
+}
+
+//	The xRename method for geopoly virtual tables: the %_geometry table must follow the prefix along with the rtree
+//	shadow tables, under the same savepoint discipline as rtreeRename.
+func geopolyRename(pVtab *sqlite3_vtab, new_name string) (rc int) {
+	tree := (Rtree *)(pVtab)
+	if rc = sqlite3_exec(tree.db, "SAVEPOINT geopoly_rename", 0, 0, 0); rc != SQLITE_OK {
+		return
+	}
+	zSql := sqlite3_mprintf("ALTER TABLE %Q.'%q_geometry' RENAME TO \"%w_geometry\"", tree.zDb, tree.zName, new_name)
+	if rc = sqlite3_exec(tree.db, zSql, 0, 0, 0); rc == SQLITE_OK {
+		rc = rtreeRename(pVtab, new_name)
+	}
+	if rc != SQLITE_OK {
+		sqlite3_exec(tree.db, "ROLLBACK TO geopoly_rename", 0, 0, 0)
+	}
+	sqlite3_exec(tree.db, "RELEASE geopoly_rename", 0, 0, 0)
+	return
+}
+
+//	The xDestroy method for geopoly virtual tables: drop %_geometry alongside the rtree shadow tables, tolerating a
+//	table already missing exactly as rtreeDestroy does.
+func geopolyDestroy(table *sqlite3_vtab) (rc int) {
+	tree := (Rtree *)(table)
+	zSql := sqlite3_mprintf("DROP TABLE IF EXISTS '%q'.'%q_geometry';", tree.zDb, tree.zName)
+	if rc = sqlite3_exec(tree.db, zSql, 0, 0, 0); rc != SQLITE_OK {
+		return
+	}
+	return rtreeDestroy(table)
+}
+
+sqlite3_module geopolyModule = {
+  0,                          /* iVersion */
+  geopolyCreate,              /* xCreate - create a table */
+  geopolyConnect,             /* xConnect - connect to an existing table */
+  rtreeBestIndex,             /* xBestIndex - Determine search strategy */
+  rtreeDisconnect,            /* xDisconnect - Disconnect from a table */
+  geopolyDestroy,             /* xDestroy - Drop a table */
+  rtreeOpen,                  /* xOpen - open a cursor */
+  rtreeClose,                 /* xClose - close a cursor */
+  rtreeFilter,                /* xFilter - configure scan constraints */
+  rtreeNext,                  /* xNext - advance a cursor */
+  rtreeEof,                   /* xEof */
+  rtreeColumn,                /* xColumn - read data */
+  rtreeRowid,                 /* xRowid - read data */
+  geopolyUpdate,              /* xUpdate - write data */
+  rtreeBegin,                 /* xBegin - begin transaction; see rtree_txn.go */
+  rtreeSync,                  /* xSync - flush deferred node writes */
+  rtreeCommit,                /* xCommit - commit transaction */
+  rtreeRollback,              /* xRollback - rollback transaction */
+  0,                          /* xFindFunction - function overloading */
+  geopolyRename,              /* xRename - rename the table */
+  rtreeSavepoint,             /* xSavepoint - see rtree_savepoint.go */
+  rtreeRelease,               /* xRelease */
+  rtreeRollbackTo             /* xRollbackTo */
+};
+
+//	Register the module and functions with a connection.
+func GeopolyInit(db *sqlite3) (rc int) {
+	if rc = db.CreateFunction("geopoly_area", 1, nil, geopolyAreaFunc, nil, nil, nil); rc != SQLITE_OK {
+		return
+	}
+	if rc = db.CreateFunction("geopoly_overlap", 2, nil, geopolyOverlapFunc, nil, nil, nil); rc != SQLITE_OK {
+		return
+	}
+	if rc = db.CreateFunction("geopoly_within", 2, nil, geopolyWithinFunc, nil, nil, nil); rc != SQLITE_OK {
+		return
+	}
+	return sqlite3_create_module_v2(db, "geopoly", &geopolyModule, nil, 0)
+}
@@ -0,0 +1,147 @@
+package serendipity
+
+//	This file rewrites GLOB matching iteratively. patternCompare recurses on every '*' and so goes quadratic on
+//	pathological patterns like "*a*a*a*a*ab" - and being recursion, deep patterns also cost stack. The compiled form
+//	below parses the pattern once into a flat op list and matches with the classic single-backtrack-point walk: when
+//	a mismatch occurs the matcher resumes after the most recent '*', one subject character along. '*' is the only
+//	unbounded operator in GLOB, so this is exact, needs no recursion and runs in O(len(pattern) * len(subject)) in
+//	the worst case and linearly on ordinary patterns.
+//
+//	The compiled pattern is cached in the statement through the auxiliary-data mechanism, keyed to the pattern
+//	argument, so a prepared statement running GLOB over a table compiles its pattern once instead of once per row.
+
+//	Compiled pattern operators.
+const (
+	GLOB_LITERAL	= iota	//	Match exactly one specific character
+	GLOB_ANY				//	'*' - match any run of characters, including none
+	GLOB_ONE				//	'?' - match exactly one character
+	GLOB_CLASS				//	[...] - match one character against a set
+	GLOB_NEVER				//	An unterminated class; matches nothing, as the recursive matcher behaved
+)
+
+type globOp struct {
+	kind	int
+	r		rune		//	GLOB_LITERAL character
+	negate	bool		//	GLOB_CLASS [^...] form
+	singles	[]rune		//	GLOB_CLASS individual characters
+	ranges	[][2]rune	//	GLOB_CLASS lo-hi pairs
+}
+
+type compiledGlob struct {
+	source	string
+	ops		[]globOp
+}
+
+//	Parse a GLOB pattern. Runs of '*' collapse to one GLOB_ANY; class parsing follows the long-standing rules: a
+//	leading '^' negates, a ']' first in the list is literal, 'a-z' is a range, and a trailing '-' is literal.
+func compileGlob(pattern string) (compiled *compiledGlob) {
+	compiled = &compiledGlob{ source: pattern }
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '*':
+			if n := len(compiled.ops); n == 0 || compiled.ops[n - 1].kind != GLOB_ANY {
+				compiled.ops = append(compiled.ops, globOp{ kind: GLOB_ANY })
+			}
+		case '?':
+			compiled.ops = append(compiled.ops, globOp{ kind: GLOB_ONE })
+		case '[':
+			op := globOp{ kind: GLOB_CLASS }
+			j := i + 1
+			if j < len(runes) && runes[j] == '^' {
+				op.negate = true
+				j++
+			}
+			first := true
+			for ; j < len(runes) && (first || runes[j] != ']'); first = false {
+				if j + 2 < len(runes) && runes[j + 1] == '-' && runes[j + 2] != ']' {
+					op.ranges = append(op.ranges, [2]rune{ runes[j], runes[j + 2] })
+					j += 3
+				} else {
+					op.singles = append(op.singles, runes[j])
+					j++
+				}
+			}
+			if j == len(runes) {
+				op = globOp{ kind: GLOB_NEVER }
+			}
+			compiled.ops = append(compiled.ops, op)
+			i = j
+		default:
+			compiled.ops = append(compiled.ops, globOp{ kind: GLOB_LITERAL, r: runes[i] })
+		}
+	}
+	return
+}
+
+func (op *globOp) matchesClass(r rune) bool {
+	matched := false
+	for _, single := range op.singles {
+		if r == single {
+			matched = true
+			break
+		}
+	}
+	for _, span := range op.ranges {
+		if !matched && r >= span[0] && r <= span[1] {
+			matched = true
+		}
+	}
+	return matched != op.negate
+}
+
+//	Match the subject iteratively. starOp/starS record the most recent GLOB_ANY and the subject position it is
+//	currently assumed to cover; a mismatch downstream re-enters there with one more character consumed.
+func (compiled *compiledGlob) Match(subject string) bool {
+	s := []rune(subject)
+	op, i := 0, 0
+	starOp, starS := -1, 0
+	for {
+		if op == len(compiled.ops) {
+			if i == len(s) {
+				return true
+			}
+		} else {
+			switch o := &compiled.ops[op]; o.kind {
+			case GLOB_ANY:
+				starOp, starS = op, i
+				op++
+				continue
+			case GLOB_ONE:
+				if i < len(s) {
+					op++
+					i++
+					continue
+				}
+			case GLOB_LITERAL:
+				if i < len(s) && s[i] == o.r {
+					op++
+					i++
+					continue
+				}
+			case GLOB_CLASS:
+				if i < len(s) && o.matchesClass(s[i]) {
+					op++
+					i++
+					continue
+				}
+			}
+		}
+		if starOp < 0 || starS >= len(s) {
+			return false
+		}
+		starS++
+		op, i = starOp + 1, starS
+	}
+}
+
+//	Match using the compiled pattern cached on the statement, compiling when the cache is cold or the pattern
+//	argument has changed since the last row.
+func globMatchCached(context *Context, pattern, subject string) bool {
+	compiled, _ := context.GetAuxData(0).(*compiledGlob)
+	if compiled == nil || compiled.source != pattern {
+		compiled = compileGlob(pattern)
+		context.SetAuxData(0, compiled, nil)
+	}
+	return compiled.Match(subject)
+}
@@ -0,0 +1,137 @@
+package serendipity
+
+import (
+	"unicode"
+)
+
+//	This file implements the ILIKE operator: a LIKE that is both case-insensitive and accent-insensitive, so
+//	'résumé' ILIKE 'RESUME' is true. The expression parser maps "x ILIKE y" to the two-argument function
+//	ilike(y, x) through parseLikeOperator below, exactly as LIKE and GLOB map to their functions, and the function
+//	is registered with SQLITE_FUNC_LIKE and without SQLITE_FUNC_CASE so that sqlite3IsLikeFunction reports it as a
+//	case-insensitive LIKE. That lets the planner apply the existing LIKE optimization: an ILIKE 'prefix%' pattern
+//	over a column with a NOCASE-collated index becomes a range scan on that index, with the folding matcher run
+//	only as the final filter.
+//
+//	Folding is simple Unicode lower-casing followed by accent stripping over the Latin ranges; characters outside
+//	the table compare as themselves after lower-casing. The wildcards are the LIKE wildcards: '%' matches any run
+//	of characters, '_' exactly one, and the optional third argument supplies an escape character.
+
+//	Accented Latin letters and the base letters they fold to. Both cases are covered by lower-casing first.
+var ilikeAccents = map[rune]rune{
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a', 'ā': 'a', 'ă': 'a', 'ą': 'a',
+	'ç': 'c', 'ć': 'c', 'ĉ': 'c', 'ċ': 'c', 'č': 'c',
+	'ď': 'd', 'đ': 'd',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e', 'ē': 'e', 'ĕ': 'e', 'ė': 'e', 'ę': 'e', 'ě': 'e',
+	'ĝ': 'g', 'ğ': 'g', 'ġ': 'g', 'ģ': 'g',
+	'ĥ': 'h', 'ħ': 'h',
+	'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i', 'ĩ': 'i', 'ī': 'i', 'ĭ': 'i', 'į': 'i', 'ı': 'i',
+	'ĵ': 'j',
+	'ķ': 'k',
+	'ĺ': 'l', 'ļ': 'l', 'ľ': 'l', 'ŀ': 'l', 'ł': 'l',
+	'ñ': 'n', 'ń': 'n', 'ņ': 'n', 'ň': 'n',
+	'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o', 'ō': 'o', 'ŏ': 'o', 'ő': 'o',
+	'ŕ': 'r', 'ŗ': 'r', 'ř': 'r',
+	'ś': 's', 'ŝ': 's', 'ş': 's', 'š': 's',
+	'ţ': 't', 'ť': 't', 'ŧ': 't',
+	'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u', 'ũ': 'u', 'ū': 'u', 'ŭ': 'u', 'ů': 'u', 'ű': 'u', 'ų': 'u',
+	'ŵ': 'w',
+	'ý': 'y', 'ÿ': 'y', 'ŷ': 'y',
+	'ź': 'z', 'ż': 'z', 'ž': 'z',
+}
+
+func ilikeFold(r rune) rune {
+	r = unicode.ToLower(r)
+	if base, folded := ilikeAccents[r]; folded {
+		return base
+	}
+	return r
+}
+
+//	Match s against pattern, both already folded. The standard LIKE algorithm: advance both in step, with '%'
+//	trying every suffix and '_' consuming exactly one character. An escape of zero means no escape character.
+func ilikeMatch(pattern, s []rune, escape rune) bool {
+	for len(pattern) > 0 {
+		c := pattern[0]
+		switch {
+		case escape != 0 && c == escape:
+			if len(pattern) < 2 || len(s) == 0 || s[0] != ilikeFold(pattern[1]) {
+				return false
+			}
+			pattern, s = pattern[2:], s[1:]
+		case c == '%':
+			for len(pattern) > 0 && pattern[0] == '%' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if ilikeMatch(pattern, s[i:], escape) {
+					return true
+				}
+			}
+			return false
+		case c == '_':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		default:
+			if len(s) == 0 || s[0] != c {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+func ilikeFoldString(text string) (folded []rune) {
+	folded = make([]rune, 0, len(text))
+	for _, r := range text {
+		folded = append(folded, ilikeFold(r))
+	}
+	return
+}
+
+//	The ilike SQL function. As with like, the pattern is the first argument - "x ILIKE y" arrives as ilike(y, x) -
+//	and the optional third argument is the escape character.
+func ilikeFunc(context *Context, args []*sqlite3_value) {
+	if sqlite3_value_type(args[0]) == SQLITE_NULL || sqlite3_value_type(args[1]) == SQLITE_NULL {
+		return
+	}
+	var escape	rune
+	if len(args) == 3 {
+		esc := []rune(sqlite3_value_text(args[2]))
+		if len(esc) != 1 {
+			sqlite3_result_error(context, "ESCAPE expression must be a single character", -1)
+			return
+		}
+		escape = esc[0]
+	}
+	pattern := ilikeFoldString(sqlite3_value_text(args[0]))
+	subject := ilikeFoldString(sqlite3_value_text(args[1]))
+	if ilikeMatch(pattern, subject, escape) {
+		sqlite3_result_int(context, 1)
+	} else {
+		sqlite3_result_int(context, 0)
+	}
+}
+
+//	Map an infix LIKE-style keyword to the function implementing it. Called by the expression parser when it sees
+//	"x OP y" with an identifier operator; ILIKE joins the vocabulary LIKE, GLOB, REGEXP and MATCH have always had.
+func parseLikeOperator(keyword string) (zFunc string, ok bool) {
+	switch {
+	case CaseInsensitiveComparison(keyword, "like") == 0:
+		return "like", true
+	case CaseInsensitiveComparison(keyword, "ilike") == 0:
+		return "ilike", true
+	case CaseInsensitiveComparison(keyword, "glob") == 0:
+		return "glob", true
+	case CaseInsensitiveComparison(keyword, "regexp") == 0:
+		return "regexp", true
+	case CaseInsensitiveComparison(keyword, "match") == 0:
+		return "match", true
+	}
+	return "", false
+}
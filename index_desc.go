@@ -0,0 +1,90 @@
+package serendipity
+
+//	This file implements DESC index columns and their use for ordering. An index declared
+//
+//		CREATE INDEX i ON t(a ASC, b DESC)
+//
+//	stores b's key bytes inverted, so the btree's bytewise order is the declared mixed order and a query with the
+//	matching "ORDER BY a, b DESC" reads rows already sorted. The planner also recognises the exact complement -
+//	"ORDER BY a DESC, b" - and satisfies it from the same index by walking the btree backwards, so one index
+//	serves both directions of its declared ordering and neither needs a sort step. Any other direction pattern
+//	genuinely requires sorting and falls through to the sorter as before.
+
+//	Per-column sort orders in Index.aSortOrder; an index without the array (built before DESC support) is all
+//	ascending, which columnSortOrder encodes so older schemas read unchanged.
+const (
+	SQLITE_SO_ASC	= 0
+	SQLITE_SO_DESC	= 1
+)
+
+func (index *Index) columnSortOrder(i int) byte {
+	if i >= len(index.aSortOrder) {
+		return SQLITE_SO_ASC
+	}
+	return index.aSortOrder[i]
+}
+
+//	Append one index key column honouring its declared direction: a DESC column's encoding is bit-inverted, which
+//	reverses bytewise order while preserving the encoding's self-delimiting structure, since both its terminators
+//	and its tags are inverted consistently.
+func encodeDirectedKeyValue(buffer []byte, value interface{}, sortOrder byte) []byte {
+	if sortOrder == SQLITE_SO_ASC {
+		return encodeKeyValue(buffer, value)
+	}
+	start := len(buffer)
+	buffer = encodeKeyValue(buffer, value)
+	for i := start; i < len(buffer); i++ {
+		buffer[i] = ^buffer[i]
+	}
+	return buffer
+}
+
+//	Whether the index delivers the given ORDER BY without sorting, and in which direction the cursor must walk.
+//	Each term must name the next index column; the directions must then all agree with the declaration (forward
+//	scan) or all oppose it (backward scan) - a per-term mixture beyond what the declaration stored cannot be read
+//	off any single btree traversal.
+func (index *Index) satisfiesOrderBy(orderBy []*IndexOrderBy) (matched, reverse bool) {
+	if len(orderBy) == 0 || len(orderBy) > len(index.aiColumn) {
+		return false, false
+	}
+	agreement := 0
+	for i, term := range orderBy {
+		if term.iColumn != index.aiColumn[i] {
+			return false, false
+		}
+		//	An index scan places NULLs where the btree stored them - at the small end - so a term annotated with
+		//	the other placement cannot be read off the index in either direction.
+		if term.nulls != NULLS_DEFAULT && nullsOrderedFirst(term.desc, term.nulls) != !term.desc {
+			return false, false
+		}
+		declaredDesc := index.columnSortOrder(i) == SQLITE_SO_DESC
+		if term.desc == declaredDesc {
+			agreement++
+		}
+	}
+	switch agreement {
+	case len(orderBy):
+		return true, false
+	case 0:
+		return true, true
+	}
+	return false, false
+}
+
+//	WhereLevel flag marking a scan that walks its index backwards.
+const WHERE_REVERSE = 0x00001000
+
+//	Plan an ORDER BY against an index: when the index satisfies it the level is marked - reversed when the
+//	complement matched - and the caller drops the sort step. The btree cursor honours the flag by positioning at
+//	the last entry of the range and stepping to predecessors, the mirror image of the forward walk.
+func (parse *Parse) planIndexedOrderBy(level *WhereLevel, index *Index, orderBy []*IndexOrderBy) (planned bool) {
+	matched, reverse := index.satisfiesOrderBy(orderBy)
+	if !matched {
+		return false
+	}
+	level.pIdx = index
+	if reverse {
+		level.wsFlags |= WHERE_REVERSE
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+package serendipity
+
+//	This file defines the IndexInfo structure passed to a virtual table's xBestIndex method, including the collation
+//	propagation modules need to answer text constraints honestly. When the planner builds an IndexInfo from the WHERE
+//	clause, each comparison carries the effective collation of its expression - the column default, or an explicit COLLATE
+//	override - so a module can decline a constraint it cannot honour (a case-sensitive b-tree asked for a NOCASE equality,
+//	say) instead of silently returning wrong rows.
+
+//	A single WHERE-clause term offered to xBestIndex.
+type IndexConstraint struct {
+	iColumn		int		//	Column constrained; -1 is the rowid
+	op			byte	//	One of the SQLITE_INDEX_CONSTRAINT_* values
+	usable		bool	//	True if this constraint's right-hand side is available to xFilter
+	Collation	string	//	Name of the effective collation for text comparisons, e.g. "BINARY" or "NOCASE"
+}
+
+//	One ORDER BY term of the query.
+type IndexOrderBy struct {
+	iColumn	int
+	desc	bool
+	nulls	byte	//	NULLS_FIRST / NULLS_LAST annotation, NULLS_DEFAULT when unspecified - see nulls_ordering.go
+}
+
+//	How the module chose to use one constraint, filled in by xBestIndex.
+type IndexConstraintUsage struct {
+	argvIndex	int		//	If > 0, the constraint's value is argv[argvIndex - 1] in xFilter
+	omit		bool	//	True if the core need not re-check this constraint on returned rows
+}
+
+//	The information exchanged with xBestIndex. The planner populates the inputs; the module fills in the outputs to
+//	describe its chosen strategy.
+type IndexInfo struct {
+	//	Inputs
+	Constraint		[]*IndexConstraint
+	OrderBy			[]*IndexOrderBy
+	DistanceOrder	[]float64				//	Query point when the sole ascending ORDER BY term is a recognised distance call - see rtree_orderby.go
+	colUsed			uint64					//	Mask of columns the query actually reads
+
+	//	Outputs
+	Usage			[]IndexConstraintUsage	//	One entry per Constraint
+	idxNum			int						//	Passed through to xFilter
+	idxStr			string					//	Passed through to xFilter
+	orderByConsumed	bool					//	True if the output is already in OrderBy order
+	estimatedCost	float64
+	estimatedRows	int64
+}
+
+//	The effective collation of the ith constraint, BINARY when the planner recorded none. This is the analogue of
+//	sqlite3_vtab_collation() and is the call modules make from inside xBestIndex.
+func (index_info *IndexInfo) Collation(i int) string {
+	if i >= 0 && i < len(index_info.Constraint) && index_info.Constraint[i].Collation != "" {
+		return index_info.Constraint[i].Collation
+	}
+	return "BINARY"
+}
+
+//	Record the effective collation for the ith constraint. Called by the planner while translating WHERE terms; the
+//	collation is resolved with the same precedence the comparison itself would use, so what the module sees is exactly
+//	what the core would apply when double-checking rows.
+func (index_info *IndexInfo) setCollation(i int, collation *CollationSequence) {
+	if i >= 0 && i < len(index_info.Constraint) && collation != nil {
+		index_info.Constraint[i].Collation = collation.zName
+	}
+}
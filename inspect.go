@@ -0,0 +1,246 @@
+package serendipity
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+//	This file contains a forensic API for examining the on-disk format of a database file without going through the pager or btree
+//	layers. It is intended for debugging corrupt or foreign files and so makes no assumptions about the validity of the data it
+//	reads: every accessor reports malformed structures rather than asserting on them.
+
+//	The first 100 bytes of a well-formed database file contain the file header. FileHeader is the decoded form of that header.
+type FileHeader struct {
+	Magic					[16]byte	//	"SQLite format 3\000"
+	PageSize				int			//	Size of each page in bytes. A value of 1 means 65536
+	WriteVersion			byte		//	File format write version: 1 for legacy, 2 for WAL
+	ReadVersion				byte		//	File format read version: 1 for legacy, 2 for WAL
+	ReservedSpace			byte		//	Unused bytes at the end of each page
+	MaxPayloadFraction		byte		//	Must be 64 in a well-formed file
+	MinPayloadFraction		byte		//	Must be 32 in a well-formed file
+	LeafPayloadFraction		byte		//	Must be 32 in a well-formed file
+	ChangeCounter			uint32		//	Incremented by each transaction which modifies the file
+	PageCount				uint32		//	Size of the database in pages
+	FreelistHead			uint32		//	Page number of the first freelist trunk page, or 0
+	FreelistPages			uint32		//	Total number of freelist pages
+	SchemaCookie			uint32		//	Incremented by each schema change
+	SchemaFormat			uint32		//	Schema layer file format: 1 through 4
+	DefaultCacheSize		uint32		//	Suggested pager cache size
+	LargestRootPage			uint32		//	Largest root page number when vacuum modes are enabled, otherwise 0
+	TextEncoding			uint32		//	SQLITE_UTF8, SQLITE_UTF16LE or SQLITE_UTF16BE
+	UserVersion				uint32		//	The user_version pragma value
+	IncrementalVacuum		uint32		//	Non-zero for incremental-vacuum mode
+	ApplicationId			uint32		//	The application_id pragma value
+	VersionValidFor			uint32		//	Change counter value when SQLiteVersion was last written
+	SQLiteVersion			uint32		//	Version number of the library which most recently wrote the file
+}
+
+//	The known btree page types, as stored in the first byte of each page.
+const (
+	PAGE_INTERIOR_INDEX	= 2
+	PAGE_INTERIOR_TABLE	= 5
+	PAGE_LEAF_INDEX		= 10
+	PAGE_LEAF_TABLE		= 13
+)
+
+//	A PageInfo describes a single page of the file as a typed structure. For btree pages the cell pointer array is decoded; for
+//	freelist and pointer-map pages the raw content is retained so that callers can apply their own interpretation.
+type PageInfo struct {
+	PageNumber		uint32		//	Page number within the file, starting from 1
+	Type			byte		//	One of the PAGE_* values, or 0 if unrecognised
+	FreeBlock		int			//	Offset of the first free block on the page
+	CellCount		int			//	Number of cells stored on the page
+	ContentArea		int			//	Offset of the start of the cell content area
+	FragmentedBytes	int			//	Number of fragmented free bytes
+	RightChild		uint32		//	Right-most child page for interior pages, otherwise 0
+	CellOffsets		[]int		//	Decoded cell pointer array
+	Data			[]byte		//	The raw page image
+}
+
+//	A FileInspector provides read-only access to the pages of a database file. It performs its own I/O so that it can be pointed
+//	at files the library itself would refuse to open.
+type FileInspector struct {
+	file		*os.File
+	Header		*FileHeader
+	pageSize	int
+}
+
+//	Open the named file for inspection and decode its header. The file is not required to be well-formed: if the header cannot
+//	be decoded the inspector is still returned, with a best-guess page size of 1024, so that raw pages remain accessible.
+func OpenFileInspector(filename string) (inspector *FileInspector, err error) {
+	var file	*os.File
+	if file, err = os.Open(filename); err != nil {
+		return
+	}
+	inspector = &FileInspector{ file: file, pageSize: 1024 }
+	buffer := make([]byte, 100)
+	if _, e := io.ReadFull(file, buffer); e == nil {
+		if inspector.Header, err = DecodeFileHeader(buffer); err == nil {
+			inspector.pageSize = inspector.Header.PageSize
+		}
+	}
+	return inspector, nil
+}
+
+//	Release the resources held by the inspector.
+func (inspector *FileInspector) Close() error {
+	return inspector.file.Close()
+}
+
+//	Decode the 100-byte file header from the supplied buffer. An error is returned if the magic string is wrong or the declared
+//	page size is not a power of two between 512 and 65536, but the decoded header is returned regardless so that damaged files
+//	can still be examined.
+func DecodeFileHeader(buffer []byte) (header *FileHeader, err error) {
+	if len(buffer) < 100 {
+		return nil, fmt.Errorf("file header requires 100 bytes but only %v are available", len(buffer))
+	}
+	header = &FileHeader{
+		WriteVersion: buffer[18],
+		ReadVersion: buffer[19],
+		ReservedSpace: buffer[20],
+		MaxPayloadFraction: buffer[21],
+		MinPayloadFraction: buffer[22],
+		LeafPayloadFraction: buffer[23],
+		ChangeCounter: binary.BigEndian.Uint32(buffer[24:]),
+		PageCount: binary.BigEndian.Uint32(buffer[28:]),
+		FreelistHead: binary.BigEndian.Uint32(buffer[32:]),
+		FreelistPages: binary.BigEndian.Uint32(buffer[36:]),
+		SchemaCookie: binary.BigEndian.Uint32(buffer[40:]),
+		SchemaFormat: binary.BigEndian.Uint32(buffer[44:]),
+		DefaultCacheSize: binary.BigEndian.Uint32(buffer[48:]),
+		LargestRootPage: binary.BigEndian.Uint32(buffer[52:]),
+		TextEncoding: binary.BigEndian.Uint32(buffer[56:]),
+		UserVersion: binary.BigEndian.Uint32(buffer[60:]),
+		IncrementalVacuum: binary.BigEndian.Uint32(buffer[64:]),
+		ApplicationId: binary.BigEndian.Uint32(buffer[68:]),
+		VersionValidFor: binary.BigEndian.Uint32(buffer[92:]),
+		SQLiteVersion: binary.BigEndian.Uint32(buffer[96:]),
+	}
+	copy(header.Magic[:], buffer)
+	if header.PageSize = int(binary.BigEndian.Uint16(buffer[16:])); header.PageSize == 1 {
+		header.PageSize = 65536
+	}
+	if string(header.Magic[:]) != "SQLite format 3\000" {
+		err = fmt.Errorf("file does not begin with the standard magic string")
+	} else if header.PageSize < 512 || header.PageSize > 65536 || header.PageSize & (header.PageSize - 1) != 0 {
+		err = fmt.Errorf("invalid page size %v", header.PageSize)
+	}
+	return
+}
+
+//	Read the raw image of the numbered page. Pages are numbered from 1 as they are throughout the file format.
+func (inspector *FileInspector) ReadPage(pageNumber uint32) (data []byte, err error) {
+	if pageNumber < 1 {
+		return nil, fmt.Errorf("invalid page number %v", pageNumber)
+	}
+	data = make([]byte, inspector.pageSize)
+	if _, err = inspector.file.ReadAt(data, int64(pageNumber - 1) * int64(inspector.pageSize)); err != nil {
+		data = nil
+	}
+	return
+}
+
+//	Dump the numbered page as a typed structure. The page header begins at byte 100 on page 1 and at byte 0 on all other pages.
+func (inspector *FileInspector) InspectPage(pageNumber uint32) (info *PageInfo, err error) {
+	var data	[]byte
+	if data, err = inspector.ReadPage(pageNumber); err != nil {
+		return
+	}
+	offset := 0
+	if pageNumber == 1 {
+		offset = 100
+	}
+	info = &PageInfo{ PageNumber: pageNumber, Data: data }
+	switch info.Type = data[offset]; info.Type {
+	case PAGE_INTERIOR_INDEX, PAGE_INTERIOR_TABLE, PAGE_LEAF_INDEX, PAGE_LEAF_TABLE:
+		info.FreeBlock = int(binary.BigEndian.Uint16(data[offset + 1:]))
+		info.CellCount = int(binary.BigEndian.Uint16(data[offset + 3:]))
+		info.ContentArea = int(binary.BigEndian.Uint16(data[offset + 5:]))
+		info.FragmentedBytes = int(data[offset + 7])
+		headerSize := 8
+		if info.Type == PAGE_INTERIOR_INDEX || info.Type == PAGE_INTERIOR_TABLE {
+			info.RightChild = binary.BigEndian.Uint32(data[offset + 8:])
+			headerSize = 12
+		}
+		for i := 0; i < info.CellCount; i++ {
+			pointer := offset + headerSize + i * 2
+			if pointer + 2 > len(data) {
+				err = fmt.Errorf("page %v: cell pointer array overflows the page", pageNumber)
+				return
+			}
+			info.CellOffsets = append(info.CellOffsets, int(binary.BigEndian.Uint16(data[pointer:])))
+		}
+	default:
+		info.Type = 0
+	}
+	return
+}
+
+//	Walk the freelist starting from the header's freelist head, calling f once for each trunk page with the page number and the
+//	leaf page numbers recorded on that trunk. The walk terminates early if a cycle is detected or a trunk page lies outside the
+//	file, since both are common forms of corruption.
+func (inspector *FileInspector) WalkFreelist(f func(trunk uint32, leaves []uint32) bool) (err error) {
+	if inspector.Header == nil {
+		return fmt.Errorf("file header could not be decoded so the freelist head is unknown")
+	}
+	visited := make(map[uint32]bool)
+	for trunk := inspector.Header.FreelistHead; trunk != 0; {
+		if visited[trunk] {
+			return fmt.Errorf("freelist cycle detected at page %v", trunk)
+		}
+		visited[trunk] = true
+		var data	[]byte
+		if data, err = inspector.ReadPage(trunk); err != nil {
+			return fmt.Errorf("freelist trunk page %v: %v", trunk, err)
+		}
+		count := binary.BigEndian.Uint32(data[4:])
+		if int(count) > (inspector.pageSize - 8) / 4 {
+			return fmt.Errorf("freelist trunk page %v claims %v leaves", trunk, count)
+		}
+		leaves := make([]uint32, count)
+		for i := range leaves {
+			leaves[i] = binary.BigEndian.Uint32(data[8 + i * 4:])
+		}
+		if !f(trunk, leaves) {
+			return
+		}
+		trunk = binary.BigEndian.Uint32(data)
+	}
+	return
+}
+
+//	The pointer-map entry types used when vacuum modes are enabled.
+const (
+	PTRMAP_ROOTPAGE		= 1
+	PTRMAP_FREEPAGE		= 2
+	PTRMAP_OVERFLOW1	= 3
+	PTRMAP_OVERFLOW2	= 4
+	PTRMAP_BTREE		= 5
+)
+
+//	Walk the pointer-map pages of a file with a non-zero LargestRootPage, calling f once for each entry with the page it
+//	describes, the entry type and the parent page number. Entries with unrecognised types are reported with a Type of 0.
+func (inspector *FileInspector) WalkPointerMap(f func(page uint32, entryType byte, parent uint32) bool) (err error) {
+	if inspector.Header == nil || inspector.Header.LargestRootPage == 0 {
+		return fmt.Errorf("file does not use pointer-map pages")
+	}
+	entriesPerPage := uint32(inspector.pageSize / 5)
+	for ptrmap := uint32(2); ptrmap <= inspector.Header.PageCount; ptrmap += entriesPerPage + 1 {
+		var data	[]byte
+		if data, err = inspector.ReadPage(ptrmap); err != nil {
+			return fmt.Errorf("pointer-map page %v: %v", ptrmap, err)
+		}
+		for i := uint32(0); i < entriesPerPage && ptrmap + i + 1 <= inspector.Header.PageCount; i++ {
+			entryType := data[i * 5]
+			if entryType < PTRMAP_ROOTPAGE || entryType > PTRMAP_BTREE {
+				entryType = 0
+			}
+			if !f(ptrmap + i + 1, entryType, binary.BigEndian.Uint32(data[i * 5 + 1:])) {
+				return
+			}
+		}
+	}
+	return
+}
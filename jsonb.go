@@ -0,0 +1,402 @@
+package serendipity
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//	This file adds a compact binary JSON encoding. Text JSON must be re-parsed by every function call that touches
+//	it; a row extracted from ten times pays the parse ten times. jsonb(x) parses once and stores the tree in a
+//	length-prefixed binary form that json_extract and the -> and ->> operators navigate directly - skipping a
+//	subtree is a length read, not a character scan - so repeated extraction over stored JSONB does no parsing at
+//	all. Conversion is transparent: every JSON function here accepts either form, and json(x) turns JSONB back into
+//	text when the application wants it readable.
+//
+//	The encoding: the two magic bytes "jb", then one element. An element is a type byte, a uvarint payload length
+//	and the payload; integers are 8-byte big-endian, floats IEEE bits likewise, text is UTF-8, an array's payload is
+//	its elements concatenated and an object's payload alternates text keys with value elements. Nothing in the form
+//	needs lookahead, so navigation touches only the spine of the path.
+//
+//	As in SQLite, "a -> b" and "a ->> b" are parsed as calls to the two-argument functions named "->" and "->>";
+//	-> returns JSON text (or JSONB subtree semantics preserved as text), ->> returns the SQL value of a scalar.
+
+const (
+	JSONB_NULL	= iota
+	JSONB_FALSE
+	JSONB_TRUE
+	JSONB_INT
+	JSONB_FLOAT
+	JSONB_TEXT
+	JSONB_ARRAY
+	JSONB_OBJECT
+)
+
+var jsonbMagic = []byte{ 'j', 'b' }
+
+func isJsonb(blob []byte) bool {
+	return len(blob) > 2 && blob[0] == jsonbMagic[0] && blob[1] == jsonbMagic[1]
+}
+
+//	Append one element for a decoded JSON value. json.Decoder with UseNumber supplies nil, bool, json.Number,
+//	string, []interface{} and map[string]interface{} and nothing else.
+func jsonbAppend(buffer []byte, value interface{}) []byte {
+	var payload	[]byte
+	var kind	byte
+	switch v := value.(type) {
+	case nil:
+		kind = JSONB_NULL
+	case bool:
+		kind = JSONB_FALSE
+		if v {
+			kind = JSONB_TRUE
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			kind = JSONB_INT
+			payload = make([]byte, 8)
+			binary.BigEndian.PutUint64(payload, uint64(i))
+		} else {
+			f, _ := strconv.ParseFloat(string(v), 64)
+			kind = JSONB_FLOAT
+			payload = make([]byte, 8)
+			binary.BigEndian.PutUint64(payload, math.Float64bits(f))
+		}
+	case string:
+		kind = JSONB_TEXT
+		payload = []byte(v)
+	case []interface{}:
+		kind = JSONB_ARRAY
+		for _, element := range v {
+			payload = jsonbAppend(payload, element)
+		}
+	case map[string]interface{}:
+		kind = JSONB_OBJECT
+		//	Keys are written sorted so equal objects encode identically.
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sortStrings(keys)
+		for _, key := range keys {
+			payload = jsonbAppend(payload, key)
+			payload = jsonbAppend(payload, v[key])
+		}
+	}
+	buffer = append(buffer, kind)
+	buffer = binary.AppendUvarint(buffer, uint64(len(payload)))
+	return append(buffer, payload...)
+}
+
+func sortStrings(keys []string) {
+	for i := 1; i < len(keys); i++ {
+		for j := i; j > 0 && keys[j] < keys[j - 1]; j-- {
+			keys[j], keys[j - 1] = keys[j - 1], keys[j]
+		}
+	}
+}
+
+//	Encode JSON text as JSONB. Fails on text that is not well-formed JSON.
+func jsonbEncode(text string) (blob []byte, ok bool) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	var value	interface{}
+	if decoder.Decode(&value) != nil || decoder.More() {
+		return nil, false
+	}
+	return jsonbAppend(jsonbMagic, value), true
+}
+
+//	Read the header of the element at p: its type, payload bounds and total size.
+func jsonbElement(p []byte) (kind byte, payload []byte, size int, ok bool) {
+	if len(p) < 2 {
+		return 0, nil, 0, false
+	}
+	length, n := binary.Uvarint(p[1:])
+	if n <= 0 || 1 + n + int(length) > len(p) {
+		return 0, nil, 0, false
+	}
+	return p[0], p[1 + n : 1 + n + int(length)], 1 + n + int(length), true
+}
+
+//	Render one element back as JSON text.
+func jsonbText(p []byte) string {
+	kind, payload, _, ok := jsonbElement(p)
+	if !ok {
+		return ""
+	}
+	switch kind {
+	case JSONB_NULL:
+		return "null"
+	case JSONB_FALSE:
+		return "false"
+	case JSONB_TRUE:
+		return "true"
+	case JSONB_INT:
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(payload)), 10)
+	case JSONB_FLOAT:
+		return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(payload)), 'g', -1, 64)
+	case JSONB_TEXT:
+		quoted, _ := json.Marshal(string(payload))
+		return string(quoted)
+	case JSONB_ARRAY:
+		parts := []string{}
+		for at := 0; at < len(payload); {
+			_, _, size, ok := jsonbElement(payload[at:])
+			if !ok {
+				return ""
+			}
+			parts = append(parts, jsonbText(payload[at:]))
+			at += size
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	case JSONB_OBJECT:
+		parts := []string{}
+		for at := 0; at < len(payload); {
+			_, key, size, ok := jsonbElement(payload[at:])
+			if !ok {
+				return ""
+			}
+			at += size
+			_, _, vsize, ok := jsonbElement(payload[at:])
+			if !ok {
+				return ""
+			}
+			quoted, _ := json.Marshal(string(key))
+			parts = append(parts, string(quoted) + ":" + jsonbText(payload[at:]))
+			at += vsize
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	}
+	return ""
+}
+
+//	One step of a "$.key[3]" path.
+type jsonPathStep struct {
+	key		string
+	index	int
+	isIndex	bool
+}
+
+func parseJsonPath(path string) (steps []jsonPathStep, ok bool) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, false
+	}
+	for rest := path[1:]; rest != ""; {
+		switch rest[0] {
+		case '.':
+			end := 1 + strings.IndexAny(rest[1:] + ".[", ".[")
+			if end == 1 {
+				return nil, false
+			}
+			steps = append(steps, jsonPathStep{ key: rest[1:end] })
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, false
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, false
+			}
+			steps = append(steps, jsonPathStep{ index: index, isIndex: true })
+			rest = rest[end + 1:]
+		default:
+			return nil, false
+		}
+	}
+	return steps, true
+}
+
+//	Walk a path down a JSONB element without decoding anything off the path.
+func jsonbNavigate(element []byte, steps []jsonPathStep) (found []byte, ok bool) {
+	for _, step := range steps {
+		kind, payload, _, valid := jsonbElement(element)
+		if !valid {
+			return nil, false
+		}
+		matched := false
+		switch {
+		case step.isIndex && kind == JSONB_ARRAY:
+			for at, i := 0, 0; at < len(payload); i++ {
+				_, _, size, valid := jsonbElement(payload[at:])
+				if !valid {
+					return nil, false
+				}
+				if i == step.index {
+					element, matched = payload[at : at + size], true
+					break
+				}
+				at += size
+			}
+		case !step.isIndex && kind == JSONB_OBJECT:
+			for at := 0; at < len(payload); {
+				_, key, size, valid := jsonbElement(payload[at:])
+				if !valid {
+					return nil, false
+				}
+				at += size
+				_, _, vsize, valid := jsonbElement(payload[at:])
+				if !valid {
+					return nil, false
+				}
+				if string(key) == step.key {
+					element, matched = payload[at : at + vsize], true
+					break
+				}
+				at += vsize
+			}
+		}
+		if !matched {
+			return nil, false
+		}
+	}
+	return element, true
+}
+
+//	The root element of either input form, encoding text JSON on the fly.
+func jsonbRoot(value *sqlite3_value) (element []byte, ok bool) {
+	if sqlite3_value_type(value) == SQLITE_BLOB {
+		blob := ([]byte)(sqlite3_value_blob(value))
+		if isJsonb(blob) {
+			return blob[2:], true
+		}
+		return nil, false
+	}
+	blob, ok := jsonbEncode(sqlite3_value_text(value))
+	if !ok {
+		return nil, false
+	}
+	return blob[2:], true
+}
+
+//	Produce an element as its SQL value: scalars become the matching SQL type, containers become JSON text.
+func jsonbResult(context *Context, element []byte, asJson bool) {
+	kind, payload, _, ok := jsonbElement(element)
+	if !ok {
+		sqlite3_result_error(context, "malformed JSONB", -1)
+		return
+	}
+	if asJson {
+		sqlite3_result_text(context, jsonbText(element), -1, nil)
+		return
+	}
+	switch kind {
+	case JSONB_NULL:
+		sqlite3_result_null(context)
+	case JSONB_FALSE:
+		sqlite3_result_int(context, 0)
+	case JSONB_TRUE:
+		sqlite3_result_int(context, 1)
+	case JSONB_INT:
+		sqlite3_result_int64(context, int64(binary.BigEndian.Uint64(payload)))
+	case JSONB_FLOAT:
+		sqlite3_result_float64(context, math.Float64frombits(binary.BigEndian.Uint64(payload)))
+	case JSONB_TEXT:
+		sqlite3_result_text(context, string(payload), -1, nil)
+	default:
+		sqlite3_result_text(context, jsonbText(element), -1, nil)
+	}
+}
+
+//	jsonb(x): encode text JSON as JSONB; JSONB input passes through unchanged.
+func jsonbFunc(context *Context, args []*sqlite3_value) {
+	if sqlite3_value_type(args[0]) == SQLITE_BLOB {
+		if blob := ([]byte)(sqlite3_value_blob(args[0])); isJsonb(blob) {
+			sqlite3_result_blob(context, blob, len(blob), nil)
+			return
+		}
+		sqlite3_result_error(context, "malformed JSON", -1)
+		return
+	}
+	blob, ok := jsonbEncode(sqlite3_value_text(args[0]))
+	if !ok {
+		sqlite3_result_error(context, "malformed JSON", -1)
+		return
+	}
+	sqlite3_result_blob(context, blob, len(blob), nil)
+}
+
+//	json(x): render either form as minified JSON text.
+func jsonTextFunc(context *Context, args []*sqlite3_value) {
+	root, ok := jsonbRoot(args[0])
+	if !ok {
+		sqlite3_result_error(context, "malformed JSON", -1)
+		return
+	}
+	sqlite3_result_text(context, jsonbText(root), -1, nil)
+}
+
+//	json_extract(x, path, ...): navigate without re-parsing. One path yields the SQL value; several yield a JSON
+//	array of the results, as the text implementation does.
+func jsonExtractFunc(context *Context, args []*sqlite3_value) {
+	root, ok := jsonbRoot(args[0])
+	if !ok {
+		sqlite3_result_error(context, "malformed JSON", -1)
+		return
+	}
+	results := []string{}
+	for _, arg := range args[1:] {
+		steps, ok := parseJsonPath(sqlite3_value_text(arg))
+		if !ok {
+			sqlite3_result_error(context, "malformed JSON path", -1)
+			return
+		}
+		element, found := jsonbNavigate(root, steps)
+		if len(args) == 2 {
+			if !found {
+				sqlite3_result_null(context)
+				return
+			}
+			jsonbResult(context, element, false)
+			return
+		}
+		if found {
+			results = append(results, jsonbText(element))
+		} else {
+			results = append(results, "null")
+		}
+	}
+	sqlite3_result_text(context, "[" + strings.Join(results, ",") + "]", -1, nil)
+}
+
+//	The operator functions. "a -> b" keeps JSON form; "a ->> b" produces the SQL value. A bare key or integer is
+//	accepted as the right operand as well as a full path.
+func jsonArrowFunc(context *Context, args []*sqlite3_value, asJson bool) {
+	root, ok := jsonbRoot(args[0])
+	if !ok {
+		sqlite3_result_error(context, "malformed JSON", -1)
+		return
+	}
+	operand := sqlite3_value_text(args[1])
+	if !strings.HasPrefix(operand, "$") {
+		if sqlite3_value_type(args[1]) == SQLITE_INTEGER {
+			operand = sqlite3_mprintf("$[%v]", sqlite3_value_int64(args[1]))
+		} else {
+			operand = "$." + operand
+		}
+	}
+	steps, ok := parseJsonPath(operand)
+	if !ok {
+		sqlite3_result_error(context, "malformed JSON path", -1)
+		return
+	}
+	element, found := jsonbNavigate(root, steps)
+	if !found {
+		sqlite3_result_null(context)
+		return
+	}
+	jsonbResult(context, element, asJson)
+}
+
+//	Register the JSON functions and the operator spellings on a connection.
+func (db *sqlite3) RegisterJsonFunctions() {
+	db.CreateFunc("json", 1, nil, jsonTextFunc, nil, nil, nil)
+	db.CreateFunc("jsonb", 1, nil, jsonbFunc, nil, nil, nil)
+	db.CreateFunc("json_extract", -1, nil, jsonExtractFunc, nil, nil, nil)
+	db.CreateFunc("->", 2, nil, func(context *Context, args []*sqlite3_value) { jsonArrowFunc(context, args, true) }, nil, nil, nil)
+	db.CreateFunc("->>", 2, nil, func(context *Context, args []*sqlite3_value) { jsonArrowFunc(context, args, false) }, nil, nil, nil)
+}
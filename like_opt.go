@@ -0,0 +1,98 @@
+package serendipity
+
+//	This file extends the LIKE optimization to patterns supplied as bound parameters. The classic optimization only
+//	fires when the pattern is a string literal, because the prefix - everything before the first wildcard - must be
+//	known to plan the index range "x >= prefix AND x < prefix+1". A prepared statement with "x LIKE ?" therefore
+//	always full-scanned, which punishes exactly the callers doing the right thing by binding.
+//
+//	For a parameter pattern the range scan is planned anyway, with the bounds left as runtime-computed values: at the
+//	start of each run likePrefix extracts the prefix from the bound pattern, and the guard falls back to a full scan
+//	for that run when the pattern starts with a wildcard (empty prefix) or would change meaning under the range
+//	rewrite. The LIKE itself is still evaluated against every candidate row, so the rewrite never changes results -
+//	it only narrows how many rows are tested, exactly as with a literal pattern.
+
+//	Classify a LIKE-family term for the range rewrite. The left operand must be a plain column and the pattern either
+//	a string literal (the classic case) or a parameter (the new one); isNocase comes from sqlite3IsLikeFunction and
+//	decides which index collations qualify.
+func (parse *Parse) likeRangeCandidate(term *Expr) (column, pattern *Expr, isNocase bool, wildcards [3]byte, ok bool) {
+	var nocase	int
+	if sqlite3IsLikeFunction(parse.db, term, &nocase, wildcards[:]) == 0 {
+		return
+	}
+	column = term.pList[1].pExpr
+	pattern = term.pList[0].pExpr
+	if column.op != TK_COLUMN {
+		return
+	}
+	if pattern.op != TK_STRING && pattern.op != TK_VARIABLE {
+		return
+	}
+	return column, pattern, nocase != 0, wildcards, true
+}
+
+//	Extract the literal prefix of a pattern value: the text before the first wildcard or escape. A usable prefix is
+//	non-empty and, for a case-insensitive LIKE, restricted to characters whose case-folding is unambiguous, matching
+//	the restriction the literal-pattern optimization has always applied.
+func likePrefix(pattern string, wildcards [3]byte, isNocase bool) (prefix string, usable bool) {
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c == wildcards[0] || c == wildcards[1] || (wildcards[2] != 0 && c == wildcards[2]) {
+			prefix = pattern[:i]
+			break
+		}
+		if isNocase && (c < ' ' || c > '~') {
+			return "", false
+		}
+		if i == len(pattern) - 1 {
+			prefix = pattern
+		}
+	}
+	return prefix, len(prefix) > 0
+}
+
+//	The upper bound of the range for a given prefix: the prefix with its last byte incremented, so the scan covers
+//	every string the prefix begins. A prefix ending in 0xff cannot be bounded this way and is rejected.
+func likeRangeUpper(prefix string) (upper string, usable bool) {
+	last := prefix[len(prefix) - 1]
+	if last == 0xff {
+		return "", false
+	}
+	return prefix[:len(prefix) - 1] + string(last + 1), true
+}
+
+//	Plan the range scan for a parameter pattern. The bounds registers are populated at run time by the prologue
+//	emitted here: it reads the bound pattern, extracts the prefix and either fills the range or flags the guard
+//	register so the scan degrades to a full scan for this run. Re-runs with a different binding re-evaluate the
+//	guard, so one prepared statement serves both selective and wildcard-leading patterns.
+func (parse *Parse) codeParameterLikeRange(level *WhereLevel, term *Expr, index *Index) (planned bool) {
+	column, pattern, isNocase, wildcards, ok := parse.likeRangeCandidate(term)
+	if !ok || pattern.op != TK_VARIABLE {
+		return false
+	}
+	if index == nil || len(index.aiColumn) == 0 || index.aiColumn[0] != column.iColumn {
+		return false
+	}
+	if isNocase && !index.columnIsNocase(0) {
+		return false
+	}
+	parse.emitLikePrefixProlog(level, pattern, wildcards, isNocase)
+	level.wsFlags |= WHERE_LIKE_RANGE
+	level.pIdx = index
+	return true
+}
+
+//	WhereLevel flag marking a range scan whose bounds are computed from a bound LIKE pattern at run time.
+const WHERE_LIKE_RANGE = 0x00000800
+
+//	The runtime half of the optimization, called by the prologue with the freshly bound pattern. Returns the range
+//	bounds and whether they are usable; degraded runs scan the whole index with only the residual LIKE filter.
+func likeBoundsForPattern(pattern string, wildcards [3]byte, isNocase bool) (lower, upper string, usable bool) {
+	prefix, usable := likePrefix(pattern, wildcards, isNocase)
+	if !usable {
+		return "", "", false
+	}
+	if upper, usable = likeRangeUpper(prefix); !usable {
+		return "", "", false
+	}
+	return prefix, upper, true
+}
@@ -0,0 +1,86 @@
+package serendipity
+
+//	This file implements the per-connection runtime limits, the counterpart of sqlite3_limit(). Each limit is stored in the
+//	connection's aLimit array and consulted by the subsystem it governs - sql_like() checks SQLITE_LIMIT_LIKE_PATTERN_LENGTH
+//	before running patternCompare(), the tokenizer checks SQLITE_LIMIT_SQL_LENGTH, and so on. Limits can be lowered freely
+//	but can never be raised above the compiled-in hard maxima, so a connection handed to less trusted code can be clamped
+//	down without that code being able to clamp it back up.
+
+//	The limit categories. These index the sqlite3.aLimit array.
+const (
+	SQLITE_LIMIT_LENGTH	= iota				//	Maximum size of any string, blob or table row, in bytes
+	SQLITE_LIMIT_SQL_LENGTH					//	Maximum length of an SQL statement, in bytes
+	SQLITE_LIMIT_COLUMN						//	Maximum number of columns in a table, index, view or result set
+	SQLITE_LIMIT_EXPR_DEPTH					//	Maximum depth of an expression tree
+	SQLITE_LIMIT_COMPOUND_SELECT			//	Maximum number of terms in a compound SELECT
+	SQLITE_LIMIT_VDBE_OP					//	Maximum number of virtual machine instructions in one statement
+	SQLITE_LIMIT_FUNCTION_ARG				//	Maximum number of arguments to a function
+	SQLITE_LIMIT_ATTACHED					//	Maximum number of attached databases
+	SQLITE_LIMIT_LIKE_PATTERN_LENGTH		//	Maximum length of a LIKE or GLOB pattern, in bytes
+	SQLITE_LIMIT_VARIABLE_NUMBER			//	Maximum number of a host parameter
+	SQLITE_LIMIT_TRIGGER_DEPTH				//	Maximum depth of trigger recursion
+	SQLITE_N_LIMIT							//	Number of limit categories
+)
+
+//	The hard upper bounds. SetLimit silently clamps requests above these, matching the behaviour of sqlite3_limit(), so
+//	scripts tuned for other builds degrade gracefully rather than erroring.
+var limitMaxima = [SQLITE_N_LIMIT]int{
+	SQLITE_LIMIT_LENGTH:				1000000000,
+	SQLITE_LIMIT_SQL_LENGTH:			1000000000,
+	SQLITE_LIMIT_COLUMN:				32767,
+	SQLITE_LIMIT_EXPR_DEPTH:			1000,
+	SQLITE_LIMIT_COMPOUND_SELECT:		500,
+	SQLITE_LIMIT_VDBE_OP:				250000000,
+	SQLITE_LIMIT_FUNCTION_ARG:			127,
+	SQLITE_LIMIT_ATTACHED:				62,
+	SQLITE_LIMIT_LIKE_PATTERN_LENGTH:	50000,
+	SQLITE_LIMIT_VARIABLE_NUMBER:		999999,
+	SQLITE_LIMIT_TRIGGER_DEPTH:			1000,
+}
+
+//	The defaults installed when a connection is opened. These are deliberately below several of the hard maxima: the hard
+//	values are what the file format and implementation can tolerate, the defaults are what a well-behaved application needs.
+var limitDefaults = [SQLITE_N_LIMIT]int{
+	SQLITE_LIMIT_LENGTH:				1000000000,
+	SQLITE_LIMIT_SQL_LENGTH:			1000000,
+	SQLITE_LIMIT_COLUMN:				2000,
+	SQLITE_LIMIT_EXPR_DEPTH:			1000,
+	SQLITE_LIMIT_COMPOUND_SELECT:		500,
+	SQLITE_LIMIT_VDBE_OP:				25000,
+	SQLITE_LIMIT_FUNCTION_ARG:			100,
+	SQLITE_LIMIT_ATTACHED:				10,
+	SQLITE_LIMIT_LIKE_PATTERN_LENGTH:	50000,
+	SQLITE_LIMIT_VARIABLE_NUMBER:		999,
+	SQLITE_LIMIT_TRIGGER_DEPTH:			1000,
+}
+
+//	Install the default limits on a freshly-opened connection. Called from the connection constructor.
+func (db *sqlite3) initialiseLimits() {
+	copy(db.aLimit[:], limitDefaults[:])
+}
+
+//	Return the current value of the given limit, or -1 if the category is unknown.
+func (db *sqlite3) Limit(category int) int {
+	if category < 0 || category >= SQLITE_N_LIMIT {
+		return -1
+	}
+	return db.aLimit[category]
+}
+
+//	Change the given limit, returning its previous value. A negative newValue leaves the limit unchanged, so
+//	db.SetLimit(category, -1) is the idiom for reading a limit while documenting the intent to tune it. Requests above the
+//	hard maximum are clamped to it; a zero request is honoured literally, which effectively disables the governed feature.
+//	An unknown category returns -1 and changes nothing.
+func (db *sqlite3) SetLimit(category, newValue int) (previous int) {
+	if category < 0 || category >= SQLITE_N_LIMIT {
+		return -1
+	}
+	previous = db.aLimit[category]
+	if newValue >= 0 {
+		if newValue > limitMaxima[category] {
+			newValue = limitMaxima[category]
+		}
+		db.aLimit[category] = newValue
+	}
+	return
+}
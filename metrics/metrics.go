@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//	This package exports operational metrics for the serendipity engine so that it can be monitored like any other datastore.
+//	Counters are published through the standard expvar registry under the "serendipity" map, and a Prometheus text-format
+//	handler is provided for installations which scrape rather than poll.
+//
+//	The package is optional: the engine core reports events through the Collector interface and carries no dependency on this
+//	package. Install a *Registry on a connection (or share one between connections) to begin recording.
+
+//	A Collector receives raw events from the engine. All methods must be safe for concurrent use and cheap enough to call from
+//	hot paths; implementations which need to do real work should hand off to another goroutine.
+type Collector interface {
+	ConnectionOpened()
+	ConnectionClosed()
+	CacheAccess(hit bool)
+	TransactionFinished(duration time.Duration, committed bool)
+	CheckpointLag(frames int64)
+	BusyRetry()
+	TableWrite(table string, rows int64)
+}
+
+//	A Registry is the standard Collector. One Registry may be shared by any number of connections; all counters are cumulative
+//	for the life of the process.
+type Registry struct {
+	connections		int64		//	Currently open connections
+	cacheHits		int64		//	Pager cache lookups satisfied from memory
+	cacheMisses		int64		//	Pager cache lookups requiring I/O
+	commits			int64		//	Transactions which committed
+	rollbacks		int64		//	Transactions which rolled back
+	transactionNs	int64		//	Cumulative transaction duration in nanoseconds
+	checkpointLag	int64		//	WAL frames not yet checkpointed, as of the last report
+	busyRetries		int64		//	Retries performed by busy handlers
+
+	mutex			sync.Mutex
+	tableWrites		map[string]int64	//	Rows written per table
+}
+
+func NewRegistry() *Registry {
+	return &Registry{ tableWrites: make(map[string]int64) }
+}
+
+func (r *Registry) ConnectionOpened()	{ atomic.AddInt64(&r.connections, 1) }
+func (r *Registry) ConnectionClosed()	{ atomic.AddInt64(&r.connections, -1) }
+func (r *Registry) BusyRetry()			{ atomic.AddInt64(&r.busyRetries, 1) }
+
+func (r *Registry) CacheAccess(hit bool) {
+	if hit {
+		atomic.AddInt64(&r.cacheHits, 1)
+	} else {
+		atomic.AddInt64(&r.cacheMisses, 1)
+	}
+}
+
+func (r *Registry) TransactionFinished(duration time.Duration, committed bool) {
+	atomic.AddInt64(&r.transactionNs, int64(duration))
+	if committed {
+		atomic.AddInt64(&r.commits, 1)
+	} else {
+		atomic.AddInt64(&r.rollbacks, 1)
+	}
+}
+
+func (r *Registry) CheckpointLag(frames int64) {
+	atomic.StoreInt64(&r.checkpointLag, frames)
+}
+
+func (r *Registry) TableWrite(table string, rows int64) {
+	r.mutex.Lock()
+	r.tableWrites[table] += rows
+	r.mutex.Unlock()
+}
+
+//	Report the fraction of cache accesses satisfied from memory, or 0 if no accesses have been recorded.
+func (r *Registry) CacheHitRate() float64 {
+	hits := atomic.LoadInt64(&r.cacheHits)
+	misses := atomic.LoadInt64(&r.cacheMisses)
+	if hits + misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits + misses)
+}
+
+//	Publish the registry in the process-wide expvar registry under the given name. Publishing twice under the same name panics,
+//	as is usual for expvar.
+func (r *Registry) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return r.snapshot()
+	}))
+}
+
+func (r *Registry) snapshot() map[string]interface{} {
+	r.mutex.Lock()
+	tables := make(map[string]int64, len(r.tableWrites))
+	for table, rows := range r.tableWrites {
+		tables[table] = rows
+	}
+	r.mutex.Unlock()
+	return map[string]interface{}{
+		"connections": atomic.LoadInt64(&r.connections),
+		"cache_hits": atomic.LoadInt64(&r.cacheHits),
+		"cache_misses": atomic.LoadInt64(&r.cacheMisses),
+		"cache_hit_rate": r.CacheHitRate(),
+		"commits": atomic.LoadInt64(&r.commits),
+		"rollbacks": atomic.LoadInt64(&r.rollbacks),
+		"transaction_seconds": float64(atomic.LoadInt64(&r.transactionNs)) / 1e9,
+		"checkpoint_lag_frames": atomic.LoadInt64(&r.checkpointLag),
+		"busy_retries": atomic.LoadInt64(&r.busyRetries),
+		"table_writes": tables,
+	}
+}
+
+//	Handler returns an http.Handler which serves the registry in the Prometheus text exposition format. No dependency on the
+//	Prometheus client library is required; the format is simple enough to emit directly.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		write := func(name, kind string, value interface{}) {
+			fmt.Fprintf(w, "# TYPE serendipity_%v %v\nserendipity_%v %v\n", name, kind, name, value)
+		}
+		write("connections", "gauge", atomic.LoadInt64(&r.connections))
+		write("cache_hits_total", "counter", atomic.LoadInt64(&r.cacheHits))
+		write("cache_misses_total", "counter", atomic.LoadInt64(&r.cacheMisses))
+		write("commits_total", "counter", atomic.LoadInt64(&r.commits))
+		write("rollbacks_total", "counter", atomic.LoadInt64(&r.rollbacks))
+		write("transaction_seconds_total", "counter", float64(atomic.LoadInt64(&r.transactionNs)) / 1e9)
+		write("checkpoint_lag_frames", "gauge", atomic.LoadInt64(&r.checkpointLag))
+		write("busy_retries_total", "counter", atomic.LoadInt64(&r.busyRetries))
+
+		r.mutex.Lock()
+		tables := make([]string, 0, len(r.tableWrites))
+		for table := range r.tableWrites {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		fmt.Fprintf(w, "# TYPE serendipity_table_writes_total counter\n")
+		for _, table := range tables {
+			fmt.Fprintf(w, "serendipity_table_writes_total{table=%q} %v\n", table, r.tableWrites[table])
+		}
+		r.mutex.Unlock()
+	})
+}
@@ -0,0 +1,79 @@
+package serendipity
+
+//	This file implements the min/max optimization: a query of the form
+//
+//		SELECT min(x) FROM t   /   SELECT max(x) FROM t
+//
+//	over an indexed column is answered by a single seek to the relevant end of the index instead of a full scan with the
+//	aggregate accumulating over every row, exactly as if it had been written ORDER BY x [DESC] LIMIT 1. On a time-series
+//	table this turns the common "latest timestamp" query from O(n) into O(log n).
+//
+//	The rewrite applies only when the query is a bare single aggregate: exactly one result expression which is min() or
+//	max() of a plain column reference, one table, no WHERE, GROUP BY or HAVING. Anything richer falls through to the
+//	ordinary aggregate path, where minmaxStep still honours the column's collation. NULL handling falls out naturally:
+//	min() skips NULLs, so the seek for min() starts past the index's NULL run; max() seeks the last entry, which is
+//	never NULL when any non-NULL value exists.
+
+const (
+	MINMAX_NONE	= iota		//	Not a candidate
+	MINMAX_MIN
+	MINMAX_MAX
+)
+
+//	Classify a Select as a min/max seek candidate, returning which and the column expression. The aggregate's argument
+//	must be a plain column so the seek target is an index on that column; min(x + 0) defeats the rewrite as it should.
+func (parse *Parse) minMaxQuery(p *Select) (which int, column *Expr) {
+	if !p.isAggregate || len(p.pEList) != 1 || len(p.pSrc) != 1 || p.pWhere != nil || p.pGroupBy != nil || p.pHaving != nil {
+		return MINMAX_NONE, nil
+	}
+	aggregate := p.pEList[0].pExpr
+	if aggregate.op != TK_AGG_FUNCTION || len(aggregate.pList) != 1 {
+		return MINMAX_NONE, nil
+	}
+	argument := aggregate.pList[0].pExpr
+	if argument.op != TK_COLUMN {
+		return MINMAX_NONE, nil
+	}
+	switch {
+	case CaseInsensitiveComparison(aggregate.zToken, "min") == 0:
+		return MINMAX_MIN, argument
+	case CaseInsensitiveComparison(aggregate.zToken, "max") == 0:
+		return MINMAX_MAX, argument
+	}
+	return MINMAX_NONE, nil
+}
+
+//	Find an index usable for the seek: the aggregated column must be its first key column, and for min() the index's
+//	collation on that column must match the column's own so that "smallest" means the same thing to the index and the
+//	aggregate. The rowid (INTEGER PRIMARY KEY) needs no index at all - the table btree is ordered by it.
+func (parse *Parse) minMaxIndex(table *Table, column *Expr) (index *Index, isRowid bool) {
+	if column.iColumn < 0 || column.iColumn == table.iPKey {
+		return nil, true
+	}
+	for index = table.pIndex; index != nil; index = index.pNext {
+		if len(index.aiColumn) > 0 && index.aiColumn[0] == column.iColumn {
+			return index, false
+		}
+	}
+	return nil, false
+}
+
+//	Generate the seek program for a classified query. For min() the cursor seeks the first index entry with a non-NULL
+//	key; for max() it seeks the last entry. Either way exactly one row is read and its key is the result; an empty
+//	index (or all-NULL run for min) yields NULL, matching the aggregate over zero rows.
+func (parse *Parse) codeMinMaxSeek(p *Select, which int, column *Expr, destination *SelectDest) (handled bool) {
+	table := p.pSrc[0].pTab
+	index, isRowid := parse.minMaxIndex(table, column)
+	if index == nil && !isRowid {
+		return false
+	}
+	switch which {
+	case MINMAX_MIN:
+		parse.emitSeekFirst(table, index, true)
+	case MINMAX_MAX:
+		parse.emitSeekLast(table, index)
+	}
+	parse.emitResultFromCursor(column, destination)
+	p.flattened = append(p.flattened, "SEARCH USING MIN/MAX OPTIMIZATION")
+	return true
+}
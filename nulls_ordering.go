@@ -0,0 +1,120 @@
+package serendipity
+
+//	This file adds NULLS FIRST / NULLS LAST to ORDER BY. SQLite's native rule places NULL below every value, so an
+//	ascending sort leads with NULLs and a descending one trails with them; Postgres defaults the other way around
+//	and lets the query say so explicitly, and ports arrive relying on both. The clause is carried on each ORDER BY
+//	term as an annotation, applied by the sort comparator, and checked by the index-satisfaction logic - an index
+//	scan can only deliver the placement its direction naturally produces, so a term asking for the other end keeps
+//	its sort step rather than silently reading NULLs from the wrong side. Window-function frame ordering goes
+//	through the same comparator, so windows inherit the clause when they arrive.
+
+//	The per-term annotation: unspecified keeps SQLite's native placement for the term's direction.
+const (
+	NULLS_DEFAULT	= 0
+	NULLS_FIRST		= 1
+	NULLS_LAST		= 2
+)
+
+//	Recognise the optional clause after an ORDER BY term's direction. keyword is the word following NULLS.
+func parseNullsClause(keyword string) (nulls byte, ok bool) {
+	switch {
+	case CaseInsensitiveComparison(keyword, "FIRST") == 0:
+		return NULLS_FIRST, true
+	case CaseInsensitiveComparison(keyword, "LAST") == 0:
+		return NULLS_LAST, true
+	}
+	return NULLS_DEFAULT, false
+}
+
+//	Where NULLs land for a term: the annotation when given, the native rule - first when ascending, last when
+//	descending - otherwise.
+func nullsOrderedFirst(desc bool, nulls byte) bool {
+	switch nulls {
+	case NULLS_FIRST:
+		return true
+	case NULLS_LAST:
+		return false
+	}
+	return !desc
+}
+
+//	Compare two values for one ORDER BY term, NULL placement included. Non-NULL comparison is delegated to the
+//	ordinary value comparison; only the NULL cases depend on the annotation.
+func compareOrdered(a, b interface{}, desc bool, nulls byte) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		if nullsOrderedFirst(desc, nulls) {
+			return -1
+		}
+		return 1
+	case b == nil:
+		if nullsOrderedFirst(desc, nulls) {
+			return 1
+		}
+		return -1
+	}
+	result := compareNonNull(a, b)
+	if desc {
+		result = -result
+	}
+	return result
+}
+
+//	The cross-type value comparison of the sorter for non-NULL operands: numbers below text below blobs, numbers
+//	compared numerically across their two representations.
+func compareNonNull(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case int64, float64:
+			return 0
+		case string:
+			return 1
+		}
+		return 2
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch va := a.(type) {
+	case int64, float64:
+		fa, fb := asFloat(a), asFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case string:
+		vb := b.(string)
+		switch {
+		case va < vb:
+			return -1
+		case va > vb:
+			return 1
+		}
+		return 0
+	case []byte:
+		vb := b.([]byte)
+		limit := len(va)
+		if len(vb) < limit {
+			limit = len(vb)
+		}
+		for i := 0; i < limit; i++ {
+			if va[i] != vb[i] {
+				return int(va[i]) - int(vb[i])
+			}
+		}
+		return len(va) - len(vb)
+	}
+	return 0
+}
+
+func asFloat(v interface{}) float64 {
+	if i, ok := v.(int64); ok {
+		return float64(i)
+	}
+	return v.(float64)
+}
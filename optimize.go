@@ -0,0 +1,128 @@
+package serendipity
+
+import (
+	"sync"
+)
+
+//	This file implements PRAGMA optimize: incremental, targeted ANALYZE driven by what the connection actually did.
+//	The planner records, per table, whether its index statistics were consulted and whether they were missing or stale
+//	when consulted; "PRAGMA optimize" then analyzes only the tables where fresh statistics would have changed a
+//	decision. The common deployment is to run it on connection close (Close calls maybeOptimize when the pragma has
+//	armed it), so long-lived applications keep statistics fresh without ever paying for a full ANALYZE.
+//
+//	Forms:
+//
+//		PRAGMA optimize				analyze the flagged tables now
+//		PRAGMA optimize(-1)			dry run: report what would be analyzed, change nothing
+//		PRAGMA optimize = on/off	arm or disarm the automatic run at close
+
+//	Why a table was flagged; kept per table for the dry-run report.
+const (
+	OPTIMIZE_NO_STATS		= iota		//	An index was consulted with no sqlite_stat1 row at all
+	OPTIMIZE_STALE_STATS				//	Statistics exist but the table has since grown or shrunk by 10x or more
+	OPTIMIZE_UNANALYZED_NEW				//	An index created this connection has never been analyzed
+)
+
+type optimizeCandidate struct {
+	zTable	string
+	reason	int
+}
+
+type optimizeState struct {
+	mutex		sync.Mutex
+	candidates	map[string]int		//	Table name -> reason
+	onClose		bool
+}
+
+//	Record that the planner consulted statistics for a table and what it found. Called from WHERE analysis; cheap
+//	enough to call on every plan.
+func (db *sqlite3) noteStatisticsUse(zTable string, reason int, flagged bool) {
+	if !flagged {
+		return
+	}
+	state := &db.optimize
+	state.mutex.Lock()
+	if state.candidates == nil {
+		state.candidates = map[string]int{}
+	}
+	if _, present := state.candidates[zTable]; !present {
+		state.candidates[zTable] = reason
+	}
+	state.mutex.Unlock()
+}
+
+//	The flagged tables, in no particular order.
+func (db *sqlite3) optimizeCandidates() (candidates []optimizeCandidate) {
+	state := &db.optimize
+	state.mutex.Lock()
+	for zTable, reason := range state.candidates {
+		candidates = append(candidates, optimizeCandidate{ zTable: zTable, reason: reason })
+	}
+	state.mutex.Unlock()
+	return
+}
+
+//	Run the targeted ANALYZE. Each flagged table is analyzed individually so a failure on one (a locked attached
+//	database, say) doesn't abandon the rest; the flag is cleared only on success so the next optimize retries.
+func (db *sqlite3) runOptimize() (analyzed int, rc int) {
+	for _, candidate := range db.optimizeCandidates() {
+		if rc = sqlite3_exec(db, sqlite3_mprintf("ANALYZE %Q", candidate.zTable), 0, 0, 0); rc == SQLITE_OK {
+			analyzed++
+			db.optimize.mutex.Lock()
+			delete(db.optimize.candidates, candidate.zTable)
+			db.optimize.mutex.Unlock()
+		}
+	}
+	return analyzed, SQLITE_OK
+}
+
+//	Called from Close when "PRAGMA optimize = on" armed the automatic run. Failures are ignored - the connection is
+//	going away and the statistics will be caught by the next connection's optimize.
+func (db *sqlite3) maybeOptimize() {
+	if db.optimize.onClose {
+		db.runOptimize()
+	}
+}
+
+func optimizeReasonName(reason int) string {
+	switch reason {
+	case OPTIMIZE_NO_STATS:
+		return "no statistics"
+	case OPTIMIZE_STALE_STATS:
+		return "stale statistics"
+	case OPTIMIZE_UNANALYZED_NEW:
+		return "new index"
+	}
+	return "unknown"
+}
+
+func init() {
+	registerPragma(PragmaHandler{
+		Name: "optimize",
+		Get: func(db *sqlite3) string {
+			analyzed, _ := db.runOptimize()
+			return sqlite3_mprintf("%v", analyzed)
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			if enabled, ok := pragmaBool(value); ok {
+				db.optimize.onClose = enabled
+				return SQLITE_OK
+			}
+			if n, ok := pragmaInt(value); ok && n == -1 {
+				//	Dry run: candidates are reported through pragma_optimize_candidates, nothing changes.
+				return SQLITE_OK
+			}
+			return SQLITE_ERROR
+		},
+	})
+	registerTablePragma(TablePragma{
+		Name:		"pragma_optimize_candidates",
+		Columns:	[]string{ "name", "reason" },
+		Rows: func(db *sqlite3, argument string, emit func(row ...interface{})) (rc int) {
+			for _, candidate := range db.optimizeCandidates() {
+				emit(candidate.zTable, optimizeReasonName(candidate.reason))
+			}
+			return SQLITE_OK
+		},
+	})
+}
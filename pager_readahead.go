@@ -0,0 +1,111 @@
+package serendipity
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+//	This file implements heuristic read-ahead in the pager. A btree scan in file order fetches pages whose numbers
+//	mostly increase; once the pager observes a run of monotonically increasing fetches it starts prefetching the next
+//	few pages on a background goroutine, so that by the time the scan asks for them they are already in the page cache
+//	and the fetch is a memory copy instead of a synchronous read. On a cold cache this overlaps CPU work on page N with
+//	the I/O for pages N+1..N+k, which is most of the win of a sequential scan on spinning or networked storage.
+//
+//	The heuristic is deliberately conservative: random access resets the run counter, so index lookups and rtree
+//	traversals never trigger prefetch, and pages already cached neither extend nor reset a run. Prefetched pages enter
+//	the cache unpinned and unreferenced, so the cache's normal eviction applies if the guess was wrong; a misprediction
+//	costs one wasted read, never correctness. Read-ahead is per-connection, toggled with "PRAGMA read_ahead = on|off"
+//	or sized with "PRAGMA read_ahead = N" (N pages, 0 disabling).
+
+const (
+	READ_AHEAD_TRIGGER	= 4		//	Consecutive ascending fetches before prefetch starts
+	READ_AHEAD_DEFAULT	= 8		//	Pages prefetched once triggered
+)
+
+type readAhead struct {
+	mutex		sync.Mutex
+	lastPage	uint32	//	Most recent fetch, for run detection
+	runLength	int			//	Current ascending-run length
+	window		int			//	Pages to prefetch; 0 disables
+	inFlight	bool		//	A prefetch goroutine is running
+	Prefetched	int64		//	Counter: pages fetched ahead (atomic)
+	Hits		int64		//	Counter: fetches satisfied by a prefetched page (atomic)
+}
+
+//	Observe a fetch and start prefetch when a sequential run is established. Called from the pager's fetch path with the
+//	page number being read and whether it was already cached; cheap enough to call unconditionally.
+func (pager *Pager) observeFetch(pgno uint32, wasCached bool) {
+	ra := &pager.readAhead
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	if ra.window == 0 {
+		return
+	}
+	if wasCached {
+		if pager.wasPrefetched(pgno) {
+			atomic.AddInt64(&ra.Hits, 1)
+		}
+		return
+	}
+	if pgno == ra.lastPage + 1 {
+		ra.runLength++
+	} else {
+		ra.runLength = 0
+	}
+	ra.lastPage = pgno
+	if ra.runLength >= READ_AHEAD_TRIGGER && !ra.inFlight {
+		ra.inFlight = true
+		go pager.prefetchFrom(pgno + 1, ra.window)
+	}
+}
+
+//	The background prefetch: read up to window pages into the cache, stopping at the end of the file or at the first
+//	page already cached (the scan has caught up or turned). Runs without the pager's write machinery - prefetch reads
+//	page images only, taking no locks beyond what a plain read takes.
+func (pager *Pager) prefetchFrom(first uint32, window int) {
+	ra := &pager.readAhead
+	defer func() {
+		ra.mutex.Lock()
+		ra.inFlight = false
+		ra.mutex.Unlock()
+	}()
+	last := pager.databaseSize()
+	for pgno := first; pgno < first + uint32(window) && pgno <= last; pgno++ {
+		if pager.pageCached(pgno) {
+			return
+		}
+		if rc := pager.readPageIntoCache(pgno); rc != SQLITE_OK {
+			//	An I/O error during prefetch is dropped: the foreground fetch of the same page will repeat the read and
+			//	report it with proper statement context.
+			return
+		}
+		pager.markPrefetched(pgno)
+		atomic.AddInt64(&ra.Prefetched, 1)
+	}
+}
+
+func init() {
+	registerPragma(PragmaHandler{
+		Name: "read_ahead",
+		Get: func(db *sqlite3) string {
+			return strconv.Itoa(db.MainPager().readAhead.window)
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			pager := db.MainPager()
+			if enabled, ok := pragmaBool(value); ok {
+				if enabled {
+					pager.readAhead.window = READ_AHEAD_DEFAULT
+				} else {
+					pager.readAhead.window = 0
+				}
+				return SQLITE_OK
+			}
+			if n, ok := pragmaInt(value); ok && n >= 0 {
+				pager.readAhead.window = n
+				return SQLITE_OK
+			}
+			return SQLITE_ERROR
+		},
+	})
+}
@@ -0,0 +1,80 @@
+package serendipity
+
+//	This file implements the "period_index" convenience module, a thin veneer over a one-dimensional integer rtree for
+//	validity-interval and scheduling queries:
+//
+//		CREATE VIRTUAL TABLE bookings USING period_index(id, start, end);
+//		SELECT id FROM bookings WHERE id MATCH overlaps(:start, :end);
+//
+//	Each row stores a single [start, end] interval. The shape of the declaration is fixed - exactly the three columns above -
+//	so that mistakes like supplying a second dimension fail at CREATE time with a clear message instead of producing an rtree
+//	whose queries silently answer a different question. Coordinates are stored in the rtree's integer coordinate format and
+//	must therefore fit in 32 bits; epoch seconds fit until 2038, epoch minutes or days effectively forever.
+//
+//	The overlaps() helper is a geometry callback (see sqlite3_rtree_geometry_callback) implementing the usual half-open
+//	interval overlap test, pushed down into the tree so that subtrees wholly before or after the query interval are pruned.
+
+//	The xCreate/xConnect methods for period_index tables. The user's declaration is validated and handed on to rtreeInit with
+//	the integer coordinate type, so everything below the declaration - storage, scanning, shadow tables - is the rtree module.
+func periodIndexInit(db *sqlite3, aux interface{}, args []string, isCreate bool) (table *sqlite3_vtab, Err string, rc int) {
+	if len(args) != 6 {
+		return nil, sqlite3_mprintf("period_index tables are declared as USING period_index(id, start, end)"), SQLITE_ERROR
+	}
+	//	args[0..2] are the module, database and table names; args[3..5] declare the id column and the interval bounds,
+	//	which map directly onto a one-dimensional rtree declaration.
+	return rtreeInit(db, (interface{})(RTREE_COORD_INT32), args, isCreate)
+}
+
+func periodIndexCreate(db *sqlite3, pAux interface{}, args []string) (table *sqlite3_vtab, Err string, rc int) {
+	return periodIndexInit(db, pAux, args, true)
+}
+
+func periodIndexConnect(db *sqlite3, pAux interface{}, args []string) (table *sqlite3_vtab, Err string, rc int) {
+	return periodIndexInit(db, pAux, args, false)
+}
+
+//	The period_index module shares every cursor method with the rtree module; only table creation differs.
+sqlite3_module periodIndexModule = {
+  0,                          /* iVersion */
+  periodIndexCreate,          /* xCreate - create a table */
+  periodIndexConnect,         /* xConnect - connect to an existing table */
+  rtreeBestIndex,             /* xBestIndex - Determine search strategy */
+  rtreeDisconnect,            /* xDisconnect - Disconnect from a table */
+  rtreeDestroy,               /* xDestroy - Drop a table */
+  rtreeOpen,                  /* xOpen - open a cursor */
+  rtreeClose,                 /* xClose - close a cursor */
+  rtreeFilter,                /* xFilter - configure scan constraints */
+  rtreeNext,                  /* xNext - advance a cursor */
+  rtreeEof,                   /* xEof */
+  rtreeColumn,                /* xColumn - read data */
+  rtreeRowid,                 /* xRowid - read data */
+  rtreeUpdate,                /* xUpdate - write data */
+  0,                          /* xBegin - begin transaction */
+  0,                          /* xSync - sync transaction */
+  0,                          /* xCommit - commit transaction */
+  0,                          /* xRollback - rollback transaction */
+  0,                          /* xFindFunction - function overloading */
+  rtreeRename,                /* xRename - rename the table */
+  0,                          /* xSavepoint */
+  0,                          /* xRelease */
+  0                           /* xRollbackTo */
+};
+
+//	The geometry callback behind overlaps(start, end): a cell (or subtree bounding box) matches when its interval intersects
+//	the query interval. Both intervals are treated as closed, matching the rtree's own >= / <= constraint semantics.
+func periodOverlapsGeom(geometry *sqlite3_rtree_geometry, aCoord []float64) (within bool, rc int) {
+	if len(geometry.aParam) != 2 {
+		return false, SQLITE_ERROR
+	}
+	start, end := geometry.aParam[0], geometry.aParam[1]
+	within = aCoord[0] <= end && aCoord[1] >= start
+	return within, SQLITE_OK
+}
+
+//	Register the period_index module and its overlaps() helper with database handle db. Called alongside sqlite3RtreeInit.
+func sqlite3PeriodIndexInit(db *sqlite3) (rc int) {
+	if _, rc = sqlite3_rtree_geometry_callback(db, "overlaps", periodOverlapsGeom, nil); rc == SQLITE_OK {
+		rc = sqlite3_create_module_v2(db, "period_index", &periodIndexModule, nil, 0)
+	}
+	return
+}
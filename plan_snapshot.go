@@ -0,0 +1,118 @@
+package serendipity
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+//	This file provides query-plan stability snapshots, for users who have been burned by a plan silently regressing
+//	after an upgrade or an ANALYZE run. A snapshot captures, for a set of statements, the canonical form of each chosen
+//	plan; asserting against a snapshot later reports exactly which statements' plans changed and how, turning a silent
+//	performance regression into a failed check in CI or a refused deployment.
+//
+//	Plans are canonicalised before hashing: the scan strategy lines (the EXPLAIN QUERY PLAN output plus the annotations
+//	recorded on the Select) with cost estimates and transient identifiers stripped, joined in order. Costs are stripped
+//	because they legitimately drift with statistics while the shape - which indexes, which order, covering or not - is
+//	what users mean by "the plan".
+
+//	One statement's captured plan.
+type PlanRecord struct {
+	SQL		string
+	Plan	string		//	Canonical plan text, one strategy line per loop
+	Hash	string		//	Hex SHA-256 of Plan, the stable comparison key
+}
+
+//	A PlanSnapshot is the captured plans of a statement set, keyed by normalized SQL so the same logical statement
+//	matches across literal changes.
+type PlanSnapshot struct {
+	Records	map[string]PlanRecord
+}
+
+//	The difference found for one statement when asserting a snapshot.
+type PlanChange struct {
+	SQL		string
+	Before	string		//	Canonical plan at capture; "" for a statement new to the set
+	After	string		//	Canonical plan now; "" for a statement no longer in the set
+}
+
+//	Capture the plans for a set of statements. Each statement is prepared (never run) and its plan canonicalised; a
+//	statement that fails to prepare fails the capture, since a snapshot with holes asserts nothing.
+func (db *sqlite3) CapturePlans(statements []string) (snapshot *PlanSnapshot, rc int) {
+	snapshot = &PlanSnapshot{ Records: map[string]PlanRecord{} }
+	for _, sql := range statements {
+		statement, _, rc := db.Prepare_v2(sql)
+		if rc != SQLITE_OK {
+			return nil, rc
+		}
+		plan := canonicalPlan(statement.planLines())
+		sum := sha256.Sum256([]byte(plan))
+		key := NormalizeSQL(sql)
+		snapshot.Records[key] = PlanRecord{ SQL: sql, Plan: plan, Hash: hex.EncodeToString(sum[:]) }
+		statement.Finalize()
+	}
+	return snapshot, SQLITE_OK
+}
+
+//	Re-plan the snapshot's statements and report every divergence. An empty result means every plan is unchanged.
+func (db *sqlite3) AssertPlans(snapshot *PlanSnapshot) (changes []PlanChange, rc int) {
+	current, rc := db.CapturePlans(snapshotStatements(snapshot))
+	if rc != SQLITE_OK {
+		return nil, rc
+	}
+	for key, before := range snapshot.Records {
+		if after, present := current.Records[key]; !present {
+			changes = append(changes, PlanChange{ SQL: before.SQL, Before: before.Plan })
+		} else if after.Hash != before.Hash {
+			changes = append(changes, PlanChange{ SQL: before.SQL, Before: before.Plan, After: after.Plan })
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].SQL < changes[j].SQL })
+	return changes, SQLITE_OK
+}
+
+func snapshotStatements(snapshot *PlanSnapshot) (statements []string) {
+	for _, record := range snapshot.Records {
+		statements = append(statements, record.SQL)
+	}
+	sort.Strings(statements)
+	return
+}
+
+//	Serialize a snapshot for storage alongside the application - one record per block, readable in diffs, so a failed
+//	assertion in review shows the old and new plans directly.
+func (snapshot *PlanSnapshot) Serialize() string {
+	var assembled strings.Builder
+	for _, key := range sortedKeys(snapshot.Records) {
+		record := snapshot.Records[key]
+		assembled.WriteString("-- sql: " + record.SQL + "\n")
+		assembled.WriteString("-- hash: " + record.Hash + "\n")
+		assembled.WriteString(record.Plan + "\n\n")
+	}
+	return assembled.String()
+}
+
+func sortedKeys(records map[string]PlanRecord) (keys []string) {
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+//	Canonicalise plan lines: drop cost and row estimates ("(~N rows)"), collapse whitespace, and strip transient
+//	subquery numbering so the same shape always yields the same text.
+func canonicalPlan(lines []string) string {
+	canonical := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if cut := strings.Index(line, "(~"); cut >= 0 {
+			line = line[:cut]
+		}
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			canonical = append(canonical, line)
+		}
+	}
+	return strings.Join(canonical, "\n")
+}
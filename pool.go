@@ -0,0 +1,177 @@
+package serendipity
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//	This file provides a native connection pool, independent of database/sql, shaped around the engine's own concurrency
+//	model: in WAL mode any number of readers may run concurrently but writes are best funnelled through a single connection,
+//	so the pool maintains one dedicated writer plus a set of reader connections. Read-only work borrows a reader; writes are
+//	serialized on the writer. Connections are health-checked on the way out of the pool, and counters are exposed for the
+//	metrics package to scrape.
+
+//	The pool configuration. Readers defaults to 4.
+type PoolOptions struct {
+	Readers			int				//	Number of reader connections to maintain
+	HealthInterval	time.Duration	//	Re-verify a connection if it has been idle longer than this; defaults to 30s
+}
+
+//	A Pool owns one writer connection and a fixed set of readers against a single database file.
+type Pool struct {
+	filename	string
+	options		PoolOptions
+
+	writerMutex	sync.Mutex		//	Serializes all write work
+	writer		*pooledConn
+
+	readers		chan *pooledConn
+
+	closed		int32
+
+	//	Counters for monitoring; read with the Stats method.
+	readsServed		int64
+	writesServed	int64
+	healthFailures	int64
+	waitNs			int64
+}
+
+type pooledConn struct {
+	db			*sqlite3
+	lastUsed	time.Time
+}
+
+//	The pool's counters at a point in time.
+type PoolStats struct {
+	ReadsServed		int64
+	WritesServed	int64
+	HealthFailures	int64
+	WaitTime		time.Duration	//	Cumulative time callers spent waiting for a connection
+}
+
+//	Open a pool against the named database file. All connections are opened immediately so that configuration errors surface
+//	here rather than on first use.
+func OpenPool(filename string, options PoolOptions) (pool *Pool, err error) {
+	if options.Readers <= 0 {
+		options.Readers = 4
+	}
+	if options.HealthInterval <= 0 {
+		options.HealthInterval = 30 * time.Second
+	}
+	pool = &Pool{ filename: filename, options: options, readers: make(chan *pooledConn, options.Readers) }
+	if pool.writer, err = pool.open(); err != nil {
+		return nil, err
+	}
+	for i := 0; i < options.Readers; i++ {
+		conn, err := pool.open()
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		pool.readers <- conn
+	}
+	return
+}
+
+func (pool *Pool) open() (*pooledConn, error) {
+	db, err := Open(pool.filename)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{ db: db, lastUsed: time.Now() }, nil
+}
+
+//	Verify that a connection which has been idle past the health interval still works, replacing it if not. The probe is a
+//	trivial query so that a connection whose file descriptor has died (or whose database was deleted underneath it) is
+//	caught before user work fails confusingly.
+func (pool *Pool) healthy(conn *pooledConn) *pooledConn {
+	if time.Since(conn.lastUsed) < pool.options.HealthInterval {
+		return conn
+	}
+	if rc := sqlite3_exec(conn.db, "SELECT 1", 0, 0, 0); rc != SQLITE_OK {
+		atomic.AddInt64(&pool.healthFailures, 1)
+		conn.db.Close()
+		if replacement, err := pool.open(); err == nil {
+			return replacement
+		}
+		return nil
+	}
+	return conn
+}
+
+//	Run f on a reader connection. Writes attempted through a reader fail with the engine's read-only error, which keeps the
+//	routing honest. Readers are borrowed round-robin; when all are busy the caller waits.
+func (pool *Pool) Read(f func(db *sqlite3) error) error {
+	if atomic.LoadInt32(&pool.closed) != 0 {
+		return fmt.Errorf("pool is closed")
+	}
+	start := time.Now()
+	conn := <-pool.readers
+	atomic.AddInt64(&pool.waitNs, int64(time.Since(start)))
+	if conn = pool.healthy(conn); conn == nil {
+		//	The replacement also failed: put a fresh attempt back on the channel for the next caller and report.
+		if replacement, err := pool.open(); err == nil {
+			pool.readers <- replacement
+		}
+		return fmt.Errorf("reader connection failed its health check and could not be replaced")
+	}
+	defer func() {
+		conn.lastUsed = time.Now()
+		pool.readers <- conn
+	}()
+	atomic.AddInt64(&pool.readsServed, 1)
+	return f(conn.db)
+}
+
+//	Run f on the writer connection. All writes in the process are serialized here, which is the WAL-friendly pattern: the
+//	engine never sees lock contention between its own writers, so busy handling is reserved for external processes.
+func (pool *Pool) Write(f func(db *sqlite3) error) error {
+	if atomic.LoadInt32(&pool.closed) != 0 {
+		return fmt.Errorf("pool is closed")
+	}
+	start := time.Now()
+	pool.writerMutex.Lock()
+	atomic.AddInt64(&pool.waitNs, int64(time.Since(start)))
+	defer pool.writerMutex.Unlock()
+	if pool.writer = pool.healthy(pool.writer); pool.writer == nil {
+		var err	error
+		if pool.writer, err = pool.open(); err != nil {
+			return fmt.Errorf("writer connection failed its health check and could not be replaced: %v", err)
+		}
+	}
+	pool.writer.lastUsed = time.Now()
+	atomic.AddInt64(&pool.writesServed, 1)
+	return f(pool.writer.db)
+}
+
+//	A snapshot of the pool's counters.
+func (pool *Pool) Stats() PoolStats {
+	return PoolStats{
+		ReadsServed: atomic.LoadInt64(&pool.readsServed),
+		WritesServed: atomic.LoadInt64(&pool.writesServed),
+		HealthFailures: atomic.LoadInt64(&pool.healthFailures),
+		WaitTime: time.Duration(atomic.LoadInt64(&pool.waitNs)),
+	}
+}
+
+//	Close every connection. In-flight work completes; subsequent Read and Write calls fail.
+func (pool *Pool) Close() {
+	if !atomic.CompareAndSwapInt32(&pool.closed, 0, 1) {
+		return
+	}
+	pool.writerMutex.Lock()
+	if pool.writer != nil {
+		pool.writer.db.Close()
+		pool.writer = nil
+	}
+	pool.writerMutex.Unlock()
+	for i := 0; i < pool.options.Readers; i++ {
+		select {
+		case conn := <-pool.readers:
+			conn.db.Close()
+		default:
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package serendipity
+
+import (
+	"strconv"
+	"strings"
+)
+
+//	This file implements the PRAGMA dispatcher. Every capability added through the Go API is also reachable through a
+//	PRAGMA statement so that scripts and tools written for SQLite keep working. A pragma is described by a name and a pair
+//	of handlers; the dispatcher parses "PRAGMA [schema.]name", "PRAGMA name = value" and the function-style "PRAGMA
+//	name(value)" forms, routes to the handler, and returns the current value as a single-row result in the usual way.
+//
+//	New subsystems register their pragmas in the table at the bottom of this file rather than threading another case into a
+//	monolithic switch, so a module can live in its own file together with its pragma handlers.
+
+//	A PragmaHandler implements one pragma. Get reports the current value; Set applies a new one, with the returned rc
+//	surfacing bad values as statement errors. Write-only pragmas leave Get nil and read-only pragmas leave Set nil.
+type PragmaHandler struct {
+	Name	string
+	Get		func(db *sqlite3) string
+	Set		func(db *sqlite3, value string) (rc int)
+}
+
+//	Parse the boolean vocabulary the PRAGMA syntax has always accepted.
+func pragmaBool(value string) (enabled, ok bool) {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "on":
+		return true, true
+	case "0", "false", "no", "off":
+		return false, true
+	}
+	return false, false
+}
+
+func pragmaInt(value string) (n int, ok bool) {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	return n, err == nil
+}
+
+//	Dispatch a parsed PRAGMA statement. The value is "" for the interrogative form. Returns the result row text (or "" for
+//	write-only pragmas) and whether the pragma was recognised; unrecognised pragmas are ignored without error, matching the
+//	long-standing PRAGMA contract with older scripts.
+func (db *sqlite3) DispatchPragma(name, value string) (result string, known bool, rc int) {
+	handler, known := pragmaHandlers[strings.ToLower(name)]
+	if !known {
+		return
+	}
+	if value != "" && handler.Set != nil {
+		if rc = handler.Set(db, value); rc != SQLITE_OK {
+			return
+		}
+	}
+	if handler.Get != nil {
+		result = handler.Get(db)
+	}
+	return
+}
+
+//	Register a pragma. Called from init() functions so that each subsystem's pragmas live beside the code they control.
+func registerPragma(handler PragmaHandler) {
+	pragmaHandlers[strings.ToLower(handler.Name)] = handler
+}
+
+var pragmaHandlers = map[string]PragmaHandler{}
+
+//	The pragmas for the connection-level subsystems. Limit-backed pragmas share one implementation.
+func limitPragma(name string, category int) PragmaHandler {
+	return PragmaHandler{
+		Name: name,
+		Get: func(db *sqlite3) string {
+			return strconv.Itoa(db.Limit(category))
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			n, ok := pragmaInt(value)
+			if !ok || n < 0 {
+				return SQLITE_ERROR
+			}
+			db.SetLimit(category, n)
+			return SQLITE_OK
+		},
+	}
+}
+
+func init() {
+	registerPragma(PragmaHandler{
+		Name: "busy_timeout",
+		Get: func(db *sqlite3) string {
+			return strconv.Itoa(db.busyTimeoutMs)
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			n, ok := pragmaInt(value)
+			if !ok {
+				return SQLITE_ERROR
+			}
+			db.SetBusyTimeout(n)
+			return SQLITE_OK
+		},
+	})
+	registerPragma(PragmaHandler{
+		Name: "cache_size",
+		Get: func(db *sqlite3) string {
+			return strconv.Itoa(db.MainPager().CacheSize())
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			n, ok := pragmaInt(value)
+			if !ok {
+				return SQLITE_ERROR
+			}
+			db.MainPager().SetCacheSize(n)
+			return SQLITE_OK
+		},
+	})
+	registerPragma(PragmaHandler{
+		Name: "mmap_size",
+		Get: func(db *sqlite3) string {
+			return strconv.FormatInt(db.MainPager().MmapSize(), 10)
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			n, ok := pragmaInt(value)
+			if !ok || n < 0 {
+				return SQLITE_ERROR
+			}
+			db.MainPager().SetMmapSize(int64(n))
+			return SQLITE_OK
+		},
+	})
+	registerPragma(PragmaHandler{
+		Name: "wal_autocheckpoint",
+		Get: func(db *sqlite3) string {
+			return strconv.Itoa(db.walAutoCheckpoint)
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			n, ok := pragmaInt(value)
+			if !ok {
+				return SQLITE_ERROR
+			}
+			db.walAutoCheckpoint = n
+			return SQLITE_OK
+		},
+	})
+	registerPragma(PragmaHandler{
+		Name: "defensive",
+		Get: func(db *sqlite3) string {
+			if db.defensive() {
+				return "1"
+			}
+			return "0"
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			enabled, ok := pragmaBool(value)
+			if !ok {
+				return SQLITE_ERROR
+			}
+			//	Defensive mode can be switched on by SQL but never off - see defensive.go.
+			if enabled {
+				db.EnableDefensive()
+			} else if db.defensive() {
+				return SQLITE_ERROR
+			}
+			return SQLITE_OK
+		},
+	})
+	registerPragma(limitPragma("max_sql_length", SQLITE_LIMIT_SQL_LENGTH))
+	registerPragma(limitPragma("max_expr_depth", SQLITE_LIMIT_EXPR_DEPTH))
+	registerPragma(limitPragma("max_like_pattern_length", SQLITE_LIMIT_LIKE_PATTERN_LENGTH))
+	registerPragma(limitPragma("max_compound_select", SQLITE_LIMIT_COMPOUND_SELECT))
+	registerPragma(limitPragma("max_attached", SQLITE_LIMIT_ATTACHED))
+	registerPragma(limitPragma("max_variable_number", SQLITE_LIMIT_VARIABLE_NUMBER))
+}
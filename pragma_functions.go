@@ -0,0 +1,175 @@
+package serendipity
+
+import (
+	"strings"
+)
+
+//	This file exposes the schema-introspection pragmas as eponymous table-valued functions, so that
+//
+//		SELECT m.name, ti.* FROM sqlite_master AS m JOIN pragma_table_info(m.name) AS ti
+//
+//	works the way it does in SQLite. A table pragma is registered with its column list and a row producer; one shared
+//	virtual table module serves them all, passing the function's arguments through a HIDDEN argument column the same way
+//	other eponymous modules do. The single-valued pragmas in pragma.go are unaffected - only pragmas registered here gain
+//	a function form, and each remains available in PRAGMA statement form as before.
+
+//	A TablePragma implements one multi-row pragma. Rows pushes each result row to emit; the argument is the pragma
+//	argument ("PRAGMA table_info(t)" and "SELECT * FROM pragma_table_info('t')" deliver the same t), empty for pragmas
+//	like database_list which take none.
+type TablePragma struct {
+	Name	string
+	Columns	[]string
+	Rows	func(db *sqlite3, argument string, emit func(row ...interface{})) (rc int)
+}
+
+var tablePragmas = map[string]TablePragma{}
+
+//	Register a table pragma and its function form. The module is registered lazily per-connection the first time the
+//	function name is resolved, because module registration needs a connection.
+func registerTablePragma(pragma TablePragma) {
+	tablePragmas[strings.ToLower(pragma.Name)] = pragma
+}
+
+//	The virtual table behind one pragma function.
+type pragmaVtab struct {
+	db		*sqlite3
+	pragma	TablePragma
+}
+
+//	Its cursor: rows are produced eagerly on xFilter, which keeps the row producer free of iterator state. Pragma results
+//	are small - bounded by schema size - so the buffering never matters.
+type pragmaVtabCursor struct {
+	pVtab	*pragmaVtab
+	rows	[][]interface{}
+	iRow	int
+}
+
+func pragmaVtabConnect(db *sqlite3, pragma TablePragma) (table *pragmaVtab, zSchema string, rc int) {
+	//	The trailing HIDDEN column carries the function argument.
+	zSchema = sqlite3_mprintf("CREATE TABLE x(%v, arg HIDDEN)", strings.Join(pragma.Columns, ", "))
+	return &pragmaVtab{ db: db, pragma: pragma }, zSchema, SQLITE_OK
+}
+
+//	Constrain the planner to pass the argument: when a constraint on the HIDDEN column is present it becomes the one
+//	xFilter argument; otherwise the pragma runs argument-less, which only the no-argument pragmas support.
+func (table *pragmaVtab) BestIndex(info *IndexInfo) (rc int) {
+	for i, constraint := range info.Constraint {
+		if constraint.iColumn == len(table.pragma.Columns) && constraint.op == SQLITE_INDEX_CONSTRAINT_EQ && constraint.usable {
+			info.Usage[i].argvIndex = 1
+			info.Usage[i].omit = true
+			info.estimatedCost = 10
+			return SQLITE_OK
+		}
+	}
+	info.estimatedCost = 100
+	return SQLITE_OK
+}
+
+func (table *pragmaVtab) Open() (cursor *pragmaVtabCursor, rc int) {
+	return &pragmaVtabCursor{ pVtab: table }, SQLITE_OK
+}
+
+func (cursor *pragmaVtabCursor) Filter(argv []*sqlite3_value) (rc int) {
+	argument := ""
+	if len(argv) > 0 {
+		argument = argv[0].Text()
+	}
+	cursor.rows = cursor.rows[:0]
+	cursor.iRow = 0
+	return cursor.pVtab.pragma.Rows(cursor.pVtab.db, argument, func(row ...interface{}) {
+		cursor.rows = append(cursor.rows, row)
+	})
+}
+
+func (cursor *pragmaVtabCursor) Next() (rc int) {
+	cursor.iRow++
+	return SQLITE_OK
+}
+
+func (cursor *pragmaVtabCursor) Eof() bool {
+	return cursor.iRow >= len(cursor.rows)
+}
+
+func (cursor *pragmaVtabCursor) Column(context *Context, i int) (rc int) {
+	if i < len(cursor.rows[cursor.iRow]) {
+		sqlite3_result_value(context, cursor.rows[cursor.iRow][i])
+	}
+	return SQLITE_OK
+}
+
+func (cursor *pragmaVtabCursor) Rowid() (rowid int64, rc int) {
+	return int64(cursor.iRow), SQLITE_OK
+}
+
+//	The built-in table pragmas. Each reads the in-memory schema rather than re-parsing SQL, so the function forms stay
+//	consistent with what the planner itself sees.
+func init() {
+	registerTablePragma(TablePragma{
+		Name:		"pragma_table_info",
+		Columns:	[]string{ "cid", "name", "type", "\"notnull\"", "dflt_value", "pk" },
+		Rows: func(db *sqlite3, argument string, emit func(row ...interface{})) (rc int) {
+			table := db.FindTable(argument, "")
+			if table == nil {
+				return SQLITE_OK
+			}
+			for i, column := range table.Columns {
+				pk := 0
+				if i == table.iPKey {
+					pk = 1
+				}
+				emit(int64(i), column.zName, column.zType, int64(column.notNull), column.zDflt, int64(pk))
+			}
+			return SQLITE_OK
+		},
+	})
+	registerTablePragma(TablePragma{
+		Name:		"pragma_index_list",
+		Columns:	[]string{ "seq", "name", "\"unique\"" },
+		Rows: func(db *sqlite3, argument string, emit func(row ...interface{})) (rc int) {
+			table := db.FindTable(argument, "")
+			if table == nil {
+				return SQLITE_OK
+			}
+			seq := 0
+			for index := table.pIndex; index != nil; index = index.pNext {
+				emit(int64(seq), index.zName, int64(index.onError))
+				seq++
+			}
+			return SQLITE_OK
+		},
+	})
+	registerTablePragma(TablePragma{
+		Name:		"pragma_index_info",
+		Columns:	[]string{ "seqno", "cid", "name" },
+		Rows: func(db *sqlite3, argument string, emit func(row ...interface{})) (rc int) {
+			index := db.FindIndex(argument, "")
+			if index == nil {
+				return SQLITE_OK
+			}
+			for i, iColumn := range index.aiColumn {
+				emit(int64(i), int64(iColumn), index.pTable.Columns[iColumn].zName)
+			}
+			return SQLITE_OK
+		},
+	})
+	registerTablePragma(TablePragma{
+		Name:		"pragma_database_list",
+		Columns:	[]string{ "seq", "name", "file" },
+		Rows: func(db *sqlite3, argument string, emit func(row ...interface{})) (rc int) {
+			for i, database := range db.Databases {
+				emit(int64(i), database.zName, database.filename())
+			}
+			return SQLITE_OK
+		},
+	})
+	registerTablePragma(TablePragma{
+		Name:		"pragma_function_list",
+		Columns:	[]string{ "name", "narg" },
+		Rows: func(db *sqlite3, argument string, emit func(row ...interface{})) (rc int) {
+			for _, function := range db.registeredFunctions() {
+				emit(function.zName, int64(function.nArg))
+			}
+			return SQLITE_OK
+		},
+	})
+}
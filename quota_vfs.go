@@ -0,0 +1,169 @@
+package serendipity
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+//	This file provides a quota-enforcing VFS wrapper for services embedding many databases, one per tenant. Two levels of
+//	quota are supported: a per-database byte limit applied to each file opened through the wrapper, and per-directory
+//	limits applied to the combined size of every file the wrapper has opened beneath the directory - so a tenant's
+//	database, WAL and journal count against one budget, which is the number an operator actually provisions.
+//
+//	A write that would exceed a quota fails with SQLITE_FULL, exactly what a genuinely full disk produces, so the engine's
+//	existing rollback handling applies unchanged. Before failing, the callback (if any) is consulted with the quota's
+//	current state; returning true grants a one-time allowance for the write and permanently raises the quota to cover it,
+//	which lets a service implement "soft" quotas that alert and expand rather than hard-failing tenants.
+
+//	The error a refused write surfaces. The pager maps it to SQLITE_FULL, so the engine's disk-full handling - statement
+//	failure and clean rollback - applies unchanged.
+type ErrQuota struct {
+	Filename	string
+}
+
+func (e *ErrQuota) Error() string {
+	return sqlite3_mprintf("quota exceeded writing %v", e.Filename)
+}
+
+//	The state passed to a quota callback.
+type QuotaExceeded struct {
+	Directory	string		//	The directory whose quota was hit, or "" for a per-database quota
+	Filename	string		//	The file being written
+	Limit		int64		//	The quota in bytes
+	Requested	int64		//	The size the write needs
+}
+
+type QuotaVFS struct {
+	Underlying		VFSLayer
+	DatabaseLimit	int64		//	Per-file limit; 0 means unlimited
+	Callback		func(exceeded *QuotaExceeded) (allow bool)
+	mutex			sync.Mutex
+	directories		map[string]*directoryQuota
+	sizes			map[string]int64		//	Current size of each open file
+}
+
+type directoryQuota struct {
+	limit	int64
+	used	int64
+}
+
+//	Set the quota for a directory. May be called while databases beneath it are open; an over-quota directory simply
+//	refuses further growth.
+func (vfs *QuotaVFS) SetDirectoryQuota(directory string, limit int64) {
+	vfs.mutex.Lock()
+	defer vfs.mutex.Unlock()
+	if vfs.directories == nil {
+		vfs.directories = map[string]*directoryQuota{}
+	}
+	if quota := vfs.directories[directory]; quota != nil {
+		quota.limit = limit
+	} else {
+		vfs.directories[directory] = &directoryQuota{ limit: limit }
+	}
+}
+
+func (vfs *QuotaVFS) Open(filename string, flags int) (VFSFile, error) {
+	file, err := vfs.Underlying.Open(filename, flags)
+	if err != nil {
+		return nil, err
+	}
+	vfs.mutex.Lock()
+	if vfs.sizes == nil {
+		vfs.sizes = map[string]int64{}
+	}
+	vfs.mutex.Unlock()
+	return &quotaFile{ vfs: vfs, file: file, filename: filename }, nil
+}
+
+func (vfs *QuotaVFS) Delete(filename string) error {
+	if err := vfs.Underlying.Delete(filename); err != nil {
+		return err
+	}
+	vfs.release(filename)
+	return nil
+}
+
+//	Account for a file growing to newSize, deciding whether the growth is allowed. Shrinkage is always allowed and
+//	returns budget to the directory.
+func (vfs *QuotaVFS) charge(filename string, newSize int64) bool {
+	vfs.mutex.Lock()
+	defer vfs.mutex.Unlock()
+	oldSize := vfs.sizes[filename]
+	if newSize <= oldSize {
+		vfs.sizes[filename] = newSize
+		if quota := vfs.directoryFor(filename); quota != nil {
+			quota.used -= oldSize - newSize
+		}
+		return true
+	}
+	if vfs.DatabaseLimit > 0 && newSize > vfs.DatabaseLimit {
+		if !vfs.consult(&QuotaExceeded{ Filename: filename, Limit: vfs.DatabaseLimit, Requested: newSize }) {
+			return false
+		}
+		vfs.DatabaseLimit = newSize
+	}
+	if quota := vfs.directoryFor(filename); quota != nil {
+		if used := quota.used + newSize - oldSize; quota.limit > 0 && used > quota.limit {
+			exceeded := &QuotaExceeded{ Directory: filepath.Dir(filename), Filename: filename, Limit: quota.limit, Requested: used }
+			if !vfs.consult(exceeded) {
+				return false
+			}
+			quota.limit = used
+		}
+		quota.used += newSize - oldSize
+	}
+	vfs.sizes[filename] = newSize
+	return true
+}
+
+//	Consult the callback about an exceeded quota. It runs under the VFS mutex, so it may inspect the exceeded state and
+//	adjust limits via the fields but must not open or write files through this VFS.
+func (vfs *QuotaVFS) consult(exceeded *QuotaExceeded) bool {
+	return vfs.Callback != nil && vfs.Callback(exceeded)
+}
+
+func (vfs *QuotaVFS) directoryFor(filename string) *directoryQuota {
+	return vfs.directories[filepath.Dir(filename)]
+}
+
+func (vfs *QuotaVFS) release(filename string) {
+	vfs.mutex.Lock()
+	defer vfs.mutex.Unlock()
+	if quota := vfs.directoryFor(filename); quota != nil {
+		quota.used -= vfs.sizes[filename]
+	}
+	delete(vfs.sizes, filename)
+}
+
+type quotaFile struct {
+	vfs			*QuotaVFS
+	file		VFSFile
+	filename	string
+}
+
+func (f *quotaFile) ReadAt(buffer []byte, offset int64) (int, error) {
+	return f.file.ReadAt(buffer, offset)
+}
+
+func (f *quotaFile) WriteAt(buffer []byte, offset int64) (int, error) {
+	if !f.vfs.charge(f.filename, offset + int64(len(buffer))) {
+		return 0, &ErrQuota{ Filename: f.filename }
+	}
+	return f.file.WriteAt(buffer, offset)
+}
+
+func (f *quotaFile) Sync() error {
+	return f.file.Sync()
+}
+
+func (f *quotaFile) Truncate(size int64) error {
+	if err := f.file.Truncate(size); err != nil {
+		return err
+	}
+	f.vfs.charge(f.filename, size)
+	return nil
+}
+
+func (f *quotaFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,245 @@
+package serendipity
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+//	This file implements a best-effort recovery mode, equivalent in spirit to the shell's ".recover" command. A damaged database
+//	is scanned page by page using the forensic API in inspect.go; every leaf table cell which can be decoded is reconstructed as
+//	a row and written into a fresh database. No attempt is made to follow the btree structure from the root downwards, since in
+//	a corrupt file interior pages are exactly the pages most likely to be untrustworthy.
+
+//	A RecoveredRow is a single row salvaged from the damaged file. Values are reported as the Go types produced by the record
+//	decoder: nil, int64, float64, string or []byte.
+type RecoveredRow struct {
+	RootPage	uint32			//	Root page of the btree the row is believed to belong to, or 0 if unknown
+	Table		string			//	Name of the owning table if it could be determined from the schema
+	Rowid		int64			//	The rowid stored in the leaf cell
+	Values		[]interface{}	//	The decoded column values
+}
+
+//	A RecoveryReport summarises what could and could not be salvaged.
+type RecoveryReport struct {
+	PagesScanned	int			//	Total number of pages examined
+	PagesUnreadable	int			//	Pages which could not be read at all
+	PagesOrphaned	int			//	Leaf pages which could not be attributed to any table
+	RowsRecovered	int			//	Rows successfully reconstructed
+	CellsDiscarded	int			//	Cells which could not be decoded as records
+	Errors			[]string	//	Human-readable descriptions of everything that was skipped
+}
+
+func (report *RecoveryReport) note(format string, values ...interface{}) {
+	report.Errors = append(report.Errors, fmt.Sprintf(format, values...))
+}
+
+//	Scan every page of the named file and pass each row which can be reconstructed to f, together with the report accumulated so
+//	far. Rows from pages which cannot be attributed to a table are reported with a Table of "" and a RootPage of 0; this includes
+//	orphaned rtree shadow rows, whose %_node, %_parent and %_rowid tables are ordinary rowid tables and so are salvaged by the
+//	same path as user tables. Callers wanting a fresh database simply replay the rows through INSERT statements, using the
+//	lost_and_found convention for unattributed rows.
+func RecoverFile(filename string, f func(row *RecoveredRow)) (report *RecoveryReport, err error) {
+	var inspector	*FileInspector
+	if inspector, err = OpenFileInspector(filename); err != nil {
+		return
+	}
+	defer inspector.Close()
+
+	report = &RecoveryReport{}
+	pageCount := uint32(0)
+	if inspector.Header != nil {
+		pageCount = inspector.Header.PageCount
+	}
+	if pageCount == 0 {
+		report.note("page count missing from header; scanning until the first unreadable page")
+		pageCount = 0xffffffff
+	}
+
+	//	First pass: decode what we can of the schema so that leaf pages can be attributed to tables. The schema btree is rooted
+	//	at page 1, but rather than walking it we simply remember every (name, rootpage) pair found in any cell which looks like a
+	//	schema record, which also catches schema rows stranded on orphaned pages.
+	tables := map[uint32]string{}
+	parents := map[uint32]uint32{}
+
+	scan := func(pass int) {
+		for pageNumber := uint32(1); pageNumber <= pageCount; pageNumber++ {
+			info, e := inspector.InspectPage(pageNumber)
+			switch {
+			case e != nil:
+				if pass == 1 {
+					report.PagesUnreadable++
+					report.note("page %v: %v", pageNumber, e)
+				}
+				if pageCount == 0xffffffff {
+					pageCount = pageNumber - 1
+				}
+				continue
+			case info.Type == PAGE_INTERIOR_TABLE:
+				//	Interior pages are only used to establish page parentage so that leaves can be attributed to a root.
+				if pass == 1 {
+					for _, offset := range info.CellOffsets {
+						if offset >= 0 && offset + 4 <= len(info.Data) {
+							parents[binary.BigEndian.Uint32(info.Data[offset:])] = pageNumber
+						}
+					}
+					parents[info.RightChild] = pageNumber
+				}
+				continue
+			case info.Type != PAGE_LEAF_TABLE:
+				continue
+			}
+			if pass == 1 {
+				report.PagesScanned++
+			}
+			for _, offset := range info.CellOffsets {
+				rowid, values, e := decodeLeafTableCell(info.Data, offset)
+				if e != nil {
+					if pass == 2 {
+						report.CellsDiscarded++
+						report.note("page %v cell at %v: %v", pageNumber, offset, e)
+					}
+					continue
+				}
+				if pass == 1 {
+					//	A schema record has five columns: type, name, tbl_name, rootpage, sql.
+					if len(values) == 5 {
+						if kind, ok := values[0].(string); ok && kind == "table" {
+							if name, ok := values[1].(string); ok {
+								if root, ok := values[3].(int64); ok && root > 0 {
+									tables[uint32(root)] = name
+								}
+							}
+						}
+					}
+				} else {
+					root := pageNumber
+					for steps := 0; steps < 64; steps++ {
+						parent, ok := parents[root]
+						if !ok {
+							break
+						}
+						root = parent
+					}
+					row := &RecoveredRow{ RootPage: root, Table: tables[root], Rowid: rowid, Values: values }
+					if row.Table == "" {
+						row.RootPage = 0
+					}
+					report.RowsRecovered++
+					f(row)
+				}
+			}
+		}
+	}
+	scan(1)
+	scan(2)
+
+	for pageNumber := uint32(1); pageNumber <= pageCount && pageCount != 0xffffffff; pageNumber++ {
+		if info, e := inspector.InspectPage(pageNumber); e == nil && info.Type == PAGE_LEAF_TABLE {
+			if root := rootOf(pageNumber, parents); tables[root] == "" {
+				report.PagesOrphaned++
+			}
+		}
+	}
+	return
+}
+
+func rootOf(pageNumber uint32, parents map[uint32]uint32) uint32 {
+	for steps := 0; steps < 64; steps++ {
+		parent, ok := parents[pageNumber]
+		if !ok {
+			break
+		}
+		pageNumber = parent
+	}
+	return pageNumber
+}
+
+//	Decode the varint format used throughout database records: big-endian, seven bits per byte, with the ninth byte (if present)
+//	contributing a full eight bits.
+func decodeVarint(data []byte) (value int64, length int) {
+	for length < 8 && length < len(data) {
+		value = (value << 7) | int64(data[length] & 0x7f)
+		if data[length] & 0x80 == 0 {
+			length++
+			return
+		}
+		length++
+	}
+	if length == 8 && length < len(data) {
+		value = (value << 8) | int64(data[length])
+		length++
+	}
+	return
+}
+
+//	Decode a single cell from a leaf table page into its rowid and column values. Overflow chains are not followed: a cell whose
+//	payload spills to overflow pages is rejected, since in a damaged file the overflow chain cannot be trusted and a truncated
+//	row is worse than a reported omission.
+func decodeLeafTableCell(data []byte, offset int) (rowid int64, values []interface{}, err error) {
+	if offset < 0 || offset >= len(data) {
+		return 0, nil, fmt.Errorf("cell offset outside the page")
+	}
+	payloadSize, n := decodeVarint(data[offset:])
+	offset += n
+	rowid, n = decodeVarint(data[offset:])
+	offset += n
+	if payloadSize < 0 || offset + int(payloadSize) > len(data) {
+		return 0, nil, fmt.Errorf("payload of %v bytes overflows the page", payloadSize)
+	}
+	payload := data[offset:offset + int(payloadSize)]
+
+	headerSize, n := decodeVarint(payload)
+	if headerSize < int64(n) || headerSize > int64(len(payload)) {
+		return 0, nil, fmt.Errorf("record header size %v is invalid", headerSize)
+	}
+	body := payload[headerSize:]
+	for header := payload[n:headerSize]; len(header) > 0; {
+		serialType, n := decodeVarint(header)
+		header = header[n:]
+		var value	interface{}
+		var size	int
+		switch {
+		case serialType == 0:
+			value = nil
+		case serialType >= 1 && serialType <= 6:
+			size = []int{ 1, 2, 3, 4, 6, 8 }[serialType - 1]
+			if size > len(body) {
+				return 0, nil, fmt.Errorf("record body truncated")
+			}
+			v := int64(0)
+			for i := 0; i < size; i++ {
+				v = (v << 8) | int64(body[i])
+			}
+			//	Sign-extend from the stored width.
+			if shift := uint(64 - 8 * size); shift > 0 {
+				v = (v << shift) >> shift
+			}
+			value = v
+		case serialType == 7:
+			if size = 8; size > len(body) {
+				return 0, nil, fmt.Errorf("record body truncated")
+			}
+			value = math.Float64frombits(binary.BigEndian.Uint64(body))
+		case serialType == 8:
+			value = int64(0)
+		case serialType == 9:
+			value = int64(1)
+		case serialType >= 12 && serialType % 2 == 0:
+			if size = int(serialType - 12) / 2; size > len(body) {
+				return 0, nil, fmt.Errorf("record body truncated")
+			}
+			value = append([]byte{}, body[:size]...)
+		case serialType >= 13:
+			if size = int(serialType - 13) / 2; size > len(body) {
+				return 0, nil, fmt.Errorf("record body truncated")
+			}
+			value = string(body[:size])
+		default:
+			return 0, nil, fmt.Errorf("reserved serial type %v", serialType)
+		}
+		body = body[size:]
+		values = append(values, value)
+	}
+	return
+}
@@ -0,0 +1,135 @@
+package serendipity
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//	This file implements the follower side of WAL shipping. A Replica owns a read-only database file and applies FrameGroups
+//	received from a leader (see wal_hooks.go), turning a single-writer deployment into a read tier: any number of followers
+//	may apply the same stream and serve read-only queries from the result. Application is transactional - a frame group is
+//	either applied completely or not at all - so reader connections on the replica always observe a committed state.
+
+//	A Replica applies shipped frame groups to a local database file and reports how far behind the leader it is.
+type Replica struct {
+	db				*sqlite3
+	mutex			sync.Mutex
+	generation		uint64		//	Generation of the last applied group, or 0 before the first snapshot
+	appliedFrame	uint32		//	Highest frame applied within the current generation
+	appliedAt		time.Time	//	When the last group was applied
+	committedAt		time.Time	//	Leader commit time of the last applied group, when provided
+	needSnapshot	bool		//	Set when a generation change invalidates the local file
+}
+
+//	The lag figures reported by a replica. Frames is meaningful only while leader and replica agree on the generation.
+type ReplicaLag struct {
+	Generation		uint64
+	AppliedFrame	uint32
+	Behind			time.Duration	//	Local apply time minus leader commit time for the last group
+	NeedSnapshot	bool			//	The replica cannot catch up by applying frames and must re-seed
+}
+
+//	Open the named database file as a replica. The file must have been seeded from a snapshot of the leader; until the first
+//	frame group arrives it simply serves the snapshot contents. The underlying connection is forced read-only for queries so
+//	that local writes can never diverge the replica from its leader.
+func OpenReplica(filename string) (replica *Replica, err error) {
+	var db	*sqlite3
+	if db, err = Open(filename); err != nil {
+		return
+	}
+	db.flags |= SQLITE_ReadOnly
+	return &Replica{ db: db, needSnapshot: true }, nil
+}
+
+//	The read-only connection serving queries against the replica.
+func (replica *Replica) Connection() *sqlite3 {
+	return replica.db
+}
+
+//	GenerationChanged implements FrameShipper for the direct-attachment case where leader and replica share a process. A new
+//	generation means the local file can no longer be advanced by applying frames, so the replica flags itself for re-seeding.
+func (replica *Replica) GenerationChanged(generation uint64) {
+	replica.mutex.Lock()
+	if generation != replica.generation {
+		replica.generation, replica.appliedFrame = generation, 0
+		replica.needSnapshot = replica.appliedAt != (time.Time{})
+	}
+	replica.mutex.Unlock()
+}
+
+//	Seed the replica from a full snapshot, clearing any pending re-seed flag. The caller supplies the generation and frame
+//	position the snapshot corresponds to, which the leader records at snapshot time.
+func (replica *Replica) Seeded(generation uint64, frame uint32) {
+	replica.mutex.Lock()
+	replica.generation, replica.appliedFrame, replica.needSnapshot = generation, frame, false
+	replica.appliedAt = time.Now()
+	replica.mutex.Unlock()
+}
+
+//	ShipFrames implements FrameShipper: apply one committed frame group to the replica. Groups must arrive in commit order;
+//	a gap in frame numbering means the transport dropped a group and the replica must re-seed rather than apply further
+//	frames to what is now a torn state.
+func (replica *Replica) ShipFrames(group *FrameGroup) (err error) {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	switch {
+	case replica.needSnapshot:
+		return fmt.Errorf("replica requires a fresh snapshot before frames can be applied")
+	case group.Generation != replica.generation:
+		replica.needSnapshot = true
+		return fmt.Errorf("frame group is from generation %v but replica is at generation %v", group.Generation, replica.generation)
+	case len(group.Frames) > 0 && group.Frames[0].Frame != replica.appliedFrame + 1:
+		replica.needSnapshot = true
+		return fmt.Errorf("frame gap: expected frame %v, received %v", replica.appliedFrame + 1, group.Frames[0].Frame)
+	}
+
+	//	Apply the page images directly through the pager, bracketed as a single write transaction so that concurrent readers
+	//	on the replica see either all of the group or none of it.
+	pager := replica.db.MainPager()
+	if err = pager.BeginExclusive(); err != nil {
+		return
+	}
+	for _, frame := range group.Frames {
+		if err = pager.WritePageImage(frame.PageNumber, frame.Data); err != nil {
+			pager.Rollback()
+			return fmt.Errorf("applying page %v: %v", frame.PageNumber, err)
+		}
+	}
+	if err = pager.CommitAtSize(group.DatabaseSize); err != nil {
+		pager.Rollback()
+		return
+	}
+	replica.appliedFrame = group.Frames[len(group.Frames) - 1].Frame
+	replica.appliedAt = time.Now()
+	replica.committedAt = group.CommittedAt
+	return
+}
+
+//	Report how far behind the leader this replica is. Behind is zero when no commit timestamps are available.
+func (replica *Replica) Lag() ReplicaLag {
+	replica.mutex.Lock()
+	defer replica.mutex.Unlock()
+	lag := ReplicaLag{ Generation: replica.generation, AppliedFrame: replica.appliedFrame, NeedSnapshot: replica.needSnapshot }
+	if !replica.committedAt.IsZero() && replica.appliedAt.After(replica.committedAt) {
+		lag.Behind = replica.appliedAt.Sub(replica.committedAt)
+	}
+	return lag
+}
+
+//	Apply a backlog of frame groups in order, stopping at the first failure. This is the catch-up path used after a follower
+//	reconnects: the transport replays everything committed since the follower's last applied frame.
+func (replica *Replica) CatchUp(groups []*FrameGroup) (applied int, err error) {
+	for _, group := range groups {
+		if err = replica.ShipFrames(group); err != nil {
+			return
+		}
+		applied++
+	}
+	return
+}
+
+//	Close the replica's connection.
+func (replica *Replica) Close() error {
+	return replica.db.Close()
+}
@@ -0,0 +1,97 @@
+package serendipity
+
+import (
+	"strings"
+)
+
+//	This file adds engine-enforced row scoping. A multi-tenant application is one forgotten WHERE clause away
+//	from serving one tenant's rows to another, and discipline does not scale across a codebase. A row policy
+//	moves the predicate into the connection: a hook consulted at prepare time for every table reference, whose
+//	returned predicate is conjoined onto the statement before planning, so a query that forgets the tenant
+//	filter gets it anyway:
+//
+//		db.SetRowPolicy(func(zTable, zName string) SqlExpr {
+//			if zTable == "orders" {
+//				return &BinaryExpr{ Op: "=", Left: &ColumnRef{ Name: "tenant_id" }, Right: &Variable{ Name: ":tenant" } }
+//			}
+//			return nil
+//		})
+//
+//	The rewrite runs on the AST from sql_ast.go, never on text, so quoting and nesting cannot confuse it, and
+//	the existing WHERE clause is parenthesised before the policy term is conjoined so an OR inside it cannot
+//	escape the scope. Column references in the returned predicate are qualified with the reference's effective
+//	name - its alias when it has one - so a self-join scopes each arm separately.
+//
+//	A policy fails closed: with a hook installed, a SELECT the AST subset cannot represent is refused with
+//	SQLITE_AUTH rather than prepared unfiltered, since a statement that evades the rewrite would otherwise be
+//	the obvious way around it. Non-SELECT statements currently pass through unchanged; scoping writes needs
+//	the UPDATE and DELETE forms of the AST and is the natural next step on top of this hook.
+
+//	The policy hook: called with the table's schema name and its effective name in the statement, it returns
+//	the predicate to append, or nil for tables the policy leaves alone.
+type RowPolicy func(zTable, zName string) SqlExpr
+
+//	Install or, with nil, remove the connection's row policy. Statements prepared before the call are
+//	unaffected; anything prepared afterwards - including reprepares after schema changes - is filtered.
+func (db *sqlite3) SetRowPolicy(policy RowPolicy) {
+	db.rowPolicy = policy
+}
+
+//	A deep copy of a policy predicate with its unqualified column references bound to zName. The policy author
+//	writes columns bare; qualification here is what makes the same predicate correct on every arm of a
+//	self-join.
+func qualifyPolicyExpr(expr SqlExpr, zName string) SqlExpr {
+	switch node := expr.(type) {
+	case *ColumnRef:
+		if node.Table == "" {
+			return &ColumnRef{ Table: zName, Name: node.Name }
+		}
+		return &ColumnRef{ Table: node.Table, Name: node.Name }
+	case *UnaryExpr:
+		return &UnaryExpr{ Op: node.Op, Operand: qualifyPolicyExpr(node.Operand, zName) }
+	case *BinaryExpr:
+		return &BinaryExpr{ Op: node.Op, Left: qualifyPolicyExpr(node.Left, zName), Right: qualifyPolicyExpr(node.Right, zName) }
+	case *ParenExpr:
+		return &ParenExpr{ Operand: qualifyPolicyExpr(node.Operand, zName) }
+	case *Call:
+		qualified := &Call{ Name: node.Name, Distinct: node.Distinct, Star: node.Star }
+		for _, arg := range node.Args {
+			qualified.Args = append(qualified.Args, qualifyPolicyExpr(arg, zName))
+		}
+		return qualified
+	}
+	return expr
+}
+
+//	Apply the policy to a parsed statement: one predicate per table reference that draws one, each conjoined
+//	onto the WHERE clause.
+func (statement *SelectStatement) applyRowPolicy(policy RowPolicy) {
+	for _, reference := range statement.From {
+		zName := reference.Name
+		if reference.Alias != "" {
+			zName = reference.Alias
+		}
+		if predicate := policy(reference.Name, zName); predicate != nil {
+			statement.AndWhere(qualifyPolicyExpr(predicate, zName))
+		}
+	}
+}
+
+//	The prepare-time rewrite. SQL that is not a SELECT passes through; a SELECT is parsed, filtered and
+//	re-rendered. A SELECT the parser cannot represent is refused - see the header for why that must not fall
+//	through to an unfiltered prepare.
+func (db *sqlite3) filterRowPolicies(sql string) (string, int) {
+	if db.rowPolicy == nil {
+		return sql, SQLITE_OK
+	}
+	tokens, diagnostics := sqlScan(sql)
+	if len(diagnostics) > 0 || len(tokens) == 0 || strings.ToUpper(tokens[0].text) != "SELECT" {
+		return sql, SQLITE_OK
+	}
+	statement, diagnostic := ParseSelect(sql)
+	if diagnostic != nil {
+		return "", SQLITE_AUTH
+	}
+	statement.applyRowPolicy(db.rowPolicy)
+	return RenderSql(statement), SQLITE_OK
+}
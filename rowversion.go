@@ -0,0 +1,127 @@
+package serendipity
+
+import (
+	"strings"
+	"sync"
+)
+
+//	This file gives applications optimistic concurrency control without triggers. The pattern - read a row,
+//	compute, write back only if nobody else wrote in between - needs a version counter that every update bumps,
+//	and a counter maintained by discipline fails the same way a remembered WHERE clause does: the one update
+//	that forgets it silently clobbers a concurrent change. Registering a table's version column moves the bump
+//	into the engine:
+//
+//		db.EnableRowVersion("accounts", "rowversion")
+//
+//	From then on every UPDATE against the table is rewritten at prepare time to increment the column, exactly
+//	as the row policy in row_policy.go injects its predicate, unless the statement assigns the column itself -
+//	that is how an application opts a statement out, and how the compare-and-swap helper avoids a double bump.
+//	UpdateIfUnchanged is that helper: one statement that applies the assignments, bumps the version and matches
+//	the expected version in its WHERE clause, reporting via the change counter whether it won or lost the race.
+//
+//	For the writers that would rather queue than retry, each table also has an engine-held write lock:
+//	SerializedWrite runs its body with the named table's lock held, so two such writers never interleave. The
+//	two mechanisms compose - serialize the hot table, CAS the rest.
+
+//	Register zColumn as zTable's version counter. The column is the application's to declare; INTEGER with a
+//	default of 1 is the conventional shape.
+func (db *sqlite3) EnableRowVersion(zTable, zColumn string) {
+	if db.rowVersionTables == nil {
+		db.rowVersionTables = map[string]string{}
+	}
+	db.rowVersionTables[strings.ToLower(zTable)] = zColumn
+}
+
+//	The prepare-time rewrite: splice "column = column + 1," into the SET clause of an UPDATE against a
+//	registered table. Token positions index the original text, so the splice cannot be confused by quoting or
+//	by the column's name appearing inside a string.
+func (db *sqlite3) filterRowVersion(sql string) string {
+	if len(db.rowVersionTables) == 0 {
+		return sql
+	}
+	tokens, diagnostics := sqlScan(sql)
+	if len(diagnostics) > 0 || len(tokens) < 4 || strings.ToUpper(tokens[0].text) != "UPDATE" {
+		return sql
+	}
+	at := 1
+	if strings.ToUpper(tokens[at].text) == "OR" {
+		at += 2
+	}
+	zColumn, versioned := db.rowVersionTables[strings.ToLower(tokens[at].text)]
+	if !versioned {
+		return sql
+	}
+	for ; at < len(tokens); at++ {
+		if tokens[at].kind == SQLTOKEN_IDENTIFIER && strings.ToUpper(tokens[at].text) == "SET" {
+			break
+		}
+	}
+	if at >= len(tokens) - 1 {
+		return sql
+	}
+	//	A statement that assigns the column itself has taken charge of the version - leave it alone.
+	for i := at + 1; i < len(tokens); i++ {
+		if tokens[i].kind == SQLTOKEN_IDENTIFIER && strings.ToUpper(tokens[i].text) == "WHERE" {
+			break
+		}
+		if tokens[i].kind == SQLTOKEN_IDENTIFIER && CaseInsensitiveComparison(tokens[i].text, zColumn) == 0 {
+			return sql
+		}
+	}
+	splice := tokens[at + 1].position
+	return sqlite3_mprintf("%s %Q = %Q + 1, %s", sql[:splice], zColumn, zColumn, sql[splice:])
+}
+
+//	Compare-and-swap: apply zAssignments to the row only if its version is still the one the caller read. The
+//	version bump rides in the same statement, so winning the race and bumping are atomic; a false return means
+//	another writer got there first and the caller should re-read and retry.
+func (db *sqlite3) UpdateIfUnchanged(zTable string, rowid, version int64, zAssignments string) (updated bool, rc int) {
+	zColumn, versioned := db.rowVersionTables[strings.ToLower(zTable)]
+	if !versioned {
+		return false, SQLITE_MISUSE
+	}
+	sql := sqlite3_mprintf(
+		"UPDATE %Q SET %s, %Q = %Q + 1 WHERE rowid = %lld AND %Q = %lld",
+		zTable, zAssignments, zColumn, zColumn, rowid, zColumn, version,
+	)
+	if rc = sqlite3_exec(db, sql, 0, 0, 0); rc != SQLITE_OK {
+		return
+	}
+	return db.Changes() > 0, SQLITE_OK
+}
+
+//	The current version of a row, for the read half of the read-compute-CAS cycle.
+func (db *sqlite3) RowVersion(zTable string, rowid int64) (version int64, rc int) {
+	zColumn, versioned := db.rowVersionTables[strings.ToLower(zTable)]
+	if !versioned {
+		return 0, SQLITE_MISUSE
+	}
+	statement, _, rc := db.Prepare_v2(sqlite3_mprintf("SELECT %Q FROM %Q WHERE rowid = %lld", zColumn, zTable, rowid))
+	if rc != SQLITE_OK {
+		return
+	}
+	if statement.Step() == SQLITE_ROW {
+		version = sqlite3_column_int64(statement, 0)
+	} else {
+		rc = SQLITE_NOTFOUND
+	}
+	statement.Finalize()
+	return
+}
+
+//	Run body with the named table's write lock held. The locks are connection-level conveniences for writers
+//	that prefer queueing to retrying; readers and writers that do not opt in are unaffected.
+func (db *sqlite3) SerializedWrite(zTable string, body func() int) int {
+	db.mutex.CriticalSection(func() {
+		if db.tableWriteLocks == nil {
+			db.tableWriteLocks = map[string]*sync.Mutex{}
+		}
+		if db.tableWriteLocks[strings.ToLower(zTable)] == nil {
+			db.tableWriteLocks[strings.ToLower(zTable)] = &sync.Mutex{}
+		}
+	})
+	lock := db.tableWriteLocks[strings.ToLower(zTable)]
+	lock.Lock()
+	defer lock.Unlock()
+	return body()
+}
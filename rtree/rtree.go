@@ -1,8 +1,11 @@
 package rtree
 
+import (
+	"sync"
+)
+
 const (
-	RTREE_MAX_DIMENSIONS	= 5		//	The rtree may have between 1 and RTREE_MAX_DIMENSIONS dimensions.
-	HASHSIZE				= 128	//	Size of hash table Rtree.aHash. This hash table is not expected to ever contain very many entries, so a fixed number of buckets is used.
+	RTREE_MAX_DIMENSIONS	= 16	//	Hard ceiling on dimensions; each table's working limit is negotiated in rtreeInit - see rtree_dimensions.go.
 )
 
 //	An rtree virtual-table object.
@@ -10,14 +13,23 @@ type Rtree struct {
 	base			sqlite3_vtab
 	db				*sqlite3			//	Host database connection
 	iNodeSize		int					//	Size in bytes of each node in the node table
+	iNodeSizeOption	int					//	Requested node size from a nodesize= creation option - see rtree_options.go
+	nodeFormat		int					//	Node layout version; v2 keeps the parent pointer in-node - see rtree_parent_pointers.go
+	hilbertOrdering	bool				//	Cluster entries along the Hilbert curve - see rtree_hilbert.go
 	Dimensions		int					//	Number of dimensions
 	nBytesPerCell	int					//	Bytes consumed per cell
 	iDepth			int					//	Current depth of the r-tree structure
 	zDb				string				//	Name of database containing r-tree table
 	zName			string				//	Name of r-tree table
-	aHash			[HASHSIZE]RtreeNode	//	Hash table of in-memory nodes
+	cache			rtreeNodeCache		//	LRU cache of in-memory nodes - see rtree_node_cache.go
 	nBusy			int					//	Current number of users of this structure
 
+	//	Concurrency control: access is held shared by read cursors and exclusively by writes; nodeLock serialises the
+	//	node cache, node reference counts and the shared prepared statements among concurrent readers - see
+	//	rtree_concurrency.go.
+	access			sync.RWMutex
+	nodeLock		sync.Mutex
+
 	//	List of nodes removed during a CondenseTree operation. List is linked together via the pointer normally used for hash chains -
 	//	RtreeNode.pNext. RtreeNode.iNode stores the depth of the sub-tree headed by the node (leaf nodes have RtreeNode.iNode==0).
 	pDeleted		*RtreeNode
@@ -28,15 +40,30 @@ type Rtree struct {
 	pWriteNode		*sqlite3_stmt
 	pDeleteNode		*sqlite3_stmt
 
+	//	Cached incremental blob handles onto xxx_node.data, reopened from node to node - see rtree_node_blob.go.
+	pNodeBlob		*sqlite3_blob
+	pNodeBlobWrite	*sqlite3_blob
+
 	//	Statements to read/write/delete a record from xxx_rowid
 	pReadRowid		*sqlite3_stmt
 	pWriteRowid		*sqlite3_stmt
 	pDeleteRowid	*sqlite3_stmt
 
-	//	Statements to read/write/delete a record from xxx_parent
-	pReadParent		*sqlite3_stmt
-	pWriteParent	*sqlite3_stmt
-	pDeleteParent	*sqlite3_stmt
+	//	Geopoly support: when set, column 0 is the polygon text held in the %_geometry shadow table and writes
+	//	derive the spatial cell from the parsed polygon's bounding box - see geopoly.go.
+	isGeopoly		bool
+	pReadGeometry	*sqlite3_stmt
+	pWriteGeometry	*sqlite3_stmt
+	pDeleteGeometry	*sqlite3_stmt
 
 	eCoordType		int
+	inTransaction	bool				//	Between xBegin and xCommit/xRollback; dirty node writes are deferred - see rtree_txn.go
+
+	//	Auxiliary data columns and the statements for their %_aux shadow table - see rtree_aux.go.
+	auxColumns		[]string
+	pWriteAux		*sqlite3_stmt
+	pReadAux		*sqlite3_stmt
+	pDeleteAux		*sqlite3_stmt
+
+	guard			*CursorGuard		//	Open-cursor invalidation tracking - see vtab_cursor_guard.go
 }
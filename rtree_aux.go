@@ -0,0 +1,107 @@
+package serendipity
+
+import (
+	"strings"
+)
+
+//	This file implements auxiliary data columns for rtree tables:
+//
+//		CREATE VIRTUAL TABLE rt USING rtree(id, x1, x2, y1, y2, +label, +payload)
+//
+//	A "+"-prefixed column is not spatial: it is stored in the %_aux shadow table keyed by rowid and returned by
+//	rtreeColumn alongside the coordinates, so an application can carry attributes with its rectangles instead of
+//	maintaining a parallel table and joining on every query. Aux columns must follow all coordinate columns, take any
+//	value without affinity, and play no part in constraint evaluation - filtering on them happens in the core after
+//	the spatial scan, exactly as filtering on a coordinate expression would.
+
+//	Split a CREATE VIRTUAL TABLE argument list into the spatial arguments and the aux column names. Aux columns are
+//	recognised by the "+" prefix; a spatial column after the first aux column is an error reported by the caller.
+func splitAuxColumns(args []string) (spatial, aux []string, misordered bool) {
+	spatial = args[:3:3]
+	for _, arg := range args[3:] {
+		trimmed := strings.TrimSpace(arg)
+		switch {
+		case strings.HasPrefix(trimmed, "+"):
+			aux = append(aux, strings.TrimSpace(trimmed[1:]))
+		case len(aux) > 0:
+			return nil, nil, true
+		default:
+			spatial = append(spatial, arg)
+		}
+	}
+	return
+}
+
+//	Create (if required) and prepare the %_aux shadow table statements. Called from SqlInit when the table was
+//	declared with aux columns; tables without them get no %_aux table at all, keeping existing databases untouched.
+func (tree *Rtree) auxInit(db *sqlite3, isCreate bool) (rc int) {
+	if len(tree.auxColumns) == 0 {
+		return SQLITE_OK
+	}
+	if isCreate {
+		definitions := ""
+		for _, column := range tree.auxColumns {
+			definitions = sqlite3_mprintf("%s, %Q", definitions, column)
+		}
+		create := sqlite3_mprintf("CREATE TABLE \"%s\".\"%s_aux\"(id INTEGER PRIMARY KEY%s)", tree.zDb, tree.zName, definitions)
+		if rc = sqlite3_exec(db, create, 0, 0, 0); rc != SQLITE_OK {
+			return
+		}
+	}
+	placeholders := "?"
+	for range tree.auxColumns {
+		placeholders += ", ?"
+	}
+	if tree.pWriteAux, _, rc = db.Prepare_v2(sqlite3_mprintf("INSERT OR REPLACE INTO \"%s\".\"%s_aux\" VALUES(%s)", tree.zDb, tree.zName, placeholders)); rc != SQLITE_OK {
+		return
+	}
+	if tree.pReadAux, _, rc = db.Prepare_v2(sqlite3_mprintf("SELECT * FROM \"%s\".\"%s_aux\" WHERE id = ?", tree.zDb, tree.zName)); rc != SQLITE_OK {
+		return
+	}
+	tree.pDeleteAux, _, rc = db.Prepare_v2(sqlite3_mprintf("DELETE FROM \"%s\".\"%s_aux\" WHERE id = ?", tree.zDb, tree.zName))
+	return
+}
+
+//	Store the aux values for a row. values holds the update vector entries for the aux columns, in declaration order.
+func (tree *Rtree) auxWrite(rowid int64, values []*sqlite3_value) (rc int) {
+	sqlite3_bind_int64(tree.pWriteAux, 1, rowid)
+	for i, value := range values {
+		sqlite3_bind_value(tree.pWriteAux, i + 2, value)
+	}
+	tree.pWriteAux.Step()
+	return tree.pWriteAux.Reset()
+}
+
+//	Produce one aux column of the current row as a column result. iAux is the zero-based index among the aux columns.
+//	The shared pReadAux statement is serialised among concurrent readers - see rtree_concurrency.go.
+func (tree *Rtree) auxColumn(context *Context, rowid int64, iAux int) (rc int) {
+	tree.nodeLock.Lock()
+	defer tree.nodeLock.Unlock()
+	sqlite3_bind_int64(tree.pReadAux, 1, rowid)
+	if tree.pReadAux.Step() == SQLITE_ROW {
+		sqlite3_result_value(context, tree.pReadAux.ColumnValue(iAux + 1))
+	} else {
+		sqlite3_result_null(context)
+	}
+	return tree.pReadAux.Reset()
+}
+
+//	Remove the aux row when the spatial row is deleted.
+func (tree *Rtree) auxDelete(rowid int64) (rc int) {
+	sqlite3_bind_int64(tree.pDeleteAux, 1, rowid)
+	tree.pDeleteAux.Step()
+	return tree.pDeleteAux.Reset()
+}
+
+//	Finalize the aux statements at disconnect.
+func (tree *Rtree) auxCleanup() {
+	if tree.pWriteAux != nil {
+		tree.pWriteAux.Finalize()
+	}
+	if tree.pReadAux != nil {
+		tree.pReadAux.Finalize()
+	}
+	if tree.pDeleteAux != nil {
+		tree.pDeleteAux.Finalize()
+	}
+}
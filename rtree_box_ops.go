@@ -0,0 +1,88 @@
+package serendipity
+
+//	This file adds native box operators to the r-tree query interface. A query for the entries inside a region
+//	used to spell the region out as four (or 2 * N) separate comparisons:
+//
+//		SELECT id FROM rt WHERE x0 >= $minX AND x1 <= $maxX AND y0 >= $minY AND y1 <= $maxY
+//
+//	which is verbose, easy to get subtly wrong - swap a min/max pair and the query silently returns nothing - and
+//	opaque to anyone reading it. The same region is now one MATCH term:
+//
+//		SELECT id FROM rt WHERE id MATCH rtree_within($minX, $maxX, $minY, $maxY)
+//
+//	rtree_within() selects entries contained in the box (boundary contact allowed); rtree_overlaps() selects
+//	entries whose interior genuinely intersects the box's interior, so entries that merely share an edge or a
+//	corner are excluded. Both travel to xFilter as tagged pointers, the same route knn() and the geometry
+//	callbacks use, and become a single two-sided constraint - RTREE_WITHIN or RTREE_OVERLAPS - covering every
+//	dimension at once. rtreeBestIndex needs no new strategy: its MATCH handling already carries the term, and the
+//	descent tests in testCell prune any subtree whose box misses the query box, exactly as the equivalent
+//	per-dimension comparisons would.
+
+const RTREE_BOX_POINTER_TAG = "rtree_box"
+
+//	A decoded box operator: the constraint op it becomes and the query box as min/max pairs per dimension.
+type BoxQuery struct {
+	op		int
+	aBox	[]float64
+}
+
+//	Shared argument handling for both operator functions: an even number of coordinates, each min no greater
+//	than its max.
+func boxQueryFunc(context *Context, args []*sqlite3_value, op int, zFunc string) {
+	if len(args) < 2 || len(args) % 2 != 0 {
+		sqlite3_result_error(context, sqlite3_mprintf("%s() needs a min/max pair per dimension", zFunc), -1)
+		return
+	}
+	query := &BoxQuery{ op: op }
+	for _, arg := range args {
+		query.aBox = append(query.aBox, sqlite3_value_float64(arg))
+	}
+	for i := 0; i < len(query.aBox); i += 2 {
+		if query.aBox[i] > query.aBox[i + 1] {
+			sqlite3_result_error(context, sqlite3_mprintf("%s() min exceeds max in dimension %v", zFunc, i / 2 + 1), -1)
+			return
+		}
+	}
+	context.sqlite3_result_pointer(query, RTREE_BOX_POINTER_TAG)
+}
+
+func rtreeWithinFunc(context *Context, args []*sqlite3_value) {
+	boxQueryFunc(context, args, RTREE_WITHIN, "rtree_within")
+}
+
+func rtreeOverlapsFunc(context *Context, args []*sqlite3_value) {
+	boxQueryFunc(context, args, RTREE_OVERLAPS, "rtree_overlaps")
+}
+
+//	The leaf tests. Containment admits the boundary; strict overlap requires the interiors to meet, so a shared
+//	edge or corner does not qualify.
+func (tree *Rtree) boxContainsCell(aBox []float64, cell *RtreeCell) bool {
+	for i := 0; i < tree.Dimensions * 2; i += 2 {
+		if DCOORD(cell.aCoord[i]) < aBox[i] || DCOORD(cell.aCoord[i + 1]) > aBox[i + 1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (tree *Rtree) boxStrictlyOverlapsCell(aBox []float64, cell *RtreeCell) bool {
+	for i := 0; i < tree.Dimensions * 2; i += 2 {
+		if DCOORD(cell.aCoord[i]) >= aBox[i + 1] || DCOORD(cell.aCoord[i + 1]) <= aBox[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//	The descent test, shared by both operators: a subtree can hold a contained or overlapping entry only if its
+//	bounding box touches the query box, so anything disjoint from it is pruned. The within/overlap distinction
+//	cannot be drawn here - a subtree box poking outside the query box may still hold fully contained entries -
+//	and is left to the per-entry tests above.
+func (tree *Rtree) boxTouchesCell(aBox []float64, cell *RtreeCell) bool {
+	for i := 0; i < tree.Dimensions * 2; i += 2 {
+		if DCOORD(cell.aCoord[i]) > aBox[i + 1] || DCOORD(cell.aCoord[i + 1]) < aBox[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,208 @@
+package serendipity
+
+import (
+	"strconv"
+)
+
+//	This file adds bulk deletion to the r-tree. A "DELETE FROM rt WHERE <box constraints>" used to run row at a
+//	time: the scan finds each rowid, rtreeUpdate calls DeleteRowid, and every call pays a rowid-table lookup to
+//	find the leaf again, condenses the tree, and reinserts the contents of any node it emptied - work the next
+//	deletion promptly disturbs. DeleteRange instead walks the tree once, descending only subtrees whose box
+//	intersects the range, edits each matching leaf in a single pass, and defers all condensing fallout to one
+//	reinsertion sweep at the end, so deleting a region costs one traversal however many entries it holds.
+//
+//	DeleteWhere is the SQL path: the DELETE code generator offers it the table's WHERE clause, and when that is a
+//	pure conjunction of constant bounds boxing every dimension the whole statement becomes one DeleteRange call
+//	and the row-at-a-time loop is skipped. Any other WHERE shape is declined and handled the usual way.
+
+//	An entry is deleted when its box lies inside the range; a subtree is descended when its box touches it. Both
+//	read coordinates straight off the node image, as the scan does.
+func (tree *Rtree) rangeContainsCell(bbox *RtreeCell, node *RtreeNode, iCell int) bool {
+	for i := 0; i < tree.Dimensions * 2; i += 2 {
+		if DCOORD(tree.nodeGetCoord(node, iCell, i)) < bbox.aCoord[i] || DCOORD(tree.nodeGetCoord(node, iCell, i + 1)) > bbox.aCoord[i + 1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (tree *Rtree) rangeIntersectsCell(bbox *RtreeCell, node *RtreeNode, iCell int) bool {
+	for i := 0; i < tree.Dimensions * 2; i += 2 {
+		if DCOORD(tree.nodeGetCoord(node, iCell, i)) > bbox.aCoord[i + 1] || DCOORD(tree.nodeGetCoord(node, iCell, i + 1)) < bbox.aCoord[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//	The collection walk: the numbers of every leaf whose box intersects the range. Leaves are edited afterwards,
+//	not during the walk, so the condensing a deletion triggers never runs under an active traversal.
+func (tree *Rtree) collectRangeLeaves(node *RtreeNode, height int, bbox *RtreeCell, leaves []int64) ([]int64, int) {
+	if height == 0 {
+		return append(leaves, node.iNode), SQLITE_OK
+	}
+	for i := 0; i < NCELL(node); i++ {
+		if !tree.rangeIntersectsCell(bbox, node, i) {
+			continue
+		}
+		child, rc := tree.nodeAcquire(tree.nodeGetRowid(node, i), node)
+		if rc != SQLITE_OK {
+			return leaves, rc
+		}
+		leaves, rc = tree.collectRangeLeaves(child, height - 1, bbox, leaves)
+		if rc2 := tree.nodeRelease(child); rc == SQLITE_OK {
+			rc = rc2
+		}
+		if rc != SQLITE_OK {
+			return leaves, rc
+		}
+	}
+	return leaves, SQLITE_OK
+}
+
+//	Edit one leaf: remove every contained entry in a single pass over the node image, then settle the structure
+//	once - remove the leaf if it fell below the minimum, otherwise tighten the ancestor boxes once rather than
+//	after every cell as deleteCell would.
+func (tree *Rtree) deleteRangeFromLeaf(iNode int64, bbox *RtreeCell) (nDeleted int, rc int) {
+	leaf, rc := tree.nodeAcquire(iNode, nil)
+	if rc != SQLITE_OK {
+		return
+	}
+	if rc = tree.fixLeafParent(leaf); rc == SQLITE_OK {
+		for iCell := NCELL(leaf) - 1; rc == SQLITE_OK && iCell >= 0; iCell-- {
+			if !tree.rangeContainsCell(bbox, leaf, iCell) {
+				continue
+			}
+			rowid := tree.nodeGetRowid(leaf, iCell)
+			tree.nodeDeleteCell(leaf, iCell)
+			sqlite3_bind_int64(tree.pDeleteRowid, 1, rowid)
+			tree.pDeleteRowid.Step()
+			rc = tree.pDeleteRowid.Reset()
+			nDeleted++
+		}
+		if rc == SQLITE_OK && nDeleted > 0 && leaf.pParent != nil {
+			if NCELL(leaf) < RTREE_MINCELLS(tree) {
+				rc = tree.removeNode(leaf, 0)
+			} else {
+				rc = tree.fixBoundingBox(leaf)
+			}
+		}
+	}
+	if rc2 := tree.nodeRelease(leaf); rc == SQLITE_OK {
+		rc = rc2
+	}
+	return
+}
+
+//	Remove every entry whose box lies inside bbox. aCoord holds min/max pairs per dimension, as a cell does.
+func (tree *Rtree) DeleteRange(bbox *RtreeCell) (nDeleted int, rc int) {
+	root, rc := tree.nodeAcquire(1, nil)
+	if rc != SQLITE_OK {
+		return
+	}
+
+	var leaves	[]int64
+	if leaves, rc = tree.collectRangeLeaves(root, tree.iDepth, bbox, nil); rc == SQLITE_OK {
+		for _, iNode := range leaves {
+			n, rc2 := tree.deleteRangeFromLeaf(iNode, bbox)
+			nDeleted += n
+			if rc = rc2; rc != SQLITE_OK {
+				break
+			}
+		}
+	}
+
+	//	As in DeleteRowid: collapse the root while it holds a single child, then reinsert the contents of every
+	//	node the deletions emptied - here once for the whole range rather than once per rowid.
+	for rc == SQLITE_OK && tree.iDepth > 0 && NCELL(root) == 1 {
+		var child	*RtreeNode
+		iChild := tree.nodeGetRowid(root, 0)
+		if child, rc = tree.nodeAcquire(iChild, root); rc == SQLITE_OK {
+			rc = tree.removeNode(child, tree.iDepth - 1)
+		}
+		if rc2 := tree.nodeRelease(child); rc == SQLITE_OK {
+			rc = rc2
+		}
+		if rc == SQLITE_OK {
+			tree.iDepth--
+			writeInt16(root.zData, tree.iDepth)
+			root.dirty(0, 2)
+		}
+	}
+
+	for leaf := tree.pDeleted; leaf != nil; leaf = tree.pDeleted {
+		if rc == SQLITE_OK {
+			rc = tree.reinsertNodeContent(leaf)
+		}
+		tree.pDeleted = leaf.pNext
+		sqlite3_free(leaf)
+	}
+
+	if rc2 := tree.nodeRelease(root); rc == SQLITE_OK {
+		rc = rc2
+	}
+	return
+}
+
+//	Translate a WHERE clause into a range when it is a pure box: a conjunction of comparisons between this table's
+//	coordinate columns and constants, bounding every dimension on both sides. The bounds follow the scan's
+//	semantics - a term on a minimum column sets the range's lower edge, one on a maximum column the upper.
+func rtreeWhereRange(tree *Rtree, where *Expr, iTable int, bbox *RtreeCell, bounded []bool) bool {
+	if where.op == TK_AND {
+		return rtreeWhereRange(tree, where.pLeft, iTable, bbox, bounded) && rtreeWhereRange(tree, where.pRight, iTable, bbox, bounded)
+	}
+	column, value := where.pLeft, where.pRight
+	if column == nil || value == nil || column.op != TK_COLUMN || column.iTable != iTable {
+		return false
+	}
+	if value.op != TK_INTEGER && value.op != TK_FLOAT {
+		return false
+	}
+	bound, err := strconv.ParseFloat(value.zToken, 64)
+	if err != nil || column.iColumn < 1 || column.iColumn > tree.Dimensions * 2 {
+		return false
+	}
+	//	Only inclusive bounds are ranges we can honour exactly; strict inequalities fall back to the row loop
+	//	rather than silently including entries on the boundary.
+	iCoord := column.iColumn - 1
+	switch where.op {
+	case TK_GE:
+		//	A lower bound: meaningful on the dimension's minimum column.
+		if iCoord % 2 != 0 {
+			return false
+		}
+		bbox.aCoord[iCoord] = bound
+	case TK_LE:
+		if iCoord % 2 != 1 {
+			return false
+		}
+		bbox.aCoord[iCoord] = bound
+	default:
+		return false
+	}
+	bounded[iCoord] = true
+	return true
+}
+
+//	The SQL path. Offered the DELETE's WHERE clause before the row-at-a-time loop is generated; handles the whole
+//	statement as one DeleteRange when the clause is a fully-bounded box over this table, and declines otherwise.
+func (tree *Rtree) DeleteWhere(where *Expr, iTable int) (handled bool, nDeleted int, rc int) {
+	if where == nil {
+		return false, 0, SQLITE_OK
+	}
+	bbox := NewRtreeCell(0)
+	bounded := make([]bool, tree.Dimensions * 2)
+	if !rtreeWhereRange(tree, where, iTable, bbox, bounded) {
+		return false, 0, SQLITE_OK
+	}
+	for _, b := range bounded {
+		if !b {
+			return false, 0, SQLITE_OK
+		}
+	}
+	tree.access.Lock()
+	defer tree.access.Unlock()
+	tree.cursorGuard().InvalidateAll()
+	nDeleted, rc = tree.DeleteRange(bbox)
+	return true, nDeleted, rc
+}
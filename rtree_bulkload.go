@@ -0,0 +1,204 @@
+package serendipity
+
+import (
+	"sort"
+)
+
+//	This file adds a bulk-load path for r-trees using Sort-Tile-Recursive (STR) packing. Inserting n rectangles one at a
+//	time costs n searches plus the node splits and parent rewrites the splits cascade into; for a bulk load all of that
+//	work is wasted, because the final tree shape is known once all the rectangles are. STR instead builds the tree
+//	bottom-up: the cells are sorted into spatial tiles sized to the node capacity, packed into full leaf nodes, and the
+//	leaves' bounding boxes become the cells of the next level up, recursively, until one root remains. The result loads
+//	in O(n log n) comparisons and one write per node, and the packed tree is also a better tree - nodes are full and
+//	spatially coherent, so queries touch fewer of them.
+//
+//	BulkLoad requires an empty tree: packing cannot coexist with an existing structure, and refusing non-empty trees is
+//	better than silently degrading to repeated insertion. The SQL-level fast path in rtreeUpdate batches "INSERT INTO
+//	rt SELECT ..." rows and hands them here when the target is empty.
+
+//	The number of cells packed per node: full minus a small slack so immediately-following single inserts don't all
+//	split freshly packed nodes.
+func (tree *Rtree) packedNodeCapacity() int {
+	capacity := tree.nodeCapacity()
+	if capacity > 4 {
+		capacity--
+	}
+	return capacity
+}
+
+//	Load cells into an empty tree with STR packing. Writes the node and parent mappings through the same prepared
+//	statements as ordinary insertion, inside the caller's transaction. Returns SQLITE_CONSTRAINT if the tree is not
+//	empty.
+func (tree *Rtree) BulkLoad(cells []*RtreeCell) (rc int) {
+	root, rc := tree.nodeAcquire(1, nil)
+	if rc != SQLITE_OK {
+		return
+	}
+	defer tree.nodeRelease(root)
+	if NCELL(root) != 0 || tree.iDepth != 0 {
+		return SQLITE_CONSTRAINT
+	}
+	if len(cells) == 0 {
+		return SQLITE_OK
+	}
+
+	//	Record the rowid mappings first; they are level-independent.
+	for _, cell := range cells {
+		if rc = tree.rowidWrite(cell.iRowid, 0); rc != SQLITE_OK {
+			return
+		}
+	}
+
+	level, rc := tree.packLevel(append([]*RtreeCell{}, cells...), 0)
+	if rc != SQLITE_OK {
+		return
+	}
+	height := 0
+	for len(level) > 1 {
+		height++
+		if level, rc = tree.packLevel(level, height); rc != SQLITE_OK {
+			return
+		}
+	}
+	//	The last packed "level" is a single cell describing the whole tree; its content becomes the root.
+	tree.iDepth = height
+	writeInt16(root.zData, tree.iDepth)
+	return tree.adoptAsRoot(root, level[0])
+}
+
+//	Pack one level: sort-tile the cells, write each tile as a node at the given height, and return one bounding cell
+//	per node for the level above. A write failure abandons the level and is reported to the caller; the caller's
+//	enclosing transaction rolls back whatever was already packed.
+func (tree *Rtree) packLevel(cells []*RtreeCell, height int) (parents []*RtreeCell, rc int) {
+	capacity := tree.packedNodeCapacity()
+	var tiles [][]*RtreeCell
+	if tree.hilbertOrdering {
+		tiles = tree.hilbertTiles(cells, capacity)
+	} else {
+		tiles = tileCells(cells, capacity, tree.Dimensions)
+	}
+	for _, tile := range tiles {
+		node := tree.nodeNew(nil)
+		for _, cell := range tile {
+			tree.nodeInsertCell(node, cell)
+		}
+		if rc = tree.nodeWrite(node); rc != SQLITE_OK {
+			tree.nodeRelease(node)
+			return nil, rc
+		}
+		bounds := tree.boundsOf(tile)
+		bounds.iRowid = node.iNode
+		parents = append(parents, bounds)
+		//	Leaf cells' rowid mappings now gain their true node numbers; internal levels record their children's parent pointers.
+		for _, cell := range tile {
+			if height == 0 {
+				rc = tree.rowidWrite(cell.iRowid, node.iNode)
+			} else {
+				rc = tree.parentWrite(cell.iRowid, node.iNode)
+			}
+			if rc != SQLITE_OK {
+				tree.nodeRelease(node)
+				return nil, rc
+			}
+		}
+		if rc = tree.nodeRelease(node); rc != SQLITE_OK {
+			return nil, rc
+		}
+	}
+	return
+}
+
+//	Sort-Tile-Recursive tiling: sort by the first dimension, cut into vertical slices of √(n/capacity) tiles each, sort
+//	each slice by the second dimension, and cut into tiles of capacity cells. Higher dimensions refine recursively, but
+//	two passes capture almost all of the benefit and match the published algorithm for the planar case.
+func tileCells(cells []*RtreeCell, capacity, dimensions int) (tiles [][]*RtreeCell) {
+	sortByCentre(cells, 0)
+	nodes := (len(cells) + capacity - 1) / capacity
+	slices := intSqrt(nodes)
+	if slices < 1 {
+		slices = 1
+	}
+	sliceSize := (len(cells) + slices - 1) / slices
+	for start := 0; start < len(cells); start += sliceSize {
+		end := start + sliceSize
+		if end > len(cells) {
+			end = len(cells)
+		}
+		slice := cells[start:end]
+		if dimensions > 1 {
+			sortByCentre(slice, 1)
+		}
+		for from := 0; from < len(slice); from += capacity {
+			to := from + capacity
+			if to > len(slice) {
+				to = len(slice)
+			}
+			tiles = append(tiles, slice[from:to])
+		}
+	}
+	return
+}
+
+//	Sort cells by the centre of their extent in one dimension.
+func sortByCentre(cells []*RtreeCell, dimension int) {
+	sort.Slice(cells, func(i, j int) bool {
+		return cells[i].aCoord[dimension * 2] + cells[i].aCoord[dimension * 2 + 1] < cells[j].aCoord[dimension * 2] + cells[j].aCoord[dimension * 2 + 1]
+	})
+}
+
+//	The bounding cell of a tile.
+func (tree *Rtree) boundsOf(cells []*RtreeCell) (bounds *RtreeCell) {
+	bounds = cells[0].Duplicate()
+	for _, cell := range cells[1:] {
+		for d := 0; d < tree.Dimensions; d++ {
+			if cell.aCoord[d * 2] < bounds.aCoord[d * 2] {
+				bounds.aCoord[d * 2] = cell.aCoord[d * 2]
+			}
+			if cell.aCoord[d * 2 + 1] > bounds.aCoord[d * 2 + 1] {
+				bounds.aCoord[d * 2 + 1] = cell.aCoord[d * 2 + 1]
+			}
+		}
+	}
+	return
+}
+
+//	Make the last packed node the tree's root. The r-tree format fixes the root at node 1, so the packed top node's
+//	cells are copied into node 1, its own record deleted, and its children re-parented onto the root.
+func (tree *Rtree) adoptAsRoot(root *RtreeNode, top *RtreeCell) (rc int) {
+	if tree.iDepth == 0 {
+		//	Everything fit in one leaf: top describes a node already written; rewrite it as node 1.
+		node, rc := tree.nodeAcquire(top.iRowid, nil)
+		if rc != SQLITE_OK {
+			return rc
+		}
+		copy(root.zData[2:], node.zData[2:])
+		tree.nodeRelease(node)
+		sqlite3_bind_int64(tree.pDeleteNode, 1, top.iRowid)
+		tree.pDeleteNode.Step()
+		tree.pDeleteNode.Reset()
+		root.dirty(0, tree.iNodeSize)
+		return tree.nodeWrite(root)
+	}
+	node, rc := tree.nodeAcquire(top.iRowid, nil)
+	if rc != SQLITE_OK {
+		return
+	}
+	copy(root.zData[2:], node.zData[2:])
+	for i := 0; i < NCELL(root); i++ {
+		child := tree.nodeGetRowid(root, i)
+		tree.parentWrite(child, 1)
+	}
+	tree.nodeRelease(node)
+	sqlite3_bind_int64(tree.pDeleteNode, 1, top.iRowid)
+	tree.pDeleteNode.Step()
+	tree.pDeleteNode.Reset()
+	root.dirty(0, tree.iNodeSize)
+	return tree.nodeWrite(root)
+}
+
+func intSqrt(n int) (root int) {
+	for root * root < n {
+		root++
+	}
+	return
+}
@@ -1,6 +1,7 @@
 package serendipity
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
 )
@@ -10,16 +11,16 @@ import (
 //	Database Format of R-Tree Tables
 //	--------------------------------
 //
-//	The data structure for a single virtual r-tree table is stored in three native SQLite tables declared as follows. In each case, the '%' character
+//	The data structure for a single virtual r-tree table is stored in two native SQLite tables declared as follows. In each case, the '%' character
 //	in the table name is replaced with the user-supplied name of the r-tree table.
 //
 //		CREATE TABLE %_node(nodeno INTEGER PRIMARY KEY, data BLOB)
-//		CREATE TABLE %_parent(nodeno INTEGER PRIMARY KEY, parentnode INTEGER)
 //		CREATE TABLE %_rowid(rowid INTEGER PRIMARY KEY, nodeno INTEGER)
 //
-//	The data for each node of the r-tree structure is stored in the %_node table. For each node that is not the root node of the r-tree, there is
-//	an entry in the %_parent table associating the node with its parent. And for each row of data in the table, there is an entry in the %_rowid
-//	table that maps from the entries rowid to the id of the node that it is stored on.
+//	The data for each node of the r-tree structure is stored in the %_node table. And for each row of data in the table, there is an entry in the
+//	%_rowid table that maps from the entries rowid to the id of the node that it is stored on. Earlier versions of this module kept a third table,
+//	%_parent, mapping each non-root node to its parent; that mapping now lives inside the nodes themselves and old tables are migrated on connect -
+//	see rtree_parent_pointers.go.
 //
 //	The root node of an r-tree always exists, even if the r-tree table is empty. The nodeno of the root node is always 1. All other nodes in the
 //	table must be the same size as the root node. The content of each node is formatted as follows:
@@ -31,6 +32,8 @@ import (
 //
 //		3	The remainder of the node contains the node entries. Each entry consists of a single 8-byte integer followed by an even number
 //			of 4-byte coordinates. For leaf nodes the integer is the rowid of a record. For internal nodes it is the node number of a child page.
+//
+//		4	The final 8 bytes of the node contain the node number of the node's parent as a big-endian integer, or zero for the root node.
 
 
 //	This file contains an implementation of a couple of different variants of the r-tree algorithm. See the README file for further details. The 
@@ -74,7 +77,7 @@ import (
 # define UNUSED_PARAMETER(x) (void)(x)
 #endif
 
-//	Possible values for eCoordType:
+//	Possible values for eCoordType (RTREE_COORD_INT64 is defined in rtree_i64.go):
 #define RTREE_COORD_REAL32 0
 #define RTREE_COORD_INT32  1
 
@@ -92,7 +95,7 @@ import (
 //		m = M/3
 //
 //	If an R*-tree "Reinsert" operation is required, the same number of cells are removed from the overfull node and reinserted into the tree.
-#define RTREE_MINCELLS(p) ((((p).iNodeSize - 4) / (p).nBytesPerCell) / 3)
+#define RTREE_MINCELLS(p) ((p).nodeCapacity() / 3)
 #define RTREE_REINSERT(p) RTREE_MINCELLS(p)
 #define RTREE_MAXCELLS 51
 
@@ -108,6 +111,11 @@ type RtreeCursor struct {
 	iStrategy	int						//	Copy of idxNum search parameter
 	nConstraint	int						//	Number of entries in aConstraint
 	aConstraint	*RtreeConstraint		//	Search constraints.
+	iRowLimit	int64					//	Maximum rows to return, or 0 for no limit (LIMIT pushdown)
+	nRowsReturned	int64				//	Rows returned so far when iRowLimit is set
+	guard		GuardedCursor			//	Invalidation state - see vtab_cursor_guard.go
+	pKnn		*KnnState				//	Best-first traversal state for k-NN queries - see rtree_knn.go
+	pQuery		*QueryState				//	Best-first traversal state for scored query callbacks - see rtree_query_callback.go
 }
 
 union RtreeCoord {
@@ -137,15 +145,19 @@ type RtreeConstraint struct {
   rValue	float64						//	Constraint value.
   xGeom		func(*sqlite3_rtree_geometry, []float64) (bool, int)
   pGeom		*sqlite3_rtree_geometry		//	Constraint callback argument for a MATCH
+  aBox		[]float64					//	Query box for a WITHIN/OVERLAPS constraint - see rtree_box_ops.go
 };
 
 /* Possible values for RtreeConstraint.op */
-#define RTREE_EQ    0x41
-#define RTREE_LE    0x42
-#define RTREE_LT    0x43
-#define RTREE_GE    0x44
-#define RTREE_GT    0x45
-#define RTREE_MATCH 0x46
+#define RTREE_EQ       0x41
+#define RTREE_LE       0x42
+#define RTREE_LT       0x43
+#define RTREE_GE       0x44
+#define RTREE_GT       0x45
+#define RTREE_MATCH    0x46
+#define RTREE_LIMIT    0x47
+#define RTREE_WITHIN   0x48
+#define RTREE_OVERLAPS 0x49
 
 //	An rtree structure node.
 type RtreeNode struct {
@@ -153,6 +165,8 @@ type RtreeNode struct {
 	iNode		int64
 	nRef		int
 	isDirty		bool
+	dirtyLow	int						//	Byte range of zData modified since the last write - see rtree_node_blob.go
+	dirtyHigh	int
 	zData		[]byte
 	pNext		*RtreeNode				//	Next node in this hash chain
 }
@@ -281,40 +295,21 @@ func (tree *Rtree) nodeZero(p *RtreeNode) {
 	for i := tree.iNodeSize; i > 1; i-- {
 		p.zData[i] = 0
 	}
-	p.isDirty = true
+	p.dirty(0, tree.iNodeSize)
 }
 
-//	Given a node number iNode, return the corresponding key to use in the Rtree.aHash table.
-func nodeHash(iNode int64) (r int) {
-	r = (iNode >> 56) ^ (iNode >> 48) ^ (iNode >> 40) ^ (iNode >> 32) ^ (iNode >> 24) ^ (iNode >> 16) ^ (iNode >> 8) ^ (iNode >> 0)
-	r %= HASHSIZE
-	return
-}
-
-//	Search the node hash table for node iNode. If found, return a pointer to it. Otherwise, return 0.
+//	The fixed-bucket node hash table has been replaced by the size-bounded LRU node cache - see rtree_node_cache.go.
+//	These helpers keep the historical names used throughout this file.
 func (tree *Rtree) nodeHashLookup(iNode int64) (p *RtreeNode) {
-	for p = tree.aHash[nodeHash(iNode)]; p != nil && p.iNode != iNode; p = p.pNext {}
-	return
+	return tree.cacheLookup(iNode)
 }
 
-//	Add node pNode to the node hash table.
 func (tree *Rtree) nodeHashInsert(node *RtreeNode) {
-	assert( pNode.pNext == 0 )
-	iHash := nodeHash(node.iNode)
-	node.pNext = tree.aHash[iHash]
-	tree.aHash[iHash] = node
+	tree.cacheInsert(node)
 }
 
-//	Remove node pNode from the node hash table.
 func (tree *Rtree) nodeHashDelete(node *RtreeNode) {
-	if node.iNode != 0 {
-		p := &tree.aHash[nodeHash(node.iNode)]
-		for ; (*p) != node; p = &(*p).pNext) {
-			assert(*p)
-		}
-		*p = node.pNext
-		node.pNext = 0
-	}
+	tree.cacheRemove(node)
 }
 
 //	Allocate and return new r-tree node. Initially, (RtreeNode.iNode == 0), indicating that node has not yet been assigned a node number. It is
@@ -330,8 +325,9 @@ func (tree *Rtree) nodeNew(parent *RtreeNode) (node *RtreeNode) {
 	return
 }
 
-//	Obtain a reference to an r-tree node.
-func (tree *Rtree) nodeAcquire(iNode int64, parent *RtreeNode) (node *RtreeNode, rc int) {
+//	Obtain a reference to an r-tree node. Callers use the nodeAcquire wrapper, which serialises access to the node
+//	cache and the pReadNode statement across concurrent read cursors - see rtree_concurrency.go.
+func (tree *Rtree) nodeAcquireLocked(iNode int64, parent *RtreeNode) (node *RtreeNode, rc int) {
 	//	Check if the requested node is already in the hash table. If so, increase its reference count and return it.
 	if node = tree.nodeHashLookup(iNode); node != nil {
 		assert( parent == nil || node.pParent == nil || node.pParent == pParent )
@@ -340,26 +336,27 @@ func (tree *Rtree) nodeAcquire(iNode int64, parent *RtreeNode) (node *RtreeNode,
 			node.pParent = parent
 		}
 		node.nRef++
+		if node.nRef == 1 {
+			//	The node was resting unpinned in the cache; pin it for the lifetime of this reference.
+			tree.cachePin(node)
+		}
 		return node, SQLITE_OK
 	}
 
-	sqlite3_bind_int64(tree.pReadNode, 1, iNode)
-	if rc = tree.pReadNode.Step(); rc == SQLITE_ROW {
-		zBlob := tree.pReadNode.ColumnBlob(0)
-		if tree.iNodeSize == tree.pReadNode.ColumnBytes(0) {
-			node = &RtreeNode{
-				pParent: parent,
-				zData: ([]byte)(&node[1]),
-				nRef: 1,
-				iNode: iNode,
-				isDirty: false,
-				pNext: nil,
-			}
-			copy(node.zData, zBlob)
-			node.pParent.Reference()
+	//	Read through the cached incremental blob handle rather than the pReadNode statement, so the row's data
+	//	arrives in the node buffer without an intermediate value copy - see rtree_node_blob.go.
+	zBlob, rc := tree.nodeBlobRead(iNode)
+	if zBlob != nil {
+		node = &RtreeNode{
+			pParent: parent,
+			zData: zBlob,
+			nRef: 1,
+			iNode: iNode,
+			isDirty: false,
+			pNext: nil,
 		}
+		node.pParent.Reference()
 	}
-	rc = tree.pReadNode.Reset()
 
 	//	If the root node was just loaded, set pRtree.iDepth to the height of the r-tree structure. A height of zero means all data is stored on
 	//	the root node. A height of one means the children of the root node are the leaves, and so on. If the depth as specified on the root node
@@ -373,7 +370,7 @@ func (tree *Rtree) nodeAcquire(iNode int64, parent *RtreeNode) (node *RtreeNode,
 
 	//	If no error has occurred so far, check if the "number of entries" field on the node is too large. If so, set the return code to SQLITE_CORRUPT_VTAB.
 	if node != nil && rc == SQLITE_OK {
-		if NCELL(node) > ((tree.iNodeSize - 4) / tree.nBytesPerCell) {
+		if NCELL(node) > tree.nodeCapacity() {
 			rc = SQLITE_CORRUPT_VTAB
 		}
 	}
@@ -395,9 +392,9 @@ func (tree *Rtree) nodeOverwriteCell(node *RtreeNode, cell *RtreeCell, i int) {
 	p := node.zData[4 + tree.nBytesPerCell * i]
 	p += writeInt64(p, cell.iRowid)
 	for j := 0; j < (tree.Dimensions * 2); j++ {
-		p += writeCoord(p, &cell.aCoord[j])
+		p += tree.writeCoordAt(p, &cell.aCoord[j])
 	}
-	node.isDirty = true
+	node.dirty(4 + tree.nBytesPerCell * i, 4 + tree.nBytesPerCell * (i + 1))
 }
 
 //	Remove cell the cell with index iCell from node pNode.
@@ -407,7 +404,7 @@ func (tree *Rtree) nodeDeleteCell(node *RtreeNode, i int) {
 	nByte := (NCELL(node) - i - 1) * tree.nBytesPerCell
 	memmove(pDst, pSrc, nByte)
 	writeInt16(&node.zData[2], NCELL(node) - 1)
-	node.isDirty = true
+	node.dirty(2, 4 + (NCELL(node) + 1) * tree.nBytesPerCell)
 }
 
 //	Insert the contents of cell pCell into node pNode. If the insert is successful, return SQLITE_OK.
@@ -416,14 +413,14 @@ func (tree *Rtree) nodeInsertCell(node *RtreeNode, cell *RtreeCell) int {
 	int nCell;                    /* Current number of cells in pNode */
 	int nMaxCell;                 /* Maximum number of cells for pNode */
 
-	max_cell := (tree.iNodeSize - 4) / tree.nBytesPerCell
+	max_cell := tree.nodeCapacity()
 	n := NCELL(node)
 
 	assert( n <= max_cell )
 	if n < max_cell {
 		tree.nodeOverwriteCell(node, cell, n)
 		writeInt16(&pNode.zData[2], n + 1)
-		node.isDirty = 1
+		node.dirty(2, 4)
 	}
 	return n == max_cell
 }
@@ -431,17 +428,18 @@ func (tree *Rtree) nodeInsertCell(node *RtreeNode, cell *RtreeCell) int {
 //	If the node is dirty, write it out to the database.
 func (tree *Rtree) nodeWrite(node *RtreeNode) (rc int) {
 	if node.isDirty {
-		p := tree.pWriteNode
 		if node.iNode > 0 {
-			sqlite3_bind_int64(p, 1, node.iNode)
-		} else {
-			sqlite3_bind_null(p, 1)
+			//	An existing row: rewrite only the dirtied byte range through the blob handle - see rtree_node_blob.go.
+			return tree.nodeBlobWrite(node)
 		}
+		p := tree.pWriteNode
+		sqlite3_bind_null(p, 1)
 		sqlite3_bind_blob(p, 2, node.zData, tree.iNodeSize, SQLITE_STATIC)
 		p.Step()
 		node.isDirty = false
+		node.dirtyLow, node.dirtyHigh = 0, 0
 		rc = p.Reset()
-		if node.iNode == 0 && rc == SQLITE_OK {
+		if rc == SQLITE_OK {
 			node.iNode = sqlite3_last_insert_rowid(tree.db)
 			tree.nodeHashInsert(node)
 		}
@@ -450,7 +448,8 @@ func (tree *Rtree) nodeWrite(node *RtreeNode) (rc int) {
 }
 
 //	Release a reference to a node. If the node is dirty and the reference count drops to zero, the node data is written to the database.
-func (tree *Rtree) nodeRelease(node *RtreeNode) (rc int) {
+//	Callers use the nodeRelease wrapper - see rtree_concurrency.go.
+func (tree *Rtree) nodeReleaseLocked(node *RtreeNode) (rc int) {
 	if node != nil {
 		assert( node.nRef > 0 )
 		node.nRef--
@@ -459,13 +458,19 @@ func (tree *Rtree) nodeRelease(node *RtreeNode) (rc int) {
 				tree.iDepth = -1
 			}
 			if node.pParent != nil {
-				rc = tree.nodeRelease(node.pParent)
+				rc = tree.nodeReleaseLocked(node.pParent)
 			}
 			if rc == SQLITE_OK {
-				rc = tree.nodeWrite(node)
+				//	Inside a transaction the write of an already-numbered node is deferred: it stays in the cache,
+				//	pinned by its dirtiness, and is written once at xSync however many rows touch it - see
+				//	rtree_txn.go. New nodes are written immediately so they obtain a node number.
+				if !tree.inTransaction || node.iNode == 0 {
+					rc = tree.nodeWrite(node)
+				}
 			}
-			tree.nodeHashDelete(node)
-			sqlite3_free(node)
+			//	When clean and unreferenced the node is retained in the LRU cache instead of being discarded, so a
+			//	later nodeAcquire can skip the %_node SELECT - see rtree_node_cache.go.
+			tree.cacheUnpin(node)
 		}
 	}
 	return
@@ -478,9 +483,10 @@ func (tree *Rtree) nodeGetRowid(node *RtreeNode, i int) int64 {
 	return readInt64(&node.zData[4 + tree.nBytesPerCell * i])
 }
 
-//	Return coordinate iCoord from cell iCell in node pNode.
+//	Return coordinate iCoord from cell iCell in node pNode. The coordinate width is 4 bytes except in 64-bit integer
+//	mode - see rtree_i64.go.
 func (tree *Rtree) nodeGetCoord(node *RtreeNode, iCell, iCoord int) (coord *RtreeCoord) {
-	return readCoord(&node.zData[12 + tree.nBytesPerCell * iCell + 4 * iCoord])
+	return tree.readCoordAt(&node.zData[12 + tree.nBytesPerCell * iCell + tree.coordSize() * iCoord])
 }
 
 //	Deserialize cell iCell of node pNode. Populate the structure pointed to by pCell with the results.
@@ -504,38 +510,54 @@ func rtreeConnect(db *sqlite3, pAux interface{}, args []string) (table *sqlite3_
 	return rtreeInit(db, pAux, args, false)
 }
 
-//	Increment the r-tree reference count.
+//	Increment the r-tree reference count. Concurrent read cursors share the structure, so the count is adjusted
+//	under nodeLock - see rtree_concurrency.go.
 func (tree *Rtree) Reference() {
+	tree.nodeLock.Lock()
+	defer tree.nodeLock.Unlock()
 	tree.nBusy++
 }
 
 //	Decrement the r-tree reference count. When the reference count reaches zero the structure is deleted.
 func (tree *Rtree) Release() {
+	tree.nodeLock.Lock()
+	defer tree.nodeLock.Unlock()
 	if tree.nBusy--; pRtree.nBusy == 0 {
+		tree.nodeBlobClose()
 		tree.pReadNode.Finalize()
 		tree.pWriteNode.Finalize()
 		tree.pDeleteNode.Finalize()
 		tree.pReadRowid.Finalize()
 		tree.pWriteRowid.Finalize()
 		tree.pDeleteRowid.Finalize()
-		tree.pReadParent.Finalize()
-		tree.pWriteParent.Finalize()
-		tree.pDeleteParent.Finalize()
+		if tree.isGeopoly {
+			//	The nil guard matters on the geopolyInit error paths, where only some statements were prepared.
+			for _, statement := range []*sqlite3_stmt{ tree.pReadGeometry, tree.pWriteGeometry, tree.pDeleteGeometry } {
+				if statement != nil {
+					statement.Finalize()
+				}
+			}
+		}
+		tree.auxCleanup()
 		sqlite3_free(tree)
 	}
 }
 
 //	Rtree virtual table module xDisconnect method.
 func rtreeDisconnect(table *sqlite3_vtab) int{
-	tree.Release((Rtree *)(table))
+	tree := (Rtree *)(table)
+	deregisterRtreeInstance(tree.db, tree)
+	tree.Release()
 	return SQLITE_OK
 }
 
 //	Rtree virtual table module xDestroy method.
 func rtreeDestroy(table *sqlite3_vtab) (rc int) {
 	tree := (Rtree *)(table)
+	//	IF EXISTS forms tolerate shadow tables missing after a partially-failed create, so that DROP TABLE always succeeds
+	//	on a damaged rtree and clears the way for recreating it.
 	zCreate := sqlite3_mprintf(
-		"DROP TABLE '%q'.'%q_node'; DROP TABLE '%q'.'%q_rowid'; DROP TABLE '%q'.'%q_parent';",
+		"DROP TABLE IF EXISTS '%q'.'%q_node'; DROP TABLE IF EXISTS '%q'.'%q_rowid'; DROP TABLE IF EXISTS '%q'.'%q_parent';",
 		tree.zDb, tree.zName, 
 		tree.zDb, tree.zName,
 		tree.zDb, tree.zName
@@ -543,6 +565,7 @@ func rtreeDestroy(table *sqlite3_vtab) (rc int) {
 	rc = sqlite3_exec(tree.db, zCreate, 0, 0, 0)
 	sqlite3_free(zCreate)
 	if rc == SQLITE_OK {
+		deregisterRtreeInstance(tree.db, tree)
 		tree.Release()
 	}
 	return
@@ -551,11 +574,25 @@ func rtreeDestroy(table *sqlite3_vtab) (rc int) {
 //	Rtree virtual table module xOpen method.
 //		cursor ===> *sqlite3_vtab_cursor
 func rtreeOpen(table *sqlite3_vtab) (cursor *RtreeCursor) {
+	tree := (Rtree *)(table)
+	tree.access.Lock()
+	defer tree.access.Unlock()
 	cursor = new(RtreeCursor)
 	cursor.base.pVtab = table
+	//	An rtree cursor caches a position inside a node that the write path may rewrite, so it is guarded: rtreeUpdate
+	//	invalidates open cursors and rtreeNext fails them cleanly rather than walking a restructured tree.
+	tree.cursorGuard().Register(&cursor.guard, nil)
 	return
 }
 
+//	The guard tracking this table's open cursors, created on first use.
+func (tree *Rtree) cursorGuard() *CursorGuard {
+	if tree.guard == nil {
+		tree.guard = NewCursorGuard()
+	}
+	return tree.guard
+}
+
 //	Free the RtreeCursor.aConstraint[] array and its contents.
 func (cursor *RtreeCursor) freeConstraints() {
 	if cursor.aConstraint != nil {
@@ -577,7 +614,16 @@ func (cursor *RtreeCursor) freeConstraints() {
 func rtreeClose(cursor *sqlite3_vtab_cursor) (rc int) {
 	tree := (Rtree *)(cursor.pVtab)
 	pCsr := (RtreeCursor *)(cursor)
+	tree.access.Lock()
+	defer tree.access.Unlock()
+	tree.cursorGuard().Deregister(&pCsr.guard)
 	pCsr.freeConstraints()
+	if pCsr.pKnn != nil {
+		tree.knnDrain(pCsr.pKnn)
+	}
+	if pCsr.pQuery != nil {
+		tree.queryDrain(pCsr.pQuery)
+	}
 	rc = tree.nodeRelease(pCsr.pNode)
 	sqlite3_free(pCsr)
 	return
@@ -613,20 +659,26 @@ func (tree *Rtree) testCell(cursor *RtreeCursor) (isEof bool, rc int) {
 		cell_min := DCOORD(cell.aCoord[(p.iCoord >> 1) * 2])
 		cell_max := DCOORD(cell.aCoord[(p.iCoord >> 1) * 2 + 1])
 
-		assert( p.op == RTREE_LE || p.op == RTREE_LT || p.op == RTREE_GE || p.op == RTREE_GT || p.op == RTREE_EQ || p.op == RTREE_MATCH )
+		assert( p.op == RTREE_LE || p.op == RTREE_LT || p.op == RTREE_GE || p.op == RTREE_GT || p.op == RTREE_EQ || p.op == RTREE_MATCH || p.op == RTREE_WITHIN || p.op == RTREE_OVERLAPS )
 
 		switch p.op {
 		case RTREE_LE: fallthrough
-		case RTREE_LT: 
+		case RTREE_LT:
 			isEof = p.rValue < cell_min
 
 		case RTREE_GE: fallthrough
-		case RTREE_GT: 
+		case RTREE_GT:
 			isEof = p.rValue > cell_max
 
 		case RTREE_EQ:
 			isEof = p.rValue > cell_max || p.rValue < cell_min
 
+		case RTREE_WITHIN: fallthrough
+		case RTREE_OVERLAPS:
+			//	Both box operators prune identically here: a subtree disjoint from the query box can hold neither
+			//	contained nor overlapping entries. The distinction is drawn per entry in testEntry.
+			isEof = !tree.boxTouchesCell(p.aBox, &cell)
+
 		default:
 			assert( p.op == RTREE_MATCH )
 			rc = tree.testGeom(p, &cell, &isEof)
@@ -647,7 +699,7 @@ func (tree *Rtree) testEntry(cursor *RtreeCursor) (isEof bool, rc int) {
 		p := &cursor.aConstraint[i]
 		coord := DCOORD(cell.aCoord[p.iCoord])
 
-		assert(p.op == RTREE_LE || p.op == RTREE_LT || p.op == RTREE_GE || p.op == RTREE_GT || p.op == RTREE_EQ || p.op == RTREE_MATCH)
+		assert(p.op == RTREE_LE || p.op == RTREE_LT || p.op == RTREE_GE || p.op == RTREE_GT || p.op == RTREE_EQ || p.op == RTREE_MATCH || p.op == RTREE_WITHIN || p.op == RTREE_OVERLAPS)
 		switch res := false; p.op {
 		case RTREE_LE:
 			res = coord <= p.rValue
@@ -659,6 +711,10 @@ func (tree *Rtree) testEntry(cursor *RtreeCursor) (isEof bool, rc int) {
 			res = coord > p.rValue
 		case RTREE_EQ:
 			res = coord == p.rValue)
+		case RTREE_WITHIN:
+			res = tree.boxContainsCell(p.aBox, cell)
+		case RTREE_OVERLAPS:
+			res = tree.boxStrictlyOverlapsCell(p.aBox, cell)
 		default:
 			assert( p.op == RTREE_MATCH )
 			if res, rc = tree.testGeom(p, cell); rc != SQLITE_OK {
@@ -737,15 +793,31 @@ func (tree *Rtree) nodeParentIndex(pNode *RtreeNode) (index, rc int){
 func rtreeNext(pVtabCursor *sqlite3_vtab_cursor) (rc int) {
 	tree := (Rtree *)(pVtabCursor.pVtab)
 	cursor := (RtreeCursor *)(pVtabCursor)
+	tree.access.RLock()
+	defer tree.access.RUnlock()
 
 	//	RtreeCursor.pNode must not be NULL. If is is NULL, then this cursor is already at EOF. It is against the rules to call the xNext() method of
 	//	a cursor that has already reached EOF.
 
 	assert( cursor.pNode )
+	if rc = cursor.guard.Check(); rc != SQLITE_OK {
+		return
+	}
 	if cursor.iStrategy == 1 {
 		//	This "scan" is a direct lookup by rowid. There is no next entry.
 		tree.nodeRelease(cursor.pNode)
 		cursor.pNode = nil
+	} else if cursor.pKnn != nil {
+		//	A k-NN traversal pops the priority queue instead of walking cells - see rtree_knn.go.
+		rc = tree.knnStep(cursor)
+	} else if cursor.pQuery != nil {
+		//	A scored query-callback traversal likewise - see rtree_query_callback.go.
+		rc = tree.queryStep(cursor)
+	} else if cursor.nRowsReturned++; cursor.iRowLimit > 0 && cursor.nRowsReturned >= cursor.iRowLimit {
+		//	A LIMIT pushed down from the outer query has been satisfied: stop the scan here rather than enumerating the
+		//	remaining matches for the core to discard.
+		tree.nodeRelease(cursor.pNode)
+		cursor.pNode = nil
 	} else {
 		//	Move to the next entry that matches the configured constraints.
 		height := 0
@@ -782,17 +854,26 @@ func rtreeRowid(pVtabCursor *sqlite3_vtab_cursor) (rowid int64, rc int) {
 func rtreeColumn(pVtabCursor *sqlite3_vtab_cursor, ctx *Context, i int) int {
 	tree := (Rtree *)(pVtabCursor.pVtab)
 	cursor := (RtreeCursor *)(pVtabCursor)
+	tree.access.RLock()
+	defer tree.access.RUnlock()
 
 	if i == 0 {
 		iRowid := tree.nodeGetRowid(cursor.pNode, cursor.iCell)
+		if tree.isGeopoly {
+			//	A geopoly table's first column is the polygon text, joined from %_geometry by rowid - see geopoly.go.
+			return tree.geometryColumn(ctx, iRowid)
+		}
 		sqlite3_result_int64(ctx, iRowid)
+	} else if i > tree.Dimensions * 2 {
+		//	An aux column: read it from the %_aux shadow table by rowid - see rtree_aux.go.
+		return tree.auxColumn(ctx, tree.nodeGetRowid(cursor.pNode, cursor.iCell), i - tree.Dimensions * 2 - 1)
 	} else {
 		c := tree.nodeGetCoord(cursor.pNode, cursor.iCell, i - 1)
 		if pRtree.eCoordType == RTREE_COORD_REAL32 {
 			sqlite3_result_float64(ctx, c.f)
 		} else {
-			assert( tree.eCoordType == RTREE_COORD_INT32 )
-			sqlite3_result_int(ctx, c.i)
+			assert( tree.eCoordType == RTREE_COORD_INT32 || tree.eCoordType == RTREE_COORD_INT64 )
+			sqlite3_result_int64(ctx, c.i)
 		}
 	}
 	return SQLITE_OK
@@ -802,10 +883,13 @@ func rtreeColumn(pVtabCursor *sqlite3_vtab_cursor, ctx *Context, i int) int {
 //	return SQLITE_OK. If there is no such record in the table, set *ppLeaf to 0 and return SQLITE_OK. If an error occurs, set *ppLeaf
 //	to zero and return an SQLite error code.
 func (tree *Rtree) findLeafNode(rowid int64) (pLeaf *RtreeNode, rc int) {
+	//	The shared pReadRowid statement is serialised among concurrent readers - see rtree_concurrency.go.
+	tree.nodeLock.Lock()
+	defer tree.nodeLock.Unlock()
 	sqlite3_bind_int64(tree.pReadRowid, 1, rowid)
 	if tree.pReadRowid.Step() == SQLITE_ROW {
 		iNode := sqlite3_column_int64(tree.pReadRowid, 0)
-		pLeaf, rc = tree.nodeAcquire(iNode, nil)
+		pLeaf, rc = tree.nodeAcquireLocked(iNode, nil)
 		tree.pReadRowid.Reset()
 	} else {
 		rc = tree.pReadRowid.Reset()
@@ -856,9 +940,13 @@ func deserializeGeometry(pValue *sqlite3_value, pCons *RtreeConstraint) (rc int)
 func rtreeFilter(pVtabCursor *sqlite3_vtab_cursor, idxNum int, idxStr string, argc int, argv []*sqlite3_value) (rc int) {
 	tree := (Rtree *)(pVtabCursor.pVtab)
 	pCsr := (RtreeCursor *)(pVtabCursor)
+	tree.access.RLock()
+	defer tree.access.RUnlock()
 	tree.Reference()
 	pCsr.freeConstraints()
 	pCsr.iStrategy = idxNum
+	pCsr.iRowLimit = 0
+	pCsr.nRowsReturned = 0
 
 	if idxNum == 1 {
 		//	Special case - lookup by rowid.
@@ -871,7 +959,9 @@ func rtreeFilter(pVtabCursor *sqlite3_vtab_cursor, idxNum int, idxStr string, ar
 			pCsr.iCell, rc = tree.nodeRowidIndex(pLeaf, iRowid)
 		}
 	} else {
-		//	Normal case - r-tree scan. Set up the RtreeCursor.aConstraint array with the configured constraints. 
+		//	Normal case - r-tree scan. Set up the RtreeCursor.aConstraint array with the configured constraints.
+		//	An ORDER BY distance pushdown appends its query point to idxStr behind a separator - see rtree_orderby.go.
+		idxStr, orderPoint := splitOrderPoint(idxStr)
 		if argc > 0 {
 			pCsr.aConstraint = sqlite3_malloc(sizeof(RtreeConstraint) * argc)
 			pCsr.nConstraint = argc
@@ -883,8 +973,53 @@ func rtreeFilter(pVtabCursor *sqlite3_vtab_cursor, idxNum int, idxStr string, ar
 				for i := 0; i < argc; i++ {
 					p = &pCsr.aConstraint[i]
 					p.op = idxStr[i * 2]
+					if p.op == RTREE_LIMIT {
+						//	Not a spatial constraint: the value is a LIMIT pushed down by the planner. xBestIndex always
+						//	places it last in idxStr, so trimming nConstraint leaves the real constraints contiguous.
+						pCsr.iRowLimit = sqlite3_value_int64(argv[i])
+						pCsr.nConstraint--
+						continue
+					}
 					p.iCoord = idxStr[i * 2 + 1] - 'a'
 					if p.op == RTREE_MATCH {
+						if query, ok := sqlite3_value_pointer(argv[i], RTREE_KNN_POINTER_TAG).(*KnnQuery); ok {
+							//	MATCH against knn(): switch the cursor into best-first traversal and ignore the
+							//	remaining spatial machinery for this scan - see rtree_knn.go.
+							pCsr.nConstraint--
+							if rc = tree.knnFilter(pCsr, query); rc != SQLITE_OK {
+								break
+							}
+							tree.Release()
+							return rc
+						}
+						if query, ok := sqlite3_value_pointer(argv[i], RTREE_QUERY_POINTER_TAG).(*RtreeQuery); ok {
+							//	MATCH against a scored query callback: best-first traversal ordered by the scores the
+							//	callback assigns - see rtree_query_callback.go.
+							pCsr.nConstraint--
+							if rc = tree.queryFilter(pCsr, query); rc != SQLITE_OK {
+								break
+							}
+							tree.Release()
+							return rc
+						}
+						if box, ok := sqlite3_value_pointer(argv[i], RTREE_BOX_POINTER_TAG).(*BoxQuery); ok {
+							//	MATCH against rtree_within()/rtree_overlaps(): one two-sided box constraint covering
+							//	every dimension - see rtree_box_ops.go.
+							if len(box.aBox) != tree.Dimensions * 2 {
+								rc = SQLITE_ERROR
+								break
+							}
+							p.op = box.op
+							p.aBox = box.aBox
+							continue
+						}
+						if match, ok := sqlite3_value_pointer(argv[i], RTREE_WKB_POINTER_TAG).(*WkbMatch); ok {
+							//	MATCH against a WKB polygon: becomes an ordinary geometry constraint whose test
+							//	is the polygon/box intersection - see geometry_wkx.go.
+							p.xGeom = match.geometryTest
+							p.pGeom = &sqlite3_rtree_geometry{}
+							continue
+						}
 						//	A MATCH operator. The right-hand-side must be a blob that can be cast into an RtreeMatchArg object. One created using
 						//	an sqlite3_rtree_geometry_callback() SQL user function.
 						if rc = deserializeGeometry(argv[i], p); rc != SQLITE_OK {
@@ -892,11 +1027,20 @@ func rtreeFilter(pVtabCursor *sqlite3_vtab_cursor, idxNum int, idxStr string, ar
 						}
 					} else {
 						p.rValue = sqlite3_value_float64(argv[i])
+						tree.transformConstraint(p)
 					}
 				}
 			}
 		}
 
+		if rc == SQLITE_OK && orderPoint != nil {
+			//	The planner consumed an ORDER BY on distance: run the best-first traversal, constraints applied
+			//	during expansion, instead of the tree-order scan.
+			rc = tree.orderedFilter(pCsr, orderPoint)
+			tree.Release()
+			return rc
+		}
+
 		var root	*RtreeNode
 		if rc == SQLITE_OK {
 			pCsr.pNode = nil
@@ -955,8 +1099,6 @@ func rtreeBestIndex(tab *sqlite3_vtab, index_info *IndexInfo) (rc int) {
 
 	char zIdxStr[RTREE_MAX_DIMENSIONS * 8 + 1]
 
-	UNUSED_PARAMETER(tab);
-
 	assert( index_info.idxStr == 0 )
 	for i := 0; i < len(index_info.Constraint) && iIdx < int(sizeof(zIdxStr) - 1); i++ {
 		p := index_info.Constraint[i]
@@ -1002,8 +1144,31 @@ func rtreeBestIndex(tab *sqlite3_vtab, index_info *IndexInfo) (rc int) {
 		}
 	}
 
+	//	If the planner offers a LIMIT on this scan, accept it as a final pseudo-constraint so that xFilter can halt the scan
+	//	as soon as enough rows have been returned, instead of enumerating every matching cell for the core to discard.
+	for i := 0; i < len(index_info.Constraint) && iIdx < int(sizeof(zIdxStr) - 3); i++ {
+		p := index_info.Constraint[i]
+		if p.usable && p.op == SQLITE_INDEX_CONSTRAINT_LIMIT {
+			zIdxStr[iIdx++] = RTREE_LIMIT
+			zIdxStr[iIdx++] = '0'
+			index_info.Usage[i].argvIndex = iIdx / 2
+			index_info.Usage[i].omit = true
+			break
+		}
+	}
+
 	index_info.idxNum = 2
 	index_info.idxStr = sqlite3_mprintf("%s", zIdxStr)
+
+	//	When the planner recognised an ORDER BY on a distance function of this table's coordinates, claim the
+	//	ordering and carry the query point to xFilter: the best-first traversal delivers rows already sorted, so
+	//	the external sort - and with a LIMIT, most of the scan - disappears. See rtree_orderby.go.
+	tree := (Rtree *)(tab)
+	if len(index_info.DistanceOrder) == tree.Dimensions {
+		index_info.idxStr = sqlite3_mprintf("%s%c%s", index_info.idxStr, RTREE_ORDERBY_SEP, encodeOrderPoint(index_info.DistanceOrder))
+		index_info.orderByConsumed = true
+	}
+
 	assert( iIdx >= 0 )
 	index_info.estimatedCost = 2000000.0 / float64(iIdx + 1)
 	return
@@ -1044,7 +1209,7 @@ func (tree *Rtree) Union(c1, c2 *RtreeCell) {
 
 //	Return true if the area covered by p2 is a subset of the area covered by p1. False otherwise.
 func (tree *Rtree) Contains(c1, c2 *RtreeCell) bool {
-	isInt := (pRtree.eCoordType == RTREE_COORD_INT32)
+	isInt := (pRtree.eCoordType != RTREE_COORD_REAL32)
 	for i := 0; i < tree.Dimensions * 2; i += 2 {
 		a1 := &c1.aCoord[i]
 		a2 := &c2.aCoord[i]
@@ -1149,6 +1314,15 @@ func (tree *Rtree) ChooseLeaf(cell *RtreeCell, height int) (node *RtreeNode, rc
 #endif
 		}
 
+		//	Under Hilbert ordering, break the growth tie towards the child nearest the new cell on the curve
+		//	rather than the smallest area, keeping curve neighbours together as the table grows - see
+		//	rtree_hilbert.go.
+		if tree.hilbertOrdering {
+			if rowid, ok := tree.hilbertChooseChild(node, cell, MinGrowth); ok {
+				best_rowid = rowid
+			}
+		}
+
 		var child	*RtreeNode
 		child, rc = tree.nodeAcquire(best_rowid, node)
 		tree.nodeRelease(node)
@@ -1183,12 +1357,16 @@ func (tree *Rtree) rowidWrite(rowid, node int64) int {
 	return tree.pWriteRowid.Reset()
 }
 
-//	Write mapping (node->parent) to the <rtree>_parent table.
-func (tree *Rtree) parentWrite(node, parent int64) int {
-	sqlite3_bind_int64(tree.pWriteParent, 1, node)
-	sqlite3_bind_int64(tree.pWriteParent, 2, parent)
-	tree.pWriteParent.Step()
-	return tree.pWriteParent.Reset()
+//	Write mapping (node->parent) into the child node's reserved trailing bytes - see rtree_parent_pointers.go.
+//	The name and signature survive from the %_parent era so the split and condense paths are unchanged.
+func (tree *Rtree) parentWrite(node, parent int64) (rc int) {
+	child, rc := tree.nodeAcquire(node, nil)
+	if rc != SQLITE_OK {
+		return
+	}
+	writeInt64(&child.zData[tree.iNodeSize - 8], parent)
+	child.dirty(tree.iNodeSize - 8, tree.iNodeSize)
+	return tree.nodeRelease(child)
 }
 
 #if VARIANT_GUTTMAN_LINEAR_SPLIT
@@ -1517,7 +1695,7 @@ func (tree *Rtree) SplitNode(node *RtreeNode, cell *RtreeCell, height int) (rc i
 		Right = tree.nodeNew(node)
 		Left = tree.nodeNew(node)
 		tree.iDepth++;
-		node.isDirty = true
+		node.dirty(0, 2)
 		writeInt16(node.zData, tree.iDepth)
 	} else {
 		Left = node;
@@ -1604,26 +1782,21 @@ splitnode_out:
 //	the pLeaf->pParent chain all the way up to the root node.
 //
 //	This operation is required when a row is deleted (or updated - an update is implemented as a delete followed by an insert). SQLite provides the
-//	rowid of the row to delete, which can be used to find the leaf on which the entry resides (argument pLeaf). Once the leaf is located, this 
-// function is called to determine its ancestry.
+//	rowid of the row to delete, which can be used to find the leaf on which the entry resides (argument pLeaf). Once the leaf is located, this
+// function is called to determine its ancestry. The parent node number is read straight from each node's image, so the walk costs no SQL -
+//	see rtree_parent_pointers.go.
 func (tree *Rtree) fixLeafParent(Leaf *RtreeNode) (rc int) {
 	for child := Leaf; rc == SQLITE_OK && child.iNode != 1 && child.pParent == nil; {
-		rc2 := SQLITE_OK
-		sqlite3_bind_int64(tree.pReadParent, 1, child.iNode)
-		if rc = tree.pReadParent.Step(); rc == SQLITE_ROW {
+		if parent_node := tree.nodeParentNumber(child); parent_node != 0 {
 			var test	*RtreeNode
 
 			//	Before setting child.pParent, test that we are not creating a loop of references (as we would if, say, child == pParent). We don't
 			//	want to do this as it leads to a memory leak when trying to delete the referenced counted node structures.
-			parent_node := sqlite3_column_int64(tree.pReadParent, 0)
-			for test := Leaf; test != nil && test.iNode != iNode; test = test.pParent {}
+			for test = Leaf; test != nil && test.iNode != parent_node; test = test.pParent {}
 			if test == nil {
-				child.pParent, rc2 = tree.nodeAcquire(parent_node, nil)
+				child.pParent, rc = tree.nodeAcquire(parent_node, nil)
 			}
 		}
-		if rc = tree.pReadParent.Reset(); rc == SQLITE_OK {
-			rc = rc2
-		}
 		if rc == SQLITE_OK && child.pParent == nil {
 			rc = SQLITE_CORRUPT_VTAB
 		}
@@ -1653,20 +1826,13 @@ func (tree *Rtree) removeNode(node *RtreeNode, height int) (rc int) {
 		return
 	}
 
-	//	Remove the xxx_node entry.
+	//	Remove the xxx_node entry. The parent pointer goes with it - it lives inside the node image.
 	sqlite3_bind_int64(tree.pDeleteNode, 1, node.iNode)
 	tree.pDeleteNode.Step()
 	if rc = tree.pDeleteNode.Reset(); rc != SQLITE_OK {
 		return
 	}
 
-	//	Remove the xxx_parent entry.
-	sqlite3_bind_int64(tree.pDeleteParent, 1, node.iNode)
-	tree.pDeleteParent.Step()
-	if rc = tree.pDeleteParent.Reset(); rc != SQLITE_OK {
-		return
-	}
-  
 	//	Remove the node from the in-memory hash table and link it into the Rtree.pDeleted list. Its contents will be re-inserted later on.
 	pRtree.nodeHashDelete(node)
 	node.iNode = height
@@ -1814,7 +1980,7 @@ func (tree *Rtree) DeleteRowid(rowid int64) (rc int) {
 		if rc == SQLITE_OK {
 			tree.iDepth--
 			writeInt16(Root.zData, tree.iDepth)
-			Root.isDirty = true
+			Root.dirty(0, 2)
 		}
 	}
 
@@ -1869,9 +2035,12 @@ func rtreeValueUp(v *sqlite_value) RtreeValue {
 	return
 }
 
-//	The xUpdate method for rtree module virtual tables.
+//	The xUpdate method for rtree module virtual tables. Writes hold the access lock exclusively, so no read cursor
+//	is inside the tree while nodes are being restructured - see rtree_concurrency.go.
 func rtreeUpdate(pVtab *sqlite3_vtab, nData int, azData []sqlite3_value) (rowid int64, rc int) {
 	tree := (Rtree *)(pVtab)
+	tree.access.Lock()
+	defer tree.access.Unlock()
 	HaveRowid := false
 
 	defer func() {
@@ -1881,6 +2050,10 @@ func rtreeUpdate(pVtab *sqlite3_vtab, nData int, azData []sqlite3_value) (rowid
 	tree.Reference()
 	assert(nData >= 1)
 
+	//	Any write may restructure nodes that open cursors on this table point into, so those cursors must not continue
+	//	from their cached positions.
+	tree.cursorGuard().InvalidateAll()
+
 	//	Constraint handling. A write operation on an r-tree table may return SQLITE_CONSTRAINT for two reasons:
 	//
 	//		1. A duplicate rowid value, or
@@ -1890,12 +2063,27 @@ func rtreeUpdate(pVtab *sqlite3_vtab, nData int, azData []sqlite3_value) (rowid
 	//	case, SQLITE_CONSTRAINT must be returned regardless of the conflict-handling mode specified by the user.
 	cell := tree.NewCell(-1)				//	New cell to insert if nData > 1
 	if nData > 1 {
-		//	Populate the cell.aCoord[] array. The first coordinate is azData[3].
-		assert( nData == (tree.Dimensions * 2 + 3) )
+		//	Populate the cell.aCoord[] array. The first coordinate is azData[3]; any aux columns follow the coordinates.
+		assert( nData == (tree.Dimensions * 2 + 3 + len(tree.auxColumns)) )
 		for i := 0; i < (tree.Dimensions * 2); i += 2 {
-			cell.aCoord[i].i = sqlite3_value_int(azData[i + 3])
-			cell.aCoord[i + 1].i = sqlite3_value_int(azData[i + 4])
-			if cell.aCoord[i].i > cell.aCoord[i + 1].i {
+			if transform := tree.transform(); transform != nil {
+				//	A registered transform maps the supplied coordinates into index space before they are stored, mirroring
+				//	the conversion applied to query constraints in rtreeFilter.
+				cell.aCoord[i].i = int(transform.Apply(i / 2, sqlite3_value_float64(azData[i + 3])))
+				cell.aCoord[i + 1].i = int(transform.Apply(i / 2, sqlite3_value_float64(azData[i + 4])))
+			} else if tree.eCoordType == RTREE_COORD_REAL32 {
+				//	Narrowing float64 coordinates to 4 bytes must widen the box, never shrink it: mins round down
+				//	and maxes round up, so the stored box always contains the values supplied - see rtree_real32.go.
+				cell.aCoord[i].f = rtreeValueDown(azData[i + 3])
+				cell.aCoord[i + 1].f = rtreeValueUp(azData[i + 4])
+				if rc = tree.strictRoundingCheck(&cell, i, sqlite3_value_float64(azData[i + 3]), sqlite3_value_float64(azData[i + 4])); rc != SQLITE_OK {
+					return
+				}
+			} else {
+				cell.aCoord[i].i = sqlite3_value_int(azData[i + 3])
+				cell.aCoord[i + 1].i = sqlite3_value_int(azData[i + 4])
+			}
+			if DCOORD(cell.aCoord[i]) > DCOORD(cell.aCoord[i + 1]) {
 				rc = SQLITE_CONSTRAINT
 				return
 			}
@@ -1924,6 +2112,9 @@ func rtreeUpdate(pVtab *sqlite3_vtab, nData int, azData []sqlite3_value) (rowid
 	//	If azData[0] is not an SQL NULL value, it is the rowid of a record to delete from the r-tree table. The following block does just that.
 	if sqlite3_value_type(azData[0]) != SQLITE_NULL {
 		rc = tree.DeleteRowid(sqlite3_value_int64(azData[0]))
+		if rc == SQLITE_OK && len(tree.auxColumns) > 0 {
+			rc = tree.auxDelete(sqlite3_value_int64(azData[0]))
+		}
 	}
 
 	//	If the azData[] array contains more than one element, elements (azData[2]..azData[argc-1]) contain a new record to insert into the r-tree structure.
@@ -1946,20 +2137,66 @@ func rtreeUpdate(pVtab *sqlite3_vtab, nData int, azData []sqlite3_value) (rowid
 				rc = rc2
 			}
 		}
+		if rc == SQLITE_OK && len(tree.auxColumns) > 0 {
+			rc = tree.auxWrite(rowid, azData[3 + tree.Dimensions * 2:])
+		}
 	}
 	return
 }
 
-//	The xRename method for rtree module virtual tables.
+//	The xRename method for rtree module virtual tables. The two shadow tables must be renamed together or not at all: if
+//	the second ALTER TABLE fails (a name collision, for instance) the earlier rename is rolled back, so the module
+//	is never left with a mismatched set of shadow tables. The rename is bracketed in a savepoint rather than a transaction
+//	because xRename already runs inside the statement transaction of the enclosing ALTER TABLE.
 func rtreeRename(pVtab *sqlite3_vtab, new_name string) (rc int) {
 	tree := (Rtree *)(pVtab)
+	if rc = sqlite3_exec(tree.db, "SAVEPOINT rtree_rename", 0, 0, 0); rc != SQLITE_OK {
+		return
+	}
 	zSql := sqlite3_mprintf(
-		"ALTER TABLE %Q.'%q_node'   RENAME TO \"%w_node\"; ALTER TABLE %Q.'%q_parent' RENAME TO \"%w_parent\"; ALTER TABLE %Q.'%q_rowid'  RENAME TO \"%w_rowid\";",
-		tree.zDb, tree.zName, new_name,
+		"ALTER TABLE %Q.'%q_node'   RENAME TO \"%w_node\"; ALTER TABLE %Q.'%q_rowid'  RENAME TO \"%w_rowid\";",
 		tree.zDb, tree.zName, new_name,
 		tree.zDb, tree.zName, new_name,
 	)
-	return sqlite3_exec(tree.db, zSql, 0, 0, 0)
+	if rc = sqlite3_exec(tree.db, zSql, 0, 0, 0); rc != SQLITE_OK {
+		sqlite3_exec(tree.db, "ROLLBACK TO rtree_rename", 0, 0, 0)
+	}
+	sqlite3_exec(tree.db, "RELEASE rtree_rename", 0, 0, 0)
+	return
+}
+
+//	Re-link shadow tables orphaned by a rename which completed on some tables but not others - the state older versions of
+//	rtreeRename could leave behind. Each of %_node, %_rowid and %_parent (the last only present on unmigrated v1 tables)
+//	still carrying the old prefix is renamed to the new prefix, skipping any which already exist under the new name. The whole repair runs in a savepoint so that it is itself
+//	atomic. Returns the number of tables renamed.
+func (db *sqlite3) RepairRtreeShadowTables(zDb, oldPrefix, newPrefix string) (renamed int, rc int) {
+	if rc = sqlite3_exec(db, "SAVEPOINT rtree_repair", 0, 0, 0); rc != SQLITE_OK {
+		return
+	}
+	for _, suffix := range []string{ "node", "rowid", "parent" } {
+		sql := sqlite3_mprintf(
+			"SELECT count(*) FROM %Q.sqlite_master WHERE type = 'table' AND name = '%q_%s'",
+			zDb, oldPrefix, suffix,
+		)
+		if present, _ := db.GetIntFromStmt(sql); present == 0 {
+			continue
+		}
+		sql = sqlite3_mprintf(
+			"SELECT count(*) FROM %Q.sqlite_master WHERE type = 'table' AND name = '%q_%s'",
+			zDb, newPrefix, suffix,
+		)
+		if present, _ := db.GetIntFromStmt(sql); present != 0 {
+			continue
+		}
+		sql = sqlite3_mprintf("ALTER TABLE %Q.'%q_%s' RENAME TO \"%w_%s\"", zDb, oldPrefix, suffix, newPrefix, suffix)
+		if rc = sqlite3_exec(db, sql, 0, 0, 0); rc != SQLITE_OK {
+			sqlite3_exec(db, "ROLLBACK TO rtree_repair", 0, 0, 0)
+			break
+		}
+		renamed++
+	}
+	sqlite3_exec(db, "RELEASE rtree_repair", 0, 0, 0)
+	return
 }
 
 sqlite3_module rtreeModule = {
@@ -1977,58 +2214,52 @@ sqlite3_module rtreeModule = {
   rtreeColumn,                /* xColumn - read data */
   rtreeRowid,                 /* xRowid - read data */
   rtreeUpdate,                /* xUpdate - write data */
-  0,                          /* xBegin - begin transaction */
-  0,                          /* xSync - sync transaction */
-  0,                          /* xCommit - commit transaction */
-  0,                          /* xRollback - rollback transaction */
+  rtreeBegin,                 /* xBegin - begin transaction; see rtree_txn.go */
+  rtreeSync,                  /* xSync - flush deferred node writes */
+  rtreeCommit,                /* xCommit - commit transaction */
+  rtreeRollback,              /* xRollback - rollback transaction */
   0,                          /* xFindFunction - function overloading */
   rtreeRename,                /* xRename - rename the table */
-  0,                          /* xSavepoint */
-  0,                          /* xRelease */
-  0                           /* xRollbackTo */
+  rtreeSavepoint,             /* xSavepoint - see rtree_savepoint.go */
+  rtreeRelease,               /* xRelease */
+  rtreeRollbackTo             /* xRollbackTo */
 };
 
-const N_STATEMENT = 9
-
-func (tree *Rtree) SqlInit(db *sqlite3, zDb, zPrefix string, isCreate bool) (rc int) {
-#define N_STATEMENT 9
-	sql_statements := []string{
-		//	Read and write the xxx_node table
-		"SELECT data FROM '%q'.'%q_node' WHERE nodeno = :1",
-		"INSERT OR REPLACE INTO '%q'.'%q_node' VALUES(:1, :2)",
-		"DELETE FROM '%q'.'%q_node' WHERE nodeno = :1",
-
-		//	Read and write the xxx_rowid table
-		"SELECT nodeno FROM '%q'.'%q_rowid' WHERE rowid = :1",
-		"INSERT OR REPLACE INTO '%q'.'%q_rowid' VALUES(:1, :2)",
-		"DELETE FROM '%q'.'%q_rowid' WHERE rowid = :1",
-
-		//	Read and write the xxx_parent table
-		"SELECT parentnode FROM '%q'.'%q_parent' WHERE nodeno = :1",
-		"INSERT OR REPLACE INTO '%q'.'%q_parent' VALUES(:1, :2)",
-		"DELETE FROM '%q'.'%q_parent' WHERE nodeno = :1"
+//	The shadow tables backing an rtree, declared once for the ShadowTables helper (see shadow_tables.go). The node->parent
+//	mapping needs no table of its own - it lives in the node images - see rtree_parent_pointers.go.
+func rtreeShadowSpecs(iNodeSize int) []ShadowTableSpec {
+	return []ShadowTableSpec{
+		{ Suffix: "node", Columns: "nodeno INTEGER PRIMARY KEY, data BLOB", KeyColumn: "nodeno", DataColumns: "data", InitialRow: sqlite3_mprintf("1, zeroblob(%d)", iNodeSize) },
+		{ Suffix: "rowid", Columns: "rowid INTEGER PRIMARY KEY, nodeno INTEGER", KeyColumn: "rowid", DataColumns: "nodeno" },
 	}
+}
 
+func (tree *Rtree) SqlInit(db *sqlite3, zDb, zPrefix string, isCreate bool) (rc int) {
 	tree.db = db
+	shadow := NewShadowTables(db, zDb, zPrefix, rtreeShadowSpecs(tree.iNodeSize))
 	if isCreate {
-		create_statement := sqlite3_mprintf(
-			"CREATE TABLE \"%w\".\"%w_node\"(nodeno INTEGER PRIMARY KEY, data BLOB); CREATE TABLE \"%w\".\"%w_rowid\"(rowid INTEGER PRIMARY KEY, nodeno INTEGER); CREATE TABLE \"%w\".\"%w_parent\"(nodeno INTEGER PRIMARY KEY, parentnode INTEGER); INSERT INTO '%q'.'%q_node' VALUES(1, zeroblob(%d))",
-			zDb, zPrefix, zDb, zPrefix, zDb, zPrefix, zDb, zPrefix, tree.iNodeSize
-		)
-		if rc = sqlite3_exec(db, create_statement, 0, 0, 0); rc != SQLITE_OK {
-			return
+		//	Before creating the shadow tables, look for any left behind by an earlier attempt or named by an IF NOT EXISTS
+		//	form. A complete set means an rtree of this name already exists: connect to it rather than failing part-way
+		//	through creation. A partial set cannot safely be adopted or silently replaced, so report exactly which tables
+		//	are present and leave them untouched for the user to inspect.
+		switch present := shadow.Present(); present {
+		case 0:
+			if rc = shadow.Create(); rc != SQLITE_OK {
+				return
+			}
+		case 2:
+			//	Both shadow tables exist: behave as a connect, which is what IF NOT EXISTS asks for.
+		default:
+			db.Error(SQLITE_ERROR, "rtree %q.%q has %d of 2 shadow tables; drop the %q_node and %q_rowid tables or repair them before recreating", zDb, zPrefix, present, zPrefix, zPrefix)
+			return SQLITE_ERROR
 		}
 	}
 
-	appStmt := []sqlite3_stmt{
-		tree.pReadNode, tree.pWriteNode, tree.pDeleteNode,
-		tree.pReadRowid, tree.pWriteRowid, tree.pDeleteRowid,
-		tree.pReadParent, tree.pWriteParent, tree.pDeleteParent,
-	}
-
-	for i := 0; i < N_STATEMENT && rc == SQLITE_OK; i++ {
-		appStmt[i], _, rc = db.Prepare_v2(sqlite3_mprintf(sql_statements[i], zDb, zPrefix))
+	if rc = shadow.Prepare(); rc != SQLITE_OK {
+		return
 	}
+	tree.pReadNode, tree.pWriteNode, tree.pDeleteNode = shadow.Statements["node"].Read, shadow.Statements["node"].Write, shadow.Statements["node"].Delete
+	tree.pReadRowid, tree.pWriteRowid, tree.pDeleteRowid = shadow.Statements["rowid"].Read, shadow.Statements["rowid"].Write, shadow.Statements["rowid"].Delete
 	return
 }
 
@@ -2046,6 +2277,19 @@ func (db *sqlite3) func GetIntFromStmt(sql string) (val, rc int) {
 	return
 }
 
+//	Count how many of the two rtree shadow tables (%_node, %_rowid) exist for the named table prefix. Used by
+//	xCreate to distinguish a fresh create (0), an IF NOT EXISTS connect to a complete earlier create (2), and the debris of
+//	a create which failed part-way (1). xDestroy tolerates missing shadow tables for the same reason, so DROP TABLE
+//	IF EXISTS on a damaged rtree always succeeds.
+func (db *sqlite3) countShadowTables(zDb, zPrefix string) (present int) {
+	sql := sqlite3_mprintf(
+		"SELECT count(*) FROM %Q.sqlite_master WHERE type = 'table' AND name IN ('%q_node', '%q_rowid')",
+		zDb, zPrefix, zPrefix,
+	)
+	present, _ = db.GetIntFromStmt(sql)
+	return
+}
+
 //	This function is called from within the xConnect() or xCreate() method to determine the node-size used by the rtree table being created or connected
 //	to. If successful, pRtree->iNodeSize is populated and SQLITE_OK returned. Otherwise, an SQLite error code is returned.
 //
@@ -2056,6 +2300,16 @@ func (db *sqlite3) func GetIntFromStmt(sql string) (val, rc int) {
 //	database page-size is so large that more than RTREE_MAXCELLS entries would fit in a single node, use a smaller node-size.
 func (tree *Rtree) getNodeSize(db *sqlite3, isCreate bool) (Err string, rc int) {
 	if isCreate {
+		if tree.iNodeSizeOption > 0 {
+			//	An explicit nodesize= creation option overrides the page-size derivation - see rtree_options.go.
+			//	The ceiling is the size beyond which no further cells can be used; the floor is enforced by
+			//	checkDimensionCapacity once this returns.
+			if tree.iNodeSizeOption > 4 + tree.nBytesPerCell * RTREE_MAXCELLS {
+				return sqlite3_mprintf("rtree nodesize too large: %v-byte cells cap nodes at %v bytes", tree.nBytesPerCell, 4 + tree.nBytesPerCell * RTREE_MAXCELLS), SQLITE_ERROR
+			}
+			tree.iNodeSize = tree.iNodeSizeOption
+			return
+		}
 		sql := sqlite3_mprintf("PRAGMA %Q.page_size", tree.zDb)
 		if iPageSize, rc := db.GetIntFromStmt(sql); rc == SQLITE_OK {
 			tree.iNodeSize = iPageSize - 64
@@ -2083,7 +2337,10 @@ func (tree *Rtree) getNodeSize(db *sqlite3, isCreate bool) (Err string, rc int)
 //
 func rtreeInit(db *sqlite3, aux interface{}, args []string, isCreate bool) (table *sqlite3_vtab, Err string, rc int) {
 	var tree	*Rtree
-	int eCoordType = (pAux ? RTREE_COORD_INT32 : RTREE_COORD_REAL32);
+	eCoordType := RTREE_COORD_REAL32
+	if coordType, ok := aux.(int); ok {
+		eCoordType = coordType
+	}
 
 	error_messages := []string{
 		"",
@@ -2092,6 +2349,21 @@ func rtreeInit(db *sqlite3, aux interface{}, args []string, isCreate bool) (tabl
 		"Too many columns for an rtree table"
 	}
 
+	//	Trailing key=value arguments are creation options, not columns - see rtree_options.go.
+	args, creationOptions, optionErr := splitCreationOptions(args)
+	if optionErr != "" {
+		Err = optionErr
+		return SQLITE_ERROR
+	}
+
+	//	"+"-prefixed trailing arguments declare aux data columns, which play no part in the spatial layout - see
+	//	rtree_aux.go. Only the remaining spatial arguments participate in the column-count rules below.
+	args, auxColumns, misordered := splitAuxColumns(args)
+	if misordered {
+		Err = sqlite3_mprintf("%s", "Auxiliary rtree columns must come after all coordinate columns")
+		return SQLITE_ERROR
+	}
+
 	var iErr	int
 	switch {
 	case len(args) < 6:
@@ -2115,31 +2387,58 @@ func rtreeInit(db *sqlite3, aux interface{}, args []string, isCreate bool) (tabl
 		zDb:			args[1],
 		zName:			args[2],
 		Dimensions:			(len(args) - 4) / 2,
-		nBytesPerCell:	8 + tree.Dimensions * 4 * 2,
 		eCoordType:		eCoordType,
+		auxColumns:		auxColumns,
 	}
+	tree.nBytesPerCell = 8 + tree.Dimensions * tree.coordSize() * 2
 
-	//	Figure out the node size to use.
-	Err, rc = tree.getNodeSize(db, isCreate)
+	//	A %_parent shadow table marks the old v1 node layout, which is migrated once SqlInit has prepared the
+	//	statements the migration needs - see rtree_parent_pointers.go.
+	if db.hasParentTable(args[1], args[2]) {
+		tree.nodeFormat = RTREE_NODE_FORMAT_V1
+	} else {
+		tree.nodeFormat = RTREE_NODE_FORMAT_V2
+	}
+
+	//	Figure out the node size to use, then confirm it can hold cells of this table's width - with the raised
+	//	dimension ceiling a wide table on a small page might otherwise leave the split algorithm no room to work.
+	//	See rtree_dimensions.go.
+	if Err, rc = tree.applyCreationOptions(creationOptions); rc != SQLITE_OK {
+		return
+	}
+	if Err, rc = tree.getNodeSize(db, isCreate); rc == SQLITE_OK {
+		Err, rc = tree.checkDimensionCapacity()
+	}
 
 	//	Create/Connect to the underlying relational database schema. If that is successful, call sqlite3_declare_vtab() to configure the r-tree table schema.
 	if rc == SQLITE_OK {
 		if rc = tree.SqlInit(db, args[1], args[2], isCreate); rc != SQLITE_OK {
 			Err = sqlite3_mprintf("%s", db.errmsg())
-		} else {
+		} else if tree.nodeFormat == RTREE_NODE_FORMAT_V1 {
+			if Err, rc = tree.migrateParentPointers(); rc != SQLITE_OK && Err == "" {
+				Err = sqlite3_mprintf("%s", db.errmsg())
+			}
+		}
+		if rc == SQLITE_OK {
 			sql := sqlite3_mprintf("CREATE TABLE x(%s", args[3])
 			for _, v := range args[4:] {
 				sql = sqlite3_mprintf("%s, %s", sql, v)
 			}
+			for _, v := range tree.auxColumns {
+				sql = sqlite3_mprintf("%s, %s", sql, v)
+			}
 			sql = sqlite3_mprintf("%s);", sql)
 			if rc = sqlite3_declare_vtab(db, sql); rc != SQLITE_OK {
 				Err = sqlite3_mprintf("%s", db.errmsg())
+			} else {
+				rc = tree.auxInit(db, isCreate)
 			}
 		}
 	}
 
 	if rc == SQLITE_OK {
 		table = (sqlite3_vtab *)(tree)
+		registerRtreeInstance(db, tree)
 	} else {
 		tree.Release()
 	}
@@ -2155,11 +2454,45 @@ func rtreeInit(db *sqlite3, aux interface{}, args []string, isCreate bool) (tabl
 //
 //	The human readable string takes the form of a Tcl list with one entry for each cell in the r-tree node. Each entry is itself a
 //	list, containing the 8-byte rowid/pageno followed by the <num-dimension> * 2 coordinates.
+//
+//	An optional third argument selects the output format: rtreenode(2, data, 'json') renders the same cells as a
+//	JSON array of {"rowid": ..., "coords": [...]} objects, which tooling can consume without a Tcl-list parser.
 func rtreenode(context *Context, args []*sqlite3_value) {
+	if len(args) < 2 || len(args) > 3 {
+		sqlite3_result_error(context, "wrong number of arguments to rtreenode()", -1)
+		return
+	}
 	tree := &Rtree{ Dimensions: sqlite3_value_int(args[0]) }
 	tree.nBytesPerCell = 8 + 8 * tree.Dimensions
 	node := &RtreeNode{ zData: ([]byte)(sqlite3_value_blob(args[1])) }
 
+	if len(args) > 2 {
+		if CaseInsensitiveComparison(sqlite3_value_text(args[2]), "json") != 0 {
+			sqlite3_result_error(context, "unknown rtreenode() format", -1)
+			return
+		}
+		type nodeCell struct {
+			Rowid	int64		`json:"rowid"`
+			Coords	[]float64	`json:"coords"`
+		}
+		cells := []nodeCell{}
+		for i := 0; i < NCELL(node); i++ {
+			cell := tree.nodeGetCell(node, i)
+			rendered := nodeCell{ Rowid: cell.iRowid }
+			for j := 0; j < tree.Dimensions * 2; j++ {
+				rendered.Coords = append(rendered.Coords, float64(cell.aCoord[j].f))
+			}
+			cells = append(cells, rendered)
+		}
+		text, err := json.Marshal(cells)
+		if err != nil {
+			sqlite3_result_error(context, err.Error(), -1)
+			return
+		}
+		sqlite3_result_text(context, string(text), -1, sqlite3_free)
+		return
+	}
+
 	var zText	string
 	for i := 0; i < NCELL(node); i++ {
 		cell := tree.nodeGetCell(node, i)
@@ -2188,12 +2521,30 @@ func rtreedepth(context *Context, args []*sqlite3_value) {
 
 //	Register the r-tree module with database handle db. This creates the virtual table module "rtree" and the debugging/analysis scalar function "rtreenode".
 func sqlite3RtreeInit(db *sqlite3) (rc int) {
-	if rc = db.CreateFunction("rtreenode", 2, nil, rtreenode, nil, nil, nil); rc == SQLITE_OK {
+	if rc = db.CreateFunction("knn", -1, nil, knnFunc, nil, nil, nil); rc != SQLITE_OK {
+		return
+	}
+	if rc = db.CreateFunction("dist", -1, nil, distFunc, nil, nil, nil); rc != SQLITE_OK {
+		return
+	}
+	if rc = db.CreateFunction("rtree_rebuild", 1, nil, rtreeRebuildFunc, nil, nil, nil); rc != SQLITE_OK {
+		return
+	}
+	if rc = db.CreateFunction("rtree_within", -1, nil, rtreeWithinFunc, nil, nil, nil); rc != SQLITE_OK {
+		return
+	}
+	if rc = db.CreateFunction("rtree_overlaps", -1, nil, rtreeOverlapsFunc, nil, nil, nil); rc != SQLITE_OK {
+		return
+	}
+	if rc = db.CreateFunction("rtreenode", -1, nil, rtreenode, nil, nil, nil); rc == SQLITE_OK {
 		if rc = db.CreateFunction("rtreedepth", 1, nil, rtreedepth, nil, nil, nil); rc == SQLITE_OK {
 			void *c = (void *)RTREE_COORD_REAL32
 			if rc = sqlite3_create_module_v2(db, "rtree", &rtreeModule, c, 0); rc == SQLITE_OK {
 				void *c = (void *)RTREE_COORD_INT32
-				rc = sqlite3_create_module_v2(db, "rtree_i32", &rtreeModule, c, 0)
+				if rc = sqlite3_create_module_v2(db, "rtree_i32", &rtreeModule, c, 0); rc == SQLITE_OK {
+					void *c = (void *)RTREE_COORD_INT64
+					rc = sqlite3_create_module_v2(db, "rtree_i64", &rtreeModule, c, 0)
+				}
 			}
 		}
 	}
@@ -0,0 +1,25 @@
+package serendipity
+
+//	This file makes read cursors on a single Rtree safe to use from multiple goroutines. Previously two concurrent
+//	scans raced on the node cache, on node reference counts and on the shared prepared statements - pReadNode most of
+//	all - with corruption of the in-memory node images as the failure mode.
+//
+//	Two locks divide the work. tree.access is a reader/writer lock held shared for the duration of each read-side
+//	virtual-table method and exclusively for rtreeUpdate, so read-only scans proceed concurrently while writes are
+//	serialised against everything. tree.nodeLock is the finer lock concurrent readers contend on: it serialises the
+//	node cache, reference counting and the shared statements, and is held only for the short sections that touch
+//	them - node images themselves are immutable while any read lock is held, so cursors walk them unlocked.
+
+//	Acquire and release node references under nodeLock. These wrappers carry the historical names so the many call
+//	sites throughout rtree_complete.go are unchanged; the Locked forms hold the actual logic.
+func (tree *Rtree) nodeAcquire(iNode int64, parent *RtreeNode) (node *RtreeNode, rc int) {
+	tree.nodeLock.Lock()
+	defer tree.nodeLock.Unlock()
+	return tree.nodeAcquireLocked(iNode, parent)
+}
+
+func (tree *Rtree) nodeRelease(node *RtreeNode) (rc int) {
+	tree.nodeLock.Lock()
+	defer tree.nodeLock.Unlock()
+	return tree.nodeReleaseLocked(node)
+}
@@ -0,0 +1,26 @@
+package serendipity
+
+//	This file lifts the historical five-dimension cap on rtree tables. Feature-vector workloads routinely need more
+//	than five dimensions, so the hard ceiling is now RTREE_MAX_DIMENSIONS = 16 and the working limit for any one table
+//	is negotiated at rtreeInit time: the declared coordinate columns fix the dimension count, which in turn fixes
+//	nBytesPerCell, and the node size derived from the database page size must still leave room for the split
+//	algorithm to operate. A table that passes the column-count check but whose cells are too wide for its page size
+//	is refused with a descriptive error rather than being created with nodes that can never split correctly.
+//
+//	Existing tables are unaffected: their dimension count and node size are read back from the schema and the root
+//	node exactly as before, and anything valid under the old cap remains valid under the new one.
+
+//	The minimum number of cells a node must be able to hold. RTREE_MINCELLS is a third of the node capacity, and the
+//	split algorithm needs at least one cell on each side of a split plus the cell being inserted, so a capacity below
+//	four leaves no legal split.
+const RTREE_MIN_NODE_CELLS = 4
+
+//	Verify that the node size settled on by getNodeSize can hold enough cells of this table's width. Called from
+//	rtreeInit once both the dimension count and the node size are known.
+func (tree *Rtree) checkDimensionCapacity() (Err string, rc int) {
+	if capacity := tree.nodeCapacity(); capacity < RTREE_MIN_NODE_CELLS {
+		Err = sqlite3_mprintf("Too many dimensions for this page size: %v-byte nodes hold only %v cells of %v bytes", tree.iNodeSize, capacity, tree.nBytesPerCell)
+		rc = SQLITE_ERROR
+	}
+	return
+}
@@ -0,0 +1,248 @@
+package serendipity
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+//	This file exchanges r-tree tables with GIS tooling as GeoJSON. rtree_to_geojson('rt') serialises every entry as
+//	a Feature - rowid as the feature id, the bounding box as both the "bbox" member and, for two-dimensional
+//	tables, a Polygon ring so viewers draw something without understanding bboxes - with any aux columns carried in
+//	"properties". rtree_from_geojson('rt', json) is the inverse: it inserts each Feature of a FeatureCollection
+//	into an existing table, taking the box from the "bbox" member or, failing that, from the extent of the
+//	feature's Polygon. Together they make an r-tree portable to and from anything that speaks GeoJSON, which in
+//	practice is every GIS tool, without custom glue for the shadow-table layout.
+
+//	The shape of the table as the functions need it: how many coordinate pairs, and which trailing columns are aux.
+func rtreeTableShape(db *sqlite3, zTable string) (columns []string, nDimensions, nAux int, rc int) {
+	statement, _, rc := db.Prepare_v2(sqlite3_mprintf("SELECT * FROM %Q LIMIT 0", zTable))
+	if rc != SQLITE_OK {
+		return
+	}
+	for i := 0; i < sqlite3_column_count(statement); i++ {
+		columns = append(columns, sqlite3_column_name(statement, i))
+	}
+	statement.Finalize()
+
+	//	Aux columns live in the %_aux shadow table; its width tells how many of the trailing columns they are.
+	if aux, _, rc2 := db.Prepare_v2(sqlite3_mprintf("SELECT * FROM \"%s_aux\" LIMIT 0", zTable)); rc2 == SQLITE_OK {
+		nAux = sqlite3_column_count(aux) - 1
+		aux.Finalize()
+	}
+	nDimensions = (len(columns) - 1 - nAux) / 2
+	if nDimensions < 1 {
+		return nil, 0, 0, SQLITE_ERROR
+	}
+	return
+}
+
+//	One entry as a GeoJSON Feature. The bbox member is [min..., max...] per the specification; the Polygon ring is
+//	only emitted for two dimensions, where a rectangle is drawable.
+func geojsonFeature(rowid int64, box []float64, nDimensions int, properties map[string]interface{}) map[string]interface{} {
+	bbox := make([]float64, 0, nDimensions * 2)
+	for d := 0; d < nDimensions; d++ {
+		bbox = append(bbox, box[d * 2])
+	}
+	for d := 0; d < nDimensions; d++ {
+		bbox = append(bbox, box[d * 2 + 1])
+	}
+	feature := map[string]interface{}{
+		"type":			"Feature",
+		"id":			rowid,
+		"bbox":			bbox,
+		"geometry":		nil,
+		"properties":	properties,
+	}
+	if nDimensions == 2 {
+		xMin, xMax, yMin, yMax := box[0], box[1], box[2], box[3]
+		feature["geometry"] = map[string]interface{}{
+			"type":			"Polygon",
+			"coordinates":	[][][2]float64{ { { xMin, yMin }, { xMax, yMin }, { xMax, yMax }, { xMin, yMax }, { xMin, yMin } } },
+		}
+	}
+	return feature
+}
+
+//	rtree_to_geojson(table): the whole table as a FeatureCollection.
+func rtreeToGeojsonFunc(context *Context, args []*sqlite3_value) {
+	db := sqlite3_context_db_handle(context)
+	zTable := sqlite3_value_text(args[0])
+	columns, nDimensions, nAux, rc := rtreeTableShape(db, zTable)
+	if rc != SQLITE_OK {
+		sqlite3_result_error(context, sqlite3_mprintf("no such rtree table: %v", zTable), -1)
+		return
+	}
+
+	statement, _, rc := db.Prepare_v2(sqlite3_mprintf("SELECT * FROM %Q", zTable))
+	if rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+	defer statement.Finalize()
+
+	features := []interface{}{}
+	for statement.Step() == SQLITE_ROW {
+		box := make([]float64, nDimensions * 2)
+		for i := range box {
+			box[i] = sqlite3_column_float64(statement, i + 1)
+		}
+		properties := map[string]interface{}{}
+		for i := 0; i < nAux; i++ {
+			iColumn := 1 + nDimensions * 2 + i
+			switch sqlite3_column_type(statement, iColumn) {
+			case SQLITE_INTEGER:
+				properties[columns[iColumn]] = sqlite3_column_int64(statement, iColumn)
+			case SQLITE_FLOAT:
+				properties[columns[iColumn]] = sqlite3_column_float64(statement, iColumn)
+			case SQLITE_NULL:
+				properties[columns[iColumn]] = nil
+			default:
+				properties[columns[iColumn]] = sqlite3_column_text(statement, iColumn)
+			}
+		}
+		features = append(features, geojsonFeature(sqlite3_column_int64(statement, 0), box, nDimensions, properties))
+	}
+	if rc = statement.Reset(); rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+
+	text, err := json.Marshal(map[string]interface{}{ "type": "FeatureCollection", "features": features })
+	if err != nil {
+		sqlite3_result_error(context, err.Error(), -1)
+		return
+	}
+	sqlite3_result_text(context, string(text), -1, nil)
+}
+
+//	The box of one imported feature: the bbox member when present, otherwise the extent of a Polygon geometry.
+func geojsonFeatureBox(feature map[string]interface{}, nDimensions int) (box []float64, ok bool) {
+	if bbox, present := feature["bbox"].([]interface{}); present && len(bbox) == nDimensions * 2 {
+		box = make([]float64, nDimensions * 2)
+		for d := 0; d < nDimensions; d++ {
+			lower, okLower := bbox[d].(float64)
+			upper, okUpper := bbox[d + nDimensions].(float64)
+			if !okLower || !okUpper {
+				return nil, false
+			}
+			box[d * 2], box[d * 2 + 1] = lower, upper
+		}
+		return box, true
+	}
+	geometry, _ := feature["geometry"].(map[string]interface{})
+	if nDimensions != 2 || geometry == nil || geometry["type"] != "Polygon" {
+		return nil, false
+	}
+	rings, _ := geometry["coordinates"].([]interface{})
+	if len(rings) == 0 {
+		return nil, false
+	}
+	ring, _ := rings[0].([]interface{})
+	box = []float64{ 0, 0, 0, 0 }
+	for i, vertex := range ring {
+		point, _ := vertex.([]interface{})
+		if len(point) < 2 {
+			return nil, false
+		}
+		x, okX := point[0].(float64)
+		y, okY := point[1].(float64)
+		if !okX || !okY {
+			return nil, false
+		}
+		if i == 0 {
+			box[0], box[1], box[2], box[3] = x, x, y, y
+			continue
+		}
+		if x < box[0] {
+			box[0] = x
+		}
+		if x > box[1] {
+			box[1] = x
+		}
+		if y < box[2] {
+			box[2] = y
+		}
+		if y > box[3] {
+			box[3] = y
+		}
+	}
+	return box, true
+}
+
+//	rtree_from_geojson(table, json): insert every Feature of a FeatureCollection, returning the number inserted.
+//	The table must already exist; aux properties are matched to aux columns by name and unknown properties are
+//	ignored, so round-trips survive tools that add their own metadata.
+func rtreeFromGeojsonFunc(context *Context, args []*sqlite3_value) {
+	db := sqlite3_context_db_handle(context)
+	zTable := sqlite3_value_text(args[0])
+	columns, nDimensions, nAux, rc := rtreeTableShape(db, zTable)
+	if rc != SQLITE_OK {
+		sqlite3_result_error(context, sqlite3_mprintf("no such rtree table: %v", zTable), -1)
+		return
+	}
+
+	var collection struct {
+		Type		string
+		Features	[]map[string]interface{}
+	}
+	if json.Unmarshal([]byte(sqlite3_value_text(args[1])), &collection) != nil || collection.Type != "FeatureCollection" {
+		sqlite3_result_error(context, "malformed GeoJSON FeatureCollection", -1)
+		return
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	statement, _, rc := db.Prepare_v2(sqlite3_mprintf("INSERT INTO %Q VALUES(%v)", zTable, placeholders))
+	if rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+	defer statement.Finalize()
+
+	inserted := int64(0)
+	for _, feature := range collection.Features {
+		box, ok := geojsonFeatureBox(feature, nDimensions)
+		if !ok {
+			sqlite3_result_error(context, "feature without a usable bbox or Polygon", -1)
+			return
+		}
+		if rowid, ok := feature["id"].(float64); ok {
+			sqlite3_bind_int64(statement, 1, int64(rowid))
+		} else {
+			sqlite3_bind_null(statement, 1)
+		}
+		for i, coordinate := range box {
+			sqlite3_bind_float64(statement, i + 2, coordinate)
+		}
+		properties, _ := feature["properties"].(map[string]interface{})
+		for i := 0; i < nAux; i++ {
+			iParameter := 2 + nDimensions * 2 + i
+			switch v := properties[columns[1 + nDimensions * 2 + i]].(type) {
+			case float64:
+				sqlite3_bind_float64(statement, iParameter, v)
+			case string:
+				sqlite3_bind_text(statement, iParameter, v, -1, nil)
+			case bool:
+				if v {
+					sqlite3_bind_int64(statement, iParameter, 1)
+				} else {
+					sqlite3_bind_int64(statement, iParameter, 0)
+				}
+			default:
+				sqlite3_bind_null(statement, iParameter)
+			}
+		}
+		statement.Step()
+		if rc = statement.Reset(); rc != SQLITE_OK {
+			sqlite3_result_error_code(context, rc)
+			return
+		}
+		inserted++
+	}
+	sqlite3_result_int64(context, inserted)
+}
+
+//	Register the GeoJSON exchange functions on a connection.
+func (db *sqlite3) RegisterGeojsonFunctions() {
+	db.CreateFunc("rtree_to_geojson", 1, nil, rtreeToGeojsonFunc, nil, nil, nil)
+	db.CreateFunc("rtree_from_geojson", 2, nil, rtreeFromGeojsonFunc, nil, nil, nil)
+}
@@ -0,0 +1,145 @@
+package serendipity
+
+import (
+	"sort"
+)
+
+//	This file adds Hilbert-curve ordering as a creation option:
+//
+//		CREATE VIRTUAL TABLE rt USING rtree(id, x1, x2, y1, y2, ordering=hilbert)
+//
+//	The Hilbert curve visits every cell of a grid while never moving far in space between successive positions,
+//	so sorting rectangles by the curve position of their centroids puts spatial neighbours next to each other
+//	in the order - a far stronger clustering than the slice-by-slice STR tiling, which separates neighbours
+//	that straddle a slice boundary. With the option set, bulk loads pack nodes along the curve, and single
+//	inserts break ChooseLeaf ties towards the child nearest the new entry on the curve, so the clustering is
+//	maintained as the table grows rather than only at load time. Range queries then touch fewer nodes for the
+//	same data.
+//
+//	The curve is computed at 16 bits per axis over the bounding box of the cells being ordered, which is
+//	precision enough for node-sized grouping decisions. The classical curve is planar; tables with other
+//	dimension counts fall back to bit-interleaved (Morton) ordering, which delivers most of the clustering and
+//	generalises to any dimension. Tables created without the option never consult any of this.
+
+const HILBERT_ORDER = 16	//	Bits of curve precision per axis
+
+//	Map one coordinate into the curve's grid given the bounds of the cells being ordered.
+func hilbertAxis(value, min, max float64) uint32 {
+	if max <= min {
+		return 0
+	}
+	scaled := (value - min) / (max - min) * float64((uint32(1) << HILBERT_ORDER) - 1)
+	if scaled < 0 {
+		return 0
+	}
+	return uint32(scaled)
+}
+
+//	The position of grid point (x, y) along the Hilbert curve: the standard rotate-and-accumulate walk from
+//	the top-level quadrant down.
+func hilbertPosition(x, y uint32) (d uint64) {
+	for s := uint32(1) << (HILBERT_ORDER - 1); s > 0; s >>= 1 {
+		var rx, ry uint32
+		if x & s > 0 {
+			rx = 1
+		}
+		if y & s > 0 {
+			ry = 1
+		}
+		d += uint64(s) * uint64(s) * uint64((3 * rx) ^ ry)
+		//	Rotate the quadrant so the curve enters and leaves where the next level expects.
+		if ry == 0 {
+			if rx == 1 {
+				x = s - 1 - x
+				y = s - 1 - y
+			}
+			x, y = y, x
+		}
+	}
+	return
+}
+
+//	Morton (Z-order) position for the non-planar fall-back: interleave the axis bits.
+func mortonPosition(axes []uint32) (d uint64) {
+	for bit := HILBERT_ORDER - 1; bit >= 0; bit-- {
+		for _, axis := range axes {
+			d = d << 1 | uint64(axis >> uint(bit) & 1)
+		}
+	}
+	return
+}
+
+//	The bounds of a cell set, as min/max per dimension, for normalising centroids onto the grid.
+func (tree *Rtree) cellSetBounds(cells []*RtreeCell) (bounds [][2]float64) {
+	bounds = make([][2]float64, tree.Dimensions)
+	for i, cell := range cells {
+		for dimension := 0; dimension < tree.Dimensions; dimension++ {
+			min, max := DCOORD(cell.aCoord[dimension * 2]), DCOORD(cell.aCoord[dimension * 2 + 1])
+			if i == 0 || min < bounds[dimension][0] {
+				bounds[dimension][0] = min
+			}
+			if i == 0 || max > bounds[dimension][1] {
+				bounds[dimension][1] = max
+			}
+		}
+	}
+	return
+}
+
+//	A cell's position on the curve: its centroid, normalised into the grid the bounds define.
+func (tree *Rtree) curvePosition(cell *RtreeCell, bounds [][2]float64) uint64 {
+	axes := make([]uint32, tree.Dimensions)
+	for dimension := 0; dimension < tree.Dimensions; dimension++ {
+		centre := (DCOORD(cell.aCoord[dimension * 2]) + DCOORD(cell.aCoord[dimension * 2 + 1])) / 2
+		axes[dimension] = hilbertAxis(centre, bounds[dimension][0], bounds[dimension][1])
+	}
+	if tree.Dimensions == 2 {
+		return hilbertPosition(axes[0], axes[1])
+	}
+	return mortonPosition(axes)
+}
+
+//	The bulk-load tiling under curve ordering: sort along the curve and chunk - neighbours on the curve are
+//	neighbours in space, so consecutive chunks are tight boxes without any slicing.
+func (tree *Rtree) hilbertTiles(cells []*RtreeCell, capacity int) (tiles [][]*RtreeCell) {
+	bounds := tree.cellSetBounds(cells)
+	sort.SliceStable(cells, func(i, j int) bool {
+		return tree.curvePosition(cells[i], bounds) < tree.curvePosition(cells[j], bounds)
+	})
+	for from := 0; from < len(cells); from += capacity {
+		to := from + capacity
+		if to > len(cells) {
+			to = len(cells)
+		}
+		tiles = append(tiles, cells[from:to])
+	}
+	return
+}
+
+//	The insert-time tiebreak: among node's children needing the least enlargement, the one whose centroid is
+//	nearest the new cell along the curve, normalised over the node's own children so the comparison is local.
+func (tree *Rtree) hilbertChooseChild(node *RtreeNode, cell *RtreeCell, minGrowth float64) (rowid int64, ok bool) {
+	children := make([]*RtreeCell, NCELL(node))
+	for i := range children {
+		c := tree.nodeGetCell(node, i)
+		children[i] = &c
+	}
+	bounds := tree.cellSetBounds(append(children, cell))
+	target := tree.curvePosition(cell, bounds)
+
+	var bestDistance uint64
+	for _, child := range children {
+		if tree.cellGrowth(child, cell) > minGrowth {
+			continue
+		}
+		position := tree.curvePosition(child, bounds)
+		distance := position - target
+		if position < target {
+			distance = target - position
+		}
+		if !ok || distance < bestDistance {
+			rowid, ok, bestDistance = child.iRowid, true, distance
+		}
+	}
+	return
+}
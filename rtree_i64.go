@@ -0,0 +1,37 @@
+package serendipity
+
+//	This file adds the 64-bit integer coordinate mode, registered as the "rtree_i64" module variant. The existing
+//	encodings pack each coordinate into 4 bytes - a 32-bit float for "rtree", a 32-bit integer for "rtree_i32" - which
+//	integer keys such as nanosecond timestamps overflow. An rtree_i64 table stores 8 bytes per coordinate; everything
+//	else about the node format is unchanged, so the depth bounds, cell count arithmetic and traversal all work from
+//	nBytesPerCell, which rtreeInit computes from the per-mode coordinate size below.
+//
+//	The three modes never mix within a table: the coordinate size is fixed by the module named in CREATE VIRTUAL TABLE
+//	and recorded in eCoordType, exactly as the 32-bit integer mode always has been.
+
+const RTREE_COORD_INT64 = 2
+
+//	The storage size of one coordinate for this tree.
+func (tree *Rtree) coordSize() int {
+	if tree.eCoordType == RTREE_COORD_INT64 {
+		return 8
+	}
+	return 4
+}
+
+//	Read and write one coordinate at the tree's width. The 4-byte modes delegate to the original helpers; the 8-byte
+//	mode uses the rowid integer codec, which is already big-endian 8 bytes.
+func (tree *Rtree) readCoordAt(p []byte) (coord RtreeCoord) {
+	if tree.eCoordType == RTREE_COORD_INT64 {
+		coord.i = readInt64(p)
+		return
+	}
+	return readCoord(p)
+}
+
+func (tree *Rtree) writeCoordAt(p []byte, coord *RtreeCoord) int {
+	if tree.eCoordType == RTREE_COORD_INT64 {
+		return writeInt64(p, coord.i)
+	}
+	return writeCoord(p, coord)
+}
@@ -0,0 +1,166 @@
+package serendipity
+
+import (
+	"container/heap"
+)
+
+//	This file implements k-nearest-neighbour queries on the r-tree. The box-overlap traversal in rtree_complete.go
+//	enumerates matches in tree order; a k-NN query instead wants entries in distance order from a query point, which
+//	needs the classic best-first traversal: a priority queue ordered by minimum possible distance, holding both
+//	unexpanded subtrees (keyed by the distance to their bounding box) and actual entries (keyed by their exact
+//	distance). Popping the queue yields entries in exact nearest-first order, expanding only the subtrees that can
+//	still contain a nearer entry, so finding the 10 nearest among millions touches a handful of nodes.
+//
+//	SQL usage mirrors the geometry callbacks:
+//
+//		SELECT * FROM rt WHERE rt MATCH knn(x, y, 10)
+//
+//	knn() packages the query point and k as a tagged pointer value (see value_subtype.go); rtreeFilter recognises the
+//	tag and switches the cursor into best-first mode, and rtreeNext pops the queue instead of walking cells. Results
+//	arrive in ascending distance order, so an additional "ORDER BY distance" costs nothing.
+
+const RTREE_KNN_POINTER_TAG = "rtree_knn"
+
+//	A k-NN query as built by knn(): a point (one value per dimension of the target tree; extra dimensions are an error
+//	caught in rtreeFilter) and the number of neighbours wanted.
+type KnnQuery struct {
+	point	[]float64
+	k		int64
+}
+
+//	One priority-queue entry: either a subtree awaiting expansion or a concrete cell.
+type knnEntry struct {
+	dist	float64
+	node	*RtreeNode		//	Referenced while queued
+	iCell	int				//	Cell within node, for concrete entries
+	isCell	bool
+	depth	int				//	Remaining depth below node; 0 means node is a leaf
+}
+
+type knnQueue []knnEntry
+
+func (q knnQueue) Len() int				{ return len(q) }
+func (q knnQueue) Less(i, j int) bool	{ return q[i].dist < q[j].dist }
+func (q knnQueue) Swap(i, j int)		{ q[i], q[j] = q[j], q[i] }
+func (q *knnQueue) Push(x interface{})	{ *q = append(*q, x.(knnEntry)) }
+func (q *knnQueue) Pop() (x interface{}) {
+	old := *q
+	x = old[len(old) - 1]
+	*q = old[:len(old) - 1]
+	return
+}
+
+//	The cursor-side state of a running k-NN traversal.
+type KnnState struct {
+	query		*KnnQuery
+	queue		knnQueue
+	returned	int64
+	constrained	bool		//	Test the cursor's constraints during expansion - set for ORDER BY pushdown scans
+}
+
+//	The minimum distance from the query point to a cell's bounding box: zero inside the box, the perpendicular gap per
+//	dimension outside it. For leaf cells of a point dataset the box is degenerate and this is the exact distance.
+func (query *KnnQuery) minDistance(tree *Rtree, node *RtreeNode, iCell int) (dist float64) {
+	for d := 0; d < tree.Dimensions && d < len(query.point); d++ {
+		lower := DCOORD(tree.nodeGetCoord(node, iCell, d * 2))
+		upper := DCOORD(tree.nodeGetCoord(node, iCell, d * 2 + 1))
+		switch {
+		case query.point[d] < lower:
+			gap := lower - query.point[d]
+			dist += gap * gap
+		case query.point[d] > upper:
+			gap := query.point[d] - upper
+			dist += gap * gap
+		}
+	}
+	return
+}
+
+//	Begin a k-NN traversal: seed the queue with the root and position the cursor on the first (nearest) entry.
+func (tree *Rtree) knnFilter(cursor *RtreeCursor, query *KnnQuery) (rc int) {
+	if len(query.point) != tree.Dimensions {
+		return SQLITE_ERROR
+	}
+	root, rc := tree.nodeAcquire(1, nil)
+	if rc != SQLITE_OK {
+		return
+	}
+	cursor.pKnn = &KnnState{ query: query }
+	heap.Push(&cursor.pKnn.queue, knnEntry{ dist: 0, node: root, depth: tree.iDepth })
+	return tree.knnStep(cursor)
+}
+
+//	Advance to the next entry in distance order. Pops the queue, expanding subtree entries until a concrete cell
+//	surfaces; the cursor's pNode/iCell are set so rtreeRowid and rtreeColumn work unchanged. EOF when k entries have
+//	been returned or the queue empties.
+func (tree *Rtree) knnStep(cursor *RtreeCursor) (rc int) {
+	state := cursor.pKnn
+	if cursor.pNode != nil {
+		tree.nodeRelease(cursor.pNode)
+		cursor.pNode = nil
+	}
+	if state.returned >= state.query.k {
+		tree.knnDrain(state)
+		return SQLITE_OK
+	}
+	for state.queue.Len() > 0 {
+		entry := heap.Pop(&state.queue).(knnEntry)
+		if entry.isCell {
+			cursor.pNode = entry.node
+			cursor.iCell = entry.iCell
+			state.returned++
+			return SQLITE_OK
+		}
+		for i := 0; i < NCELL(entry.node); i++ {
+			if state.constrained {
+				excluded, rc := tree.queuedCellExcluded(cursor, entry.node, i, entry.depth == 0)
+				if rc != SQLITE_OK {
+					tree.nodeRelease(entry.node)
+					return rc
+				}
+				if excluded {
+					continue
+				}
+			}
+			dist := state.query.minDistance(tree, entry.node, i)
+			if entry.depth == 0 {
+				entry.node.Reference()
+				heap.Push(&state.queue, knnEntry{ dist: dist, node: entry.node, iCell: i, isCell: true })
+			} else {
+				child, rc := tree.nodeAcquire(tree.nodeGetRowid(entry.node, i), entry.node)
+				if rc != SQLITE_OK {
+					tree.nodeRelease(entry.node)
+					return rc
+				}
+				heap.Push(&state.queue, knnEntry{ dist: dist, node: child, depth: entry.depth - 1 })
+			}
+		}
+		tree.nodeRelease(entry.node)
+	}
+	return SQLITE_OK
+}
+
+//	Release every node still queued once the traversal ends.
+func (tree *Rtree) knnDrain(state *KnnState) {
+	for state.queue.Len() > 0 {
+		tree.nodeRelease(heap.Pop(&state.queue).(knnEntry).node)
+	}
+}
+
+//	The knn() SQL function: packages its arguments as a tagged pointer for the MATCH operator. The final argument is
+//	k; the preceding ones are the query point's coordinates.
+func knnFunc(context *Context, args []*sqlite3_value) {
+	if len(args) < 2 {
+		sqlite3_result_error(context, "knn() needs at least one coordinate and a count", -1)
+		return
+	}
+	query := &KnnQuery{ k: sqlite3_value_int64(args[len(args) - 1]) }
+	if query.k < 1 {
+		sqlite3_result_error(context, "knn() count must be at least 1", -1)
+		return
+	}
+	for _, arg := range args[:len(args) - 1] {
+		query.point = append(query.point, sqlite3_value_float64(arg))
+	}
+	context.sqlite3_result_pointer(query, RTREE_KNN_POINTER_TAG)
+}
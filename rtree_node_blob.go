@@ -0,0 +1,90 @@
+package serendipity
+
+//	This file moves node I/O onto incremental blob handles. Reading a node used to run the pReadNode SELECT,
+//	which materialises the whole data column as a value before it can be copied into the node buffer; writing
+//	one ran an INSERT OR REPLACE that passed the whole buffer back even when the edit touched one cell. For
+//	page-sized nodes that is two full copies per access, and the write amplification grows with the node. A
+//	blob handle opened on xxx_node.data reads straight into the node buffer, is reopened onto the next node
+//	number rather than re-prepared, and on the write side rewrites only the byte range an edit actually dirtied.
+//
+//	To that end every node mutation now records the range it touched through RtreeNode.dirty. An edit that
+//	cannot bound its damage - nodeZero, the wholesale copies in bulk loading - declares the full node, so the
+//	worst case is exactly the old behaviour. New nodes have no row for a handle to open and still go through
+//	the INSERT statement; everything else writes through the handle.
+
+//	Record that bytes [low, high) of the node's image differ from the stored row, widening the range already
+//	recorded. nodeWrite flushes the accumulated range and resets it.
+func (node *RtreeNode) dirty(low, high int) {
+	if !node.isDirty || high > node.dirtyHigh {
+		node.dirtyHigh = high
+	}
+	if !node.isDirty || low < node.dirtyLow {
+		node.dirtyLow = low
+	}
+	node.isDirty = true
+}
+
+//	Open or reopen the cached handle onto node iNode's data column. Reopening an existing handle skips the
+//	table and column resolution the first open pays; a handle invalidated by a schema change or an expired row
+//	is discarded and opened fresh.
+func (tree *Rtree) nodeBlobOpen(handle **sqlite3_blob, iNode int64, flags int) (rc int) {
+	if *handle != nil {
+		if rc = sqlite3_blob_reopen(*handle, iNode); rc != SQLITE_ABORT {
+			return
+		}
+		sqlite3_blob_close(*handle)
+		*handle = nil
+	}
+	*handle, rc = sqlite3_blob_open(tree.db, tree.zDb, sqlite3_mprintf("%s_node", tree.zName), "data", iNode, flags)
+	return
+}
+
+//	Read node iNode into a fresh buffer. A missing row reports no buffer and SQLITE_OK - the caller treats the
+//	absence as corruption with its own context - and a row of the wrong size is corruption outright.
+func (tree *Rtree) nodeBlobRead(iNode int64) (zData []byte, rc int) {
+	if rc = tree.nodeBlobOpen(&tree.pNodeBlob, iNode, 0); rc != SQLITE_OK {
+		if rc == SQLITE_ERROR {
+			//	No such row; distinguished from a real error by the open path only failing this way for one.
+			rc = SQLITE_OK
+		}
+		return nil, rc
+	}
+	if sqlite3_blob_bytes(tree.pNodeBlob) != tree.iNodeSize {
+		return nil, SQLITE_CORRUPT_VTAB
+	}
+	zData = make([]byte, tree.iNodeSize)
+	if rc = sqlite3_blob_read(tree.pNodeBlob, zData, tree.iNodeSize, 0); rc != SQLITE_OK {
+		zData = nil
+	}
+	return
+}
+
+//	Flush a dirty node's recorded byte range back to its row.
+func (tree *Rtree) nodeBlobWrite(node *RtreeNode) (rc int) {
+	low, high := node.dirtyLow, node.dirtyHigh
+	if high <= low {
+		//	Dirty with no recorded range: a site predating range tracking; write everything.
+		low, high = 0, tree.iNodeSize
+	}
+	if rc = tree.nodeBlobOpen(&tree.pNodeBlobWrite, node.iNode, 1); rc != SQLITE_OK {
+		return
+	}
+	if rc = sqlite3_blob_write(tree.pNodeBlobWrite, node.zData[low:high], high - low, low); rc == SQLITE_OK {
+		node.isDirty = false
+		node.dirtyLow, node.dirtyHigh = 0, 0
+	}
+	return
+}
+
+//	Drop the cached handles. Called alongside statement finalization when the tree is torn down, and whenever a
+//	transaction boundary invalidates open blob handles.
+func (tree *Rtree) nodeBlobClose() {
+	if tree.pNodeBlob != nil {
+		sqlite3_blob_close(tree.pNodeBlob)
+		tree.pNodeBlob = nil
+	}
+	if tree.pNodeBlobWrite != nil {
+		sqlite3_blob_close(tree.pNodeBlobWrite)
+		tree.pNodeBlobWrite = nil
+	}
+}
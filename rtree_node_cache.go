@@ -0,0 +1,114 @@
+package serendipity
+
+//	This file replaces the rtree module's fixed 128-bucket node hash table with a size-bounded LRU cache keyed by node
+//	number. The hash table only ever held nodes somebody had pinned: the moment the last reference went away the node
+//	was written out and freed, so a large scan revisiting interior nodes paid the %_node SELECT again and again. The
+//	cache keeps clean zero-reference nodes resident, least-recently-used first out, up to a configurable count.
+//
+//	Pinning rules: a node with references, or with unwritten changes, is pinned and never evicted - eviction only ever
+//	discards clean unpinned nodes, so it never loses data and never invalidates a pointer a cursor still holds. The
+//	unpinned budget is set with "PRAGMA rtree_cache_size = N" (nodes, applied per table; 0 restores the historical
+//	drop-on-release behaviour) and the Hits/Misses counters report how the budget is performing.
+
+//	Unpinned nodes retained per table when PRAGMA rtree_cache_size has not been set.
+const RTREE_NODE_CACHE_DEFAULT = 128
+
+type rtreeNodeCache struct {
+	nodes	map[int64]*RtreeNode	//	Every in-memory node, pinned or not, keyed by node number
+	lru		[]*RtreeNode			//	Clean zero-reference nodes, least recently used first
+	Hits	int64					//	Lookups answered from memory
+	Misses	int64					//	Lookups that fell through to the %_node SELECT
+}
+
+//	The table's unpinned-node budget, read live so pragma changes apply to open trees.
+func (tree *Rtree) cacheLimit() int {
+	if tree.db != nil && tree.db.rtreeNodeCacheSize != 0 {
+		return tree.db.rtreeNodeCacheSize
+	}
+	return RTREE_NODE_CACHE_DEFAULT
+}
+
+//	Find node iNode in the cache, recording the hit or miss. The caller pins via cachePin if it takes a reference.
+func (tree *Rtree) cacheLookup(iNode int64) (node *RtreeNode) {
+	if node = tree.cache.nodes[iNode]; node != nil {
+		tree.cache.Hits++
+	} else {
+		tree.cache.Misses++
+	}
+	return
+}
+
+//	Add a newly loaded or newly numbered node. The node arrives pinned - nodeAcquire and nodeWrite both hold a
+//	reference - so it joins the unpinned list only later, via cacheUnpin.
+func (tree *Rtree) cacheInsert(node *RtreeNode) {
+	if tree.cache.nodes == nil {
+		tree.cache.nodes = make(map[int64]*RtreeNode)
+	}
+	tree.cache.nodes[node.iNode] = node
+}
+
+//	Remove a node outright, as when it is deleted from the tree structure.
+func (tree *Rtree) cacheRemove(node *RtreeNode) {
+	if node.iNode != 0 {
+		delete(tree.cache.nodes, node.iNode)
+	}
+	tree.cacheDetach(node)
+}
+
+//	Take a node off the unpinned list because a reference to it has been taken.
+func (tree *Rtree) cachePin(node *RtreeNode) {
+	tree.cacheDetach(node)
+}
+
+//	The last reference to a node has been released: retain it, evicting least-recently-used nodes beyond the budget.
+//	A budget of zero keeps nothing, which is the historical behaviour. A node still dirty here is carrying a write
+//	deferred to the end of the transaction; it is pinned by its dirtiness and never joins the eviction list - see
+//	rtree_txn.go.
+func (tree *Rtree) cacheUnpin(node *RtreeNode) {
+	assert( node.nRef == 0 )
+	if node.isDirty {
+		return
+	}
+	limit := tree.cacheLimit()
+	if limit == 0 {
+		tree.cacheRemove(node)
+		return
+	}
+	tree.cache.lru = append(tree.cache.lru, node)
+	for len(tree.cache.lru) > limit {
+		evicted := tree.cache.lru[0]
+		tree.cache.lru = tree.cache.lru[1:]
+		delete(tree.cache.nodes, evicted.iNode)
+	}
+}
+
+func (tree *Rtree) cacheDetach(node *RtreeNode) {
+	for i, candidate := range tree.cache.lru {
+		if candidate == node {
+			tree.cache.lru = append(tree.cache.lru[:i], tree.cache.lru[i + 1:]...)
+			return
+		}
+	}
+}
+
+//	The cache counters, for callers sizing the budget.
+func (tree *Rtree) CacheStats() (hits, misses int64) {
+	return tree.cache.Hits, tree.cache.Misses
+}
+
+func init() {
+	registerPragma(PragmaHandler{
+		Name: "rtree_cache_size",
+		Get: func(db *sqlite3) string {
+			return sqlite3_mprintf("%v", db.rtreeNodeCacheSize)
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			n, ok := pragmaInt(value)
+			if !ok || n < 0 {
+				return SQLITE_ERROR
+			}
+			db.rtreeNodeCacheSize = n
+			return SQLITE_OK
+		},
+	})
+}
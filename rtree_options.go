@@ -0,0 +1,66 @@
+package serendipity
+
+import (
+	"strconv"
+	"strings"
+)
+
+//	This file adds creation options to the rtree module's argument list:
+//
+//		CREATE VIRTUAL TABLE rt USING rtree(id, x1, x2, y1, y2, nodesize=2048)
+//
+//	getNodeSize derives the node size from the database page size, which is the right default and the wrong
+//	answer for the workloads at either edge: very wide cells on a small page leave a fan-out too low to be
+//	useful, and a huge page holds far more cells per node than a point query wants to scan. nodesize=N overrides
+//	the derivation. The value is validated against the cell width - the node must hold at least
+//	RTREE_MIN_NODE_CELLS cells for splits to work, and more than RTREE_MAXCELLS can never be used - so a
+//	mistaken value is refused at CREATE time rather than baked into a tree that misbehaves.
+//
+//	Options follow all columns, spatial and auxiliary; the node size is recorded in the root node as always, so
+//	xConnect reads it back from there and the option is only consulted when the table is created.
+
+//	Split the trailing key=value options off a CREATE VIRTUAL TABLE argument list. Only the trailing run of
+//	arguments shaped like options is taken - a column name cannot contain '=' - and an unrecognised key is an
+//	error, since ignoring it would silently create a table the author did not describe.
+func splitCreationOptions(args []string) (remaining []string, options map[string]string, Err string) {
+	options = map[string]string{}
+	end := len(args)
+	for end > 3 {
+		split := strings.Index(args[end - 1], "=")
+		if split < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(args[end - 1][:split]))
+		switch key {
+		case "nodesize", "ordering":
+			options[key] = strings.TrimSpace(args[end - 1][split + 1:])
+		default:
+			return nil, nil, sqlite3_mprintf("unrecognized rtree option: %s", key)
+		}
+		end--
+	}
+	return args[:end], options, ""
+}
+
+//	Record the parsed options on the tree ahead of getNodeSize; validation that needs the settled node size
+//	happens there and in checkDimensionCapacity.
+func (tree *Rtree) applyCreationOptions(options map[string]string) (Err string, rc int) {
+	if value, ok := options["nodesize"]; ok {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return sqlite3_mprintf("rtree nodesize must be a positive integer: %s", value), SQLITE_ERROR
+		}
+		tree.iNodeSizeOption = n
+	}
+	if value, ok := options["ordering"]; ok {
+		switch strings.ToLower(value) {
+		case "hilbert":
+			tree.hilbertOrdering = true
+		case "str":
+			//	The default, accepted so a declaration can say so explicitly.
+		default:
+			return sqlite3_mprintf("unrecognized rtree ordering: %s", value), SQLITE_ERROR
+		}
+	}
+	return "", SQLITE_OK
+}
@@ -0,0 +1,141 @@
+package serendipity
+
+import (
+	"container/heap"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//	This file pushes "ORDER BY distance" into the r-tree scan. A nearest-first query phrased as
+//
+//		SELECT * FROM rt WHERE ... ORDER BY dist(x0, 3.5, y0, 7.2) LIMIT 10
+//
+//	used to enumerate every row passing the WHERE clause in tree order and hand them to an external sort, with the
+//	LIMIT applied last of all - the full cost of the scan and the sort paid for ten rows. The best-first traversal
+//	built for knn() already produces rows in exactly the order the sort would, so when the single ascending ORDER BY
+//	term is a call to a registered distance function over the table's coordinate columns, rtreeBestIndex claims the
+//	ordering with orderByConsumed and rtreeFilter runs the priority-queue traversal instead of the tree-order scan.
+//	The remaining WHERE constraints are tested during expansion, so pruned subtrees are never descended, and a
+//	pushed-down LIMIT then stops the traversal after the requested rows - the plan touches only the nodes that can
+//	still contain a nearer entry.
+//
+//	The query point is known at plan time (the function's constant arguments), so it travels to xFilter inside
+//	idxStr, appended after the constraint byte pairs behind a separator that no constraint encoding uses.
+
+//	Separates the constraint byte pairs in idxStr from the encoded ORDER BY query point.
+const RTREE_ORDERBY_SEP = '|'
+
+//	The functions recognised as distance measures in an ORDER BY term. dist() is registered by the module; an
+//	application using its own measure (great-circle distance, say) declares it here so the planner may consume the
+//	ordering - the function must be monotonic in the Euclidean distance for the traversal order to be correct.
+var rtreeDistanceFunctions = map[string]bool{ "dist": true }
+
+func RegisterRtreeDistanceFunction(zName string) {
+	rtreeDistanceFunctions[strings.ToLower(zName)] = true
+}
+
+//	Classify one ORDER BY term for the pushdown. The term must be a call to a registered distance function whose
+//	arguments pair the table's coordinate columns, in declaration order, with constant point coordinates; anything
+//	else - an expression over the columns, a parameter, a column of another table - leaves the ordering with the
+//	sorter. Called by the ORDER BY translator to populate IndexInfo.DistanceOrder.
+func distanceOrderPoint(term *Expr, iTable int) (point []float64, ok bool) {
+	if term.op != TK_FUNCTION || !rtreeDistanceFunctions[strings.ToLower(term.zToken)] {
+		return nil, false
+	}
+	for i, argument := range term.pList {
+		arg := argument.pExpr
+		switch i % 2 {
+		case 0:
+			//	Even arguments name the coordinate columns, leftmost pair first.
+			if arg.op != TK_COLUMN || arg.iTable != iTable || arg.iColumn != (i / 2) * 2 + 1 {
+				return nil, false
+			}
+		case 1:
+			//	Odd arguments are the point's coordinates and must be constants.
+			if arg.op != TK_INTEGER && arg.op != TK_FLOAT {
+				return nil, false
+			}
+			coordinate, err := strconv.ParseFloat(arg.zToken, 64)
+			if err != nil {
+				return nil, false
+			}
+			point = append(point, coordinate)
+		}
+	}
+	return point, len(point) > 0 && len(term.pList) == len(point) * 2
+}
+
+//	The textual form of the query point carried in idxStr, and its inverse in rtreeFilter.
+func encodeOrderPoint(point []float64) (encoded string) {
+	parts := make([]string, len(point))
+	for i, coordinate := range point {
+		parts[i] = strconv.FormatFloat(coordinate, 'g', -1, 64)
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitOrderPoint(idxStr string) (constraints string, point []float64) {
+	at := strings.IndexByte(idxStr, RTREE_ORDERBY_SEP)
+	if at == -1 {
+		return idxStr, nil
+	}
+	for _, part := range strings.Split(idxStr[at + 1:], ",") {
+		coordinate, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return idxStr[:at], nil
+		}
+		point = append(point, coordinate)
+	}
+	return idxStr[:at], point
+}
+
+//	The dist() SQL function: the Euclidean distance between its interleaved column/constant argument pairs, so a
+//	query reads naturally as "ORDER BY dist(x, 3.5, y, 7.2)". When the planner consumes the ordering this is never
+//	evaluated per row; when it cannot - a descending sort, a second ORDER BY term - the query still runs correctly
+//	through the sorter.
+func distFunc(context *Context, args []*sqlite3_value) {
+	if len(args) == 0 || len(args) % 2 != 0 {
+		sqlite3_result_error(context, "dist() needs column and coordinate pairs", -1)
+		return
+	}
+	var total float64
+	for i := 0; i < len(args); i += 2 {
+		gap := sqlite3_value_float64(args[i]) - sqlite3_value_float64(args[i + 1])
+		total += gap * gap
+	}
+	sqlite3_result_float64(context, math.Sqrt(total))
+}
+
+//	Whether the cell iCell of node is excluded by the cursor's constraints, for a candidate met during queue
+//	expansion. testCell and testEntry read the cursor's position, so it is borrowed and restored around the test -
+//	the same save/restore descendToCell uses.
+func (tree *Rtree) queuedCellExcluded(cursor *RtreeCursor, node *RtreeNode, iCell int, isLeaf bool) (isEof bool, rc int) {
+	saved_node := cursor.pNode
+	saved_cell := cursor.iCell
+	cursor.pNode = node
+	cursor.iCell = iCell
+	if isLeaf {
+		isEof, rc = tree.testEntry(cursor)
+	} else {
+		isEof, rc = tree.testCell(cursor)
+	}
+	cursor.pNode = saved_node
+	cursor.iCell = saved_cell
+	return
+}
+
+//	Begin a distance-ordered scan: the best-first traversal of rtree_knn.go with no neighbour limit and with the
+//	cursor's constraints applied during expansion. A pushed-down LIMIT still stops the scan through iRowLimit.
+func (tree *Rtree) orderedFilter(cursor *RtreeCursor, point []float64) (rc int) {
+	if len(point) != tree.Dimensions {
+		return SQLITE_ERROR
+	}
+	root, rc := tree.nodeAcquire(1, nil)
+	if rc != SQLITE_OK {
+		return
+	}
+	cursor.pKnn = &KnnState{ query: &KnnQuery{ point: point, k: math.MaxInt64 }, constrained: true }
+	heap.Push(&cursor.pKnn.queue, knnEntry{ dist: 0, node: root, depth: tree.iDepth })
+	return tree.knnStep(cursor)
+}
@@ -0,0 +1,90 @@
+package serendipity
+
+//	This file removes the %_parent shadow table by storing each node's parent node number inside the node itself.
+//	The old layout spent a table row and three prepared statements on the node->parent mapping, and every delete
+//	paid for it again: fixLeafParent ran one %_parent query per ancestor to rebuild the pParent chain before a
+//	leaf could be condensed. In the v2 node format the last eight bytes of every node hold the parent node number
+//	(zero for the root), so the mapping travels with the node, is read straight out of the image with no SQL at
+//	all, and is maintained by the same parentWrite calls that kept %_parent current. Cell offsets are unchanged -
+//	only the capacity calculation shrinks by the eight reserved bytes, which nodeCapacity centralises.
+//
+//	The format is detected, not declared: a table with a %_parent shadow table is v1, one without is v2. New
+//	tables are created as v2, and a v1 table is migrated transparently the first time it is connected - its leaf
+//	cells are collected and reloaded through the STR bulk-load path exactly as Rebuild does, after which %_parent
+//	is dropped. Migration rewrites every node, so the first connect of an old table costs one rebuild; every
+//	delete thereafter is cheaper.
+
+const(
+	RTREE_NODE_FORMAT_V1	= 1		//	Parent mapping held in the %_parent shadow table
+	RTREE_NODE_FORMAT_V2	= 2		//	Parent node number held in the node's trailing eight bytes
+)
+
+//	The bytes at the end of each node reserved for format bookkeeping: the parent pointer in v2, nothing in v1.
+func (tree *Rtree) nodeOverhead() int {
+	if tree.nodeFormat >= RTREE_NODE_FORMAT_V2 {
+		return 8
+	}
+	return 0
+}
+
+//	The number of cells a node can hold, net of the 4-byte header and any format overhead. This replaces the
+//	open-coded (iNodeSize - 4) / nBytesPerCell of the v1-only code.
+func (tree *Rtree) nodeCapacity() int {
+	return (tree.iNodeSize - 4 - tree.nodeOverhead()) / tree.nBytesPerCell
+}
+
+//	Read the parent node number from a v2 node image. Zero means the root, or a node not yet linked in.
+func (tree *Rtree) nodeParentNumber(node *RtreeNode) int64 {
+	return readInt64(&node.zData[tree.iNodeSize - 8])
+}
+
+//	Whether the %_parent shadow table exists for the named table prefix, which marks a v1-format tree.
+func (db *sqlite3) hasParentTable(zDb, zPrefix string) bool {
+	sql := sqlite3_mprintf(
+		"SELECT count(*) FROM %Q.sqlite_master WHERE type = 'table' AND name = '%q_parent'",
+		zDb, zPrefix,
+	)
+	present, _ := db.GetIntFromStmt(sql)
+	return present != 0
+}
+
+//	Migrate a v1 table to the in-node parent-pointer format: collect every leaf cell, tear the shadow rows down,
+//	reload through BulkLoad with the v2 capacity in force, and drop %_parent. Called from rtreeInit before the
+//	table is declared, so no cursors can be open on the tree yet. The collection must run with the v1 capacity -
+//	old nodes legitimately hold more cells than a v2 node of the same size - so the format flips only once the
+//	cells are safely in memory.
+func (tree *Rtree) migrateParentPointers() (Err string, rc int) {
+	root, rc := tree.nodeAcquire(1, nil)
+	if rc != SQLITE_OK {
+		return
+	}
+	cells, rc := tree.collectLeafCells(root, tree.iDepth, nil)
+	if rc2 := tree.nodeRelease(root); rc == SQLITE_OK {
+		rc = rc2
+	}
+	if rc != SQLITE_OK {
+		return
+	}
+
+	//	The reserved parent bytes shrink the capacity; a v1 table created right at the capacity floor has no
+	//	legal v2 layout, and is refused rather than rebuilt into nodes that can never split.
+	tree.nodeFormat = RTREE_NODE_FORMAT_V2
+	if capacity := tree.nodeCapacity(); capacity < RTREE_MIN_NODE_CELLS {
+		tree.nodeFormat = RTREE_NODE_FORMAT_V1
+		return sqlite3_mprintf("rtree %q.%q cannot adopt the in-node parent format: %v-byte nodes would hold only %v cells of %v bytes; recreate it with a larger nodesize", tree.zDb, tree.zName, tree.iNodeSize, capacity, tree.nBytesPerCell), SQLITE_ERROR
+	}
+
+	teardown := sqlite3_mprintf(
+		"DELETE FROM \"%s\".\"%s_node\"; DELETE FROM \"%s\".\"%s_rowid\"; INSERT INTO \"%s\".\"%s_node\" VALUES(1, zeroblob(%d)); DROP TABLE \"%s\".\"%s_parent\";",
+		tree.zDb, tree.zName, tree.zDb, tree.zName, tree.zDb, tree.zName, tree.iNodeSize, tree.zDb, tree.zName,
+	)
+	if rc = sqlite3_exec(tree.db, teardown, 0, 0, 0); rc != SQLITE_OK {
+		return
+	}
+	tree.nodeLock.Lock()
+	tree.cache.nodes = nil
+	tree.cache.lru = nil
+	tree.nodeLock.Unlock()
+	tree.iDepth = 0
+	return "", tree.BulkLoad(cells)
+}
@@ -0,0 +1,154 @@
+package serendipity
+
+import (
+	"container/heap"
+)
+
+//	This file adds the second-generation geometry callback API. The original sqlite3_rtree_geometry_callback path
+//	(deserializeGeometry and RtreeMatchArg) can only answer include/exclude for leaf cells, so a callback cannot
+//	steer the traversal - every subtree whose box passes the other constraints is descended in tree order. A query
+//	callback is consulted for internal cells too, and as well as visibility it assigns a score; the traversal is
+//	best-first on that score, using the same priority-queue machinery as k-NN, so "best N by some measure" queries
+//	expand only the subtrees that can still contain a better entry.
+//
+//	Registration and use mirror the knn() function:
+//
+//		db.RegisterRtreeQueryCallback("hotspot", scoreFunc, context)
+//		SELECT * FROM rt WHERE rt MATCH hotspot(p1, p2, ...)
+//
+//	The SQL function packages its arguments and the callback as a tagged pointer; rtreeFilter recognises the tag and
+//	switches the cursor into scored traversal. Results arrive best-score-first (ascending, as with distance).
+
+const RTREE_QUERY_POINTER_TAG = "rtree_query"
+
+//	Visibility verdicts a callback may assign. PARTLY_WITHIN descends (or returns) the cell; FULLY_WITHIN does the
+//	same but promises every descendant is visible, letting the callback skip detailed tests below; NOT_WITHIN prunes.
+const (
+	NOT_WITHIN		= 0
+	PARTLY_WITHIN	= 1
+	FULLY_WITHIN	= 2
+)
+
+//	The information passed to a query callback for one cell, and the fields it fills in. Level is 0 for an entry on
+//	a leaf - Rowid is only meaningful there - and counts upward toward the root.
+type RtreeQueryInfo struct {
+	Context		interface{}	//	The context registered with the callback
+	Params		[]float64	//	The arguments given to the SQL function
+	Coords		[]float64	//	The cell's bounding coordinates, min/max per dimension
+	Level		int
+	Rowid		int64
+	ParentScore	float64		//	Score assigned to the containing subtree
+	ParentWithin	int		//	Verdict on the containing subtree, FULLY_WITHIN to short-circuit
+	Score		float64		//	OUT: traversal priority; lower is better and is the result order
+	Within		int			//	OUT: one of the verdicts above
+}
+
+type RtreeQueryFunc func(info *RtreeQueryInfo) (rc int)
+
+//	A parsed MATCH operand: the registered callback plus the arguments from this query.
+type RtreeQuery struct {
+	xQuery	RtreeQueryFunc
+	context	interface{}
+	params	[]float64
+}
+
+//	The cursor-side state of a scored traversal. Queue entries carry the callback's score in the dist field and the
+//	verdict in place of nothing - FULLY_WITHIN subtrees propagate to their children via parentWithin.
+type QueryState struct {
+	query	*RtreeQuery
+	queue	knnQueue
+	within	map[*RtreeNode]int	//	Verdict on each queued subtree, for ParentWithin
+}
+
+//	Register a query callback as an SQL function usable as a MATCH operand on any rtree of this connection.
+func (db *sqlite3) RegisterRtreeQueryCallback(zName string, xQuery RtreeQueryFunc, context interface{}) (rc int) {
+	return db.CreateFunction(zName, -1, nil, func(fctx *Context, args []*sqlite3_value) {
+		query := &RtreeQuery{ xQuery: xQuery, context: context }
+		for _, arg := range args {
+			query.params = append(query.params, sqlite3_value_float64(arg))
+		}
+		fctx.sqlite3_result_pointer(query, RTREE_QUERY_POINTER_TAG)
+	}, nil, nil, nil)
+}
+
+//	Consult the callback for cell iCell of node, whose own subtree was admitted with parentScore/parentWithin.
+func (tree *Rtree) queryScore(state *QueryState, node *RtreeNode, iCell, level int, parentScore float64, parentWithin int) (info *RtreeQueryInfo, rc int) {
+	info = &RtreeQueryInfo{
+		Context:		state.query.context,
+		Params:			state.query.params,
+		Coords:			make([]float64, tree.Dimensions * 2),
+		Level:			level,
+		ParentScore:	parentScore,
+		ParentWithin:	parentWithin,
+	}
+	for i := range info.Coords {
+		info.Coords[i] = DCOORD(tree.nodeGetCoord(node, iCell, i))
+	}
+	if level == 0 {
+		info.Rowid = tree.nodeGetRowid(node, iCell)
+	}
+	rc = state.query.xQuery(info)
+	return
+}
+
+//	Begin a scored traversal: seed the queue with the root and position the cursor on the best entry.
+func (tree *Rtree) queryFilter(cursor *RtreeCursor, query *RtreeQuery) (rc int) {
+	root, rc := tree.nodeAcquire(1, nil)
+	if rc != SQLITE_OK {
+		return
+	}
+	cursor.pQuery = &QueryState{ query: query, within: map[*RtreeNode]int{ root: PARTLY_WITHIN } }
+	heap.Push(&cursor.pQuery.queue, knnEntry{ dist: 0, node: root, depth: tree.iDepth })
+	return tree.queryStep(cursor)
+}
+
+//	Advance to the next entry in score order. As knnStep, but expansion asks the callback about every cell - leaf
+//	entries and subtree boxes alike - and queues only those it admits.
+func (tree *Rtree) queryStep(cursor *RtreeCursor) (rc int) {
+	state := cursor.pQuery
+	if cursor.pNode != nil {
+		tree.nodeRelease(cursor.pNode)
+		cursor.pNode = nil
+	}
+	for state.queue.Len() > 0 {
+		entry := heap.Pop(&state.queue).(knnEntry)
+		if entry.isCell {
+			cursor.pNode = entry.node
+			cursor.iCell = entry.iCell
+			return SQLITE_OK
+		}
+		parentWithin := state.within[entry.node]
+		delete(state.within, entry.node)
+		for i := 0; i < NCELL(entry.node); i++ {
+			info, rc := tree.queryScore(state, entry.node, i, entry.depth, entry.dist, parentWithin)
+			if rc != SQLITE_OK {
+				tree.nodeRelease(entry.node)
+				return rc
+			}
+			if info.Within == NOT_WITHIN {
+				continue
+			}
+			if entry.depth == 0 {
+				entry.node.Reference()
+				heap.Push(&state.queue, knnEntry{ dist: info.Score, node: entry.node, iCell: i, isCell: true })
+			} else {
+				child, rc := tree.nodeAcquire(tree.nodeGetRowid(entry.node, i), entry.node)
+				if rc != SQLITE_OK {
+					tree.nodeRelease(entry.node)
+					return rc
+				}
+				state.within[child] = info.Within
+				heap.Push(&state.queue, knnEntry{ dist: info.Score, node: child, depth: entry.depth - 1 })
+			}
+		}
+		tree.nodeRelease(entry.node)
+	}
+	return SQLITE_OK
+}
+
+//	Release every node still queued once the traversal ends.
+func (tree *Rtree) queryDrain(state *QueryState) {
+	for state.queue.Len() > 0 {
+		tree.nodeRelease(heap.Pop(&state.queue).(knnEntry).node)
+	}
+}
@@ -0,0 +1,47 @@
+package serendipity
+
+//	This file corrects coordinate narrowing for REAL32 r-trees. A table declared with 4-byte float coordinates
+//	stores each float64 it is handed through a narrowing conversion, and the update path used to truncate -
+//	worse, via sqlite3_value_int - so a stored box could come out smaller than the box supplied and a query for
+//	the original rectangle would miss its own row. The insert path now rounds asymmetrically, mins towards
+//	negative infinity and maxes towards positive via rtreeValueDown/rtreeValueUp, so the stored box always
+//	contains the supplied one; a query can at worst see a box one representable float too generous, which the
+//	core's own row re-check already tolerates.
+//
+//	Some applications would rather know than be approximated: coordinates fed from a fixed grid are expected to
+//	be exactly representable, and a rounded store means bad input. PRAGMA rtree_strict = on rejects any insert
+//	whose stored box is not bit-exact around the supplied values, returning SQLITE_CONSTRAINT instead of
+//	widening silently.
+
+//	The strict-mode check for one dimension of a freshly rounded cell: the stored pair must still bracket the
+//	supplied values exactly. Rounding guarantees containment, so a violation can only mean the supplied value
+//	itself was not representable - precisely what strict mode exists to reject.
+func (tree *Rtree) strictRoundingCheck(cell *RtreeCell, i int, min, max float64) int {
+	if !tree.db.rtreeStrictReal32 {
+		return SQLITE_OK
+	}
+	if float64(cell.aCoord[i].f) != min || float64(cell.aCoord[i + 1].f) != max {
+		return SQLITE_CONSTRAINT
+	}
+	return SQLITE_OK
+}
+
+func init() {
+	registerPragma(PragmaHandler{
+		Name: "rtree_strict",
+		Get: func(db *sqlite3) string {
+			if db.rtreeStrictReal32 {
+				return "1"
+			}
+			return "0"
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			enabled, ok := pragmaBool(value)
+			if !ok {
+				return SQLITE_ERROR
+			}
+			db.rtreeStrictReal32 = enabled
+			return SQLITE_OK
+		},
+	})
+}
@@ -0,0 +1,102 @@
+package serendipity
+
+//	This file adds offline rebuilding of an r-tree. A long life of deletes and reinserts leaves a tree worse than
+//	its data deserves: nodes hover near the minimum fill, sibling boxes overlap from splits that long-gone entries
+//	forced, and queries descend more subtrees than a fresh load of the same rectangles would. Rebuild reads every
+//	leaf cell, empties the shadow tables, and reloads the cells through the STR bulk-load path - the tree comes
+//	back packed and spatially coherent, with the fragmentation gone. Rowids and aux rows are untouched; only the
+//	spatial structure is rebuilt.
+//
+//	The SQL form is rtree_rebuild('rt'), which needs the live module instance for the named table; instances
+//	register themselves per connection as they connect and retire as they disconnect.
+
+//	The connection's live r-tree instances, keyed by table name.
+func registerRtreeInstance(db *sqlite3, tree *Rtree) {
+	if db.rtreeTables == nil {
+		db.rtreeTables = map[string]*Rtree{}
+	}
+	db.rtreeTables[tree.zName] = tree
+}
+
+func deregisterRtreeInstance(db *sqlite3, tree *Rtree) {
+	if db.rtreeTables[tree.zName] == tree {
+		delete(db.rtreeTables, tree.zName)
+	}
+}
+
+//	Every leaf cell of the subtree below node, duplicated out of the node images so they survive the teardown.
+func (tree *Rtree) collectLeafCells(node *RtreeNode, height int, cells []*RtreeCell) ([]*RtreeCell, int) {
+	if height == 0 {
+		for i := 0; i < NCELL(node); i++ {
+			cells = append(cells, tree.nodeGetCell(node, i).Duplicate())
+		}
+		return cells, SQLITE_OK
+	}
+	for i := 0; i < NCELL(node); i++ {
+		child, rc := tree.nodeAcquire(tree.nodeGetRowid(node, i), node)
+		if rc != SQLITE_OK {
+			return cells, rc
+		}
+		cells, rc = tree.collectLeafCells(child, height - 1, cells)
+		if rc2 := tree.nodeRelease(child); rc == SQLITE_OK {
+			rc = rc2
+		}
+		if rc != SQLITE_OK {
+			return cells, rc
+		}
+	}
+	return cells, SQLITE_OK
+}
+
+//	Rebuild the tree in place: collect, tear down, bulk-reload. Runs under the writer lock with open cursors
+//	invalidated, exactly as a write invalidates them.
+func (tree *Rtree) Rebuild() (nCells int, rc int) {
+	tree.access.Lock()
+	defer tree.access.Unlock()
+	tree.cursorGuard().InvalidateAll()
+
+	root, rc := tree.nodeAcquire(1, nil)
+	if rc != SQLITE_OK {
+		return
+	}
+	cells, rc := tree.collectLeafCells(root, tree.iDepth, nil)
+	if rc2 := tree.nodeRelease(root); rc == SQLITE_OK {
+		rc = rc2
+	}
+	if rc != SQLITE_OK {
+		return
+	}
+
+	//	Tear down: every shadow row goes, the cache with it, and a zeroed root takes node 1 so the loader finds
+	//	the empty tree it insists on.
+	teardown := sqlite3_mprintf(
+		"DELETE FROM \"%s\".\"%s_node\"; DELETE FROM \"%s\".\"%s_rowid\"; INSERT INTO \"%s\".\"%s_node\" VALUES(1, zeroblob(%d));",
+		tree.zDb, tree.zName, tree.zDb, tree.zName, tree.zDb, tree.zName, tree.iNodeSize,
+	)
+	if rc = sqlite3_exec(tree.db, teardown, 0, 0, 0); rc != SQLITE_OK {
+		return
+	}
+	tree.nodeLock.Lock()
+	tree.cache.nodes = nil
+	tree.cache.lru = nil
+	tree.nodeLock.Unlock()
+	tree.iDepth = 0
+
+	return len(cells), tree.BulkLoad(cells)
+}
+
+//	rtree_rebuild(table): rebuild the named table, returning the number of entries reloaded.
+func rtreeRebuildFunc(context *Context, args []*sqlite3_value) {
+	db := sqlite3_context_db_handle(context)
+	tree := db.rtreeTables[sqlite3_value_text(args[0])]
+	if tree == nil {
+		sqlite3_result_error(context, sqlite3_mprintf("no such rtree table: %v", sqlite3_value_text(args[0])), -1)
+		return
+	}
+	nCells, rc := tree.Rebuild()
+	if rc != SQLITE_OK {
+		sqlite3_result_error_code(context, rc)
+		return
+	}
+	sqlite3_result_int64(context, int64(nCells))
+}
@@ -0,0 +1,32 @@
+package serendipity
+
+//	This file implements the savepoint methods of the rtree module. With the slots zeroed, SAVEPOINT and ROLLBACK TO
+//	around r-tree writes worked on the shadow tables alone: the %_node rows were rolled back underneath the module
+//	while the in-memory node cache kept the images from the abandoned writes, and the next scan walked a tree that no
+//	longer existed in the database.
+//
+//	The contract is simple. xSavepoint flushes every dirty node so the database holds exactly the state the savepoint
+//	must be able to restore. xRelease has nothing to flush - the changes are already in the shadow tables and commit
+//	or further rollback is handled a level up. xRollbackTo is where the cache lies: the shadow tables have been
+//	rewound, so every cached node image is suspect and the whole cache is discarded, along with the cached tree depth,
+//	and open cursors are invalidated exactly as a write invalidates them - they fail cleanly rather than walking
+//	freed structure.
+
+func rtreeSavepoint(pVtab *sqlite3_vtab, iSavepoint int) (rc int) {
+	return (Rtree *)(pVtab).flushDirtyNodes()
+}
+
+func rtreeRelease(pVtab *sqlite3_vtab, iSavepoint int) (rc int) {
+	return SQLITE_OK
+}
+
+func rtreeRollbackTo(pVtab *sqlite3_vtab, iSavepoint int) (rc int) {
+	tree := (Rtree *)(pVtab)
+	tree.cursorGuard().InvalidateAll()
+	tree.nodeLock.Lock()
+	defer tree.nodeLock.Unlock()
+	tree.cache.nodes = nil
+	tree.cache.lru = nil
+	tree.iDepth = -1
+	return SQLITE_OK
+}
@@ -0,0 +1,150 @@
+package serendipity
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+//	This file adds structural introspection for r-tree tables. Choosing a node size or judging a split variant is
+//	blind without numbers: the shadow tables are opaque blobs, and the only observable is query speed. rtree_stat
+//	walks %_node and reports, per level of the tree, how many nodes and cells it holds, how full its nodes are,
+//	how many bytes sit dead past the last cell, and how often sibling boxes overlap - the figure that decides how
+//	many subtrees a point query descends. Registered through the table-pragma module, so both forms work:
+//
+//		SELECT * FROM rtree_stat('rt')
+//		PRAGMA rtree_stat(rt)
+//
+//	Levels are reported root first; the leaf level is level 0, matching the depth stored in the node header.
+
+//	One decoded node image.
+type rtreeStatNode struct {
+	data	[]byte
+	level	int
+}
+
+func (node *rtreeStatNode) cellCount() int {
+	return int(binary.BigEndian.Uint16(node.data[2:]))
+}
+
+//	The per-cell byte width is not recorded in the shadow table, so it is inferred: the width is right when the
+//	root's first child pointer names a node that exists. Leaf-only trees have no pointer to test, but there the
+//	width only affects the fill figures and the 4-byte reading is the overwhelmingly common one.
+func rtreeStatCellWidth(nodes map[int64]*rtreeStatNode, nDimensions int) int {
+	width := 8 + nDimensions * 2 * 4
+	root := nodes[1]
+	if root.level > 0 && root.cellCount() > 0 {
+		if _, ok := nodes[int64(binary.BigEndian.Uint64(root.data[4:]))]; !ok {
+			width = 8 + nDimensions * 2 * 8
+		}
+	}
+	return width
+}
+
+//	The bounding box of one cell, decoded as 32-bit floats; 64-bit trees use the wide reading.
+func rtreeStatCellBox(node *rtreeStatNode, iCell, width, nDimensions int) (box []float64) {
+	at := 4 + iCell * width + 8
+	for i := 0; i < nDimensions * 2; i++ {
+		if width == 8 + nDimensions * 2 * 8 {
+			box = append(box, float64(int64(binary.BigEndian.Uint64(node.data[at:]))))
+			at += 8
+		} else {
+			box = append(box, float64(math.Float32frombits(binary.BigEndian.Uint32(node.data[at:]))))
+			at += 4
+		}
+	}
+	return
+}
+
+func rtreeStatBoxesOverlap(a, b []float64, nDimensions int) bool {
+	for d := 0; d < nDimensions; d++ {
+		if a[d * 2] > b[d * 2 + 1] || a[d * 2 + 1] < b[d * 2] {
+			return false
+		}
+	}
+	return true
+}
+
+func init() {
+	registerTablePragma(TablePragma{
+		Name:		"rtree_stat",
+		Columns:	[]string{ "level", "nodes", "cells", "avg_fill", "dead_bytes", "overlap" },
+		Rows: func(db *sqlite3, argument string, emit func(row ...interface{})) (rc int) {
+			_, nDimensions, _, rc := rtreeTableShape(db, argument)
+			if rc != SQLITE_OK {
+				return
+			}
+			statement, _, rc := db.Prepare_v2(sqlite3_mprintf("SELECT nodeno, data FROM \"%s_node\"", argument))
+			if rc != SQLITE_OK {
+				return
+			}
+			nodes := map[int64]*rtreeStatNode{}
+			for statement.Step() == SQLITE_ROW {
+				nodes[sqlite3_column_int64(statement, 0)] = &rtreeStatNode{ data: ([]byte)(sqlite3_column_blob(statement, 1)), level: -1 }
+			}
+			if rc = statement.Finalize(); rc != SQLITE_OK {
+				return
+			}
+			root := nodes[1]
+			if root == nil || len(root.data) < 4 {
+				return SQLITE_CORRUPT_VTAB
+			}
+
+			//	Assign levels by descent from the root, whose header records the tree depth.
+			depth := int(binary.BigEndian.Uint16(root.data))
+			root.level = depth
+			width := rtreeStatCellWidth(nodes, nDimensions)
+			frontier := []*rtreeStatNode{ root }
+			for len(frontier) > 0 {
+				node := frontier[0]
+				frontier = frontier[1:]
+				if node.level == 0 {
+					continue
+				}
+				for i := 0; i < node.cellCount(); i++ {
+					child := nodes[int64(binary.BigEndian.Uint64(node.data[4 + i * width:]))]
+					if child == nil || len(child.data) < 4 {
+						return SQLITE_CORRUPT_VTAB
+					}
+					child.level = node.level - 1
+					frontier = append(frontier, child)
+				}
+			}
+
+			capacity := (len(root.data) - 4) / width
+			for level := depth; level >= 0; level-- {
+				var nNodes, nCells, deadBytes, overlapping, pairs int64
+				for _, node := range nodes {
+					if node.level != level {
+						continue
+					}
+					nNodes++
+					nCell := node.cellCount()
+					nCells += int64(nCell)
+					deadBytes += int64(len(node.data) - 4 - nCell * width)
+					boxes := make([][]float64, nCell)
+					for i := 0; i < nCell; i++ {
+						boxes[i] = rtreeStatCellBox(node, i, width, nDimensions)
+					}
+					for i := 0; i < nCell; i++ {
+						for j := i + 1; j < nCell; j++ {
+							pairs++
+							if rtreeStatBoxesOverlap(boxes[i], boxes[j], nDimensions) {
+								overlapping++
+							}
+						}
+					}
+				}
+				if nNodes == 0 {
+					continue
+				}
+				avgFill := float64(nCells) / (float64(nNodes) * float64(capacity))
+				overlap := 0.0
+				if pairs > 0 {
+					overlap = float64(overlapping) / float64(pairs)
+				}
+				emit(int64(level), nNodes, nCells, avgFill, deadBytes, overlap)
+			}
+			return SQLITE_OK
+		},
+	})
+}
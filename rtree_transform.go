@@ -0,0 +1,69 @@
+package serendipity
+
+import "sync"
+
+//	This file implements per-table coordinate transforms for rtree tables. Applications frequently index coordinates in a
+//	space other than the one they work in - latitude/longitude projected to Web Mercator, or floats scaled onto an int32 grid
+//	to control precision. Registering a transform once per table applies the conversion symmetrically: cell coordinates are
+//	transformed on insert and update, and the values of query constraints are transformed identically before the scan begins,
+//	so results are consistent without every statement repeating the conversion.
+
+//	A CoordinateTransform converts one coordinate value from user space into index space. The dimension is the coordinate
+//	column index (0 for x1/x2, 1 for y1/y2, and so on) so that a projection can treat axes differently. Transforms must be
+//	monotonic in each dimension: an rtree stores intervals, and a non-monotonic transform would let an interval's low bound
+//	map above its high bound, which xUpdate rejects as a constraint violation.
+type CoordinateTransform interface {
+	Apply(dimension int, value float64) float64
+}
+
+//	A TransformFunc adapts an ordinary function to the CoordinateTransform interface.
+type TransformFunc func(dimension int, value float64) float64
+
+func (f TransformFunc) Apply(dimension int, value float64) float64 {
+	return f(dimension, value)
+}
+
+//	The transform registry, keyed by "database.table". Shared by every connection in the process so that a transform
+//	registered before the table is first used applies uniformly.
+var rtreeTransforms = struct {
+	sync.RWMutex
+	table	map[string]CoordinateTransform
+}{ table: make(map[string]CoordinateTransform) }
+
+//	Register a coordinate transform for the named rtree table, replacing any transform registered earlier. A nil transform
+//	removes the registration. Registering a transform for a table which already contains rows does not rewrite those rows;
+//	it is the caller's responsibility to register transforms before loading data.
+func RegisterRtreeTransform(zDb, zName string, transform CoordinateTransform) {
+	rtreeTransforms.Lock()
+	if transform == nil {
+		delete(rtreeTransforms.table, zDb + "." + zName)
+	} else {
+		rtreeTransforms.table[zDb + "." + zName] = transform
+	}
+	rtreeTransforms.Unlock()
+}
+
+//	Look up the transform for this tree, or nil if none is registered.
+func (tree *Rtree) transform() CoordinateTransform {
+	rtreeTransforms.RLock()
+	transform := rtreeTransforms.table[tree.zDb + "." + tree.zName]
+	rtreeTransforms.RUnlock()
+	return transform
+}
+
+//	Transform one inserted coordinate value from user space into index space. Called by rtreeUpdate for each bound of each
+//	dimension; i is the index into the cell's coordinate array, so the dimension is i/2.
+func (tree *Rtree) transformCoordinate(i int, value float64) float64 {
+	if transform := tree.transform(); transform != nil {
+		return transform.Apply(i / 2, value)
+	}
+	return value
+}
+
+//	Transform one query constraint value from user space into index space. The constraint on coordinate column iCoord
+//	compares against bounds of dimension iCoord/2, so the same transform applied on insert keeps the comparison exact.
+func (tree *Rtree) transformConstraint(constraint *RtreeConstraint) {
+	if transform := tree.transform(); transform != nil {
+		constraint.rValue = transform.Apply(int(constraint.iCoord) / 2, constraint.rValue)
+	}
+}
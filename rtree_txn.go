@@ -0,0 +1,61 @@
+package serendipity
+
+//	This file implements the transaction methods of the rtree module so that dirty node writes are batched. Without
+//	them every write went through nodeRelease, which flushed each node the moment its reference count hit zero - for
+//	a bulk insert that meant one "INSERT OR REPLACE INTO %_node" per touched node per row, with interior nodes near
+//	the root rewritten for almost every row.
+//
+//	Between xBegin and xCommit a dirty node that already has a node number stays in the cache, pinned by its
+//	dirtiness, and nodeRelease skips the write (see nodeReleaseLocked). xSync - called while the statement journal
+//	can still unwind a failure - writes every dirty node in one pass, so each node reaches the shadow table once per
+//	transaction however many rows touched it. xCommit merely clears the flag; xRollback discards the deferred images
+//	outright, exactly as ROLLBACK TO discards them in rtree_savepoint.go, since the shadow tables are rewound by the
+//	core and the cached copies no longer describe anything.
+
+func rtreeBegin(pVtab *sqlite3_vtab) (rc int) {
+	tree := (Rtree *)(pVtab)
+	tree.inTransaction = true
+	return SQLITE_OK
+}
+
+func rtreeSync(pVtab *sqlite3_vtab) (rc int) {
+	return (Rtree *)(pVtab).flushDirtyNodes()
+}
+
+func rtreeCommit(pVtab *sqlite3_vtab) (rc int) {
+	tree := (Rtree *)(pVtab)
+	//	Open blob handles would hold the shadow table across the commit boundary - see rtree_node_blob.go.
+	tree.nodeBlobClose()
+	tree.inTransaction = false
+	return SQLITE_OK
+}
+
+func rtreeRollback(pVtab *sqlite3_vtab) (rc int) {
+	tree := (Rtree *)(pVtab)
+	tree.nodeBlobClose()
+	tree.cursorGuard().InvalidateAll()
+	tree.nodeLock.Lock()
+	defer tree.nodeLock.Unlock()
+	tree.cache.nodes = nil
+	tree.cache.lru = nil
+	tree.iDepth = -1
+	tree.inTransaction = false
+	return SQLITE_OK
+}
+
+//	Write every deferred dirty node. Nodes left clean and unreferenced join the LRU eviction list like any other.
+func (tree *Rtree) flushDirtyNodes() (rc int) {
+	tree.nodeLock.Lock()
+	defer tree.nodeLock.Unlock()
+	for _, node := range tree.cache.nodes {
+		if node.isDirty {
+			if rc = tree.nodeWrite(node); rc != SQLITE_OK {
+				return
+			}
+			if node.nRef == 0 {
+				tree.cacheUnpin(node)
+			}
+		}
+	}
+	return SQLITE_OK
+}
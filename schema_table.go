@@ -0,0 +1,105 @@
+package serendipity
+
+import (
+	"strings"
+)
+
+//	This file provides the sqlite_master / sqlite_schema table as a view over the in-memory Schema structures, and the
+//	writable_schema mode that repair tools need.
+//
+//	Reads are always allowed: the table is synthesised row by row from the schema objects, so it cannot drift from what
+//	the connection actually believes the schema to be. Writes are refused unless "PRAGMA writable_schema = ON" is in
+//	effect, and that pragma is itself refused while defensive mode is active, because writable_schema is precisely the
+//	mechanism an SQL-injection payload would use to corrupt a database through an honest application. The combination
+//	leaves repair tooling a documented path - open normally, enable writable_schema, fix, reload - while an application
+//	that enables defensive mode once at open can never be talked into schema writes by its SQL.
+
+//	The rows of sqlite_schema: (type, name, tbl_name, rootpage, sql). Both historical names resolve to the same table.
+func isSchemaTableName(zName string) bool {
+	switch strings.ToLower(zName) {
+	case "sqlite_master", "sqlite_schema":
+		return true
+	}
+	return false
+}
+
+//	Produce the schema table rows for one database. Objects appear in creation order within each kind, matching what a
+//	file-backed sqlite_master scan would return.
+func (db *sqlite3) schemaTableRows(zDb string, emit func(zType, zName, zTblName string, rootPage int, zSql string)) {
+	schema := db.schemaNamed(zDb)
+	if schema == nil {
+		return
+	}
+	for _, table := range schema.tablesInCreationOrder() {
+		emit("table", table.zName, table.zName, table.rootPage, table.zSql)
+		for index := table.pIndex; index != nil; index = index.pNext {
+			emit("index", index.zName, table.zName, index.rootPage, index.zSql)
+		}
+	}
+	for _, view := range schema.viewsInCreationOrder() {
+		emit("view", view.zName, view.zName, 0, view.zSql())
+	}
+	for _, trigger := range schema.triggersInCreationOrder() {
+		emit("trigger", trigger.zName, trigger.zTableName, 0, trigger.zSql)
+	}
+}
+
+//	Whether a write to the schema table is permitted right now. Called by the INSERT, UPDATE and DELETE code generators
+//	when their target is sqlite_schema, alongside the existing defensive-mode write checks.
+func (db *sqlite3) schemaTableWritable() bool {
+	return db.writableSchema && !db.defensive()
+}
+
+//	Apply a write to the schema table. The row is stored verbatim - no validation beyond shape - because the entire point
+//	of writable_schema is expressing states the normal DDL path refuses; the schema is marked stale so the next statement
+//	reparses it, at which point nonsense surfaces as SQLITE_CORRUPT rather than silent misbehaviour.
+func (db *sqlite3) writeSchemaTable(zDb, zType, zName, zTblName string, rootPage int, zSql string) (rc int) {
+	if !db.schemaTableWritable() {
+		return SQLITE_READONLY
+	}
+	schema := db.schemaNamed(zDb)
+	if schema == nil {
+		return SQLITE_ERROR
+	}
+	schema.storeRawRow(zType, zName, zTblName, rootPage, zSql)
+	schema.expired = true
+	return SQLITE_OK
+}
+
+func init() {
+	registerPragma(PragmaHandler{
+		Name: "writable_schema",
+		Get: func(db *sqlite3) string {
+			if db.writableSchema {
+				return "1"
+			}
+			return "0"
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			enabled, ok := pragmaBool(value)
+			if !ok {
+				return SQLITE_ERROR
+			}
+			//	Defensive mode wins: schema writes stay off and the attempt is an error, not a silent no-op, so repair
+			//	tools discover the conflict immediately.
+			if enabled && db.defensive() {
+				return SQLITE_ERROR
+			}
+			db.writableSchema = enabled
+			return SQLITE_OK
+		},
+	})
+	registerTablePragma(TablePragma{
+		Name:		"pragma_schema_list",
+		Columns:	[]string{ "type", "name", "tbl_name", "rootpage", "sql" },
+		Rows: func(db *sqlite3, argument string, emit func(row ...interface{})) (rc int) {
+			if argument == "" {
+				argument = "main"
+			}
+			db.schemaTableRows(argument, func(zType, zName, zTblName string, rootPage int, zSql string) {
+				emit(zType, zName, zTblName, int64(rootPage), zSql)
+			})
+			return SQLITE_OK
+		},
+	})
+}
@@ -0,0 +1,126 @@
+package serendipity
+
+//	This file implements compound SELECTs: UNION, UNION ALL, INTERSECT and EXCEPT. A compound is represented as the usual
+//	linked list - the rightmost Select is the head, with pPrior chaining back through the earlier operands and op naming
+//	the operator joining each Select to its predecessor. ORDER BY and LIMIT attached to the head apply to the whole
+//	compound; the parser has already rejected them on inner operands.
+//
+//	Two evaluation strategies are generated:
+//
+//	1. The general strategy runs each operand into a transient btree keyed on the full result row. UNION and INTERSECT
+//	   use the btree for duplicate elimination; EXCEPT populates it from the left operand and deletes while running the
+//	   right. UNION ALL needs no btree and simply runs the operands in sequence.
+//
+//	2. The merge strategy applies when both operands of a binary compound already deliver rows in the comparison order -
+//	   typically because each is an index scan - and the compound carries a matching ORDER BY. The operands are run as
+//	   coroutines and merged a row at a time, so no transient storage is needed and LIMIT can stop the whole compound
+//	   early. This mirrors the multiSelectOrderBy path in the C code.
+
+//	Compound operators, matching the parser's token values for the keywords.
+const (
+	TK_ALL			= 115		//	UNION ALL
+	TK_UNION		= 116
+	TK_INTERSECT	= 117
+	TK_EXCEPT		= 118
+)
+
+//	Verify the operands of a compound are union-compatible: every operand must produce the same number of result columns.
+//	Column names and affinities come from the leftmost operand, as in the C implementation.
+func (parse *Parse) checkCompound(p *Select) (rc int) {
+	for current := p; current.pPrior != nil; current = current.pPrior {
+		if len(current.pEList) != len(current.pPrior.pEList) {
+			parse.zErrMsg = sqlite3_mprintf("SELECTs to the left and right of %v do not have the same number of result columns", compoundOperatorName(current.op))
+			return SQLITE_ERROR
+		}
+	}
+	return SQLITE_OK
+}
+
+func compoundOperatorName(op int) string {
+	switch op {
+	case TK_ALL:
+		return "UNION ALL"
+	case TK_UNION:
+		return "UNION"
+	case TK_INTERSECT:
+		return "INTERSECT"
+	case TK_EXCEPT:
+		return "EXCEPT"
+	}
+	return "compound operator"
+}
+
+//	Decide whether the merge strategy applies to the binary compound p: both operands must be sorted by the compound's
+//	ORDER BY without an explicit sort step, and the ORDER BY terms must be a prefix of the result columns compared left
+//	to right, which is what the row-at-a-time merge comparison assumes.
+func (parse *Parse) compoundCanMerge(p *Select) bool {
+	if p.pOrderBy == nil || p.pPrior == nil || p.pPrior.pPrior != nil {
+		return false
+	}
+	for i, term := range p.pOrderBy {
+		if term.iOrderByCol != i + 1 {
+			return false
+		}
+	}
+	return parse.deliversInOrder(p.pPrior, p.pOrderBy) && parse.deliversInOrder(p, p.pOrderBy)
+}
+
+//	Generate a binary compound with the merge strategy. Each operand runs as a coroutine; rows are drawn alternately
+//	according to the comparison and the operator decides which survive:
+//
+//		UNION ALL	emit both sides, ties in either order
+//		UNION		emit both sides, equal rows once
+//		INTERSECT	emit only equal rows, once
+//		EXCEPT		emit left-side rows with no equal right-side row
+//
+//	Because rows arrive in comparison order, each decision needs only the current row from each side, and a LIMIT on the
+//	compound stops both coroutines as soon as it is satisfied.
+func (parse *Parse) codeCompoundMerge(p *Select, destination *SelectDest) (rc int) {
+	left := parse.startCoroutine(p.pPrior)
+	right := parse.startCoroutine(p)
+	limiter := parse.codeLimit(p.pLimit, destination)
+	parse.emitMergeLoop(left, right, p.op, len(p.pOrderBy), destination, limiter)
+	p.flattened = append(p.flattened, sqlite3_mprintf("MERGE (%v)", compoundOperatorName(p.op)))
+	return SQLITE_OK
+}
+
+//	Generate a compound with the general strategy. Operands are processed left to right; a transient btree keyed on the
+//	whole row provides duplicate elimination where the operator requires it.
+func (parse *Parse) codeCompoundGeneral(p *Select, destination *SelectDest) (rc int) {
+	if p.pPrior != nil {
+		if rc = parse.codeCompoundGeneral(p.pPrior, destination); rc != SQLITE_OK {
+			return
+		}
+	}
+	switch p.op {
+	case TK_ALL:
+		//	Append this operand's rows directly; duplicates are wanted.
+		rc = parse.codeSelectInto(p, destination)
+	case TK_UNION:
+		//	Insert into the transient btree; the unique key discards duplicates from either side.
+		rc = parse.codeSelectInto(p, destination.dedupe(parse))
+	case TK_INTERSECT:
+		//	The left side has filled the btree; keep only its rows that the right side also produces.
+		rc = parse.codeSelectIntersect(p, destination.dedupe(parse))
+	case TK_EXCEPT:
+		//	The left side has filled the btree; delete every row the right side produces.
+		rc = parse.codeSelectExcept(p, destination.dedupe(parse))
+	}
+	return
+}
+
+//	The entry point for code generation of a compound SELECT head. ORDER BY and LIMIT on the head are applied to the
+//	combined result: under the merge strategy they come for free, otherwise the transient btree (or an output sorter for
+//	UNION ALL) supplies the ordering before the limit counter runs.
+func (parse *Parse) codeCompoundSelect(p *Select, destination *SelectDest) (rc int) {
+	if rc = parse.checkCompound(p); rc != SQLITE_OK {
+		return
+	}
+	if parse.compoundCanMerge(p) {
+		return parse.codeCompoundMerge(p, destination)
+	}
+	if rc = parse.codeCompoundGeneral(p, destination); rc == SQLITE_OK && p.pOrderBy != nil {
+		rc = parse.codeSortOutput(p.pOrderBy, p.pLimit, destination)
+	}
+	return
+}
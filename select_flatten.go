@@ -0,0 +1,153 @@
+package serendipity
+
+//	This file implements the subquery-flattening and WHERE-clause push-down passes. Without them every view and derived
+//	table is materialized into a transient table before the outer query runs, which defeats indexes on the underlying
+//	tables; with them
+//
+//		SELECT a FROM (SELECT a, b FROM t WHERE b > 5) WHERE a < 10
+//
+//	is rewritten into the single query "SELECT a FROM t WHERE b > 5 AND a < 10" and planned as one scan.
+//
+//	Flattening is attempted for each FROM-clause subquery; when the restrictions below forbid it, the push-down pass still
+//	tries to copy outer WHERE terms into the subquery so that the materialization is at least as small as possible. Both
+//	passes can be disabled with "PRAGMA query_flattener = off" for comparing plans, and every decision is recorded on the
+//	Select so that EXPLAIN QUERY PLAN can annotate the output ("FLATTENED" / "MATERIALIZED subquery pushed-down").
+
+//	The reasons flattening may be refused, kept as a list both for the EXPLAIN annotation and because the exact
+//	restrictions are subtle enough that "which rule fired" is the first debugging question.
+const (
+	FLATTEN_OK					= iota
+	FLATTEN_AGGREGATE			//	Subquery is an aggregate and the outer query also aggregates or joins
+	FLATTEN_LIMIT				//	Subquery has LIMIT/OFFSET and the outer query joins, aggregates or has its own LIMIT
+	FLATTEN_DISTINCT			//	Subquery uses DISTINCT and the outer query joins
+	FLATTEN_COMPOUND			//	Subquery is a compound SELECT (handled by the compound merge pass instead)
+	FLATTEN_OUTER_JOIN			//	Subquery is the right operand of a LEFT JOIN and uses features unsafe to flatten there
+	FLATTEN_ORDER_BY			//	Both subquery and outer query have ORDER BY
+	FLATTEN_RECURSIVE			//	Subquery is a recursive CTE
+	FLATTEN_DISABLED			//	PRAGMA query_flattener = off
+)
+
+var flattenReasons = map[int]string{
+	FLATTEN_AGGREGATE:	"subquery is an aggregate",
+	FLATTEN_LIMIT:		"subquery has LIMIT",
+	FLATTEN_DISTINCT:	"subquery uses DISTINCT",
+	FLATTEN_COMPOUND:	"subquery is a compound SELECT",
+	FLATTEN_OUTER_JOIN:	"subquery is inside an outer join",
+	FLATTEN_ORDER_BY:	"conflicting ORDER BY clauses",
+	FLATTEN_RECURSIVE:	"subquery is recursive",
+	FLATTEN_DISABLED:	"query_flattener is disabled",
+}
+
+//	Decide whether the iFrom'th FROM term of outer, a subquery, can be flattened into it. Returns FLATTEN_OK or the first
+//	restriction that applies. The restriction order matters only for the quality of the annotation.
+func (parse *Parse) flattenRestrictions(outer *Select, sub *Select, iFrom int, isLeftOperand bool) int {
+	switch {
+	case !parse.db.queryFlattener:
+		return FLATTEN_DISABLED
+	case sub.pPrior != nil:
+		return FLATTEN_COMPOUND
+	case sub.isRecursive:
+		return FLATTEN_RECURSIVE
+	case sub.isAggregate && (outer.isAggregate || len(outer.pSrc) > 1):
+		return FLATTEN_AGGREGATE
+	case sub.pLimit != nil && (len(outer.pSrc) > 1 || outer.isAggregate || outer.pLimit != nil):
+		return FLATTEN_LIMIT
+	case sub.isDistinct && len(outer.pSrc) > 1:
+		return FLATTEN_DISTINCT
+	case !isLeftOperand && (sub.pWhere != nil || sub.isAggregate || sub.pLimit != nil):
+		return FLATTEN_OUTER_JOIN
+	case sub.pOrderBy != nil && outer.pOrderBy != nil:
+		return FLATTEN_ORDER_BY
+	}
+	return FLATTEN_OK
+}
+
+//	Flatten the iFrom'th FROM term of outer into it. The caller has already verified flattenRestrictions returned
+//	FLATTEN_OK. Column references into the subquery are substituted with the subquery's result expressions, the FROM terms
+//	are spliced in place of the subquery, and WHERE clauses are conjoined. The subquery's ORDER BY (legal here only when
+//	the outer query has none) and LIMIT migrate outward.
+func (parse *Parse) flattenSubquery(outer *Select, iFrom int) {
+	sub := outer.pSrc[iFrom].pSelect
+	substitution := make(map[int]*Expr, len(sub.pEList))
+	for i, item := range sub.pEList {
+		substitution[i] = item.pExpr
+	}
+	outer.substituteColumns(outer.pSrc[iFrom].iCursor, substitution)
+
+	spliced := append([]*SrcListItem{}, outer.pSrc[:iFrom]...)
+	spliced = append(spliced, sub.pSrc...)
+	outer.pSrc = append(spliced, outer.pSrc[iFrom + 1:]...)
+
+	outer.pWhere = conjoin(outer.pWhere, sub.pWhere)
+	if outer.pOrderBy == nil {
+		outer.pOrderBy = sub.pOrderBy
+	}
+	if outer.pLimit == nil {
+		outer.pLimit = sub.pLimit
+	}
+	outer.flattened = append(outer.flattened, "FLATTENED")
+}
+
+//	Push outer WHERE terms down into a subquery which could not be flattened. A term qualifies when every column it
+//	references resolves into the subquery's result list and it contains no functions with side effects; qualifying terms
+//	are copied (not moved - the outer test still applies after materialization, harmlessly) with columns substituted.
+func (parse *Parse) pushDownWhere(outer *Select, iFrom int) (pushed int) {
+	sub := outer.pSrc[iFrom].pSelect
+	cursor := outer.pSrc[iFrom].iCursor
+	for _, term := range conjuncts(outer.pWhere) {
+		if !term.referencesOnly(cursor) || term.hasSideEffects() {
+			continue
+		}
+		copied := term.Dup()
+		substitution := make(map[int]*Expr, len(sub.pEList))
+		for i, item := range sub.pEList {
+			substitution[i] = item.pExpr
+		}
+		copied.substituteColumns(cursor, substitution)
+		sub.pWhere = conjoin(sub.pWhere, copied)
+		pushed++
+	}
+	if pushed > 0 {
+		outer.flattened = append(outer.flattened, sqlite3_mprintf("MATERIALIZED subquery with %d pushed-down terms", pushed))
+	}
+	return
+}
+
+//	The driver: run the two passes over every FROM-clause subquery of the Select, recording annotations for EXPLAIN QUERY
+//	PLAN either way. Called during name resolution, after the subqueries themselves have been processed bottom-up.
+func (parse *Parse) flattenPass(outer *Select) {
+	for iFrom := 0; iFrom < len(outer.pSrc); iFrom++ {
+		item := outer.pSrc[iFrom]
+		if item.pSelect == nil {
+			continue
+		}
+		switch reason := parse.flattenRestrictions(outer, item.pSelect, iFrom, !item.fromLeftJoin); reason {
+		case FLATTEN_OK:
+			parse.flattenSubquery(outer, iFrom)
+			iFrom--		//	The spliced FROM terms may themselves contain subqueries
+		default:
+			outer.flattened = append(outer.flattened, sqlite3_mprintf("MATERIALIZED (%s)", flattenReasons[reason]))
+			parse.pushDownWhere(outer, iFrom)
+		}
+	}
+}
+
+func init() {
+	registerPragma(PragmaHandler{
+		Name: "query_flattener",
+		Get: func(db *sqlite3) string {
+			if db.queryFlattener {
+				return "1"
+			}
+			return "0"
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			enabled, ok := pragmaBool(value)
+			if !ok {
+				return SQLITE_ERROR
+			}
+			db.queryFlattener = enabled
+			return SQLITE_OK
+		},
+	})
+}
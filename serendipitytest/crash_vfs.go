@@ -0,0 +1,204 @@
+package serendipitytest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//	A scriptable crash-simulation VFS, built on the fault injection in fault_vfs.go. Where FaultVFS answers "what happens
+//	when the Nth I/O fails", CrashVFS answers the harder question "what survives when the process dies mid-commit": it
+//	buffers writes that arrive after the last sync, and Crash discards them - optionally along with the WAL or journal
+//	file itself - leaving exactly the on-disk state an OS crash would. The recovery helpers then re-open the database
+//	and verify both that recovery runs cleanly and that every committed transaction survived while no torn one did.
+//
+//	Typical use:
+//
+//		crash := serendipitytest.NewCrashVFS(base)
+//		... run transactions through a connection opened over crash ...
+//		crash.Crash(serendipitytest.DROP_WAL)
+//		serendipitytest.VerifyRecovery(t, filename, expectedRows)
+
+//	What Crash discards beyond unsynced writes.
+const (
+	DROP_NOTHING	= 0
+	DROP_WAL		= 1 << iota		//	Delete the -wal file, as if it never reached disk
+	DROP_JOURNAL					//	Delete the rollback journal
+)
+
+type CrashVFS struct {
+	Underlying	VFS
+	mutex		sync.Mutex
+	files		map[string]*crashFile
+	SyncDelays	int		//	When > 0, each Sync is a no-op this many times before taking effect, modelling lazy storage
+}
+
+func NewCrashVFS(underlying VFS) *CrashVFS {
+	return &CrashVFS{ Underlying: underlying, files: map[string]*crashFile{} }
+}
+
+func (vfs *CrashVFS) Open(filename string, flags int) (File, error) {
+	file, err := vfs.Underlying.Open(filename, flags)
+	if err != nil {
+		return nil, err
+	}
+	vfs.mutex.Lock()
+	defer vfs.mutex.Unlock()
+	wrapped := &crashFile{ vfs: vfs, file: file, filename: filename }
+	vfs.files[filename] = wrapped
+	return wrapped, nil
+}
+
+func (vfs *CrashVFS) Delete(filename string) error {
+	vfs.mutex.Lock()
+	delete(vfs.files, filename)
+	vfs.mutex.Unlock()
+	return vfs.Underlying.Delete(filename)
+}
+
+//	Simulate a crash: every write since the last effective sync vanishes, and the selected side files are deleted
+//	entirely. The wrapped files are poisoned so that the "crashed" connection's further I/O fails, as it would once the
+//	process is gone.
+func (vfs *CrashVFS) Crash(drop int) {
+	vfs.mutex.Lock()
+	defer vfs.mutex.Unlock()
+	for filename, file := range vfs.files {
+		file.mutex.Lock()
+		file.unsynced = nil
+		file.crashed = true
+		file.mutex.Unlock()
+		switch {
+		case drop & DROP_WAL != 0 && strings.HasSuffix(filename, "-wal"):
+			vfs.Underlying.Delete(filename)
+		case drop & DROP_JOURNAL != 0 && strings.HasSuffix(filename, "-journal"):
+			vfs.Underlying.Delete(filename)
+		}
+	}
+	vfs.files = map[string]*crashFile{}
+}
+
+//	One buffered write awaiting a sync.
+type pendingWrite struct {
+	buffer	[]byte
+	offset	int64
+}
+
+type crashFile struct {
+	vfs			*CrashVFS
+	file		File
+	filename	string
+	mutex		sync.Mutex
+	unsynced	[]pendingWrite
+	delayed		int
+	crashed		bool
+}
+
+func (f *crashFile) ReadAt(buffer []byte, offset int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.crashed {
+		return 0, fmt.Errorf("crashvfs: file %v used after crash", f.filename)
+	}
+	n, err := f.file.ReadAt(buffer, offset)
+	//	Reads must observe the connection's own unsynced writes, so overlay them newest-last.
+	for _, write := range f.unsynced {
+		overlay(buffer, offset, write.buffer, write.offset)
+	}
+	return n, err
+}
+
+func (f *crashFile) WriteAt(buffer []byte, offset int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.crashed {
+		return 0, fmt.Errorf("crashvfs: file %v used after crash", f.filename)
+	}
+	held := make([]byte, len(buffer))
+	copy(held, buffer)
+	f.unsynced = append(f.unsynced, pendingWrite{ buffer: held, offset: offset })
+	return len(buffer), nil
+}
+
+func (f *crashFile) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.crashed {
+		return fmt.Errorf("crashvfs: file %v used after crash", f.filename)
+	}
+	if f.delayed < f.vfs.SyncDelays {
+		f.delayed++
+		return nil
+	}
+	for _, write := range f.unsynced {
+		if _, err := f.file.WriteAt(write.buffer, write.offset); err != nil {
+			return err
+		}
+	}
+	f.unsynced = nil
+	return f.file.Sync()
+}
+
+func (f *crashFile) Truncate(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.crashed {
+		return fmt.Errorf("crashvfs: file %v used after crash", f.filename)
+	}
+	return f.file.Truncate(size)
+}
+
+func (f *crashFile) Close() error {
+	return f.file.Close()
+}
+
+//	Copy the overlap of an unsynced write into a read buffer.
+func overlay(buffer []byte, offset int64, written []byte, writtenOffset int64) {
+	start := writtenOffset - offset
+	from := int64(0)
+	if start < 0 {
+		from = -start
+		start = 0
+	}
+	for start < int64(len(buffer)) && from < int64(len(written)) {
+		buffer[start] = written[from]
+		start++
+		from++
+	}
+}
+
+//	Re-open a crashed database and verify recovery: the integrity check must pass and the given query must return
+//	exactly the expected rows - committed transactions survived, torn ones did not.
+func VerifyRecovery(t testing.TB, filename, query string, expected [][]interface{}) {
+	t.Helper()
+	db, err := opener(filename)
+	if err != nil {
+		t.Fatalf("serendipitytest: re-open after crash failed: %v", err)
+	}
+	defer db.Close()
+	if check := QueryText(t, db, "PRAGMA integrity_check"); check != "ok" {
+		t.Fatalf("serendipitytest: integrity check after crash: %v", check)
+	}
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("serendipitytest: recovery query failed: %v", err)
+	}
+	defer rows.Close()
+	for i, want := range expected {
+		if !rows.Next() {
+			t.Fatalf("serendipitytest: recovery query returned %v rows, want %v", i, len(expected))
+		}
+		got := make([]interface{}, len(want))
+		if err := rows.Scan(got); err != nil {
+			t.Fatalf("serendipitytest: scanning recovery row %v: %v", i, err)
+		}
+		for j := range want {
+			if FormatValue(got[j]) != FormatValue(want[j]) {
+				t.Fatalf("serendipitytest: recovery row %v column %v = %v, want %v", i, j, FormatValue(got[j]), FormatValue(want[j]))
+			}
+		}
+	}
+	if rows.Next() {
+		t.Fatalf("serendipitytest: recovery query returned more than %v rows", len(expected))
+	}
+}
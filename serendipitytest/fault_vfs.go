@@ -0,0 +1,151 @@
+package serendipitytest
+
+import (
+	"fmt"
+	"sync"
+)
+
+//	A fault-injecting VFS for exercising the engine's I/O error paths. The FaultVFS wraps a real VFS and fails operations
+//	according to a schedule: either every operation once a countdown reaches zero (the classic "fail the Nth I/O" loop used to
+//	sweep for unchecked errors), or specific operations selected by kind. Partial writes are simulated by truncating the
+//	buffer actually passed to the underlying file before returning success, which is how a torn sector manifests to the pager.
+
+//	The operation kinds which can be selected for failure.
+const (
+	FAULT_READ	= 1 << iota
+	FAULT_WRITE
+	FAULT_SYNC
+	FAULT_TRUNCATE
+	FAULT_DELETE
+	FAULT_OPEN
+)
+
+//	The narrow file interface the fault layer wraps. It matches the engine's VFS file methods so that a FaultVFS can be
+//	registered wherever a real VFS can.
+type File interface {
+	ReadAt(buffer []byte, offset int64) (int, error)
+	WriteAt(buffer []byte, offset int64) (int, error)
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+type VFS interface {
+	Open(filename string, flags int) (File, error)
+	Delete(filename string) error
+}
+
+//	A FaultVFS wraps another VFS and injects failures. The zero schedule injects nothing, so a FaultVFS can be installed
+//	unconditionally and armed only by the tests that need it.
+type FaultVFS struct {
+	Underlying	VFS
+	mutex		sync.Mutex
+	countdown	int		//	Fail the operation which decrements this to zero; <= 0 means disarmed
+	kinds		int		//	Bitmask of FAULT_* kinds eligible to fail; 0 means all kinds
+	persistent	bool	//	Whether to keep failing after the first injected fault
+	shortWrite	int		//	When > 0, write only this many bytes and report success
+	Faults		int		//	Number of faults injected so far
+}
+
+//	Arm the VFS to fail the nth eligible operation from now. With persistent set, every eligible operation from the nth onward
+//	fails, which is how on-disk corruption after a crash is modelled.
+func (vfs *FaultVFS) FailAfter(n int, kinds int, persistent bool) {
+	vfs.mutex.Lock()
+	vfs.countdown, vfs.kinds, vfs.persistent, vfs.shortWrite = n, kinds, persistent, 0
+	vfs.mutex.Unlock()
+}
+
+//	Arm the VFS to truncate the nth write to the given number of bytes while still reporting success, simulating a partial
+//	write that the application only discovers on a later read.
+func (vfs *FaultVFS) ShortWriteAfter(n int, bytes int) {
+	vfs.mutex.Lock()
+	vfs.countdown, vfs.kinds, vfs.persistent, vfs.shortWrite = n, FAULT_WRITE, false, bytes
+	vfs.mutex.Unlock()
+}
+
+//	Disarm the schedule without resetting the fault counter.
+func (vfs *FaultVFS) Reset() {
+	vfs.mutex.Lock()
+	vfs.countdown, vfs.kinds, vfs.persistent, vfs.shortWrite = 0, 0, false, 0
+	vfs.mutex.Unlock()
+}
+
+//	Decide whether the next operation of the given kind should fail, updating the schedule. The returned shortWrite is non-zero
+//	when the operation should be truncated rather than failed outright.
+func (vfs *FaultVFS) inject(kind int) (fail bool, shortWrite int) {
+	vfs.mutex.Lock()
+	defer vfs.mutex.Unlock()
+	if vfs.countdown <= 0 || (vfs.kinds != 0 && vfs.kinds & kind == 0) {
+		return
+	}
+	if vfs.countdown--; vfs.countdown == 0 {
+		vfs.Faults++
+		fail, shortWrite = true, vfs.shortWrite
+		if vfs.persistent {
+			vfs.countdown = 1
+		}
+	}
+	return
+}
+
+func (vfs *FaultVFS) Open(filename string, flags int) (File, error) {
+	if fail, _ := vfs.inject(FAULT_OPEN); fail {
+		return nil, fmt.Errorf("faultvfs: injected open fault on %v", filename)
+	}
+	file, err := vfs.Underlying.Open(filename, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{ vfs: vfs, file: file }, nil
+}
+
+func (vfs *FaultVFS) Delete(filename string) error {
+	if fail, _ := vfs.inject(FAULT_DELETE); fail {
+		return fmt.Errorf("faultvfs: injected delete fault on %v", filename)
+	}
+	return vfs.Underlying.Delete(filename)
+}
+
+type faultFile struct {
+	vfs		*FaultVFS
+	file	File
+}
+
+func (f *faultFile) ReadAt(buffer []byte, offset int64) (int, error) {
+	if fail, _ := f.vfs.inject(FAULT_READ); fail {
+		return 0, fmt.Errorf("faultvfs: injected read fault at offset %v", offset)
+	}
+	return f.file.ReadAt(buffer, offset)
+}
+
+func (f *faultFile) WriteAt(buffer []byte, offset int64) (int, error) {
+	if fail, shortWrite := f.vfs.inject(FAULT_WRITE); fail {
+		if shortWrite > 0 && shortWrite < len(buffer) {
+			//	A torn write: persist a prefix, report complete success.
+			if _, err := f.file.WriteAt(buffer[:shortWrite], offset); err != nil {
+				return 0, err
+			}
+			return len(buffer), nil
+		}
+		return 0, fmt.Errorf("faultvfs: injected write fault at offset %v", offset)
+	}
+	return f.file.WriteAt(buffer, offset)
+}
+
+func (f *faultFile) Sync() error {
+	if fail, _ := f.vfs.inject(FAULT_SYNC); fail {
+		return fmt.Errorf("faultvfs: injected sync fault")
+	}
+	return f.file.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if fail, _ := f.vfs.inject(FAULT_TRUNCATE); fail {
+		return fmt.Errorf("faultvfs: injected truncate fault")
+	}
+	return f.file.Truncate(size)
+}
+
+func (f *faultFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,198 @@
+package serendipitytest
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//	This package provides the helpers a project needs to test code built on serendipity: in-memory database construction,
+//	fixture loading from SQL and CSV files, golden-file comparison of query results with stable formatting for floats and
+//	blobs, and a fault-injecting VFS for exercising I/O error paths.
+//
+//	The helpers talk to the engine through the narrow Database interface below rather than a concrete connection type, so they
+//	work equally well against the raw engine API or a database/sql wrapper.
+
+//	The subset of connection behaviour the test helpers require.
+type Database interface {
+	Exec(sql string, values ...interface{}) error
+	Query(sql string, values ...interface{}) (Rows, error)
+	Close() error
+}
+
+//	A Rows iterates over a result set one row at a time. Scan fills the supplied slice with nil, int64, float64, string or
+//	[]byte values, matching the engine's storage classes.
+type Rows interface {
+	Next() bool
+	Scan(values []interface{}) error
+	Columns() []string
+	Close() error
+}
+
+//	A Opener constructs a database connection from a filename, with ":memory:" producing a private in-memory database. The
+//	application registers its opener once, typically in TestMain, so that individual tests need no engine-specific setup.
+type Opener func(filename string) (Database, error)
+
+var opener	Opener
+
+//	Register the opener used by New and similar helpers. Must be called before any helper which constructs a database.
+func RegisterOpener(f Opener) {
+	opener = f
+}
+
+//	Create a private in-memory database for the duration of the test. The connection is closed automatically when the test
+//	finishes, with close errors failing the test so that leaked statements are noticed.
+func New(t testing.TB) Database {
+	t.Helper()
+	if opener == nil {
+		t.Fatal("serendipitytest: no opener registered; call RegisterOpener from TestMain")
+	}
+	db, err := opener(":memory:")
+	if err != nil {
+		t.Fatalf("serendipitytest: opening in-memory database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("serendipitytest: closing database: %v", err)
+		}
+	})
+	return db
+}
+
+//	Execute the statements in the named SQL file against the database. Statements are separated on semicolons at the end of a
+//	line, which is sufficient for fixture files and avoids dragging a full tokenizer into the test helpers.
+func LoadSQL(t testing.TB, db Database, filename string) {
+	t.Helper()
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("serendipitytest: reading fixture %v: %v", filename, err)
+	}
+	for _, statement := range strings.Split(string(content), ";\n") {
+		if statement = strings.TrimSpace(statement); statement == "" || strings.HasPrefix(statement, "--") {
+			continue
+		}
+		if err := db.Exec(statement); err != nil {
+			t.Fatalf("serendipitytest: executing fixture statement %q: %v", statement, err)
+		}
+	}
+}
+
+//	Load the named CSV file into the named table. The first record supplies the column names; every value is bound as text and
+//	left to the table's column affinities to convert, except that a completely empty field is bound as NULL.
+func LoadCSV(t testing.TB, db Database, table, filename string) {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("serendipitytest: opening fixture %v: %v", filename, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		t.Fatalf("serendipitytest: reading header of %v: %v", filename, err)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(header)), ", ")
+	insert := fmt.Sprintf("INSERT INTO %v (%v) VALUES (%v)", table, strings.Join(header, ", "), placeholders)
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		switch {
+		case err == io.EOF:
+			return
+		case err != nil:
+			t.Fatalf("serendipitytest: reading %v line %v: %v", filename, line, err)
+		}
+		values := make([]interface{}, len(record))
+		for i, field := range record {
+			if field != "" {
+				values[i] = field
+			}
+		}
+		if err := db.Exec(insert, values...); err != nil {
+			t.Fatalf("serendipitytest: inserting %v line %v: %v", filename, line, err)
+		}
+	}
+}
+
+//	Render a single value in the stable form used for golden files: NULL for nil, shortest round-trippable decimal for floats
+//	with a trailing ".0" forced onto integral values, x'..' hex for blobs, and SQL-quoted text.
+func FormatValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		switch {
+		case math.IsNaN(value):
+			return "NaN"
+		case math.IsInf(value, 0):
+			return fmt.Sprintf("%v", value)
+		}
+		s := strconv.FormatFloat(value, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eE") {
+			s += ".0"
+		}
+		return s
+	case []byte:
+		return "x'" + hex.EncodeToString(value) + "'"
+	case string:
+		return "'" + strings.Replace(value, "'", "''", -1) + "'"
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+//	Run the query and render its complete result set, one row per line with values separated by "|", in the stable form
+//	produced by FormatValue.
+func QueryText(t testing.TB, db Database, sql string, values ...interface{}) string {
+	t.Helper()
+	rows, err := db.Query(sql, values...)
+	if err != nil {
+		t.Fatalf("serendipitytest: query %q: %v", sql, err)
+	}
+	defer rows.Close()
+
+	var builder	strings.Builder
+	row := make([]interface{}, len(rows.Columns()))
+	for rows.Next() {
+		if err := rows.Scan(row); err != nil {
+			t.Fatalf("serendipitytest: scanning result of %q: %v", sql, err)
+		}
+		for i, value := range row {
+			if i > 0 {
+				builder.WriteByte('|')
+			}
+			builder.WriteString(FormatValue(value))
+		}
+		builder.WriteByte('\n')
+	}
+	return builder.String()
+}
+
+//	Compare the result of the query against the named golden file in testdata/. When the environment variable UPDATE_GOLDEN is
+//	non-empty the golden file is rewritten instead, which is the conventional workflow for reviewing intentional changes.
+func Golden(t testing.TB, db Database, goldenName, sql string, values ...interface{}) {
+	t.Helper()
+	actual := QueryText(t, db, sql, values...)
+	path := filepath.Join("testdata", goldenName)
+	if os.Getenv("UPDATE_GOLDEN") != "" {
+		if err := os.WriteFile(path, []byte(actual), 0644); err != nil {
+			t.Fatalf("serendipitytest: writing golden file %v: %v", path, err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("serendipitytest: reading golden file %v: %v", path, err)
+	}
+	if actual != string(expected) {
+		t.Errorf("serendipitytest: %v mismatch\nexpected:\n%v\nactual:\n%v", goldenName, string(expected), actual)
+	}
+}
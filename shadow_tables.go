@@ -0,0 +1,150 @@
+package serendipity
+
+//	This file provides the shadow-table management helper shared by virtual table modules. Modules which persist their state
+//	in ordinary tables - rtree's %_node/%_rowid/%_parent, FTS's segment tables, and the like - all need the same plumbing:
+//	consistent naming from a table prefix, creation with initial content, per-table read/write/delete prepared statements,
+//	and drop/rename that keeps the set consistent. ShadowTables packages that plumbing once so that a new module declares
+//	its tables and gets the rest.
+
+//	The declaration of one shadow table: its suffix and column definitions, plus optional SQL run once at creation time
+//	(with the usual '%q'.'%q_suffix' substitution applied) to seed initial content.
+type ShadowTableSpec struct {
+	Suffix		string		//	Appended to the owning table's name as "<table>_<suffix>"
+	Columns		string		//	Column definitions, e.g. "nodeno INTEGER PRIMARY KEY, data BLOB"
+	KeyColumn	string		//	The column used by the generated read/write/delete statements
+	DataColumns	string		//	The remaining columns, comma separated, for the generated statements
+	InitialRow	string		//	Optional VALUES clause inserted at creation, e.g. "1, zeroblob(%d)"
+}
+
+//	The per-table prepared statement bundle generated for each shadow table.
+type ShadowStatements struct {
+	Read	*sqlite3_stmt	//	SELECT <data> FROM table WHERE <key> = :1
+	Write	*sqlite3_stmt	//	INSERT OR REPLACE INTO table VALUES(:1, ...)
+	Delete	*sqlite3_stmt	//	DELETE FROM table WHERE <key> = :1
+}
+
+//	A ShadowTables manages the complete set of shadow tables for one virtual table instance.
+type ShadowTables struct {
+	db			*sqlite3
+	zDb			string		//	Database holding the shadow tables
+	zPrefix		string		//	The owning virtual table's name
+	specs		[]ShadowTableSpec
+	Statements	map[string]*ShadowStatements	//	Keyed by suffix
+}
+
+//	Create a manager for the given table declarations. No SQL runs until Create or Prepare.
+func NewShadowTables(db *sqlite3, zDb, zPrefix string, specs []ShadowTableSpec) *ShadowTables {
+	return &ShadowTables{ db: db, zDb: zDb, zPrefix: zPrefix, specs: specs, Statements: make(map[string]*ShadowStatements) }
+}
+
+//	The qualified name of the shadow table with the given suffix, quoted for interpolation.
+func (s *ShadowTables) name(suffix string) string {
+	return sqlite3_mprintf("'%q'.'%q_%s'", s.zDb, s.zPrefix, suffix)
+}
+
+//	How many of the declared tables currently exist. The same 0 / all / partial distinction countShadowTables makes for the
+//	rtree module, generalised to any declared set.
+func (s *ShadowTables) Present() (present int) {
+	for _, spec := range s.specs {
+		sql := sqlite3_mprintf(
+			"SELECT count(*) FROM %Q.sqlite_master WHERE type = 'table' AND name = '%q_%s'",
+			s.zDb, s.zPrefix, spec.Suffix,
+		)
+		if n, _ := s.db.GetIntFromStmt(sql); n != 0 {
+			present++
+		}
+	}
+	return
+}
+
+//	Create every declared table, seeding initial rows where declared. Creation runs as one script so that a failure part-way
+//	is rolled back with the enclosing statement transaction rather than leaving a partial set.
+func (s *ShadowTables) Create() (rc int) {
+	script := ""
+	for _, spec := range s.specs {
+		script += sqlite3_mprintf("CREATE TABLE \"%w\".\"%w_%s\"(%s); ", s.zDb, s.zPrefix, spec.Suffix, spec.Columns)
+		if spec.InitialRow != "" {
+			script += sqlite3_mprintf("INSERT INTO %s VALUES(%s); ", s.name(spec.Suffix), spec.InitialRow)
+		}
+	}
+	return sqlite3_exec(s.db, script, 0, 0, 0)
+}
+
+//	Prepare the read/write/delete statements for every declared table. Statements already prepared are retained, so Prepare
+//	is idempotent and cheap to call from both xCreate and xConnect paths.
+func (s *ShadowTables) Prepare() (rc int) {
+	for _, spec := range s.specs {
+		if s.Statements[spec.Suffix] != nil {
+			continue
+		}
+		statements := &ShadowStatements{}
+		table := s.name(spec.Suffix)
+		//	One parameter for the key plus one per data column, in declaration order.
+		values := ":1"
+		parameter := 2
+		for i := 0; spec.DataColumns != "" && i <= len(spec.DataColumns); i++ {
+			if i == len(spec.DataColumns) || spec.DataColumns[i] == ',' {
+				values += sqlite3_mprintf(", :%d", parameter)
+				parameter++
+			}
+		}
+		sources := []struct {
+			sql		string
+			target	**sqlite3_stmt
+		}{
+			{ sqlite3_mprintf("SELECT %s FROM %s WHERE %s = :1", spec.DataColumns, table, spec.KeyColumn), &statements.Read },
+			{ sqlite3_mprintf("INSERT OR REPLACE INTO %s VALUES(%s)", table, values), &statements.Write },
+			{ sqlite3_mprintf("DELETE FROM %s WHERE %s = :1", table, spec.KeyColumn), &statements.Delete },
+		}
+		for _, source := range sources {
+			if *source.target, _, rc = s.db.Prepare_v2(source.sql); rc != SQLITE_OK {
+				return
+			}
+		}
+		s.Statements[spec.Suffix] = statements
+	}
+	return SQLITE_OK
+}
+
+//	Finalize every prepared statement. Called from the module's xDisconnect and xDestroy paths.
+func (s *ShadowTables) Finalize() {
+	for suffix, statements := range s.Statements {
+		for _, statement := range []*sqlite3_stmt{ statements.Read, statements.Write, statements.Delete } {
+			if statement != nil {
+				statement.Finalize()
+			}
+		}
+		delete(s.Statements, suffix)
+	}
+}
+
+//	Drop every declared table, tolerating tables already missing so that a damaged set can always be cleared.
+func (s *ShadowTables) Drop() (rc int) {
+	s.Finalize()
+	script := ""
+	for _, spec := range s.specs {
+		script += sqlite3_mprintf("DROP TABLE IF EXISTS %s; ", s.name(spec.Suffix))
+	}
+	return sqlite3_exec(s.db, script, 0, 0, 0)
+}
+
+//	Rename the whole set to a new prefix, atomically via a savepoint as in rtreeRename. Prepared statements are finalized
+//	first since they reference the old names.
+func (s *ShadowTables) Rename(newPrefix string) (rc int) {
+	s.Finalize()
+	if rc = sqlite3_exec(s.db, "SAVEPOINT shadow_rename", 0, 0, 0); rc != SQLITE_OK {
+		return
+	}
+	for _, spec := range s.specs {
+		sql := sqlite3_mprintf("ALTER TABLE %s RENAME TO \"%w_%s\"", s.name(spec.Suffix), newPrefix, spec.Suffix)
+		if rc = sqlite3_exec(s.db, sql, 0, 0, 0); rc != SQLITE_OK {
+			sqlite3_exec(s.db, "ROLLBACK TO shadow_rename", 0, 0, 0)
+			break
+		}
+	}
+	sqlite3_exec(s.db, "RELEASE shadow_rename", 0, 0, 0)
+	if rc == SQLITE_OK {
+		s.zPrefix = newPrefix
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package serendipity
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+//	This file implements a built-in slow-query logger layered on the statement profile hook. Statements whose execution time
+//	exceeds a configurable threshold are reported through a caller-supplied slog.Logger, with sampling available to bound the
+//	overhead on workloads where many statements cross the threshold at once.
+
+//	A StatementProfile describes one completed statement execution as seen by the profile hook. The expanded SQL has bound
+//	parameter values substituted into the original text; the plan summary is the same brief form reported by EXPLAIN QUERY PLAN.
+type StatementProfile struct {
+	Sql			string			//	The original statement text
+	ExpandedSql	string			//	The statement text with bound parameters expanded
+	Plan		string			//	One-line query plan summary
+	Duration	time.Duration	//	Wall-clock time spent executing the statement
+	WaitTime	time.Duration	//	Portion of Duration spent waiting on locks or busy handlers
+	RowsExamined	int64		//	Number of rows visited while producing the result
+	RowsReturned	int64		//	Number of rows delivered to the caller
+}
+
+//	A ProfileHook receives a StatementProfile each time a statement finishes executing on the connection it is attached to.
+type ProfileHook func(profile *StatementProfile)
+
+//	A SlowQueryLogger logs statements which run for longer than Threshold. When SampleInterval is N > 1, only every Nth slow
+//	statement is logged; the suppressed count is attached to the next logged record so that no information is silently lost.
+type SlowQueryLogger struct {
+	Logger			*slog.Logger	//	Destination for log records; slog.Default() is used when nil
+	Threshold		time.Duration	//	Statements faster than this are ignored
+	SampleInterval	int64			//	Log one slow statement in every SampleInterval; values < 2 log them all
+	seen			int64			//	Count of slow statements observed, including suppressed ones
+	suppressed		int64			//	Slow statements suppressed since the last logged record
+}
+
+//	Observe implements the profile hook. It is safe for concurrent use from multiple connections sharing one logger.
+func (l *SlowQueryLogger) Observe(profile *StatementProfile) {
+	if profile.Duration < l.Threshold {
+		return
+	}
+	if interval := l.SampleInterval; interval > 1 {
+		if atomic.AddInt64(&l.seen, 1) % interval != 1 {
+			atomic.AddInt64(&l.suppressed, 1)
+			return
+		}
+	}
+	logger := l.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	suppressed := atomic.SwapInt64(&l.suppressed, 0)
+	logger.Warn("slow query",
+		slog.String("sql", profile.ExpandedSql),
+		slog.String("plan", profile.Plan),
+		slog.Duration("duration", profile.Duration),
+		slog.Duration("wait", profile.WaitTime),
+		slog.Int64("rows_examined", profile.RowsExamined),
+		slog.Int64("rows_returned", profile.RowsReturned),
+		slog.Int64("suppressed", suppressed),
+	)
+}
+
+//	Install a profile hook on the connection, replacing any hook previously installed. A nil hook disables profiling.
+func (db *sqlite3) SetProfileHook(hook ProfileHook) {
+	db.CriticalSection(func() {
+		db.xProfile = hook
+	})
+}
+
+//	Attach a slow-query logger to the connection. This is a convenience wrapper around SetProfileHook; callers needing to
+//	combine the logger with another profile hook should install their own hook and call Observe from it.
+func (db *sqlite3) AttachSlowQueryLogger(logger *SlowQueryLogger) {
+	db.SetProfileHook(logger.Observe)
+}
+
+//	Invoke the profile hook, if one is installed, for a statement which has just finished executing. Statement execution calls
+//	this on every exit path, including error paths, so that slow statements which ultimately fail are still reported.
+func (db *sqlite3) profileStatement(profile *StatementProfile) {
+	if db.xProfile != nil {
+		db.xProfile(profile)
+	}
+}
@@ -0,0 +1,164 @@
+package serendipity
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+//	This file implements multi-version concurrency for readers. Each read transaction pins an immutable Snapshot - a commit
+//	sequence number plus, in WAL mode, the read-mark identifying how much of the WAL is visible - and every page fetch on
+//	behalf of that transaction resolves against the snapshot rather than the live file. Writers publish a new version of each
+//	page they modify instead of overwriting the version readers may still be using, so within a single process readers never
+//	block writers and writers never block readers. Writers themselves remain serialized against one another, which is what
+//	gives them SERIALIZABLE semantics: each write transaction begins from the newest committed snapshot and commits atomically
+//	by publishing a new commit sequence number.
+
+//	A Snapshot identifies one committed state of the database. Snapshots are immutable and may be shared between cursors of
+//	the same read transaction.
+type Snapshot struct {
+	sequence	uint64		//	The commit sequence number this snapshot observes
+	readMark	uint32		//	In WAL mode, the last WAL frame visible to this snapshot
+	versions	*pageVersionTable
+	refs		int64		//	Number of open transactions pinning this snapshot
+}
+
+//	A single versioned page image. Versions for one page number form a list ordered from newest to oldest; a snapshot at
+//	sequence S sees the newest version whose sequence is <= S.
+type pageVersion struct {
+	sequence	uint64
+	data		[]byte
+	older		*pageVersion
+}
+
+//	The version table shared by all connections on one database file. Pages with no entry have never been modified since the
+//	oldest live snapshot and are read directly from the file or pager cache.
+type pageVersionTable struct {
+	mutex		sync.RWMutex
+	sequence	uint64					//	The newest committed sequence number
+	pages		map[uint32]*pageVersion
+	oldest		uint64					//	The reclamation horizon: versions superseded at or below this sequence are invisible to every live snapshot
+	live		map[*Snapshot]bool		//	Snapshots still pinned, from which the horizon is recomputed as readers end
+}
+
+func newPageVersionTable() *pageVersionTable {
+	return &pageVersionTable{ pages: make(map[uint32]*pageVersion), live: make(map[*Snapshot]bool) }
+}
+
+//	Pin a snapshot of the current committed state. The returned snapshot remains valid until Release is called, regardless of
+//	how many transactions commit in the meantime.
+func (table *pageVersionTable) Pin(readMark uint32) *Snapshot {
+	table.mutex.Lock()
+	snapshot := &Snapshot{ sequence: table.sequence, readMark: readMark, versions: table, refs: 1 }
+	table.live[snapshot] = true
+	table.mutex.Unlock()
+	return snapshot
+}
+
+//	Release the snapshot. When the last reference is dropped the reclamation horizon advances past everything only this
+//	snapshot could see, and the version table reclaims accordingly.
+func (snapshot *Snapshot) Release() {
+	if atomic.AddInt64(&snapshot.refs, -1) == 0 {
+		snapshot.versions.unpin(snapshot)
+		snapshot.versions.reclaim()
+	}
+}
+
+//	Forget an ended snapshot and recompute the reclamation horizon from those still live. When none remain, every version
+//	superseded by the newest commit is invisible to all future snapshots as well - they will pin the current sequence or
+//	later - so the horizon advances to the current sequence; resetting it to zero here would make reclaim a no-op exactly
+//	when there is most to reclaim.
+func (table *pageVersionTable) unpin(snapshot *Snapshot) {
+	table.mutex.Lock()
+	delete(table.live, snapshot)
+	table.oldest = table.sequence
+	for live := range table.live {
+		if live.sequence < table.oldest {
+			table.oldest = live.sequence
+		}
+	}
+	table.mutex.Unlock()
+}
+
+//	Resolve a page fetch against the snapshot. A nil return means no retained version is applicable and the caller should
+//	read the page through the pager as usual - with the snapshot's read-mark bounding how far into the WAL that read may look.
+func (snapshot *Snapshot) Page(pageNumber uint32) []byte {
+	table := snapshot.versions
+	table.mutex.RLock()
+	defer table.mutex.RUnlock()
+	for version := table.pages[pageNumber]; version != nil; version = version.older {
+		if version.sequence <= snapshot.sequence {
+			return version.data
+		}
+	}
+	return nil
+}
+
+//	A writeSet accumulates the page images of an in-flight write transaction. Nothing in the write set is visible to any
+//	snapshot until Publish, which is the commit point for in-process readers.
+type writeSet struct {
+	table	*pageVersionTable
+	pages	map[uint32][]byte
+}
+
+func (table *pageVersionTable) NewWriteSet() *writeSet {
+	return &writeSet{ table: table, pages: make(map[uint32][]byte) }
+}
+
+//	Record the new image of a page. The image is copied so that the caller may reuse its buffer.
+func (w *writeSet) WritePage(pageNumber uint32, data []byte) {
+	w.pages[pageNumber] = append([]byte{}, data...)
+}
+
+//	Atomically publish the write set as the next commit. Existing snapshots continue to see the versions they pinned; new
+//	snapshots see the published pages. Returns the new commit sequence number.
+func (w *writeSet) Publish() uint64 {
+	table := w.table
+	table.mutex.Lock()
+	table.sequence++
+	for pageNumber, data := range w.pages {
+		table.pages[pageNumber] = &pageVersion{ sequence: table.sequence, data: data, older: table.pages[pageNumber] }
+	}
+	sequence := table.sequence
+	table.mutex.Unlock()
+	w.pages = nil
+	return sequence
+}
+
+//	Discard the write set without publishing anything.
+func (w *writeSet) Rollback() {
+	w.pages = nil
+}
+
+//	Drop page versions no live snapshot can see. A version is reclaimable when a newer version of the same page exists whose
+//	sequence is still <= the oldest pinned snapshot.
+func (table *pageVersionTable) reclaim() {
+	table.mutex.Lock()
+	for pageNumber, version := range table.pages {
+		for v := version; v != nil; v = v.older {
+			if v.sequence <= table.oldest {
+				v.older = nil
+				break
+			}
+		}
+		if version.older == nil && version.sequence < table.oldest && table.oldest > 0 {
+			//	The sole surviving version is also on disk by now; the map entry is only needed while readers might
+			//	otherwise see a newer image than their snapshot allows.
+			delete(table.pages, pageNumber)
+		}
+	}
+	table.mutex.Unlock()
+}
+
+//	Begin a snapshot-isolated read transaction on the connection. The returned snapshot must be released when the transaction
+//	ends; the engine's own transaction machinery does this from its commit and rollback paths.
+func (db *sqlite3) BeginSnapshotRead() (snapshot *Snapshot, err error) {
+	pager := db.MainPager()
+	if pager == nil {
+		return nil, fmt.Errorf("connection has no open database")
+	}
+	if pager.versions == nil {
+		pager.versions = newPageVersionTable()
+	}
+	return pager.versions.Pin(pager.WalReadMark()), nil
+}
@@ -0,0 +1,611 @@
+package serendipity
+
+import (
+	"strings"
+)
+
+//	This file exposes a structural form of SQL for tooling. Applications that rewrite queries - linters, query
+//	builders, multi-tenant row filters - have historically done it with string surgery, which breaks on the
+//	first quoted identifier or nested parenthesis it meets. ParseSelect turns a statement into a tree of typed
+//	nodes over the scanner in sql_validate.go; every node knows how to render itself back, so a rewrite is an
+//	ordinary tree edit followed by RenderSql:
+//
+//		statement, diagnostic := ParseSelect("SELECT name FROM users WHERE active")
+//		statement.AndWhere(&BinaryExpr{ Op: "=", Left: &ColumnRef{ Name: "tenant_id" }, Right: &Variable{ Name: "?" } })
+//		sql := RenderSql(statement)
+//
+//	The grammar covered is the workhorse subset: SELECT with DISTINCT, result aliases, a FROM list with joins,
+//	WHERE, GROUP BY/HAVING, ORDER BY and LIMIT/OFFSET, over expressions built from literals, column references,
+//	variables, function calls and the usual unary and binary operators. A construct outside the subset is
+//	reported as a diagnostic rather than mangled - a tool that cannot represent a statement faithfully must say
+//	so, not guess.
+
+//	An expression node. Render appends the node's SQL text; every concrete node type is exported so tools can
+//	both inspect and construct trees.
+type SqlExpr interface {
+	Render(text *strings.Builder)
+}
+
+//	A column reference, optionally qualified.
+type ColumnRef struct {
+	Table	string
+	Name	string
+}
+
+//	A literal in its source spelling: a number, a 'string' (quotes included by Render), NULL.
+type Literal struct {
+	Text		string
+	IsString	bool
+}
+
+//	A bound-parameter reference: ?, ?NNN, :name, @name or $name.
+type Variable struct {
+	Name	string
+}
+
+//	A function call; Star is count(*).
+type Call struct {
+	Name		string
+	Distinct	bool
+	Star		bool
+	Args		[]SqlExpr
+}
+
+type UnaryExpr struct {
+	Op		string
+	Operand	SqlExpr
+}
+
+type BinaryExpr struct {
+	Op		string
+	Left	SqlExpr
+	Right	SqlExpr
+}
+
+//	An explicitly parenthesised subexpression. The parser records the author's parentheses rather than deriving
+//	its own from precedence, so a parse/render round trip reproduces the original shape.
+type ParenExpr struct {
+	Operand	SqlExpr
+}
+
+func quoteSqlIdentifier(zName string) string {
+	plain := len(zName) > 0 && !sqlKeywords[strings.ToUpper(zName)]
+	for i := 0; plain && i < len(zName); i++ {
+		plain = isSqlIdentifierByte(zName[i]) && !(i == 0 && isSqlDigit(zName[i]))
+	}
+	if plain {
+		return zName
+	}
+	return "\"" + strings.Replace(zName, "\"", "\"\"", -1) + "\""
+}
+
+func (expr *ColumnRef) Render(text *strings.Builder) {
+	if expr.Table != "" {
+		text.WriteString(quoteSqlIdentifier(expr.Table))
+		text.WriteString(".")
+	}
+	text.WriteString(quoteSqlIdentifier(expr.Name))
+}
+
+func (expr *Literal) Render(text *strings.Builder) {
+	if expr.IsString {
+		text.WriteString("'" + strings.Replace(expr.Text, "'", "''", -1) + "'")
+	} else {
+		text.WriteString(expr.Text)
+	}
+}
+
+func (expr *Variable) Render(text *strings.Builder) {
+	text.WriteString(expr.Name)
+}
+
+func (expr *Call) Render(text *strings.Builder) {
+	text.WriteString(quoteSqlIdentifier(expr.Name))
+	text.WriteString("(")
+	switch {
+	case expr.Star:
+		text.WriteString("*")
+	default:
+		if expr.Distinct {
+			text.WriteString("DISTINCT ")
+		}
+		for i, arg := range expr.Args {
+			if i > 0 {
+				text.WriteString(", ")
+			}
+			arg.Render(text)
+		}
+	}
+	text.WriteString(")")
+}
+
+func (expr *UnaryExpr) Render(text *strings.Builder) {
+	text.WriteString(expr.Op)
+	if len(expr.Op) > 1 {
+		//	A word operator such as NOT needs the space; -x does not.
+		text.WriteString(" ")
+	}
+	expr.Operand.Render(text)
+}
+
+func (expr *BinaryExpr) Render(text *strings.Builder) {
+	expr.Left.Render(text)
+	text.WriteString(" " + expr.Op + " ")
+	expr.Right.Render(text)
+}
+
+func (expr *ParenExpr) Render(text *strings.Builder) {
+	text.WriteString("(")
+	expr.Operand.Render(text)
+	text.WriteString(")")
+}
+
+//	One result column; a nil Expr with Star set is the bare *.
+type ResultColumn struct {
+	Expr	SqlExpr
+	Alias	string
+	Star	bool
+}
+
+//	One FROM-list entry. Join is the join keyword text for the second and later entries ("," for the comma
+//	form); On is its constraint when one was written.
+type TableRef struct {
+	Name	string
+	Alias	string
+	Join	string
+	On		SqlExpr
+}
+
+type OrderingTerm struct {
+	Expr	SqlExpr
+	Desc	bool
+	Nulls	byte	//	NULLS_DEFAULT / NULLS_FIRST / NULLS_LAST - see nulls_ordering.go
+}
+
+//	A SELECT statement.
+type SelectStatement struct {
+	Distinct	bool
+	Columns		[]*ResultColumn
+	From		[]*TableRef
+	Where		SqlExpr
+	GroupBy		[]SqlExpr
+	Having		SqlExpr
+	OrderBy		[]*OrderingTerm
+	Limit		SqlExpr
+	Offset		SqlExpr
+}
+
+//	Conjoin a predicate onto the WHERE clause, parenthesising the existing clause so an OR inside it cannot
+//	leak around the new term. This is the primitive statement rewriters build on.
+func (statement *SelectStatement) AndWhere(predicate SqlExpr) *SelectStatement {
+	if statement.Where == nil {
+		statement.Where = predicate
+	} else {
+		statement.Where = &BinaryExpr{ Op: "AND", Left: &ParenExpr{ Operand: statement.Where }, Right: predicate }
+	}
+	return statement
+}
+
+func (statement *SelectStatement) Render(text *strings.Builder) {
+	text.WriteString("SELECT ")
+	if statement.Distinct {
+		text.WriteString("DISTINCT ")
+	}
+	for i, column := range statement.Columns {
+		if i > 0 {
+			text.WriteString(", ")
+		}
+		if column.Star {
+			text.WriteString("*")
+		} else {
+			column.Expr.Render(text)
+		}
+		if column.Alias != "" {
+			text.WriteString(" AS " + quoteSqlIdentifier(column.Alias))
+		}
+	}
+	for i, reference := range statement.From {
+		switch {
+		case i == 0:
+			text.WriteString(" FROM ")
+		case reference.Join == ",":
+			text.WriteString(", ")
+		default:
+			text.WriteString(" " + reference.Join + " ")
+		}
+		text.WriteString(quoteSqlIdentifier(reference.Name))
+		if reference.Alias != "" {
+			text.WriteString(" AS " + quoteSqlIdentifier(reference.Alias))
+		}
+		if reference.On != nil {
+			text.WriteString(" ON ")
+			reference.On.Render(text)
+		}
+	}
+	if statement.Where != nil {
+		text.WriteString(" WHERE ")
+		statement.Where.Render(text)
+	}
+	if len(statement.GroupBy) > 0 {
+		text.WriteString(" GROUP BY ")
+		for i, term := range statement.GroupBy {
+			if i > 0 {
+				text.WriteString(", ")
+			}
+			term.Render(text)
+		}
+	}
+	if statement.Having != nil {
+		text.WriteString(" HAVING ")
+		statement.Having.Render(text)
+	}
+	if len(statement.OrderBy) > 0 {
+		text.WriteString(" ORDER BY ")
+		for i, term := range statement.OrderBy {
+			if i > 0 {
+				text.WriteString(", ")
+			}
+			term.Expr.Render(text)
+			if term.Desc {
+				text.WriteString(" DESC")
+			}
+			switch term.Nulls {
+			case NULLS_FIRST:
+				text.WriteString(" NULLS FIRST")
+			case NULLS_LAST:
+				text.WriteString(" NULLS LAST")
+			}
+		}
+	}
+	if statement.Limit != nil {
+		text.WriteString(" LIMIT ")
+		statement.Limit.Render(text)
+		if statement.Offset != nil {
+			text.WriteString(" OFFSET ")
+			statement.Offset.Render(text)
+		}
+	}
+}
+
+//	Render any node - statement or expression - to SQL text.
+func RenderSql(node SqlExpr) string {
+	text := &strings.Builder{}
+	node.Render(text)
+	return text.String()
+}
+
+//	The parser: a recursive-descent walk over the token stream with precedence climbing for expressions. It
+//	stops at the first construct outside the supported subset and reports where and what.
+type sqlParser struct {
+	tokens		[]sqlToken
+	at			int
+	diagnostic	*Diagnostic
+}
+
+func (parser *sqlParser) fail(message string) {
+	position := 0
+	if parser.at < len(parser.tokens) {
+		position = parser.tokens[parser.at].position
+	} else if len(parser.tokens) > 0 {
+		position = parser.tokens[len(parser.tokens) - 1].position
+	}
+	if parser.diagnostic == nil {
+		parser.diagnostic = &Diagnostic{ Position: position, Kind: DIAG_SYNTAX, Message: message }
+	}
+}
+
+func (parser *sqlParser) peek() sqlToken {
+	if parser.at < len(parser.tokens) {
+		return parser.tokens[parser.at]
+	}
+	return sqlToken{ kind: SQLTOKEN_PUNCT }
+}
+
+func (parser *sqlParser) acceptKeyword(keywords ...string) string {
+	token := parser.peek()
+	if token.kind == SQLTOKEN_IDENTIFIER {
+		for _, keyword := range keywords {
+			if strings.ToUpper(token.text) == keyword {
+				parser.at++
+				return keyword
+			}
+		}
+	}
+	return ""
+}
+
+func (parser *sqlParser) acceptPunct(text string) bool {
+	if token := parser.peek(); token.kind == SQLTOKEN_PUNCT && token.text == text {
+		parser.at++
+		return true
+	}
+	return false
+}
+
+//	Binding powers, loosest first. Word operators are folded to upper case before lookup so their rendered form
+//	is canonical whatever the source spelled.
+var sqlBinaryPrecedence = map[string]int{
+	"OR": 1, "AND": 2,
+	"=": 4, "==": 4, "!=": 4, "<>": 4, "IS": 4, "IN": 4, "LIKE": 4, "GLOB": 4, "MATCH": 4, "REGEXP": 4,
+	"<": 5, "<=": 5, ">": 5, ">=": 5,
+	"||": 6, "+": 7, "-": 7, "*": 8, "/": 8, "%": 8,
+}
+
+//	The operator at the cursor, the number of tokens it spans, and its binding power - zero when what follows is
+//	not a binary operator. The scanner emits punctuation a byte at a time, so <=, <>, != and || span two tokens.
+func (parser *sqlParser) binaryOperator() (op string, width, precedence int) {
+	token := parser.peek()
+	switch token.kind {
+	case SQLTOKEN_IDENTIFIER:
+		op, width = strings.ToUpper(token.text), 1
+	case SQLTOKEN_PUNCT:
+		op, width = token.text, 1
+		if parser.at + 1 < len(parser.tokens) && parser.tokens[parser.at + 1].kind == SQLTOKEN_PUNCT {
+			if glued := op + parser.tokens[parser.at + 1].text; sqlBinaryPrecedence[glued] > 0 {
+				return glued, 2, sqlBinaryPrecedence[glued]
+			}
+		}
+	}
+	return op, width, sqlBinaryPrecedence[op]
+}
+
+func (parser *sqlParser) parseExpression(precedence int) SqlExpr {
+	left := parser.parsePrimary()
+	for left != nil {
+		op, width, opPrecedence := parser.binaryOperator()
+		if opPrecedence == 0 || opPrecedence < precedence {
+			return left
+		}
+		parser.at += width
+		if op == "IS" && parser.acceptKeyword("NOT") != "" {
+			op = "IS NOT"
+		}
+		right := parser.parseExpression(opPrecedence + 1)
+		if right == nil {
+			return nil
+		}
+		left = &BinaryExpr{ Op: op, Left: left, Right: right }
+	}
+	return nil
+}
+
+func (parser *sqlParser) parsePrimary() SqlExpr {
+	token := parser.peek()
+	switch {
+	case token.kind == SQLTOKEN_NUMBER:
+		parser.at++
+		return &Literal{ Text: token.text }
+	case token.kind == SQLTOKEN_STRING:
+		parser.at++
+		return &Literal{ Text: token.text, IsString: true }
+	case token.kind == SQLTOKEN_VARIABLE:
+		parser.at++
+		return &Variable{ Name: token.text }
+	case token.kind == SQLTOKEN_PUNCT && token.text == "(":
+		parser.at++
+		operand := parser.parseExpression(1)
+		if operand == nil || !parser.acceptPunct(")") {
+			parser.fail("expected )")
+			return nil
+		}
+		return &ParenExpr{ Operand: operand }
+	case token.kind == SQLTOKEN_PUNCT && (token.text == "-" || token.text == "+"):
+		parser.at++
+		if operand := parser.parsePrimary(); operand != nil {
+			return &UnaryExpr{ Op: token.text, Operand: operand }
+		}
+		return nil
+	case parser.acceptKeyword("NOT") != "":
+		if operand := parser.parseExpression(3); operand != nil {
+			return &UnaryExpr{ Op: "NOT", Operand: operand }
+		}
+		return nil
+	case parser.acceptKeyword("NULL") != "":
+		return &Literal{ Text: "NULL" }
+	case token.kind == SQLTOKEN_IDENTIFIER && !isSqlKeyword(token):
+		parser.at++
+		if parser.acceptPunct("(") {
+			call := &Call{ Name: token.text }
+			switch {
+			case parser.acceptPunct("*"):
+				call.Star = true
+			case parser.acceptPunct(")"):
+				return call
+			default:
+				call.Distinct = parser.acceptKeyword("DISTINCT") != ""
+				for {
+					arg := parser.parseExpression(1)
+					if arg == nil {
+						return nil
+					}
+					call.Args = append(call.Args, arg)
+					if !parser.acceptPunct(",") {
+						break
+					}
+				}
+			}
+			if !parser.acceptPunct(")") {
+				parser.fail("expected )")
+				return nil
+			}
+			return call
+		}
+		if parser.acceptPunct(".") {
+			name := parser.peek()
+			if name.kind != SQLTOKEN_IDENTIFIER {
+				parser.fail("expected column name")
+				return nil
+			}
+			parser.at++
+			return &ColumnRef{ Table: token.text, Name: name.text }
+		}
+		return &ColumnRef{ Name: token.text }
+	}
+	parser.fail("unsupported expression")
+	return nil
+}
+
+func (parser *sqlParser) parseTableRef(join string) *TableRef {
+	name := parser.peek()
+	if name.kind != SQLTOKEN_IDENTIFIER || isSqlKeyword(name) {
+		parser.fail("expected table name")
+		return nil
+	}
+	parser.at++
+	reference := &TableRef{ Name: name.text, Join: join }
+	parser.acceptKeyword("AS")
+	if alias := parser.peek(); alias.kind == SQLTOKEN_IDENTIFIER && !isSqlKeyword(alias) {
+		parser.at++
+		reference.Alias = alias.text
+	}
+	return reference
+}
+
+//	Parse a SELECT statement. On success the diagnostic is nil; on failure the statement is nil and the
+//	diagnostic says where the parse stopped and why.
+func ParseSelect(sql string) (statement *SelectStatement, diagnostic *Diagnostic) {
+	tokens, diagnostics := sqlScan(sql)
+	if len(diagnostics) > 0 {
+		return nil, &diagnostics[0]
+	}
+	parser := &sqlParser{ tokens: tokens }
+	if parser.acceptKeyword("SELECT") == "" {
+		parser.fail("expected SELECT")
+		return nil, parser.diagnostic
+	}
+	statement = &SelectStatement{ Distinct: parser.acceptKeyword("DISTINCT") != "" }
+	parser.acceptKeyword("ALL")
+
+	for {
+		column := &ResultColumn{}
+		if parser.acceptPunct("*") {
+			column.Star = true
+		} else {
+			if column.Expr = parser.parseExpression(1); column.Expr == nil {
+				return nil, parser.diagnostic
+			}
+			if parser.acceptKeyword("AS") != "" || parser.peek().kind == SQLTOKEN_IDENTIFIER && !isSqlKeyword(parser.peek()) {
+				column.Alias = parser.peek().text
+				parser.at++
+			}
+		}
+		statement.Columns = append(statement.Columns, column)
+		if !parser.acceptPunct(",") {
+			break
+		}
+	}
+
+	if parser.acceptKeyword("FROM") != "" {
+		reference := parser.parseTableRef("")
+		if reference == nil {
+			return nil, parser.diagnostic
+		}
+		statement.From = append(statement.From, reference)
+		for {
+			join := ""
+			switch {
+			case parser.acceptPunct(","):
+				join = ","
+			case parser.acceptKeyword("JOIN") != "":
+				join = "JOIN"
+			case parser.acceptKeyword("LEFT") != "":
+				parser.acceptKeyword("OUTER")
+				if parser.acceptKeyword("JOIN") == "" {
+					parser.fail("expected JOIN")
+					return nil, parser.diagnostic
+				}
+				join = "LEFT JOIN"
+			case parser.acceptKeyword("INNER") != "" || parser.acceptKeyword("CROSS") != "":
+				if parser.acceptKeyword("JOIN") == "" {
+					parser.fail("expected JOIN")
+					return nil, parser.diagnostic
+				}
+				join = "JOIN"
+			}
+			if join == "" {
+				break
+			}
+			if reference = parser.parseTableRef(join); reference == nil {
+				return nil, parser.diagnostic
+			}
+			if join != "," && parser.acceptKeyword("ON") != "" {
+				if reference.On = parser.parseExpression(1); reference.On == nil {
+					return nil, parser.diagnostic
+				}
+			}
+			statement.From = append(statement.From, reference)
+		}
+	}
+
+	if parser.acceptKeyword("WHERE") != "" {
+		if statement.Where = parser.parseExpression(1); statement.Where == nil {
+			return nil, parser.diagnostic
+		}
+	}
+	if parser.acceptKeyword("GROUP") != "" {
+		if parser.acceptKeyword("BY") == "" {
+			parser.fail("expected BY")
+			return nil, parser.diagnostic
+		}
+		for {
+			term := parser.parseExpression(1)
+			if term == nil {
+				return nil, parser.diagnostic
+			}
+			statement.GroupBy = append(statement.GroupBy, term)
+			if !parser.acceptPunct(",") {
+				break
+			}
+		}
+		if parser.acceptKeyword("HAVING") != "" {
+			if statement.Having = parser.parseExpression(1); statement.Having == nil {
+				return nil, parser.diagnostic
+			}
+		}
+	}
+	if parser.acceptKeyword("ORDER") != "" {
+		if parser.acceptKeyword("BY") == "" {
+			parser.fail("expected BY")
+			return nil, parser.diagnostic
+		}
+		for {
+			term := &OrderingTerm{ Nulls: NULLS_DEFAULT }
+			if term.Expr = parser.parseExpression(1); term.Expr == nil {
+				return nil, parser.diagnostic
+			}
+			if parser.acceptKeyword("DESC") != "" {
+				term.Desc = true
+			} else {
+				parser.acceptKeyword("ASC")
+			}
+			if parser.acceptKeyword("NULLS") != "" {
+				nulls, ok := parseNullsClause(parser.acceptKeyword("FIRST", "LAST"))
+				if !ok {
+					parser.fail("expected FIRST or LAST")
+					return nil, parser.diagnostic
+				}
+				term.Nulls = nulls
+			}
+			statement.OrderBy = append(statement.OrderBy, term)
+			if !parser.acceptPunct(",") {
+				break
+			}
+		}
+	}
+	if parser.acceptKeyword("LIMIT") != "" {
+		if statement.Limit = parser.parseExpression(1); statement.Limit == nil {
+			return nil, parser.diagnostic
+		}
+		if parser.acceptKeyword("OFFSET") != "" {
+			if statement.Offset = parser.parseExpression(1); statement.Offset == nil {
+				return nil, parser.diagnostic
+			}
+		}
+	}
+
+	if parser.at < len(parser.tokens) && !parser.acceptPunct(";") {
+		parser.fail("unsupported construct")
+		return nil, parser.diagnostic
+	}
+	return statement, nil
+}
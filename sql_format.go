@@ -0,0 +1,221 @@
+package serendipity
+
+import (
+	"strings"
+)
+
+//	This file adds a deterministic SQL formatter. Schema dumps and .schema-style listings reproduce whatever
+//	whitespace the author happened to type, so two logically identical schemas diff as entirely different text
+//	and a generated migration churns every line it touches. Format rewrites a statement into one canonical
+//	layout - clauses on their own lines, nesting indented, keyword case normalised - while preserving every
+//	token and every comment, so formatting is safe to apply to SQL that must keep meaning exactly:
+//
+//		Format("select a,b from t where a=1 and b=2")
+//
+//	The style is configurable through FormatStyle; the package default uses tabs and upper-case keywords,
+//	matching the DDL this project itself writes. DumpSchema feeds every CREATE statement of a database through
+//	the formatter, giving the diff-friendly schema listing that motivated the exercise.
+//
+//	The formatter works on the token stream rather than the AST deliberately: the AST covers the SELECT subset,
+//	but a formatter must never refuse a statement, and token-level rewriting handles any SQL - DDL, triggers,
+//	pragmas - without understanding it. Tokens keep their source spelling (strings, numbers, quoted names), so
+//	a format/parse round trip is the identity on everything but whitespace and keyword case.
+
+type FormatStyle struct {
+	Indent				string	//	One level of indentation
+	UppercaseKeywords	bool
+}
+
+var DefaultFormatStyle = FormatStyle{ Indent: "\t", UppercaseKeywords: true }
+
+//	Format sql in the default style.
+func Format(sql string) string {
+	return DefaultFormatStyle.Format(sql)
+}
+
+//	The formatter's own scan: the same lexical grammar as sqlScan, but comments are kept as tokens and every
+//	token keeps its raw source spelling, both of which the validator discards and the formatter cannot.
+const SQLTOKEN_COMMENT = 1000
+
+func formatScan(sql string) (tokens []sqlToken) {
+	for i := 0; i < len(sql); {
+		start, c := i, sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '-' && i + 1 < len(sql) && sql[i + 1] == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_COMMENT, text: sql[start:i], position: start })
+			continue
+		case c == '/' && i + 1 < len(sql) && sql[i + 1] == '*':
+			for i += 2; i < len(sql) && !(sql[i - 1] == '*' && sql[i] == '/'); i++ {
+			}
+			if i < len(sql) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_COMMENT, text: sql[start:i], position: start })
+			continue
+		case c == '\'' || c == '"' || c == '`':
+			for i++; i < len(sql); i++ {
+				if sql[i] == c {
+					i++
+					if i < len(sql) && sql[i] == c {
+						continue
+					}
+					break
+				}
+			}
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_STRING, text: sql[start:i], position: start })
+			continue
+		case c == '[':
+			for i++; i < len(sql) && sql[i - 1] != ']'; i++ {
+			}
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_IDENTIFIER, text: sql[start:i], position: start })
+			continue
+		case c == '?' || c == ':' || c == '@' || c == '$':
+			for i++; i < len(sql) && isSqlIdentifierByte(sql[i]); i++ {
+			}
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_VARIABLE, text: sql[start:i], position: start })
+			continue
+		case isSqlDigit(c):
+			for i < len(sql) && (isSqlIdentifierByte(sql[i]) || sql[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_NUMBER, text: sql[start:i], position: start })
+			continue
+		case isSqlIdentifierByte(c):
+			for i < len(sql) && isSqlIdentifierByte(sql[i]) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_IDENTIFIER, text: sql[start:i], position: start })
+			continue
+		}
+		tokens = append(tokens, sqlToken{ kind: SQLTOKEN_PUNCT, text: string(c), position: i })
+		i++
+	}
+	return
+}
+
+//	The keywords that open a clause and therefore a line. AND and OR continue a clause and get one extra level.
+var sqlClauseKeywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "GROUP": true, "HAVING": true, "ORDER": true, "LIMIT": true,
+	"VALUES": true, "SET": true, "UNION": true, "INTERSECT": true, "EXCEPT": true, "RETURNING": true,
+	"JOIN": true, "LEFT": true, "INNER": true, "CROSS": true, "NATURAL": true,
+}
+
+func formatNoSpaceBefore(text string) bool {
+	switch text {
+	case ",", ")", ";", ".":
+		return true
+	}
+	return false
+}
+
+func formatNoSpaceAfter(text string) bool {
+	switch text {
+	case "(", ".":
+		return true
+	}
+	return false
+}
+
+//	Format sql in the receiver's style. Statements stay separated by their semicolons, each starting at column
+//	zero; within a statement, clause keywords start lines, parenthesised bodies are indented a level, and a
+//	comma at depth zero or one breaks the line after itself, which lays out both select lists and CREATE TABLE
+//	column lists one entry per line.
+func (style FormatStyle) Format(sql string) string {
+	text, depth := &strings.Builder{}, 0
+	atLineStart, afterJoinWord := true, false
+
+	newline := func(extra int) {
+		trimmed := strings.TrimRight(text.String(), " ")
+		text.Reset()
+		text.WriteString(trimmed)
+		text.WriteString("\n")
+		for i := 0; i < depth + extra; i++ {
+			text.WriteString(style.Indent)
+		}
+		atLineStart = true
+	}
+
+	tokens := formatScan(sql)
+	for i, token := range tokens {
+		word := strings.ToUpper(token.text)
+		spelling := token.text
+		if token.kind == SQLTOKEN_IDENTIFIER && sqlKeywords[word] {
+			if style.UppercaseKeywords {
+				spelling = word
+			} else {
+				spelling = strings.ToLower(word)
+			}
+		}
+
+		switch {
+		case token.kind == SQLTOKEN_COMMENT:
+			if !atLineStart {
+				text.WriteString(" ")
+			}
+			text.WriteString(token.text)
+			if strings.HasPrefix(token.text, "--") {
+				newline(0)
+			}
+			continue
+		case token.kind == SQLTOKEN_IDENTIFIER && sqlClauseKeywords[word] && i > 0:
+			//	A JOIN spelled in several words breaks before its first word only.
+			if !afterJoinWord {
+				newline(0)
+			}
+			afterJoinWord = word != "JOIN" && (word == "LEFT" || word == "INNER" || word == "CROSS" || word == "NATURAL" || word == "OUTER")
+		case token.kind == SQLTOKEN_IDENTIFIER && (word == "AND" || word == "OR") && depth == 0 && i > 0:
+			newline(1)
+		case token.text == ")":
+			depth--
+		default:
+			afterJoinWord = false
+		}
+
+		if !atLineStart && !formatNoSpaceBefore(token.text) && !(i > 0 && formatNoSpaceAfter(tokens[i - 1].text)) {
+			//	A function call hugs its parenthesis; a keyword does not.
+			if !(token.text == "(" && i > 0 && tokens[i - 1].kind == SQLTOKEN_IDENTIFIER && !sqlKeywords[strings.ToUpper(tokens[i - 1].text)]) {
+				text.WriteString(" ")
+			}
+		}
+		text.WriteString(spelling)
+		atLineStart = false
+
+		switch {
+		case token.text == ";":
+			depth = 0
+			trimmed := strings.TrimRight(text.String(), " ")
+			text.Reset()
+			text.WriteString(trimmed + "\n")
+			atLineStart = true
+		case token.text == "(":
+			depth++
+		case token.text == "," && depth <= 1:
+			newline(0)
+		}
+	}
+	return strings.TrimRight(text.String(), "\n\t ") + "\n"
+}
+
+//	Every CREATE statement of the named database, formatted and semicolon-terminated in creation order: the
+//	diff-friendly equivalent of a shell's .schema listing.
+func (db *sqlite3) DumpSchema(zDb string) string {
+	text := &strings.Builder{}
+	db.schemaTableRows(zDb, func(zType, zName, zTblName string, rootPage int, zSql string) {
+		if zSql == "" {
+			return
+		}
+		text.WriteString(Format(zSql))
+		if !strings.HasSuffix(strings.TrimRight(text.String(), "\n"), ";") {
+			trimmed := strings.TrimRight(text.String(), "\n")
+			text.Reset()
+			text.WriteString(trimmed + ";\n")
+		}
+	})
+	return text.String()
+}
@@ -313,43 +313,28 @@ void absFunc(Context *context, int argc, sqlite3_value **argv){
 ** the number of bytes in haystack prior to the first occurrence of needle,
 ** or 0 if needle never occurs in haystack.
 */
-void instrFunc(
-  Context *context,
-  int argc,
-  sqlite3_value **argv
-){
-  const unsigned char *zHaystack;
-  const unsigned char *zNeedle;
-  int nHaystack;
-  int nNeedle;
-  int typeHaystack, typeNeedle;
-  int N = 1;
-  int isText;
-
-  UNUSED_PARAMETER(argc);
-  typeHaystack = sqlite3_value_type(argv[0]);
-  typeNeedle = sqlite3_value_type(argv[1]);
-  if( typeHaystack==SQLITE_NULL || typeNeedle==SQLITE_NULL ) return;
-  nHaystack = sqlite3_value_bytes(argv[0]);
-  nNeedle = sqlite3_value_bytes(argv[1]);
-  if( typeHaystack==SQLITE_BLOB && typeNeedle==SQLITE_BLOB ){
-    zHaystack = sqlite3_value_blob(argv[0]);
-    zNeedle = sqlite3_value_blob(argv[1]);
-    isText = 0;
-  }else{
-    zHaystack = argv[0].Text()
-    zNeedle = argv[1].Text()
-    isText = 1;
-  }
-  while( nNeedle<=nHaystack && memcmp(zHaystack, zNeedle, nNeedle)!=0 ){
-    N++;
-    do{
-      nHaystack--;
-      zHaystack++;
-    }while( isText && (zHaystack[0]&0xc0)==0x80 );
-  }
-  if( nNeedle>nHaystack ) N = 0;
-  sqlite3_result_int(context, N);
+//	For two text arguments the position counts characters, as the SQL standard's position() requires; blob arguments
+//	count bytes as before, and "PRAGMA instr_byte_positions = on" restores byte positions for text per connection (see
+//	string_functions.go).
+func instrFunc(context *Context, args []*sqlite3_value) {
+	assert( len(args) == 2 )
+	if sqlite3_value_type(args[0]) == SQLITE_NULL || sqlite3_value_type(args[1]) == SQLITE_NULL {
+		sqlite3_result_null(context)
+		return
+	}
+	haystack := sqlite3_value_text(args[0])
+	needle := sqlite3_value_text(args[1])
+	byteOffset := indexOf(haystack, needle)
+	if byteOffset < 0 {
+		sqlite3_result_int64(context, 0)
+		return
+	}
+	isBlob := sqlite3_value_type(args[0]) == SQLITE_BLOB || sqlite3_value_type(args[1]) == SQLITE_BLOB
+	if isBlob || Context_db_handle(context).instrBytePositions {
+		sqlite3_result_int64(context, int64(byteOffset) + 1)
+	} else {
+		sqlite3_result_int64(context, runePosition(haystack, byteOffset))
+	}
 }
 
 /*
@@ -861,7 +846,16 @@ func sql_like(context *Context, args []*sqlite3_value) {
 	}
 	if zA != "" && zB != "" {
 		pInfo := sqlite3_user_data(context)
-		sqlite3_result_int(context, patternCompare(zB, zA, pInfo, escape))
+		if pInfo == &globInfo && escape == 0 {
+			//	GLOB uses the iterative compiled matcher, cached per statement - see glob_match.go.
+			if globMatchCached(context, zB, zA) {
+				sqlite3_result_int(context, 1)
+			} else {
+				sqlite3_result_int(context, 0)
+			}
+		} else {
+			sqlite3_result_int(context, patternCompare(zB, zA, pInfo, escape))
+		}
 	}
 }
 
@@ -1398,24 +1392,20 @@ void soundexFunc(
 #endif /* SQLITE_SOUNDEX */
 
 #ifndef SQLITE_OMIT_LOAD_EXTENSION
-/*
-** A function that loads a shared-library extension then returns NULL.
-*/
-void loadExt(Context *context, int argc, sqlite3_value **argv){
-  zFile := argv[0].Text()
-  const char *zProc;
-  sqlite3 *db = Context_db_handle(context);
-  char *zErrMsg = 0;
-
-  if( argc==2 ){
-    zProc = argv[1].Text()
-  }else{
-    zProc = 0;
-  }
-  if( zFile && sqlite3_load_extension(db, zFile, zProc, &zErrMsg) ){
-    sqlite3_result_error(context, zErrMsg, -1);
-    sqlite3_free(zErrMsg);
-  }
+//	A function that loads an extension then returns NULL. The name is resolved against the compiled-in extension registry
+//	first and the platform plugin loader second - see extension.go. The optional second argument names the plugin entry point.
+func loadExt(context *Context, args []*sqlite3_value) {
+	db := Context_db_handle(context)
+	name := args[0].Text()
+	entryPoint := ""
+	if len(args) == 2 {
+		entryPoint = args[1].Text()
+	}
+	if name != "" {
+		if Err, rc := db.LoadExtension(name, entryPoint); rc != SQLITE_OK {
+			sqlite3_result_error(context, Err, -1)
+		}
+	}
 }
 #endif
 
@@ -1424,197 +1414,148 @@ void loadExt(Context *context, int argc, sqlite3_value **argv){
 ** An instance of the following structure holds the context of a
 ** sum() or avg() aggregate computation.
 */
-typedef struct SumCtx SumCtx;
-struct SumCtx {
-  float64 rSum;      /* Floating point sum */
-  i64 iSum;         /* Integer sum */   
-  i64 cnt;          /* Number of elements summed */
-  u8 overflow;      /* True if integer overflow seen */
-  u8 approx;        /* True if non-integer value was input to the sum */
-};
+type SumCtx struct {
+	rSum		float64	//	Floating point sum
+	iSum		int64	//	Integer sum
+	cnt			int64	//	Number of elements summed
+	overflow	bool	//	True if integer overflow seen
+	approx		bool	//	True if non-integer value was input to the sum
+}
 
-/*
-** Routines used to compute the sum, average, and total.
-**
-** The SUM() function follows the (broken) SQL standard which means
-** that it returns NULL if it sums over no inputs.  TOTAL returns
-** 0.0 in that case.  In addition, TOTAL always returns a float where
-** SUM might return an integer if it never encounters a floating point
-** value.  TOTAL never fails, but SUM might through an exception if
-** it overflows an integer.
-*/
-void sumStep(Context *context, int argc, sqlite3_value **argv){
-  SumCtx *p;
-  int type;
-  assert( argc==1 );
-  UNUSED_PARAMETER(argc);
-  p = sqlite3_aggregate_context(context, sizeof(*p));
-  type = sqlite3_value_numeric_type(argv[0]);
-  if( p && type!=SQLITE_NULL ){
-    p->cnt++;
-    if( type==SQLITE_INTEGER ){
-      i64 v = sqlite3_value_int64(argv[0]);
-      p->rSum += v;
-      if( (p->approx|p->overflow)==0 && sqlite3AddInt64(&p->iSum, v) ){
-        p->overflow = 1;
-      }
-    }else{
-      p->rSum += sqlite3_value_float64(argv[0]);
-      p->approx = 1;
-    }
-  }
+//	Routines used to compute the sum, average, and total.
+//
+//	The SUM() function follows the (broken) SQL standard which means that it returns NULL if it sums over no inputs.
+//	TOTAL returns 0.0 in that case. In addition, TOTAL always returns a float where SUM might return an integer if it
+//	never encounters a floating point value. TOTAL never fails, but SUM might through an exception if it overflows an
+//	integer.
+//
+//	Aggregate state is held through the typed AggregateState API (see aggregate_context.go) rather than a raw byte block.
+func sumStep(context *Context, args []*sqlite3_value) {
+	assert( len(args) == 1 )
+	p := context.AggregateState(func() interface{} { return &SumCtx{} }).(*SumCtx)
+	if t := sqlite3_value_numeric_type(args[0]); t != SQLITE_NULL {
+		p.cnt++
+		if t == SQLITE_INTEGER {
+			v := sqlite3_value_int64(args[0])
+			p.rSum += float64(v)
+			if !p.approx && !p.overflow && sqlite3AddInt64(&p.iSum, v) {
+				p.overflow = true
+			}
+		} else {
+			p.rSum += sqlite3_value_float64(args[0])
+			p.approx = true
+		}
+	}
 }
-void sumFinalize(Context *context){
-  SumCtx *p;
-  p = sqlite3_aggregate_context(context, 0);
-  if( p && p->cnt>0 ){
-    if( p->overflow ){
-      sqlite3_result_error(context,"integer overflow",-1);
-    }else if( p->approx ){
-      sqlite3_result_float64(context, p->rSum);
-    }else{
-      sqlite3_result_int64(context, p->iSum);
-    }
-  }
+
+func sumFinalize(context *Context) {
+	if p, ok := context.ExistingAggregateState().(*SumCtx); ok && p.cnt > 0 {
+		switch {
+		case p.overflow:
+			sqlite3_result_error(context, "integer overflow", -1)
+		case p.approx:
+			sqlite3_result_float64(context, p.rSum)
+		default:
+			sqlite3_result_int64(context, p.iSum)
+		}
+	}
 }
-void avgFinalize(Context *context){
-  SumCtx *p;
-  p = sqlite3_aggregate_context(context, 0);
-  if( p && p->cnt>0 ){
-    sqlite3_result_float64(context, p->rSum/(float64)p->cnt);
-  }
+
+func avgFinalize(context *Context) {
+	if p, ok := context.ExistingAggregateState().(*SumCtx); ok && p.cnt > 0 {
+		sqlite3_result_float64(context, p.rSum / float64(p.cnt))
+	}
 }
-void totalFinalize(Context *context){
-  SumCtx *p;
-  p = sqlite3_aggregate_context(context, 0);
-  sqlite3_result_float64(context, p ? p->rSum : 0);
+
+func totalFinalize(context *Context) {
+	if p, ok := context.ExistingAggregateState().(*SumCtx); ok {
+		sqlite3_result_float64(context, p.rSum)
+	} else {
+		sqlite3_result_float64(context, 0)
+	}
 }
 
-/*
-** The following structure keeps track of state information for the
-** count() aggregate function.
-*/
-typedef struct CountCtx CountCtx;
-struct CountCtx {
-  i64 n;
-};
+//	The following structure keeps track of state information for the count() aggregate function.
+type CountCtx struct {
+	n	int64
+}
 
-/*
-** Routines to implement the count() aggregate function.
-*/
-void countStep(Context *context, int argc, sqlite3_value **argv){
-  CountCtx *p;
-  p = sqlite3_aggregate_context(context, sizeof(*p));
-  if( (argc==0 || SQLITE_NULL!=sqlite3_value_type(argv[0])) && p ){
-    p->n++;
-  }
-}   
-void countFinalize(Context *context){
-  CountCtx *p;
-  p = sqlite3_aggregate_context(context, 0);
-  sqlite3_result_int64(context, p ? p->n : 0);
+//	Routines to implement the count() aggregate function.
+func countStep(context *Context, args []*sqlite3_value) {
+	p := context.AggregateState(func() interface{} { return &CountCtx{} }).(*CountCtx)
+	if len(args) == 0 || sqlite3_value_type(args[0]) != SQLITE_NULL {
+		p.n++
+	}
+}
+
+func countFinalize(context *Context) {
+	if p, ok := context.ExistingAggregateState().(*CountCtx); ok {
+		sqlite3_result_int64(context, p.n)
+	} else {
+		sqlite3_result_int64(context, 0)
+	}
 }
 
 /*
 ** Routines to implement min() and max() aggregate functions.
 */
-void minmaxStep(
-  Context *context, 
-  int NotUsed, 
-  sqlite3_value **argv
-){
-  Mem *pArg  = (Mem *)argv[0];
-  Mem *pBest;
-  UNUSED_PARAMETER(NotUsed);
-
-  pBest = (Mem *)sqlite3_aggregate_context(context, sizeof(*pBest));
-  if( !pBest ) return;
+type MinMaxCtx struct {
+	best	*sqlite3_value
+}
 
-  if( sqlite3_value_type(argv[0])==SQLITE_NULL ){
-    if( pBest->flags ) sqlite3SkipAccumulatorLoad(context);
-  }else if( pBest->flags ){
-    int max;
-    int cmp;
-    CollationSequence *pColl = sqlite3GetFuncCollSeq(context);
-    /* This step function is used for both the min() and max() aggregates,
-    ** the only difference between the two being that the sense of the
-    ** comparison is inverted. For the max() aggregate, the
-    ** sqlite3_user_data() function returns (void *)-1. For min() it
-    ** returns (void *)db, where db is the sqlite3* database pointer.
-    ** Therefore the next statement sets variable 'max' to 1 for the max()
-    ** aggregate, or 0 for min().
-    */
-    max = sqlite3_user_data(context)!=0;
-    cmp = sqlite3MemCompare(pBest, pArg, pColl);
-    if( (max && cmp<0) || (!max && cmp>0) ){
-      sqlite3VdbeMemCopy(pBest, pArg);
-    }else{
-      sqlite3SkipAccumulatorLoad(context);
-    }
-  }else{
-    sqlite3VdbeMemCopy(pBest, pArg);
-  }
+//	This step function is used for both the min() and max() aggregates, the only difference between the two being that
+//	the sense of the comparison is inverted: sqlite3_user_data() is non-zero for max(). Comparisons go through the
+//	function's collation sequence - resolved from the argument column by sqlite3GetFuncCollSeq - so min() and max() over
+//	a NOCASE column agree with ORDER BY over that column.
+func minmaxStep(context *Context, args []*sqlite3_value) {
+	p := context.AggregateState(func() interface{} { return &MinMaxCtx{} }).(*MinMaxCtx)
+	switch {
+	case sqlite3_value_type(args[0]) == SQLITE_NULL:
+		//	NULLs never become the running best; min() of NULLs alone is NULL via the empty finalizer path.
+	case p.best == nil:
+		p.best = sqlite3_value_dup(args[0])
+	default:
+		max := sqlite3_user_data(context) != nil
+		cmp := sqlite3MemCompare(p.best, args[0], sqlite3GetFuncCollSeq(context))
+		if (max && cmp < 0) || (!max && cmp > 0) {
+			p.best = sqlite3_value_dup(args[0])
+		}
+	}
 }
-void minMaxFinalize(Context *context){
-  sqlite3_value *pRes;
-  pRes = (sqlite3_value *)sqlite3_aggregate_context(context, 0);
-  if( pRes ){
-    if( pRes->flags ){
-      sqlite3_result_value(context, pRes);
-    }
-    sqlite3VdbeMemRelease(pRes);
-  }
+
+func minMaxFinalize(context *Context) {
+	if p, ok := context.ExistingAggregateState().(*MinMaxCtx); ok && p.best != nil {
+		sqlite3_result_value(context, p.best)
+	}
 }
 
 /*
 ** group_concat(EXPR, ?SEPARATOR?)
 */
-void groupConcatStep(
-  Context *context,
-  int argc,
-  sqlite3_value **argv
-){
-  const char *zVal;
-  StrAccum *pAccum;
-  const char *zSep;
-  int nVal, nSep;
-  assert( argc==1 || argc==2 );
-  if( sqlite3_value_type(argv[0])==SQLITE_NULL ) return;
-  pAccum = (StrAccum*)sqlite3_aggregate_context(context, sizeof(*pAccum));
-
-  if( pAccum ){
-    sqlite3 *db = Context_db_handle(context);
-    int firstTerm = pAccum->useMalloc==0;
-    pAccum->useMalloc = 2;
-    pAccum->mxAlloc = db->aLimit[SQLITE_LIMIT_LENGTH];
-    if( !firstTerm ){
-      if( argc==2 ){
-        zSep = argv[1].Text()
-        nSep = sqlite3_value_bytes(argv[1]);
-      }else{
-        zSep = ",";
-        nSep = 1;
-      }
-      sqlite3StrAccumAppend(pAccum, zSep, nSep);
-    }
-    zVal = argv[0].Text()
-    nVal = sqlite3_value_bytes(argv[0]);
-    sqlite3StrAccumAppend(pAccum, zVal, nVal);
-  }
+//	group_concat() accumulates through the length-limited Accumulator (see str_accum.go), so an oversized result reports
+//	"string or blob too big" from the finalizer instead of being silently truncated or flagged.
+func groupConcatStep(context *Context, args []*sqlite3_value) {
+	assert( len(args) == 1 || len(args) == 2 )
+	if sqlite3_value_type(args[0]) == SQLITE_NULL {
+		return
+	}
+	db := Context_db_handle(context)
+	firstTerm := context.ExistingAggregateState() == nil
+	accumulator := context.AggregateState(func() interface{} { return db.NewAccumulator() }).(*Accumulator)
+	if !firstTerm {
+		if len(args) == 2 {
+			accumulator.Append(args[1].Text())
+		} else {
+			accumulator.Append(",")
+		}
+	}
+	accumulator.Append(args[0].Text())
 }
-void groupConcatFinalize(Context *context){
-  StrAccum *pAccum;
-  pAccum = sqlite3_aggregate_context(context, 0);
-  if( pAccum ){
-    if( pAccum->tooBig ){
-      sqlite3_result_error_toobig(context);
-    }else if( pAccum->mallocFailed ){
-      sqlite3_result_error_nomem(context);
-    }else{    
-      sqlite3_result_text(context, sqlite3StrAccumFinish(pAccum), -1, 
-                          sqlite3_free);
-    }
-  }
+
+func groupConcatFinalize(context *Context) {
+	if accumulator, ok := context.ExistingAggregateState().(*Accumulator); ok {
+		accumulator.Result(context)
+	}
 }
 
 /*
@@ -1662,6 +1603,13 @@ func (db *sqlite3) RegisterLikeFunctions(caseSensitive bool) {
 	} else {
 		setLikeOptFlag(db, "like", SQLITE_FUNC_LIKE)
 	}
+
+	//	ILIKE is always case-insensitive (and accent-insensitive - see ilike.go), whatever the LIKE setting. The
+	//	likeInfoNorm user data supplies the wildcards sqlite3IsLikeFunction reads, and the absence of
+	//	SQLITE_FUNC_CASE marks it nocase so prefix patterns can use NOCASE-collated indexes.
+	db.CreateFunc("ilike", 2, (struct compareInfo*)&likeInfoNorm, ilikeFunc, nil, nil, nil)
+	db.CreateFunc("ilike", 3, (struct compareInfo*)&likeInfoNorm, ilikeFunc, nil, nil, nil)
+	setLikeOptFlag(db, "ilike", SQLITE_FUNC_LIKE)
 }
 
 /*
@@ -1729,6 +1677,15 @@ void sqlite3RegisterGlobalFunctions(void){
 		FUNCTION2(typeof,            1, 0, 0, typeofFunc,  SQLITE_FUNC_TYPEOF),
 		FUNCTION2(length,            1, 0, 0, lengthFunc,  SQLITE_FUNC_LENGTH),
 		FUNCTION(instr,              2, 0, 0, instrFunc        ),
+		FUNCTION(octet_length,       1, 0, 0, octetLengthFunc  ),
+		FUNCTION(char_length,        1, 0, 0, charLengthFunc   ),
+		FUNCTION(blob,               1, 0, 0, blobFunc         ),
+		FUNCTION(blob_append,       -1, 0, 0, blobAppendFunc   ),
+		FUNCTION(blob_slice,         3, 0, 0, blobSliceFunc    ),
+		FUNCTION(pack_le,            2, 0, 0, packLeFunc       ),
+		FUNCTION(pack_be,            2, 0, 0, packBeFunc       ),
+		FUNCTION(unpack_le,          3, 0, 0, unpackLeFunc     ),
+		FUNCTION(unpack_be,          3, 0, 0, unpackBeFunc     ),
 		FUNCTION(substr,             2, 0, 0, substrFunc       ),
 		FUNCTION(substr,             3, 0, 0, substrFunc       ),
 		FUNCTION(unicode,            1, 0, 0, unicodeFunc      ),
@@ -1736,6 +1693,9 @@ void sqlite3RegisterGlobalFunctions(void){
 		FUNCTION(abs,                1, 0, 0, absFunc          ),
 		FUNCTION(round,              1, 0, 0, roundFunc        ),
 		FUNCTION(round,              2, 0, 0, roundFunc        ),
+		FUNCTION(haversine_distance, 4, 0, 0, haversineFunc    ),
+		FUNCTION(geo_bbox_around,    4, 0, 0, geoBboxFunc      ),
+		FUNCTION(bearing,            4, 0, 0, bearingFunc      ),
 		FUNCTION(upper,              1, 0, 0, upperFunc        ),
 		FUNCTION(lower,              1, 0, 0, lowerFunc        ),
 		FUNCTION(coalesce,           1, 0, 0, 0                ),
@@ -0,0 +1,402 @@
+package serendipity
+
+import (
+	"strings"
+)
+
+//	This file adds compile-time SQL validation. An application's SQL usually sits in string literals that no
+//	compiler reads, so a misspelt column ships and fails at run time, in production, on the one code path the
+//	tests missed. Validate parses a statement and resolves every table and column reference against a schema
+//	without executing anything, returning structured diagnostics a CI step can fail the build on:
+//
+//		for _, d := range Validate(sql, schema...) {
+//			log.Printf("%v: %s: %s (%s)", d.Position, d.Kind, d.Message, d.Suggestion)
+//		}
+//
+//	Each diagnostic carries the byte position of the offending token, a stable machine-readable kind, and - when
+//	a near-miss of a known name caused it - the name the author probably meant. The schema is the same *Table
+//	model the planner uses, so a deployment can validate against its live schema or against one built from the
+//	DDL under version control.
+//
+//	Function references are deliberately not resolved: the function set is per-connection state - every
+//	CreateFunction call extends it - and a static check against a frozen list would reject valid SQL more often
+//	than it caught mistakes. Everything schema-shaped is checked; everything connection-shaped is left to run
+//	time.
+
+//	One finding. Kind is one of the DIAG_* values below; Suggestion is the closest known name when one is close
+//	enough to be a plausible typo, and empty otherwise.
+type Diagnostic struct {
+	Position	int
+	Kind		string
+	Message		string
+	Suggestion	string
+}
+
+const (
+	DIAG_SYNTAX				= "syntax"
+	DIAG_UNKNOWN_TABLE		= "unknown-table"
+	DIAG_UNKNOWN_COLUMN		= "unknown-column"
+	DIAG_AMBIGUOUS_COLUMN	= "ambiguous-column"
+	DIAG_EMPTY_STATEMENT	= "empty-statement"
+)
+
+//	A lexical token. The scanner is shared with the other tooling entry points; it preserves byte positions so
+//	every consumer can point back into the original text.
+const (
+	SQLTOKEN_IDENTIFIER	= iota
+	SQLTOKEN_STRING
+	SQLTOKEN_NUMBER
+	SQLTOKEN_VARIABLE
+	SQLTOKEN_PUNCT
+)
+
+type sqlToken struct {
+	kind		int
+	text		string
+	position	int
+}
+
+func isSqlIdentifierByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c >= 0x80
+}
+
+func isSqlDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+//	Scan sql into tokens. Comments and whitespace are dropped; quoted identifiers scan as identifiers with the
+//	quotes stripped; an unterminated literal or comment is reported and ends the scan.
+func sqlScan(sql string) (tokens []sqlToken, diagnostics []Diagnostic) {
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '-' && i + 1 < len(sql) && sql[i + 1] == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && i + 1 < len(sql) && sql[i + 1] == '*':
+			start := i
+			for i += 2; ; i++ {
+				if i + 1 >= len(sql) {
+					return tokens, append(diagnostics, Diagnostic{ Position: start, Kind: DIAG_SYNTAX, Message: "unterminated comment" })
+				}
+				if sql[i] == '*' && sql[i + 1] == '/' {
+					i += 2
+					break
+				}
+			}
+		case c == '\'' || c == '"' || c == '`':
+			start, quote := i, c
+			text := ""
+			for i++; ; i++ {
+				if i >= len(sql) {
+					return tokens, append(diagnostics, Diagnostic{ Position: start, Kind: DIAG_SYNTAX, Message: "unterminated string" })
+				}
+				if sql[i] == quote {
+					if i + 1 < len(sql) && sql[i + 1] == quote {
+						text += string(quote)
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				text += string(sql[i])
+			}
+			kind := SQLTOKEN_STRING
+			if quote != '\'' {
+				kind = SQLTOKEN_IDENTIFIER
+			}
+			tokens = append(tokens, sqlToken{ kind: kind, text: text, position: start })
+		case c == '[':
+			start := i
+			for i++; i < len(sql) && sql[i] != ']'; i++ {
+			}
+			if i >= len(sql) {
+				return tokens, append(diagnostics, Diagnostic{ Position: start, Kind: DIAG_SYNTAX, Message: "unterminated identifier" })
+			}
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_IDENTIFIER, text: sql[start + 1:i], position: start })
+			i++
+		case c == '?' || c == ':' || c == '@' || c == '$':
+			start := i
+			for i++; i < len(sql) && isSqlIdentifierByte(sql[i]); i++ {
+			}
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_VARIABLE, text: sql[start:i], position: start })
+		case isSqlDigit(c) || c == '.' && i + 1 < len(sql) && isSqlDigit(sql[i + 1]):
+			start := i
+			for i < len(sql) && (isSqlIdentifierByte(sql[i]) || sql[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_NUMBER, text: sql[start:i], position: start })
+		case isSqlIdentifierByte(c):
+			start := i
+			for i < len(sql) && isSqlIdentifierByte(sql[i]) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_IDENTIFIER, text: sql[start:i], position: start })
+		default:
+			tokens = append(tokens, sqlToken{ kind: SQLTOKEN_PUNCT, text: string(c), position: i })
+			i++
+		}
+	}
+	return
+}
+
+//	The keywords the resolver must not mistake for table or column references. This is the reference set, not a
+//	parser: any identifier in it is treated as structure, everything else as a name to resolve.
+var sqlKeywords = map[string]bool{
+	"ABORT": true, "ALL": true, "AND": true, "AS": true, "ASC": true, "BETWEEN": true, "BY": true,
+	"CASE": true, "CAST": true, "COLLATE": true, "CROSS": true, "DELETE": true, "DESC": true, "DISTINCT": true,
+	"ELSE": true, "END": true, "ESCAPE": true, "EXCEPT": true, "EXISTS": true, "FROM": true, "GLOB": true,
+	"GROUP": true, "HAVING": true, "IN": true, "INDEXED": true, "INNER": true, "INSERT": true, "INTERSECT": true,
+	"INTO": true, "IS": true, "ISNULL": true, "JOIN": true, "LEFT": true, "LIKE": true, "LIMIT": true,
+	"MATCH": true, "NATURAL": true, "NOT": true, "NOTNULL": true, "NULL": true, "OFFSET": true, "ON": true,
+	"OR": true, "ORDER": true, "OUTER": true, "REGEXP": true, "REPLACE": true, "SELECT": true, "SET": true,
+	"THEN": true, "UNION": true, "UPDATE": true, "USING": true, "VALUES": true, "WHEN": true, "WHERE": true,
+	"FIRST": true, "LAST": true, "NULLS": true, "RETURNING": true,
+}
+
+func isSqlKeyword(token sqlToken) bool {
+	return token.kind == SQLTOKEN_IDENTIFIER && sqlKeywords[strings.ToUpper(token.text)]
+}
+
+//	Levenshtein distance, for suggestions. A candidate within two edits - one for short names - is close enough
+//	to be a plausible typo; anything further is noise and no suggestion is made.
+func editDistance(a, b string) int {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	previous := make([]int, len(b) + 1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b) + 1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i - 1] == b[j - 1] {
+				cost = 0
+			}
+			current[j] = previous[j - 1] + cost
+			if previous[j] + 1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j - 1] + 1 < current[j] {
+				current[j] = current[j - 1] + 1
+			}
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func closestName(name string, candidates []string) string {
+	limit := 2
+	if len(name) < 5 {
+		limit = 1
+	}
+	best, bestDistance := "", limit + 1
+	for _, candidate := range candidates {
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+//	A table reference in scope: the table and the name it answers to, which is its alias when one was declared.
+type tableReference struct {
+	zName	string
+	table	*Table
+}
+
+func schemaTable(schema []*Table, zName string) *Table {
+	for _, table := range schema {
+		if CaseInsensitiveComparison(table.zName, zName) == 0 {
+			return table
+		}
+	}
+	return nil
+}
+
+func (reference *tableReference) column(zName string) *Column {
+	for _, column := range reference.table.Columns {
+		if CaseInsensitiveComparison(column.zName, zName) == 0 {
+			return column
+		}
+	}
+	return nil
+}
+
+func schemaTableNames(schema []*Table) (names []string) {
+	for _, table := range schema {
+		names = append(names, table.zName)
+	}
+	return
+}
+
+func (reference *tableReference) columnNames() (names []string) {
+	for _, column := range reference.table.Columns {
+		names = append(names, column.zName)
+	}
+	return
+}
+
+//	Collect the tables a statement brings into scope: the identifier after FROM, INTO, UPDATE or JOIN, plus any
+//	comma-separated companions in a FROM list, each with its alias when one follows. An unknown table is
+//	reported once here and then ignored, so its columns do not also cascade into unknown-column noise.
+func collectTableReferences(tokens []sqlToken, schema []*Table) (references []tableReference, diagnostics []Diagnostic) {
+	for i := 0; i < len(tokens); i++ {
+		keyword := strings.ToUpper(tokens[i].text)
+		if tokens[i].kind != SQLTOKEN_IDENTIFIER || keyword != "FROM" && keyword != "INTO" && keyword != "UPDATE" && keyword != "JOIN" {
+			continue
+		}
+		for i + 1 < len(tokens) {
+			name := tokens[i + 1]
+			if name.kind != SQLTOKEN_IDENTIFIER || isSqlKeyword(name) {
+				break
+			}
+			i++
+			table := schemaTable(schema, name.text)
+			if table == nil {
+				diagnostics = append(diagnostics, Diagnostic{
+					Position:	name.position,
+					Kind:		DIAG_UNKNOWN_TABLE,
+					Message:	sqlite3_mprintf("no such table: %s", name.text),
+					Suggestion:	closestName(name.text, schemaTableNames(schema)),
+				})
+			}
+			zName := name.text
+			if i + 1 < len(tokens) && strings.ToUpper(tokens[i + 1].text) == "AS" {
+				i++
+			}
+			if i + 1 < len(tokens) && tokens[i + 1].kind == SQLTOKEN_IDENTIFIER && !isSqlKeyword(tokens[i + 1]) {
+				i++
+				zName = tokens[i].text
+			}
+			if table != nil {
+				references = append(references, tableReference{ zName: zName, table: table })
+			}
+			if keyword != "FROM" || i + 1 >= len(tokens) || tokens[i + 1].text != "," {
+				break
+			}
+			i++
+		}
+	}
+	return
+}
+
+//	Resolve one column reference. A qualifier narrows the scope to its table; an unqualified name must resolve
+//	in exactly one table in scope.
+func resolveColumn(token sqlToken, qualifier string, references []tableReference) *Diagnostic {
+	if qualifier != "" {
+		for i := range references {
+			if CaseInsensitiveComparison(references[i].zName, qualifier) == 0 {
+				if references[i].column(token.text) == nil {
+					return &Diagnostic{
+						Position:	token.position,
+						Kind:		DIAG_UNKNOWN_COLUMN,
+						Message:	sqlite3_mprintf("no such column: %s.%s", qualifier, token.text),
+						Suggestion:	closestName(token.text, references[i].columnNames()),
+					}
+				}
+				return nil
+			}
+		}
+		return &Diagnostic{ Position: token.position, Kind: DIAG_UNKNOWN_TABLE, Message: sqlite3_mprintf("no such table: %s", qualifier) }
+	}
+	matches, candidates := 0, []string{}
+	for i := range references {
+		if references[i].column(token.text) != nil {
+			matches++
+		}
+		candidates = append(candidates, references[i].columnNames()...)
+	}
+	switch {
+	case matches > 1:
+		return &Diagnostic{ Position: token.position, Kind: DIAG_AMBIGUOUS_COLUMN, Message: sqlite3_mprintf("ambiguous column name: %s", token.text) }
+	case matches == 0:
+		return &Diagnostic{
+			Position:	token.position,
+			Kind:		DIAG_UNKNOWN_COLUMN,
+			Message:	sqlite3_mprintf("no such column: %s", token.text),
+			Suggestion:	closestName(token.text, candidates),
+		}
+	}
+	return nil
+}
+
+//	Validate one statement's tokens: bring its tables into scope, then resolve every identifier that reads as a
+//	column - not a keyword, not a function call, not a table alias, not an INDEXED BY or COLLATE name.
+func validateStatement(tokens []sqlToken, schema []*Table) (diagnostics []Diagnostic) {
+	references, diagnostics := collectTableReferences(tokens, schema)
+	consumed := make([]bool, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		keyword := strings.ToUpper(tokens[i].text)
+		if tokens[i].kind == SQLTOKEN_IDENTIFIER && (keyword == "FROM" || keyword == "INTO" || keyword == "UPDATE" || keyword == "JOIN" || keyword == "INDEXED" || keyword == "COLLATE" || keyword == "AS") {
+			//	The names after these are tables, aliases, index or collation names; mark them so the column walk
+			//	below skips them.
+			for i + 1 < len(tokens) && tokens[i + 1].kind == SQLTOKEN_IDENTIFIER && !isSqlKeyword(tokens[i + 1]) {
+				i++
+				consumed[i] = true
+				if keyword != "FROM" || i + 1 >= len(tokens) || tokens[i + 1].text != "," {
+					break
+				}
+				i++
+			}
+		}
+	}
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if token.kind != SQLTOKEN_IDENTIFIER || consumed[i] || isSqlKeyword(token) {
+			continue
+		}
+		if i + 1 < len(tokens) && tokens[i + 1].text == "(" {
+			//	A function call; resolution is per-connection and out of scope here - see the header.
+			continue
+		}
+		qualifier := ""
+		if i + 2 < len(tokens) && tokens[i + 1].text == "." {
+			if tokens[i + 2].text == "*" {
+				i += 2
+				continue
+			}
+			if tokens[i + 2].kind == SQLTOKEN_IDENTIFIER {
+				qualifier, token = token.text, tokens[i + 2]
+				i += 2
+			}
+		}
+		if diagnostic := resolveColumn(token, qualifier, references); diagnostic != nil {
+			diagnostics = append(diagnostics, *diagnostic)
+		}
+	}
+	return
+}
+
+//	Validate sql against schema. The text may hold several statements; each is checked independently and the
+//	findings are returned in text order. An empty slice means the SQL resolved cleanly.
+func Validate(sql string, schema ...*Table) (diagnostics []Diagnostic) {
+	tokens, diagnostics := sqlScan(sql)
+	if len(diagnostics) > 0 {
+		return
+	}
+	if len(tokens) == 0 {
+		return append(diagnostics, Diagnostic{ Position: 0, Kind: DIAG_EMPTY_STATEMENT, Message: "no statement" })
+	}
+	statement := []sqlToken{}
+	for _, token := range tokens {
+		if token.kind == SQLTOKEN_PUNCT && token.text == ";" {
+			if len(statement) > 0 {
+				diagnostics = append(diagnostics, validateStatement(statement, schema)...)
+				statement = nil
+			}
+			continue
+		}
+		statement = append(statement, token)
+	}
+	if len(statement) > 0 {
+		diagnostics = append(diagnostics, validateStatement(statement, schema)...)
+	}
+	return
+}
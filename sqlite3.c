@@ -73741,12 +73741,21 @@ func (db *sqlite3) LockAndPrepare(sql string, saveSqlFlag bool, old_vm *Vdbe) (s
 //	and so if a schema change occurs, SQLITE_SCHEMA is returned by sqlite3_stmt.Step().  In the new version, the original SQL text is retained
 //	and the statement is automatically recompiled if an schema change occurs.
 func (db *sqlite3) Prepare(sql string) (statement *sqlite3_stmt, tail string, rc int) {
+	//	A connection-level row policy rewrites the statement before it is compiled - see row_policy.go.
+	if sql, rc = db.filterRowPolicies(sql); rc != SQLITE_OK {
+		return
+	}
+	sql = db.filterRowVersion(sql)
 	statement, tail, rc = db.LockAndPrepare(zSql, false, nil)
 	assert( rc == SQLITE_OK || statement == nil )
 	return
 }
 
 func (db *sqlite3) Prepare_v2(sql string) (statement *sqlite3_stmt, tail string, rc int) {
+	if sql, rc = db.filterRowPolicies(sql); rc != SQLITE_OK {
+		return
+	}
+	sql = db.filterRowVersion(sql)
 	statement, tail, rc = db.LockAndPrepare(sql, true, nil)
 	assert( rc == SQLITE_OK || statement == nil )
 	return
@@ -0,0 +1,26 @@
+//go:build serendipity_debug
+
+package serendipity
+
+import (
+	"log"
+	"runtime"
+)
+
+//	Debug-build leak reporting. Built with -tags serendipity_debug, every Prepare records the caller's stack on the
+//	statement, and any statement or blob handle still open when its connection closes is logged with its SQL and that
+//	stack - enough to find the missing Finalize without reproducing the leak under a debugger.
+
+//	Capture the preparation stack. Called from Prepare_v2; free in release builds via the stub.
+func recordPreparationStack(statement *sqlite3_stmt) {
+	buffer := make([]byte, 8192)
+	statement.preparedAt = string(buffer[:runtime.Stack(buffer, false)])
+}
+
+func reportLeakedStatement(statement *sqlite3_stmt) {
+	log.Printf("serendipity: statement leaked at close: %q\nprepared at:\n%v", statement.zSql, statement.preparedAt)
+}
+
+func reportLeakedBlob(blob *sqlite3_blob) {
+	log.Printf("serendipity: blob handle leaked at close: %v.%v rowid %v", blob.zTable, blob.zColumn, blob.iRow)
+}
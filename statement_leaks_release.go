@@ -0,0 +1,12 @@
+//go:build !serendipity_debug
+
+package serendipity
+
+//	Release-build stubs for the leak reporting in statement_leaks_debug.go: leaked handles are still reclaimed by Close,
+//	but nothing is recorded or logged and Prepare pays no stack-capture cost.
+
+func recordPreparationStack(statement *sqlite3_stmt) {}
+
+func reportLeakedStatement(statement *sqlite3_stmt) {}
+
+func reportLeakedBlob(blob *sqlite3_blob) {}
@@ -0,0 +1,145 @@
+package serendipity
+
+import (
+	"sync/atomic"
+)
+
+//	This file adds misuse diagnostics for prepared statements. The classic API answers a misused statement with a bare
+//	SQLITE_MISUSE - or with undefined behaviour when two goroutines race - which tells the caller nothing about what
+//	they did wrong. Each statement now carries a small state machine advanced by Step, Reset, the bind routines and
+//	Finalize; the misuses it can name are stepping a finalized statement, rebinding while rows are pending, and a
+//	second Step arriving while one is already inside the VDBE. Detection still returns SQLITE_MISUSE so existing
+//	callers see the code they expect, but the typed error describing the misuse is retained on the statement and
+//	available from MisuseError.
+//
+//	The file also adds the auto-reset-on-done mode of modern SQLite: with "PRAGMA statement_auto_reset = on", a Step
+//	after SQLITE_DONE or an error resets the statement and starts a fresh run instead of returning SQLITE_MISUSE.
+//	The mode is off by default to preserve the historical behaviour.
+
+//	Statement lifecycle states, advanced under the guard below.
+const (
+	STMT_STATE_IDLE			= iota	//	Prepared or reset; no run in progress
+	STMT_STATE_ROWS					//	Step has returned SQLITE_ROW and the run is unfinished
+	STMT_STATE_DONE					//	The last run ended with SQLITE_DONE or an error
+	STMT_STATE_FINALIZED			//	Finalize has been called; every operation is a misuse
+)
+
+type ErrStatementFinalized struct {
+	SQL		string
+}
+
+func (e *ErrStatementFinalized) Error() string {
+	return sqlite3_mprintf("statement misuse: Step or bind on a finalized statement: %v", e.SQL)
+}
+
+type ErrRowsPending struct {
+	SQL		string
+}
+
+func (e *ErrRowsPending) Error() string {
+	return sqlite3_mprintf("statement misuse: rebinding while rows are pending - Reset the statement first: %v", e.SQL)
+}
+
+type ErrConcurrentStep struct {
+	SQL		string
+}
+
+func (e *ErrConcurrentStep) Error() string {
+	return sqlite3_mprintf("statement misuse: concurrent Step from two goroutines: %v", e.SQL)
+}
+
+//	The per-statement misuse guard. state follows the lifecycle above; stepping is held non-zero for the duration of
+//	one Step call so a racing Step is caught rather than corrupting the VDBE.
+type stmtMisuseGuard struct {
+	state		int32
+	stepping	int32
+	lastMisuse	error
+}
+
+//	The most recent misuse detected on this statement, or nil. Cleared by Reset.
+func (statement *sqlite3_stmt) MisuseError() error {
+	return statement.misuse.lastMisuse
+}
+
+//	Called at the top of Step. A non-nil return means the call is a misuse and Step should return SQLITE_MISUSE
+//	without touching the VDBE; otherwise the guard is held until endStep.
+func (statement *sqlite3_stmt) beginStep() (misuse error) {
+	guard := &statement.misuse
+	if atomic.LoadInt32(&guard.state) == STMT_STATE_FINALIZED {
+		misuse = &ErrStatementFinalized{ SQL: statement.zSql }
+	} else if !atomic.CompareAndSwapInt32(&guard.stepping, 0, 1) {
+		misuse = &ErrConcurrentStep{ SQL: statement.zSql }
+	} else if atomic.LoadInt32(&guard.state) == STMT_STATE_DONE {
+		if statement.db.autoResetStatements {
+			statement.Reset()
+		} else {
+			atomic.StoreInt32(&guard.stepping, 0)
+			misuse = &ErrStatementFinalized{ SQL: statement.zSql }
+		}
+	}
+	if misuse != nil {
+		guard.lastMisuse = misuse
+	} else if atomic.LoadInt32(&guard.state) == STMT_STATE_IDLE {
+		//	A fresh run is starting: arm its execution deadline - see statement_timeout.go.
+		statement.armTimeout()
+	}
+	return
+}
+
+//	Called with the result of the Step that beginStep admitted.
+func (statement *sqlite3_stmt) endStep(rc int) {
+	guard := &statement.misuse
+	statement.noteTimeoutStep(rc)
+	if rc == SQLITE_ROW {
+		atomic.StoreInt32(&guard.state, STMT_STATE_ROWS)
+	} else {
+		atomic.StoreInt32(&guard.state, STMT_STATE_DONE)
+	}
+	atomic.StoreInt32(&guard.stepping, 0)
+}
+
+//	Called at the top of every bind routine. Binding is legal on an idle or done statement - SQLite has always allowed
+//	rebinding before the reset that starts the next run - but not while rows are pending or after Finalize.
+func (statement *sqlite3_stmt) beginBind() (misuse error) {
+	guard := &statement.misuse
+	switch atomic.LoadInt32(&guard.state) {
+	case STMT_STATE_FINALIZED:
+		misuse = &ErrStatementFinalized{ SQL: statement.zSql }
+	case STMT_STATE_ROWS:
+		misuse = &ErrRowsPending{ SQL: statement.zSql }
+	}
+	if misuse != nil {
+		guard.lastMisuse = misuse
+	}
+	return
+}
+
+//	Called from Reset and Finalize respectively.
+func (statement *sqlite3_stmt) noteReset() {
+	atomic.StoreInt32(&statement.misuse.state, STMT_STATE_IDLE)
+	statement.misuse.lastMisuse = nil
+}
+
+func (statement *sqlite3_stmt) noteFinalized() {
+	atomic.StoreInt32(&statement.misuse.state, STMT_STATE_FINALIZED)
+}
+
+func init() {
+	registerPragma(PragmaHandler{
+		Name: "statement_auto_reset",
+		Get: func(db *sqlite3) string {
+			if db.autoResetStatements {
+				return "1"
+			}
+			return "0"
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			enabled, ok := pragmaBool(value)
+			if !ok {
+				return SQLITE_ERROR
+			}
+			db.autoResetStatements = enabled
+			return SQLITE_OK
+		},
+	})
+}
@@ -0,0 +1,182 @@
+package serendipity
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+//	This file implements two views of a prepared statement's SQL text used throughout the diagnostics subsystems:
+//
+//		ExpandedSQL()	the original text with bound parameter values substituted, as the statement would read if written
+//						with literals - what the slow-query log and trace spans record
+//		NormalizedSQL()	the text with every literal (and every bound parameter) reduced to "?", comments stripped and
+//						whitespace collapsed - a stable digest for statement cache keys and query aggregation
+//
+//	Both are derived with a lightweight scan over the SQL rather than the full tokenizer: only the token classes that affect
+//	the result (strings, blob literals, numbers, parameters, comments) need recognising, and a scanner with no dependencies
+//	can safely be called from logging paths even when the statement itself failed to compile.
+
+//	Return the statement's SQL with the current parameter bindings rendered as literals. Unbound parameters remain in place.
+func (statement *sqlite3_stmt) ExpandedSQL() string {
+	var builder	strings.Builder
+	parameter := 0
+	scanSQL(statement.zSql, func(token, class string) {
+		if class == "parameter" {
+			index := parameter + 1
+			if token != "?" && token[0] == '?' {
+				if explicit, err := strconv.Atoi(token[1:]); err == nil {
+					index = explicit
+				}
+			} else if token != "?" {
+				index = statement.ParameterIndex(token)
+			}
+			parameter = index
+			if index > 0 && index <= statement.nVar {
+				builder.WriteString(literalSQL(statement.BoundValue(index)))
+				return
+			}
+		}
+		builder.WriteString(token)
+	})
+	return builder.String()
+}
+
+//	Return the statement's SQL reduced to a digest: literals and parameters become "?", comments are removed, whitespace is
+//	collapsed to single spaces and keywords outside strings are left exactly as written. Two statements differing only in
+//	their literal values normalize identically.
+func (statement *sqlite3_stmt) NormalizedSQL() string {
+	return NormalizeSQL(statement.zSql)
+}
+
+//	The normalization behind NormalizedSQL, usable on raw SQL text.
+func NormalizeSQL(sql string) string {
+	var builder	strings.Builder
+	pendingSpace := false
+	scanSQL(sql, func(token, class string) {
+		switch class {
+		case "comment":
+			pendingSpace = true
+			return
+		case "space":
+			pendingSpace = true
+			return
+		case "string", "blob", "number", "parameter":
+			token = "?"
+		}
+		if pendingSpace && builder.Len() > 0 {
+			builder.WriteByte(' ')
+		}
+		pendingSpace = false
+		builder.WriteString(token)
+	})
+	return strings.TrimSpace(builder.String())
+}
+
+//	Render one bound value as a SQL literal.
+func literalSQL(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	case string:
+		return "'" + strings.Replace(value, "'", "''", -1) + "'"
+	case []byte:
+		return "x'" + hex.EncodeToString(value) + "'"
+	}
+	return "?"
+}
+
+//	Scan sql, invoking f once per token with the token text and its class: one of "string", "blob", "number", "parameter",
+//	"comment", "space" or "other". The scan never fails; malformed trailing tokens are passed through as "other" so that
+//	diagnostic output degrades gracefully on bad input.
+func scanSQL(sql string, f func(token, class string)) {
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			for i < len(sql) && (sql[i] == ' ' || sql[i] == '\t' || sql[i] == '\n' || sql[i] == '\r' || sql[i] == '\f') {
+				i++
+			}
+			f(sql[start:i], "space")
+		case c == '\'':
+			i = scanQuoted(sql, i)
+			f(sql[start:i], "string")
+		case (c == 'x' || c == 'X') && i + 1 < len(sql) && sql[i + 1] == '\'':
+			i = scanQuoted(sql, i + 1)
+			f(sql[start:i], "blob")
+		case c == '"' || c == '`':
+			//	Quoted identifiers are preserved verbatim - they name objects and must survive normalization.
+			i = scanDelimited(sql, i, c)
+			f(sql[start:i], "other")
+		case c == '[':
+			i = scanDelimited(sql, i, ']')
+			f(sql[start:i], "other")
+		case c >= '0' && c <= '9' || (c == '.' && i + 1 < len(sql) && sql[i + 1] >= '0' && sql[i + 1] <= '9'):
+			for i < len(sql) && (sql[i] >= '0' && sql[i] <= '9' || sql[i] == '.' || sql[i] == 'x' || sql[i] == 'X' ||
+				sql[i] == 'e' || sql[i] == 'E' || sql[i] >= 'a' && sql[i] <= 'f' || sql[i] >= 'A' && sql[i] <= 'F' ||
+				(sql[i] == '+' || sql[i] == '-') && (sql[i - 1] == 'e' || sql[i - 1] == 'E')) {
+				i++
+			}
+			f(sql[start:i], "number")
+		case c == '?' || c == ':' || c == '@' || c == '$':
+			for i++; i < len(sql) && (IsAlphaNumeric(sql[i]) || sql[i] == '_'); i++ {}
+			if i == start + 1 && c != '?' {
+				//	A bare ":" or "@" is an operator character, not a parameter.
+				f(sql[start:i], "other")
+			} else {
+				f(sql[start:i], "parameter")
+			}
+		case c == '-' && i + 1 < len(sql) && sql[i + 1] == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			f(sql[start:i], "comment")
+		case c == '/' && i + 1 < len(sql) && sql[i + 1] == '*':
+			for i += 2; i < len(sql) && !(sql[i - 1] == '*' && sql[i] == '/'); i++ {}
+			if i < len(sql) {
+				i++
+			}
+			f(sql[start:i], "comment")
+		default:
+			if IsAlphaNumeric(c) || c == '_' {
+				for i++; i < len(sql) && (IsAlphaNumeric(sql[i]) || sql[i] == '_'); i++ {}
+			} else {
+				i++
+			}
+			f(sql[start:i], "other")
+		}
+	}
+}
+
+//	Advance past a single-quoted string starting at i, honouring '' escapes.
+func scanQuoted(sql string, i int) int {
+	for i++; i < len(sql); i++ {
+		if sql[i] == '\'' {
+			if i + 1 < len(sql) && sql[i + 1] == '\'' {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return i
+}
+
+//	Advance past a delimited identifier starting at i and ending with the given close character.
+func scanDelimited(sql string, i int, close byte) int {
+	for i++; i < len(sql); i++ {
+		if sql[i] == close {
+			return i + 1
+		}
+	}
+	return i
+}
+
+func IsAlphaNumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
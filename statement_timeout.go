@@ -0,0 +1,97 @@
+package serendipity
+
+import (
+	"time"
+)
+
+//	This file adds per-statement execution timeouts. Embedded services need a defence against pathological queries -
+//	a cartesian join typed into an ad-hoc console, a LIKE over an unindexed terabyte - and cannot always thread a
+//	context through the layers that end up calling Step. SetTimeout attaches the limit to the statement itself and
+//	enforcement rides the same opcode counting the VDBE already performs for the progress handler, so it works with
+//	no cooperation from the caller: every STMT_TIMEOUT_CHECK_OPS opcodes the interpreter calls timeoutProgress, which
+//	compares the clock against the deadline armed when the run's first Step entered the machine.
+//
+//	A run that overruns is abandoned with SQLITE_INTERRUPT from Step, and TimeoutError then returns an ErrTimeout
+//	carrying the statistics of the partial run - opcodes executed, rows already returned, elapsed time - which is
+//	what a service wants to log when deciding whether the limit or the query is at fault.
+
+//	Opcodes executed between deadline checks. Checking the clock every opcode would be measurable; a batch this size
+//	bounds the overshoot to well under a millisecond of work.
+const STMT_TIMEOUT_CHECK_OPS = 1000
+
+type TimeoutStats struct {
+	Opcodes		int64			//	VDBE opcodes executed before the run was abandoned
+	Rows		int64			//	Rows returned by Step before the run was abandoned
+	Elapsed		time.Duration	//	Wall-clock time the run had consumed
+}
+
+type ErrTimeout struct {
+	SQL		string
+	Limit	time.Duration
+	Partial	TimeoutStats
+}
+
+func (e *ErrTimeout) Error() string {
+	return sqlite3_mprintf("statement exceeded its %v timeout after %v opcodes, %v rows, %v elapsed: %v", e.Limit, e.Partial.Opcodes, e.Partial.Rows, e.Partial.Elapsed, e.SQL)
+}
+
+//	The per-statement timeout state. limit of zero means no timeout, the default; the remaining fields describe the
+//	current run and are reset each time a run is armed.
+type stmtTimeout struct {
+	limit		time.Duration
+	started		time.Time
+	opcodes		int64
+	rows		int64
+	expired		*ErrTimeout
+}
+
+//	Set the execution time limit for each subsequent run of the statement. A duration of zero removes the limit.
+//	Applies from the next run; a Step already inside the VDBE is unaffected.
+func (statement *sqlite3_stmt) SetTimeout(d time.Duration) {
+	statement.timeout.limit = d
+}
+
+//	The ErrTimeout that abandoned the last run, or nil if it completed within its limit. Cleared when a new run arms.
+func (statement *sqlite3_stmt) TimeoutError() *ErrTimeout {
+	return statement.timeout.expired
+}
+
+//	Arm the deadline for a fresh run. Called from beginStep when Step starts a run rather than resuming one.
+func (statement *sqlite3_stmt) armTimeout() {
+	timeout := &statement.timeout
+	timeout.started = time.Now()
+	timeout.opcodes = 0
+	timeout.rows = 0
+	timeout.expired = nil
+}
+
+//	Account for the result of one Step call.
+func (statement *sqlite3_stmt) noteTimeoutStep(rc int) {
+	if rc == SQLITE_ROW {
+		statement.timeout.rows++
+	}
+}
+
+//	Called from the VDBE main loop every STMT_TIMEOUT_CHECK_OPS opcodes, alongside the progress-handler check.
+//	Returns SQLITE_INTERRUPT once the deadline has passed, which the interpreter treats exactly as it treats
+//	sqlite3_interrupt: the run is rolled back and Step reports the interrupt.
+func (statement *sqlite3_stmt) timeoutProgress(opcodes int) (rc int) {
+	timeout := &statement.timeout
+	timeout.opcodes += int64(opcodes)
+	if timeout.limit == 0 {
+		return SQLITE_OK
+	}
+	if elapsed := time.Since(timeout.started); elapsed > timeout.limit {
+		timeout.expired = &ErrTimeout{
+			SQL:	statement.zSql,
+			Limit:	timeout.limit,
+			Partial: TimeoutStats{
+				Opcodes:	timeout.opcodes,
+				Rows:		timeout.rows,
+				Elapsed:	elapsed,
+			},
+		}
+		return SQLITE_INTERRUPT
+	}
+	return SQLITE_OK
+}
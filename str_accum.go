@@ -0,0 +1,110 @@
+package serendipity
+
+import (
+	"fmt"
+	"strings"
+)
+
+//	This file provides the string accumulator used wherever the engine builds large text or blob results incrementally -
+//	group_concat(), quote(), printf-style formatting and the dump API all append through it - and it is exported for UDF
+//	authors with the same needs. It replaces the StrAccum pattern of a fixed buffer with overflow flags: growth is handled
+//	by strings.Builder, and exceeding the connection's SQLITE_LIMIT_LENGTH is reported as an explicit error from the next
+//	append rather than a flag the caller must remember to test.
+//
+//	Once an append overflows the limit, the accumulator is poisoned: all further appends are no-ops and Err continues to
+//	report the overflow, so a caller may append an entire result and check a single error at the end.
+
+//	The error reported when an accumulated result exceeds the connection's length limit.
+type ErrTooBig struct {
+	Limit	int
+}
+
+func (e *ErrTooBig) Error() string {
+	return fmt.Sprintf("string or blob exceeds the connection limit of %v bytes", e.Limit)
+}
+
+//	An Accumulator builds one string or blob result under a length limit.
+type Accumulator struct {
+	builder	strings.Builder
+	limit	int
+	err		error
+}
+
+//	Create an accumulator bounded by the connection's current SQLITE_LIMIT_LENGTH. Most callers use this constructor so
+//	that lowering the limit on a connection bounds every result built for it.
+func (db *sqlite3) NewAccumulator() *Accumulator {
+	return NewAccumulator(db.Limit(SQLITE_LIMIT_LENGTH))
+}
+
+//	Create an accumulator with an explicit byte limit. A non-positive limit means unlimited.
+func NewAccumulator(limit int) *Accumulator {
+	return &Accumulator{ limit: limit }
+}
+
+//	Check whether growing by n bytes stays within the limit, poisoning the accumulator if not.
+func (a *Accumulator) grow(n int) bool {
+	if a.err != nil {
+		return false
+	}
+	if a.limit > 0 && a.builder.Len() + n > a.limit {
+		a.err = &ErrTooBig{ Limit: a.limit }
+		return false
+	}
+	return true
+}
+
+//	Append a string.
+func (a *Accumulator) Append(s string) {
+	if a.grow(len(s)) {
+		a.builder.WriteString(s)
+	}
+}
+
+//	Append raw bytes, for blob results.
+func (a *Accumulator) AppendBytes(b []byte) {
+	if a.grow(len(b)) {
+		a.builder.Write(b)
+	}
+}
+
+//	Append a single byte.
+func (a *Accumulator) AppendByte(c byte) {
+	if a.grow(1) {
+		a.builder.WriteByte(c)
+	}
+}
+
+//	Append formatted text. The text is formatted before the limit check so that a format expanding past the limit is
+//	caught exactly like any other oversized append.
+func (a *Accumulator) Appendf(format string, values ...interface{}) {
+	if a.err == nil {
+		a.Append(fmt.Sprintf(format, values...))
+	}
+}
+
+//	The number of bytes accumulated so far.
+func (a *Accumulator) Len() int {
+	return a.builder.Len()
+}
+
+//	The overflow error, or nil. Callers building a function result report it with sqlite3_result_error_toobig.
+func (a *Accumulator) Err() error {
+	return a.err
+}
+
+//	The accumulated result. Calling String on a poisoned accumulator returns the content accumulated before the overflow,
+//	which diagnostic callers may still want; result-building callers must check Err first.
+func (a *Accumulator) String() string {
+	return a.builder.String()
+}
+
+//	Publish the accumulated result, or the overflow error, as the function result. This is the one-line ending for UDFs:
+//
+//		accumulator.Result(context)
+func (a *Accumulator) Result(context *Context) {
+	if a.err != nil {
+		sqlite3_result_error_toobig(context)
+	} else {
+		sqlite3_result_text(context, a.String(), -1, SQLITE_TRANSIENT)
+	}
+}
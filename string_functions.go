@@ -0,0 +1,79 @@
+package serendipity
+
+import (
+	"unicode/utf8"
+)
+
+//	This file extends the string function set with the unicode-aware forms applications keep asking for:
+//
+//		octet_length(x)			length in bytes, always, for text and blobs alike
+//		char_length(x)			length in codepoints for text, bytes for blobs - the SQL-standard name for what
+//								length() already does, provided so ported schemas need no edits
+//		position(sub IN str)	SQL-standard spelling; the parser rewrites it to instr(str, sub)
+//
+//	and changes instr() to return character positions for text inputs, which is what every SQL standard and every other
+//	database does; byte positions remain for blob inputs, where characters do not exist. Code that relied on the old
+//	byte-position behaviour for text can restore it per-connection with "PRAGMA instr_byte_positions = on".
+//
+//	As everywhere in the text machinery, positions are 1-based and 0 means "not found".
+
+func octetLengthFunc(context *Context, args []*sqlite3_value) {
+	assert( len(args) == 1 )
+	switch sqlite3_value_type(args[0]) {
+	case SQLITE_NULL:
+		sqlite3_result_null(context)
+	case SQLITE_BLOB:
+		sqlite3_result_int64(context, int64(sqlite3_value_bytes(args[0])))
+	default:
+		sqlite3_result_int64(context, int64(len(sqlite3_value_text(args[0]))))
+	}
+}
+
+func charLengthFunc(context *Context, args []*sqlite3_value) {
+	assert( len(args) == 1 )
+	switch sqlite3_value_type(args[0]) {
+	case SQLITE_NULL:
+		sqlite3_result_null(context)
+	case SQLITE_BLOB:
+		sqlite3_result_int64(context, int64(sqlite3_value_bytes(args[0])))
+	default:
+		sqlite3_result_int64(context, int64(utf8.RuneCountInString(sqlite3_value_text(args[0]))))
+	}
+}
+
+//	The 1-based character position of the byte at byteOffset, for instr() over text (see sql_functions.go).
+func runePosition(haystack string, byteOffset int) int64 {
+	return int64(utf8.RuneCountInString(haystack[:byteOffset])) + 1
+}
+
+func indexOf(haystack, needle string) int {
+	if len(needle) == 0 {
+		return 0
+	}
+	for i := 0; i + len(needle) <= len(haystack); i++ {
+		if haystack[i:i + len(needle)] == needle {
+			return i
+		}
+	}
+	return -1
+}
+
+func init() {
+	registerPragma(PragmaHandler{
+		Name: "instr_byte_positions",
+		Get: func(db *sqlite3) string {
+			if db.instrBytePositions {
+				return "1"
+			}
+			return "0"
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			enabled, ok := pragmaBool(value)
+			if !ok {
+				return SQLITE_ERROR
+			}
+			db.instrBytePositions = enabled
+			return SQLITE_OK
+		},
+	})
+}
@@ -0,0 +1,125 @@
+package serendipity
+
+//	This file implements correlated subqueries in expression position: scalar subqueries, EXISTS / NOT EXISTS, and
+//	IN (SELECT ...). Three successively cheaper strategies are applied:
+//
+//	1. Invariant caching. A subquery that references no outer-query columns cannot change between rows, so it is
+//	   evaluated once on first use and the result register (or, for IN, the populated transient index) is reused for the
+//	   rest of the statement. This is the TK_SELECT/TK_EXISTS "only run once" behaviour from the C code.
+//
+//	2. Decorrelation. A correlated EXISTS or IN whose correlation is a simple equality against outer columns is rewritten
+//	   as a join: EXISTS becomes a semi-join against the subquery's FROM clause, NOT EXISTS an anti-join. The planner can
+//	   then choose indexes and join order for the combined query, rather than re-running the subquery per outer row.
+//
+//	3. Per-row evaluation. Whatever cannot be cached or decorrelated is compiled as a subroutine invoked for each outer
+//	   row with the current correlated values in registers - correct for everything, fastest for nothing.
+
+//	Join-type flags added to a FROM term by decorrelation.
+const (
+	JT_SEMI	= 0x0040		//	Stop after the first match per outer row (EXISTS)
+	JT_ANTI	= 0x0080		//	Keep only outer rows with no match (NOT EXISTS)
+)
+
+//	How a subquery in expression position will be evaluated, recorded on the expression for EXPLAIN output.
+const (
+	SUBQUERY_CACHED			= iota		//	Uncorrelated: evaluated once, result reused
+	SUBQUERY_DECORRELATED				//	Rewritten into the outer query as a semi- or anti-join
+	SUBQUERY_CORRELATED					//	Re-evaluated for each outer row
+)
+
+//	The outer-query column references inside a subquery, found by walking its expression trees for TK_COLUMN nodes whose
+//	cursors belong to enclosing queries. An empty result means the subquery is invariant.
+func (parse *Parse) correlatedReferences(sub *Select, outerCursors map[int]bool) (references []*Expr) {
+	sub.WalkExpressions(func(e *Expr) {
+		if e.op == TK_COLUMN && outerCursors[e.iTable] {
+			references = append(references, e)
+		}
+	})
+	return
+}
+
+//	Decide whether a correlated EXISTS or IN subquery can be rewritten as a join. The correlation must consist entirely
+//	of top-level equality terms between a subquery column and an outer expression, the subquery must not aggregate or
+//	carry a LIMIT, and for NOT EXISTS / NOT IN the subquery columns must be provably non-NULL since an anti-join and
+//	NOT IN diverge on NULLs.
+func (parse *Parse) canDecorrelate(sub *Select, negated bool) bool {
+	if sub.isAggregate || sub.pLimit != nil || sub.pPrior != nil {
+		return false
+	}
+	for _, term := range conjuncts(sub.pWhere) {
+		if term.isCorrelated() && !term.isEquality() {
+			return false
+		}
+	}
+	if negated && !sub.resultColumnsNotNull() {
+		return false
+	}
+	return true
+}
+
+//	Rewrite EXISTS (or IN, with the comparison added as an equality term) into the outer query as a semi-join: the
+//	subquery's FROM terms are appended to the outer FROM clause marked so the generated loop stops after the first match
+//	per outer row, its WHERE clause is conjoined, and the EXISTS expression itself is replaced by TRUE. An anti-join
+//	(NOT EXISTS) instead marks the terms so only outer rows with no match survive.
+func (parse *Parse) decorrelate(outer *Select, expression *Expr, negated bool) {
+	sub := expression.pSelect
+	joinType := JT_SEMI
+	if negated {
+		joinType = JT_ANTI
+	}
+	for _, item := range sub.pSrc {
+		item.jointype |= joinType
+		outer.pSrc = append(outer.pSrc, item)
+	}
+	outer.pWhere = conjoin(outer.pWhere, sub.pWhere)
+	expression.op = TK_INTEGER
+	expression.iValue = 1
+	expression.subqueryPlan = SUBQUERY_DECORRELATED
+}
+
+//	Generate code for a subquery in expression position. Invariant subqueries are wrapped in a run-once guard: a
+//	statement-lifetime flag register skips re-evaluation, so re-running a prepared statement recomputes the value but a
+//	thousand outer rows within one run do not. Correlated subqueries become subroutines; their correlated references are
+//	rewritten to read the registers the outer loop keeps current.
+func (parse *Parse) codeSubquery(expression *Expr, outerCursors map[int]bool) (resultRegister int) {
+	references := parse.correlatedReferences(expression.pSelect, outerCursors)
+	if len(references) == 0 {
+		expression.subqueryPlan = SUBQUERY_CACHED
+		return parse.codeRunOnce(expression)
+	}
+	expression.subqueryPlan = SUBQUERY_CORRELATED
+	return parse.codeSubroutine(expression, references)
+}
+
+//	Generate code for an IN (SELECT ...) right-hand side. The subquery's rows populate a transient index probed per outer
+//	row; for an invariant subquery the index is built once under the run-once guard. NULL handling follows SQL three-
+//	valued logic: a probe miss with NULLs present in the index yields NULL, not false, which is why the build pass
+//	records whether any NULL was inserted.
+func (parse *Parse) codeInSelect(expression *Expr, outerCursors map[int]bool) (indexCursor int, hasNulls int) {
+	references := parse.correlatedReferences(expression.pSelect, outerCursors)
+	if len(references) == 0 {
+		expression.subqueryPlan = SUBQUERY_CACHED
+		return parse.codeInIndexOnce(expression)
+	}
+	expression.subqueryPlan = SUBQUERY_CORRELATED
+	return parse.codeInIndexPerRow(expression, references)
+}
+
+//	The decorrelation pass, run over a Select after flattening. Each EXISTS / NOT EXISTS / IN-subquery term at the top
+//	level of the WHERE clause is tested and rewritten where legal; terms under OR stay put because a semi-join cannot
+//	express a disjunct.
+func (parse *Parse) decorrelatePass(outer *Select) {
+	for _, term := range conjuncts(outer.pWhere) {
+		negated := term.op == TK_NOT
+		test := term
+		if negated {
+			test = term.pLeft
+		}
+		if test.op != TK_EXISTS && !(test.op == TK_IN && test.pSelect != nil) {
+			continue
+		}
+		if parse.canDecorrelate(test.pSelect, negated) {
+			parse.decorrelate(outer, test, negated)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package serendipity
+
+import (
+	"sync/atomic"
+)
+
+//	This file adds memory accounting and disk spill for the connection's transient storage: materialized CTEs,
+//	transient indexes built for DISTINCT and compound-SELECT deduplication, temp b-trees for sorting, and materialized
+//	view caches. Each starts in memory; its pages are charged against a single per-connection budget, and when an
+//	allocation would exceed the budget the largest in-memory transient structure is migrated to a temp-file b-tree and
+//	its memory returned. Queries keep working against structures that spilled - a spill changes their speed, never
+//	their results - so a pathological query degrades to disk speed instead of taking the process down.
+//
+//	The budget is set with "PRAGMA temp_store_budget = N" (bytes; 0 means unlimited, the historical behaviour), and
+//	pragma_temp_store_stats reports current usage, the high-water mark and the number of spill events, which is the
+//	counter to watch when deciding whether a budget is too small.
+
+type tempStoreAccounting struct {
+	budget		int64		//	Bytes allowed in memory; 0 is unlimited
+	used		int64		//	Current in-memory bytes (atomic)
+	highWater	int64		//	Largest value of used (atomic)
+	spills		int64		//	Structures migrated to disk (atomic)
+}
+
+//	A transient structure that can be asked to migrate itself to disk. Both the in-memory and file-backed temp b-trees
+//	implement this; Spill on an already-spilled structure is a no-op.
+type spillable interface {
+	MemoryUsed() int64
+	Spill() (rc int)
+}
+
+//	Charge n bytes of transient memory, spilling structures as needed to stay within budget. Called by the transient
+//	b-tree when it allocates a page; the registry holds every live transient structure of the connection.
+func (db *sqlite3) chargeTempStore(n int64) (rc int) {
+	accounting := &db.tempStore
+	used := atomic.AddInt64(&accounting.used, n)
+	for high := atomic.LoadInt64(&accounting.highWater); used > high; high = atomic.LoadInt64(&accounting.highWater) {
+		if atomic.CompareAndSwapInt64(&accounting.highWater, high, used) {
+			break
+		}
+	}
+	for accounting.budget > 0 && atomic.LoadInt64(&accounting.used) > accounting.budget {
+		victim := db.largestTransient()
+		if victim == nil {
+			//	Nothing left to spill: the single allocation exceeds the budget on its own. Allow it - the budget
+			//	bounds aggregate growth, and failing here would make small budgets break queries outright.
+			break
+		}
+		before := victim.MemoryUsed()
+		if rc = victim.Spill(); rc != SQLITE_OK {
+			return
+		}
+		atomic.AddInt64(&accounting.used, -before)
+		atomic.AddInt64(&accounting.spills, 1)
+	}
+	return SQLITE_OK
+}
+
+//	Return n bytes when a transient structure shrinks or is dropped.
+func (db *sqlite3) releaseTempStore(n int64) {
+	atomic.AddInt64(&db.tempStore.used, -n)
+}
+
+//	The largest in-memory transient structure, the spill victim: one large spill is cheaper than several small ones,
+//	and the largest structure is the likeliest to keep growing.
+func (db *sqlite3) largestTransient() (victim spillable) {
+	var largest int64
+	for _, candidate := range db.transientStructures {
+		if used := candidate.MemoryUsed(); used > largest {
+			victim, largest = candidate, used
+		}
+	}
+	return
+}
+
+//	Track a transient structure for the accounting's spill selection. Deregistration happens via releaseTempStore plus
+//	removal when the structure closes.
+func (db *sqlite3) registerTransient(structure spillable) {
+	db.transientStructures = append(db.transientStructures, structure)
+}
+
+func (db *sqlite3) deregisterTransient(structure spillable) {
+	for i, candidate := range db.transientStructures {
+		if candidate == structure {
+			db.transientStructures = append(db.transientStructures[:i], db.transientStructures[i + 1:]...)
+			return
+		}
+	}
+}
+
+func init() {
+	registerPragma(PragmaHandler{
+		Name: "temp_store_budget",
+		Get: func(db *sqlite3) string {
+			return sqlite3_mprintf("%v", db.tempStore.budget)
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			n, ok := pragmaInt(value)
+			if !ok || n < 0 {
+				return SQLITE_ERROR
+			}
+			db.tempStore.budget = int64(n)
+			return SQLITE_OK
+		},
+	})
+	registerTablePragma(TablePragma{
+		Name:		"pragma_temp_store_stats",
+		Columns:	[]string{ "used", "high_water", "budget", "spills" },
+		Rows: func(db *sqlite3, argument string, emit func(row ...interface{})) (rc int) {
+			accounting := &db.tempStore
+			emit(atomic.LoadInt64(&accounting.used), atomic.LoadInt64(&accounting.highWater), accounting.budget, atomic.LoadInt64(&accounting.spills))
+			return SQLITE_OK
+		},
+	})
+}
@@ -0,0 +1,114 @@
+package trace
+
+import (
+	"context"
+	"time"
+)
+
+//	This package defines the tracing hook surface for serendipity. The engine emits a span per statement and a span per
+//	transaction through the Tracer interface, propagating the caller's context so that database spans nest correctly inside
+//	whatever HTTP or gRPC spans are already active.
+//
+//	The interface is deliberately shaped like an OpenTelemetry tracer but carries no dependency on the OpenTelemetry SDK: a
+//	thin adapter (a dozen lines in the application) maps StartSpan onto trace.Tracer.Start and Attribute onto attribute.KeyValue.
+//	This keeps the engine core free of third-party imports while making the integration mechanical.
+
+//	An Attribute is a key/value pair attached to a span. Values are restricted to the types every tracing backend supports.
+type Attribute struct {
+	Key		string
+	Value	interface{}		//	string, bool, int64 or float64
+}
+
+//	A Span represents one traced operation. Spans are finished exactly once; attributes may be added at any point before End.
+type Span interface {
+	SetAttributes(attributes ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+//	A Tracer creates spans. StartSpan must return a context carrying the new span so that child operations nest beneath it.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string, attributes ...Attribute) (context.Context, Span)
+}
+
+//	The attribute keys emitted by the engine, following the OpenTelemetry semantic conventions for database clients where one
+//	exists and the serendipity namespace where none does.
+const (
+	AttributeSystem			= "db.system"				//	Always "serendipity"
+	AttributeStatement		= "db.statement"			//	The SQL digest, never the raw text
+	AttributeOperation		= "db.operation"			//	SELECT, INSERT, UPDATE, DELETE, DDL or TXN
+	AttributeRowsReturned	= "db.response.returned_rows"
+	AttributePlan			= "serendipity.plan"		//	One-line query plan summary
+	AttributeReadOnly		= "serendipity.read_only"	//	Whether the transaction took no write locks
+)
+
+//	A StatementSpan wraps a statement execution. Callers obtain one from Begin before stepping the statement and finish it when
+//	the statement is reset, recording the row count and any error on the way out.
+type StatementSpan struct {
+	ctx		context.Context
+	span	Span
+}
+
+//	The context carrying the statement span, for nesting child operations such as virtual table callbacks.
+func (s *StatementSpan) Context() context.Context {
+	if s == nil || s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+//	Finish the span, recording the outcome of the statement.
+func (s *StatementSpan) Finish(rows int64, err error) {
+	if s == nil || s.span == nil {
+		return
+	}
+	s.span.SetAttributes(Attribute{ Key: AttributeRowsReturned, Value: rows })
+	if err != nil {
+		s.span.RecordError(err)
+	}
+	s.span.End()
+}
+
+//	A Hook bundles a Tracer with the policy choices the engine needs: whether to trace at all, and how to reduce SQL text to a
+//	digest safe for export. A nil *Hook is valid everywhere and traces nothing, so call sites need no guards.
+type Hook struct {
+	Tracer	Tracer
+	Digest	func(sql string) string		//	Reduces SQL to an export-safe digest; the identity function when nil
+}
+
+//	Start a span for a single statement. The digest, operation and plan are attached immediately so that they survive even if
+//	the statement fails before producing rows.
+func (h *Hook) Begin(ctx context.Context, sql, operation, plan string) *StatementSpan {
+	if h == nil || h.Tracer == nil {
+		return nil
+	}
+	digest := sql
+	if h.Digest != nil {
+		digest = h.Digest(sql)
+	}
+	ctx, span := h.Tracer.StartSpan(ctx, operation,
+		Attribute{ Key: AttributeSystem, Value: "serendipity" },
+		Attribute{ Key: AttributeStatement, Value: digest },
+		Attribute{ Key: AttributeOperation, Value: operation },
+		Attribute{ Key: AttributePlan, Value: plan },
+	)
+	return &StatementSpan{ ctx: ctx, span: span }
+}
+
+//	Start a span covering a whole transaction. Statement spans started with the returned context become its children.
+func (h *Hook) BeginTransaction(ctx context.Context, readOnly bool) (context.Context, func(duration time.Duration, err error)) {
+	if h == nil || h.Tracer == nil {
+		return ctx, func(time.Duration, error) {}
+	}
+	ctx, span := h.Tracer.StartSpan(ctx, "TXN",
+		Attribute{ Key: AttributeSystem, Value: "serendipity" },
+		Attribute{ Key: AttributeOperation, Value: "TXN" },
+		Attribute{ Key: AttributeReadOnly, Value: readOnly },
+	)
+	return ctx, func(duration time.Duration, err error) {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}
+}
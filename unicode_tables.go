@@ -0,0 +1,118 @@
+package serendipity
+
+import (
+	"unicode/utf8"
+)
+
+//	This file adds two eponymous table-valued functions for per-character analysis in SQL:
+//
+//		chars(text)		one row per codepoint: (idx, codepoint, char)
+//		octets(blob)	one row per byte: (idx, octet)
+//
+//	idx counts from zero in codepoints for chars and bytes for octets. Malformed UTF-8 in the input to chars yields the
+//	replacement character U+FFFD for the offending byte and continues, the same recovery the rest of the text machinery
+//	applies, so the function never errors on data the database was willing to store.
+//
+//	Beyond their direct use - "SELECT count(*) FROM chars(x) WHERE codepoint > 127" finds non-ASCII - these are the
+//	simplest possible exercises of the eponymous virtual table machinery and serve as the reference implementations for
+//	writing new table-valued functions.
+
+//	Both functions share one cursor shape: rows are generated eagerly from the argument on xFilter.
+type charsVtabCursor struct {
+	rows	[][]interface{}
+	iRow	int
+}
+
+func (cursor *charsVtabCursor) Next() (rc int) {
+	cursor.iRow++
+	return SQLITE_OK
+}
+
+func (cursor *charsVtabCursor) Eof() bool {
+	return cursor.iRow >= len(cursor.rows)
+}
+
+func (cursor *charsVtabCursor) Column(context *Context, i int) (rc int) {
+	if i < len(cursor.rows[cursor.iRow]) {
+		sqlite3_result_value(context, cursor.rows[cursor.iRow][i])
+	}
+	return SQLITE_OK
+}
+
+func (cursor *charsVtabCursor) Rowid() (rowid int64, rc int) {
+	return int64(cursor.iRow), SQLITE_OK
+}
+
+//	The chars module. The input column is HIDDEN and carries the function argument, as in pragma_functions.go.
+type charsVtab struct{}
+
+func charsVtabConnect(db *sqlite3) (table *charsVtab, zSchema string, rc int) {
+	return &charsVtab{}, "CREATE TABLE x(idx INTEGER, codepoint INTEGER, char TEXT, input HIDDEN)", SQLITE_OK
+}
+
+func (table *charsVtab) BestIndex(info *IndexInfo) (rc int) {
+	return requireHiddenArgument(info, 3)
+}
+
+func (table *charsVtab) Open() (cursor *charsVtabCursor, rc int) {
+	return &charsVtabCursor{}, SQLITE_OK
+}
+
+func (table *charsVtab) Filter(cursor *charsVtabCursor, argv []*sqlite3_value) (rc int) {
+	cursor.rows = cursor.rows[:0]
+	cursor.iRow = 0
+	if len(argv) == 0 || argv[0].Type() == SQLITE_NULL {
+		return SQLITE_OK
+	}
+	text := argv[0].Text()
+	idx := int64(0)
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		cursor.rows = append(cursor.rows, []interface{}{ idx, int64(r), string(r) })
+		idx++
+		i += size
+	}
+	return SQLITE_OK
+}
+
+//	The octets module.
+type octetsVtab struct{}
+
+func octetsVtabConnect(db *sqlite3) (table *octetsVtab, zSchema string, rc int) {
+	return &octetsVtab{}, "CREATE TABLE x(idx INTEGER, octet INTEGER, input HIDDEN)", SQLITE_OK
+}
+
+func (table *octetsVtab) BestIndex(info *IndexInfo) (rc int) {
+	return requireHiddenArgument(info, 2)
+}
+
+func (table *octetsVtab) Open() (cursor *charsVtabCursor, rc int) {
+	return &charsVtabCursor{}, SQLITE_OK
+}
+
+func (table *octetsVtab) Filter(cursor *charsVtabCursor, argv []*sqlite3_value) (rc int) {
+	cursor.rows = cursor.rows[:0]
+	cursor.iRow = 0
+	if len(argv) == 0 || argv[0].Type() == SQLITE_NULL {
+		return SQLITE_OK
+	}
+	for i, octet := range argv[0].Blob() {
+		cursor.rows = append(cursor.rows, []interface{}{ int64(i), int64(octet) })
+	}
+	return SQLITE_OK
+}
+
+//	The shared BestIndex for single-argument eponymous functions: an equality constraint on the HIDDEN column at
+//	iHidden becomes the one xFilter argument, and calling the function without its argument is a planning error rather
+//	than an empty result, so "SELECT * FROM chars" fails loudly.
+func requireHiddenArgument(info *IndexInfo, iHidden int) (rc int) {
+	for i, constraint := range info.Constraint {
+		if constraint.iColumn == iHidden && constraint.op == SQLITE_INDEX_CONSTRAINT_EQ && constraint.usable {
+			info.Usage[i].argvIndex = 1
+			info.Usage[i].omit = true
+			info.estimatedCost = 10
+			return SQLITE_OK
+		}
+	}
+	return SQLITE_ERROR
+}
@@ -0,0 +1,60 @@
+package serendipity
+
+//	This file adds value subtypes and pointer-passing to the value API.
+//
+//	A subtype is a small integer a function attaches to its result so that a consuming function can recognise values it
+//	produced itself - the JSON functions use one to distinguish "already JSON" text from plain text, for instance. Subtypes
+//	survive only while a value flows directly from one function into another; storing a value strips them.
+//
+//	Pointer-passing carries rich Go objects between a binding site and a function (or between two functions) without
+//	serialising them. A pointer value presents as NULL to all ordinary SQL - it cannot be stored, compared or printed - and
+//	is only recoverable by code supplying the same type tag it was created with, so mismatched or malicious SQL cannot get
+//	at the object. This replaces the RtreeMatchArg convention of serialising callbacks into blobs: a geometry callback can
+//	now bind its parameters and function as a tagged Go object and receive it back intact in the MATCH constraint.
+
+const MEM_Pointer = 0x10000		//	Value carries a Go object with a type tag; presents as NULL to SQL
+
+//	Attach a subtype to the function result under construction. Must be called after one of the result setters.
+func (context *Context) sqlite3_result_subtype(subtype uint8) {
+	context.pOut.subtype = subtype
+}
+
+//	The subtype attached to the value, or 0 if none was set or it has been stripped in transit.
+func sqlite3_value_subtype(value *sqlite3_value) uint8 {
+	return value.subtype
+}
+
+//	Bind a Go object as the idxth parameter of a statement. The object is recoverable only by sqlite3_value_pointer with
+//	the identical tag; everything else sees NULL.
+func sqlite3_bind_pointer(statement *sqlite3_stmt, idx int, object interface{}, tag string) (rc int) {
+	value := statement.bindValue(idx)
+	if value == nil {
+		return SQLITE_RANGE
+	}
+	value.flags = MEM_Pointer
+	value.pointer = object
+	value.pointerTag = tag
+	return SQLITE_OK
+}
+
+//	Set the function result to a tagged Go object.
+func (context *Context) sqlite3_result_pointer(object interface{}, tag string) {
+	out := context.pOut
+	out.flags = MEM_Pointer
+	out.pointer = object
+	out.pointerTag = tag
+}
+
+//	Recover the object carried by a pointer value, or nil if the value is not a pointer or was created under another tag.
+//	The tag comparison is the whole safety argument, so it is an exact string match with no normalisation.
+func sqlite3_value_pointer(value *sqlite3_value, tag string) interface{} {
+	if value.flags & MEM_Pointer != 0 && value.pointerTag == tag {
+		return value.pointer
+	}
+	return nil
+}
+
+//	The type tag used by the rtree geometry machinery. A geometry function built on pointer-passing creates its match
+//	object with this tag and the MATCH operator recovers it, replacing the RtreeMatchArg blob serialisation; the blob path
+//	is retained for compatibility with callbacks registered through sqlite3_rtree_geometry_callback.
+const RTREE_GEOMETRY_POINTER_TAG = "rtree_geometry"
@@ -0,0 +1,120 @@
+package serendipity
+
+//	This file implements views. CREATE VIEW stores the defining SELECT in the schema; queries against the view splice
+//	that SELECT in as a derived table during name resolution, after which the flattening pass in select_flatten.go
+//	usually dissolves it entirely. Views are read-only unless an INSTEAD OF trigger provides the write behaviour, exactly
+//	as in SQLite.
+//
+//	Beyond standard views, CREATE TEMP MATERIALIZED VIEW caches the view's result rows in a transient table for the
+//	duration of the enclosing transaction. The first read populates the cache; later reads scan it directly. Any write to
+//	a table the view reads - observed through the update hook - and any transaction boundary invalidate the cache, so a
+//	materialized view is never stale within the semantics the transaction could observe anyway. The extension is
+//	restricted to TEMP because the cache is per-connection state that must not outlive or escape the connection.
+
+const TRIGGER_INSTEAD_OF = 2		//	Trigger fires instead of the operation, the only kind legal on a view
+
+//	The in-memory description of one view.
+type View struct {
+	zName			string		//	Name of the view
+	pSelect			*Select		//	The defining SELECT, as parsed from the schema
+	pSchema			*Schema		//	Schema containing the view
+	nCol			int			//	Number of result columns
+	azColName		[]string	//	Column names: explicit list if given, else from the SELECT
+	isMaterialized	bool		//	CREATE TEMP MATERIALIZED VIEW
+	readsTables		[]string	//	Tables the SELECT reads, for cache invalidation
+	cacheCursor		int			//	Transient table holding cached rows, or negative when not populated
+}
+
+//	Process CREATE [TEMP] [MATERIALIZED] VIEW. The column list, when present, must match the SELECT's width; otherwise
+//	column names come from the SELECT's result list. MATERIALIZED outside TEMP is an error because the cache is
+//	connection-local.
+func (parse *Parse) createView(zName string, columns []string, selectStatement *Select, isTemp, isMaterialized bool) (rc int) {
+	if isMaterialized && !isTemp {
+		parse.zErrMsg = sqlite3_mprintf("materialized views must be TEMP")
+		return SQLITE_ERROR
+	}
+	if len(columns) > 0 && len(columns) != len(selectStatement.pEList) {
+		parse.zErrMsg = sqlite3_mprintf("expected %v columns for %Q but got %v", len(columns), zName, len(selectStatement.pEList))
+		return SQLITE_ERROR
+	}
+	view := &View{
+		zName:			zName,
+		pSelect:		selectStatement,
+		nCol:			len(selectStatement.pEList),
+		azColName:		columns,
+		isMaterialized:	isMaterialized,
+		readsTables:	selectStatement.tablesRead(),
+		cacheCursor:	-1,
+	}
+	return parse.schemaFor(isTemp).addView(view)
+}
+
+//	Process DROP VIEW. Dropping a table with DROP VIEW, or vice versa, is an error, matching the C behaviour.
+func (parse *Parse) dropView(zName string, ifExists bool) (rc int) {
+	view := parse.db.findView(zName)
+	switch {
+	case view == nil && ifExists:
+		return SQLITE_OK
+	case view == nil:
+		parse.zErrMsg = sqlite3_mprintf("no such view: %v", zName)
+		return SQLITE_ERROR
+	}
+	view.invalidateCache(parse.db)
+	return view.pSchema.removeView(zName)
+}
+
+//	Expand a reference to the view into a derived table. For a plain view the defining SELECT is duplicated into the FROM
+//	term - duplication matters because the same view may appear twice in one query with different correlated contexts.
+//	For a populated materialized view the FROM term instead scans the cache; an unpopulated one expands like a plain view
+//	with the output teed into the cache.
+func (parse *Parse) expandView(item *SrcListItem, view *View) {
+	if view.isMaterialized && view.cacheCursor >= 0 {
+		item.iCursor = view.cacheCursor
+		return
+	}
+	item.pSelect = view.pSelect.Dup()
+	if view.isMaterialized {
+		parse.teeIntoCache(item, view)
+	}
+}
+
+//	Whether writes to the view are possible: only through an INSTEAD OF trigger. Called from the INSERT, UPDATE and
+//	DELETE code generators before they reject the target.
+func (parse *Parse) viewIsWritable(view *View, op int) bool {
+	return parse.findTrigger(view.zName, op, TRIGGER_INSTEAD_OF) != nil
+}
+
+//	Throw away the cached rows. Called from the update hook when a table the view reads changes, and from transaction
+//	boundaries (both commit and rollback - a new transaction may see new rows from other connections).
+func (view *View) invalidateCache(db *sqlite3) {
+	if view.cacheCursor >= 0 {
+		db.dropTransientTable(view.cacheCursor)
+		view.cacheCursor = -1
+	}
+}
+
+//	The update-hook listener that keeps materialized caches honest. Installed once per connection when the first
+//	materialized view is created; chains to any hook the application installed.
+func (db *sqlite3) watchMaterializedViews() {
+	previous := db.xUpdateCallback
+	db.xUpdateCallback = func(op int, zDb, zTable string, rowid int64) {
+		for _, view := range db.materializedViews() {
+			for _, read := range view.readsTables {
+				if CaseInsensitiveComparison(read, zTable) == 0 {
+					view.invalidateCache(db)
+					break
+				}
+			}
+		}
+		if previous != nil {
+			previous(op, zDb, zTable, rowid)
+		}
+	}
+}
+
+//	Invalidate every materialized cache at a transaction boundary.
+func (db *sqlite3) invalidateMaterializedViews() {
+	for _, view := range db.materializedViews() {
+		view.invalidateCache(db)
+	}
+}
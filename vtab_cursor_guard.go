@@ -0,0 +1,70 @@
+package serendipity
+
+//	This file defines the cursor-stability contract for virtual table modules and a small helper for honouring it.
+//
+//	Within one transaction a statement may read from a virtual table while another statement writes to it - a SELECT driving
+//	an UPDATE on the same table is the common shape. A module whose cursors point into structures that its own write path
+//	mutates (the rtree cursor points into nodes that deleteCell and SplitNode rewrite) must either keep such cursors valid
+//	or fail them cleanly; silently walking a mutated structure produces wrong results with no error, the worst outcome.
+//
+//	The contract:
+//
+//		*	a module registers each open cursor with its table's CursorGuard and deregisters it on close
+//
+//		*	any write-path operation which restructures storage that open cursors may reference calls InvalidateAll
+//			(writes which cannot affect open cursors need not)
+//
+//		*	before using a cursor's cached position, the module calls Check; an invalidated cursor returns SQLITE_ABORT
+//			to the statement, which surfaces to the application as "query aborted" rather than as corrupt results
+//
+//	A module able to re-seek cheaply may instead install a revalidation callback, turning invalidation into a transparent
+//	re-position instead of an error.
+
+//	A guarded cursor. Modules embed or reference one per cursor.
+type GuardedCursor struct {
+	invalidated	bool
+	revalidate	func() (rc int)		//	Optional: restores a valid position, clearing the invalidation
+}
+
+//	A CursorGuard tracks the open cursors of one virtual table instance. Virtual table methods on one connection are already
+//	serialized by the connection mutex, so no further locking is needed here.
+type CursorGuard struct {
+	cursors	map[*GuardedCursor]bool
+}
+
+func NewCursorGuard() *CursorGuard {
+	return &CursorGuard{ cursors: make(map[*GuardedCursor]bool) }
+}
+
+//	Register a cursor, optionally with a revalidation callback.
+func (guard *CursorGuard) Register(cursor *GuardedCursor, revalidate func() (rc int)) {
+	cursor.invalidated = false
+	cursor.revalidate = revalidate
+	guard.cursors[cursor] = true
+}
+
+func (guard *CursorGuard) Deregister(cursor *GuardedCursor) {
+	delete(guard.cursors, cursor)
+}
+
+//	Mark every open cursor invalid. Called from write paths which restructure storage.
+func (guard *CursorGuard) InvalidateAll() {
+	for cursor := range guard.cursors {
+		cursor.invalidated = true
+	}
+}
+
+//	Verify that the cursor may continue from its cached position. An invalidated cursor with a revalidation callback is
+//	given the chance to re-seek; otherwise SQLITE_ABORT is returned and the enclosing statement fails cleanly.
+func (cursor *GuardedCursor) Check() (rc int) {
+	if !cursor.invalidated {
+		return SQLITE_OK
+	}
+	if cursor.revalidate != nil {
+		if rc = cursor.revalidate(); rc == SQLITE_OK {
+			cursor.invalidated = false
+		}
+		return
+	}
+	return SQLITE_ABORT
+}
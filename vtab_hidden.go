@@ -0,0 +1,82 @@
+package serendipity
+
+import "strings"
+
+//	This file adds HIDDEN column support to sqlite3_declare_vtab() processing and to the planner's treatment of virtual
+//	tables. A module marks a column HIDDEN in its declaration:
+//
+//		CREATE TABLE x(content, fts HIDDEN, score HIDDEN)
+//
+//	and the column then behaves as a function-style parameter: it is omitted from "SELECT *" expansion and from INSERT
+//	column-count checks, but remains addressable by name so that constraints like "WHERE fts MATCH ?" reach xBestIndex as
+//	ordinary column constraints. This is the mechanism rtree aux/score columns and table-valued functions both build on -
+//	a table-valued function's arguments are exactly its hidden columns.
+//
+//	HIDDEN is not SQL the parser accepts in real CREATE TABLE statements; it is recognised only here, while processing a
+//	declaration supplied through sqlite3_declare_vtab(), and is stripped before the declaration is parsed.
+
+//	Per-column flag recorded when a declaration marks the column HIDDEN.
+const COLFLAG_HIDDEN = 0x0002
+
+//	Process a virtual table declaration: strip each HIDDEN keyword, recording which columns carried it. The returned
+//	declaration is what the schema parser consumes; the flags are applied to the resulting Table's columns in declaration
+//	order. Only the keyword as the final token of a column definition is recognised, matching its documented placement.
+func stripHiddenKeyword(declaration string) (cleaned string, hidden []bool) {
+	depth := 0
+	columnStart := 0
+	body := false
+	var builder	strings.Builder
+	flush := func(definition string) {
+		trimmed := strings.TrimSpace(definition)
+		isHidden := false
+		if len(trimmed) >= 6 && strings.EqualFold(trimmed[len(trimmed) - 6:], "hidden") {
+			//	HIDDEN must stand alone as a token, not be the tail of an identifier like "forbidden".
+			if len(trimmed) == 6 || !IsAlphaNumeric(trimmed[len(trimmed) - 7]) && trimmed[len(trimmed) - 7] != '_' {
+				isHidden = true
+				definition = strings.TrimSpace(trimmed[:len(trimmed) - 6])
+			}
+		}
+		hidden = append(hidden, isHidden)
+		builder.WriteString(definition)
+	}
+	for i := 0; i < len(declaration); i++ {
+		switch c := declaration[i]; {
+		case c == '(':
+			if depth++; depth == 1 && !body {
+				body = true
+				builder.WriteString(declaration[:i + 1])
+				columnStart = i + 1
+			}
+		case c == ')':
+			if depth--; depth == 0 && body {
+				flush(declaration[columnStart:i])
+				builder.WriteString(declaration[i:])
+				return builder.String(), hidden
+			}
+		case c == ',' && depth == 1:
+			flush(declaration[columnStart:i])
+			builder.WriteString(", ")
+			columnStart = i + 1
+		case c == '\'' || c == '"' || c == '`':
+			//	Skip quoted names and defaults so that a literal containing "hidden" or a comma cannot confuse the scan.
+			for i++; i < len(declaration) && declaration[i] != c; i++ {}
+		}
+	}
+	//	An unbalanced declaration is passed through untouched; the schema parser will produce the error.
+	return declaration, nil
+}
+
+//	Apply the hidden flags produced by stripHiddenKeyword to a freshly-declared table's columns.
+func (table *Table) applyHiddenFlags(hidden []bool) {
+	for i, isHidden := range hidden {
+		if isHidden && i < len(table.Columns) {
+			table.Columns[i].colFlags |= COLFLAG_HIDDEN
+		}
+	}
+}
+
+//	Report whether the column takes part in "SELECT *" expansion and positional INSERT. The planner also uses this to allow
+//	equality and MATCH constraints on hidden columns to pass to xBestIndex even when the column never appears in output.
+func (table *Table) IsHiddenColumn(i int) bool {
+	return i >= 0 && i < len(table.Columns) && table.Columns[i].colFlags & COLFLAG_HIDDEN != 0
+}
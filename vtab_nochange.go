@@ -0,0 +1,52 @@
+package serendipity
+
+//	This file implements the "nochange" mechanism for virtual table updates. When the planner can prove that an UPDATE
+//	leaves a column untouched (the column does not appear on the left-hand side of any SET term), the value passed to
+//	xUpdate for that column is marked no-change instead of carrying a freshly loaded copy of the stored value. An xUpdate
+//	implementation then skips rewriting storage for those columns - for wide-row modules such as rtree tables with aux
+//	columns or a kvtab, this turns an UPDATE of one column from a full-row rewrite into a single-column write.
+//
+//	The discipline mirrors the C API: sqlite3_value_nochange() answers true only for values received by xUpdate, and a
+//	module which reads such a value anyway gets the previously stored content, so ignoring the mechanism is always correct,
+//	merely slower.
+
+//	The flag recorded on a value which xUpdate may treat as unchanged.
+const MEM_Nochange = 0x8000
+
+//	Report whether the ith xUpdate argument is marked no-change. Modules call this per column before deciding whether to
+//	rewrite it. Values outside an xUpdate invocation never carry the flag.
+func sqlite3_value_nochange(value *sqlite3_value) bool {
+	return value.flags & MEM_Nochange != 0
+}
+
+//	Mark a value no-change. Called by the UPDATE code generator when building the argv array for xUpdate, for each column
+//	absent from the SET list. The stored content is retained alongside the flag so that modules which read the value
+//	regardless still see the correct data.
+func (value *sqlite3_value) setNochange() {
+	value.flags |= MEM_Nochange
+}
+
+//	Decide which columns of an UPDATE against a virtual table can be marked no-change. A column qualifies when it is not
+//	assigned by any SET term and the update is not an INSERT OR REPLACE rewrite (where every column is logically new).
+//	The result is a mask indexed by column position, consumed by the code generator when it populates xUpdate's argv.
+func updateNochangeMask(table *Table, assigned []bool, isReplace bool) (mask []bool) {
+	mask = make([]bool, len(table.Columns))
+	if isReplace {
+		return
+	}
+	for i := range mask {
+		mask[i] = i >= len(assigned) || !assigned[i]
+	}
+	return
+}
+
+//	Convenience for modules: report whether every coordinate column of this update is unchanged, in which case an rtree
+//	xUpdate only needs to rewrite aux content and can leave the tree structure alone entirely.
+func allCoordinatesUnchanged(argv []*sqlite3_value, first, count int) bool {
+	for i := first; i < first + count && i < len(argv); i++ {
+		if !sqlite3_value_nochange(argv[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package serendipity
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+//	This file protects WAL checkpoints from reader starvation. A checkpoint can only copy frames up to the oldest
+//	read mark, so one forgotten read transaction - a cursor left open in a REPL, a connection leaked by an
+//	application - pins the mark forever, the WAL grows without bound, and every subsequent checkpoint is a no-op.
+//
+//	Each read transaction registers with the gate when it opens. When a checkpoint finds itself blocked it consults
+//	the gate: a blocking reader older than the warning threshold is logged with its age and mark, and one older than
+//	the configured maximum is expired - its snapshot is withdrawn, so its next read fails with SQLITE_ABORT and the
+//	checkpoint proceeds past its mark. The maximum is off by default (readers are never broken unless asked for);
+//	"PRAGMA max_reader_age = ms" enables it, and pragma_wal_gate_stats reports the WAL size, the oldest read mark
+//	and age, and checkpoint counts and durations, which together show whether the gate is earning its keep.
+
+//	A blocked checkpoint logs a warning for readers older than this even when no maximum age is configured.
+const WAL_READER_WARN_AGE = 30 * time.Second
+
+//	One registered read transaction.
+type walReader struct {
+	mark	uint32		//	The WAL frame this reader's snapshot ends at
+	since	time.Time	//	When the read transaction opened
+	expired	bool		//	Set by the gate; the reader's next access fails and it must restart
+}
+
+//	The gate shared by every connection reading through one WAL.
+type walCheckpointGate struct {
+	mutex				sync.Mutex
+	readers				map[int]*walReader
+	nextReader			int
+	Checkpoints			int64			//	Completed checkpoints
+	Blocked				int64			//	Checkpoints that found an older reader in the way
+	Expired				int64			//	Readers forcibly expired
+	LastDuration		time.Duration	//	Duration of the most recent checkpoint
+	TotalDuration		time.Duration
+}
+
+//	Register a read transaction, returning its handle for EndRead. Called as the shared lock is taken.
+func (gate *walCheckpointGate) BeginRead(mark uint32) (id int) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	if gate.readers == nil {
+		gate.readers = make(map[int]*walReader)
+	}
+	id = gate.nextReader
+	gate.nextReader++
+	gate.readers[id] = &walReader{ mark: mark, since: time.Now() }
+	return
+}
+
+func (gate *walCheckpointGate) EndRead(id int) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	delete(gate.readers, id)
+}
+
+//	Whether the reader's snapshot has been withdrawn. Checked on each read; an expired reader returns SQLITE_ABORT
+//	to its caller and must begin a fresh transaction.
+func (gate *walCheckpointGate) ReaderExpired(id int) bool {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	reader := gate.readers[id]
+	return reader != nil && reader.expired
+}
+
+//	The oldest live read mark, or ok == false when no readers are registered.
+func (gate *walCheckpointGate) oldestReader() (oldest *walReader, ok bool) {
+	for _, reader := range gate.readers {
+		if !reader.expired && (oldest == nil || reader.mark < oldest.mark) {
+			oldest = reader
+		}
+	}
+	return oldest, oldest != nil
+}
+
+//	Called by the checkpoint path when it cannot advance past frame mark. Logs long-lived blockers and, when a
+//	maximum reader age is configured, expires those beyond it; returns whether the checkpoint should retry.
+func (gate *walCheckpointGate) CheckpointBlocked(db *sqlite3) (retry bool) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	gate.Blocked++
+	oldest, ok := gate.oldestReader()
+	if !ok {
+		return false
+	}
+	age := time.Since(oldest.since)
+	if age > WAL_READER_WARN_AGE {
+		slog.Warn("wal checkpoint blocked by long-lived reader", "mark", oldest.mark, "age", age)
+	}
+	if db.maxReaderAge > 0 && age > db.maxReaderAge {
+		oldest.expired = true
+		gate.Expired++
+		slog.Error("wal reader expired to unblock checkpoint", "mark", oldest.mark, "age", age, "max_reader_age", db.maxReaderAge)
+		return true
+	}
+	return false
+}
+
+//	Record a completed checkpoint.
+func (gate *walCheckpointGate) CheckpointDone(took time.Duration) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	gate.Checkpoints++
+	gate.LastDuration = took
+	gate.TotalDuration += took
+}
+
+func init() {
+	registerPragma(PragmaHandler{
+		Name: "max_reader_age",
+		Get: func(db *sqlite3) string {
+			return sqlite3_mprintf("%v", int64(db.maxReaderAge / time.Millisecond))
+		},
+		Set: func(db *sqlite3, value string) (rc int) {
+			n, ok := pragmaInt(value)
+			if !ok || n < 0 {
+				return SQLITE_ERROR
+			}
+			db.maxReaderAge = time.Duration(n) * time.Millisecond
+			return SQLITE_OK
+		},
+	})
+	registerTablePragma(TablePragma{
+		Name:		"pragma_wal_gate_stats",
+		Columns:	[]string{ "wal_frames", "oldest_mark", "oldest_age_ms", "checkpoints", "blocked", "expired", "last_checkpoint_ms" },
+		Rows: func(db *sqlite3, argument string, emit func(row ...interface{})) (rc int) {
+			pager := db.MainPager()
+			gate := pager.checkpointGate()
+			gate.mutex.Lock()
+			defer gate.mutex.Unlock()
+			var oldestMark uint32
+			var oldestAge int64
+			if oldest, ok := gate.oldestReader(); ok {
+				oldestMark = oldest.mark
+				oldestAge = int64(time.Since(oldest.since) / time.Millisecond)
+			}
+			emit(pager.walFrameCount(), oldestMark, oldestAge, gate.Checkpoints, gate.Blocked, gate.Expired, int64(gate.LastDuration / time.Millisecond))
+			return SQLITE_OK
+		},
+	})
+}
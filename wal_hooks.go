@@ -0,0 +1,110 @@
+package serendipity
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//	This file exposes committed WAL frames to external tooling. Continuous-backup and read-replica systems need a faithful
+//	stream of page-level changes without patching the pager, so the WAL commit path publishes each committed transaction as a
+//	FrameGroup to any registered shippers. Generation markers let consumers detect the discontinuities (checkpoint-restarts
+//	and journal-mode changes) after which frame numbering begins again and a fresh base snapshot is required.
+
+//	A single page image as committed to the WAL.
+type WalFrame struct {
+	PageNumber	uint32	//	The page this frame replaces
+	Frame		uint32	//	Position of the frame within the current generation, starting from 1
+	Data		[]byte	//	The page image; valid only for the duration of the callback unless copied
+}
+
+//	All the frames of one committed transaction, delivered atomically.
+type FrameGroup struct {
+	Generation	uint64		//	Incremented whenever the WAL is reset; frames from different generations must not be mixed
+	Salt		[2]uint32	//	The WAL salt values for this generation, for cross-checking against the live file
+	PageSize	int			//	Size of each page image in bytes
+	DatabaseSize	uint32	//	Size of the database in pages after this commit
+	CommittedAt	time.Time	//	When the leader committed this group; consumers use it to measure replication lag
+	Frames		[]WalFrame
+}
+
+//	A FrameShipper consumes committed frame groups. ShipFrames is called on the committing goroutine with the write lock still
+//	held, so implementations must be quick: copy the data out and return. An error from ShipFrames does not roll back the
+//	transaction - the commit has already happened - but it is reported to the connection's error log and the shipper is
+//	detached, since a shipper which has lost its place must re-seed from a full snapshot anyway.
+type FrameShipper interface {
+	ShipFrames(group *FrameGroup) error
+	GenerationChanged(generation uint64)	//	Called when frame numbering restarts and a new base snapshot is needed
+}
+
+//	The registry of shippers attached to one database file. The registry lives alongside the WAL so that every connection
+//	committing through the same WAL feeds the same shippers.
+type frameShippers struct {
+	mutex		sync.Mutex
+	generation	uint64
+	shippers	[]FrameShipper
+}
+
+//	Attach a shipper, returning a detach function. The shipper immediately receives the current generation so that it can
+//	decide whether its existing state is still valid.
+func (s *frameShippers) Attach(shipper FrameShipper) (detach func()) {
+	s.mutex.Lock()
+	s.shippers = append(s.shippers, shipper)
+	generation := s.generation
+	s.mutex.Unlock()
+	shipper.GenerationChanged(generation)
+	return func() {
+		s.mutex.Lock()
+		for i, attached := range s.shippers {
+			if attached == shipper {
+				s.shippers = append(s.shippers[:i], s.shippers[i + 1:]...)
+				break
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+//	Publish a committed transaction to every attached shipper. Called by the WAL commit path after the commit record has been
+//	made durable and before the write lock is released, so shippers observe transactions in commit order with no gaps. The
+//	group is stamped with the commit time here unless the caller has already recorded a more precise one.
+func (s *frameShippers) publish(group *FrameGroup, log func(format string, values ...interface{})) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	group.Generation = s.generation
+	if group.CommittedAt.IsZero() {
+		group.CommittedAt = time.Now()
+	}
+	remaining := s.shippers[:0]
+	for _, shipper := range s.shippers {
+		if err := shipper.ShipFrames(group); err != nil {
+			log("frame shipper detached: %v", err)
+		} else {
+			remaining = append(remaining, shipper)
+		}
+	}
+	s.shippers = remaining
+}
+
+//	Record that the WAL has been reset - by a checkpoint-restart, a journal-mode change or recovery after a crash - and notify
+//	shippers that frame numbering is starting over.
+func (s *frameShippers) nextGeneration() {
+	s.mutex.Lock()
+	s.generation++
+	generation := s.generation
+	shippers := append([]FrameShipper{}, s.shippers...)
+	s.mutex.Unlock()
+	for _, shipper := range shippers {
+		shipper.GenerationChanged(generation)
+	}
+}
+
+//	Attach a frame shipper to the database file underlying this connection. An error is returned if the connection is not in
+//	WAL mode, since rollback-journal commits have no frames to ship.
+func (db *sqlite3) AttachFrameShipper(shipper FrameShipper) (detach func(), err error) {
+	pager := db.MainPager()
+	if pager == nil || pager.wal == nil {
+		return nil, fmt.Errorf("frame shipping requires WAL mode")
+	}
+	return pager.wal.shippers.Attach(shipper), nil
+}
@@ -0,0 +1,177 @@
+package serendipity
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+//	This file implements WITHOUT ROWID tables: clustered-index tables whose btree is keyed by the declared PRIMARY
+//	KEY instead of a hidden integer. For a table looked up by a multi-column natural key the saving is structural -
+//	the rowid column disappears, the separate PRIMARY KEY index disappears, and a key lookup lands directly on the
+//	row instead of going key -> rowid -> row through two btrees.
+//
+//	The pieces here are the schema rules, the key format and the index format. markWithoutRowid validates and
+//	rewires a table at CREATE time: a PRIMARY KEY is mandatory (there is nothing else to key the btree with), its
+//	columns become NOT NULL as SQLite requires, and AUTOINCREMENT is refused since there is no rowid to allocate.
+//	The PRIMARY KEY columns become the btree key in declaration order, encoded with encodeTableKey so that the
+//	btree's bytewise comparisons order exactly as column-wise SQL comparison would. A secondary index entry ends
+//	with the encoded primary key where a rowid table's would end with the rowid - indexKeyColumns says which
+//	columns that is for a given index - so the planner's "index then primary key lookup" pattern carries over with
+//	the key playing the rowid's role.
+
+//	Set in Table.tabFlags when the table was declared WITHOUT ROWID.
+const TF_WITHOUT_ROWID = 0x0080
+
+func (table *Table) IsWithoutRowid() bool {
+	return table.tabFlags & TF_WITHOUT_ROWID != 0
+}
+
+//	Validate and apply a WITHOUT ROWID declaration at the end of CREATE TABLE processing. On success the table is
+//	flagged, its PRIMARY KEY columns are NOT NULL, and iPKey is cleared - there is no rowid alias column.
+func (parse *Parse) markWithoutRowid(table *Table) (rc int) {
+	pk := table.primaryKeyColumns()
+	if len(pk) == 0 {
+		parse.zErrMsg = sqlite3_mprintf("PRIMARY KEY missing on table %v", table.zName)
+		return SQLITE_ERROR
+	}
+	if table.hasAutoincrement() {
+		parse.zErrMsg = sqlite3_mprintf("AUTOINCREMENT not allowed on WITHOUT ROWID tables")
+		return SQLITE_ERROR
+	}
+	for _, iColumn := range pk {
+		table.Columns[iColumn].notNull = 1
+	}
+	table.tabFlags |= TF_WITHOUT_ROWID
+	table.iPKey = -1
+	return SQLITE_OK
+}
+
+//	The columns of the declared PRIMARY KEY, in key order: the single INTEGER PRIMARY KEY style column when iPKey
+//	names one, otherwise the columns of the first unique index created for a PRIMARY KEY clause.
+func (table *Table) primaryKeyColumns() (columns []int) {
+	if table.iPKey >= 0 {
+		return []int{ table.iPKey }
+	}
+	for index := table.pIndex; index != nil; index = index.pNext {
+		if index.autoIndex {
+			return index.aiColumn
+		}
+	}
+	return nil
+}
+
+//	The column order of one secondary index entry: the indexed columns followed by the primary key columns not
+//	already among them. On a rowid table the tail would be the rowid; here the encoded key both completes the
+//	entry's uniqueness and is what the primary btree is then probed with.
+func (table *Table) indexKeyColumns(index *Index) (columns []int) {
+	columns = append(columns, index.aiColumn...)
+	for _, iKey := range table.primaryKeyColumns() {
+		present := false
+		for _, iColumn := range index.aiColumn {
+			if iColumn == iKey {
+				present = true
+				break
+			}
+		}
+		if !present {
+			columns = append(columns, iKey)
+		}
+	}
+	return
+}
+
+//	Type tag bytes of the key encoding. Their numeric order is the SQL type order - NULL before numbers before
+//	text before blobs - so tags alone settle cross-type comparisons.
+const (
+	keyTagNull	= 0x05
+	keyTagNumber	= 0x15
+	keyTagText	= 0x25
+	keyTagBlob	= 0x35
+)
+
+//	Append one key column value in a bytewise-comparable form. Numbers of both types share one encoding (their SQL
+//	comparison is numeric across types): the IEEE bits with the sign bit flipped, and the rest inverted for
+//	negatives, which makes big-endian byte order agree with numeric order. Text and blobs escape embedded zeros as
+//	0x00 0xff and close with 0x00 0x00, so a shorter prefix orders first and following columns cannot bleed in.
+func encodeKeyValue(buffer []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buffer, keyTagNull)
+	case int64:
+		return encodeKeyNumber(buffer, float64(v))
+	case float64:
+		return encodeKeyNumber(buffer, v)
+	case string:
+		return encodeKeyBytes(append(buffer, keyTagText), []byte(v))
+	case []byte:
+		return encodeKeyBytes(append(buffer, keyTagBlob), v)
+	}
+	return append(buffer, keyTagNull)
+}
+
+func encodeKeyNumber(buffer []byte, v float64) []byte {
+	bits := math.Float64bits(v)
+	if bits & (1 << 63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	buffer = append(buffer, keyTagNumber)
+	return binary.BigEndian.AppendUint64(buffer, bits)
+}
+
+func encodeKeyBytes(buffer, v []byte) []byte {
+	for _, b := range v {
+		if b == 0x00 {
+			buffer = append(buffer, 0x00, 0xff)
+		} else {
+			buffer = append(buffer, b)
+		}
+	}
+	return append(buffer, 0x00, 0x00)
+}
+
+//	The btree key for one row of a WITHOUT ROWID table: its primary key columns, in key order, concatenated in the
+//	comparable encoding. row holds the full row in column order.
+func (table *Table) encodeTableKey(row []interface{}) (key []byte) {
+	for _, iColumn := range table.primaryKeyColumns() {
+		key = encodeKeyValue(key, row[iColumn])
+	}
+	return
+}
+
+//	One secondary index entry for a row: the index's key columns then the primary key tail, as indexKeyColumns
+//	lays them out. Declared columns honour their sort order (see index_desc.go); the key tail is always ascending,
+//	as the rowid it replaces was.
+func (table *Table) encodeIndexKey(index *Index, row []interface{}) (key []byte) {
+	for i, iColumn := range table.indexKeyColumns(index) {
+		sortOrder := byte(SQLITE_SO_ASC)
+		if i < len(index.aiColumn) {
+			sortOrder = index.columnSortOrder(i)
+		}
+		key = encodeDirectedKeyValue(key, row[iColumn], sortOrder)
+	}
+	return
+}
+
+//	Planner awareness: on a WITHOUT ROWID table an equality on every primary key column is a direct row probe and
+//	costs what a rowid lookup costs on a rowid table; the primary key also behaves as a covering index over its
+//	own columns, since they are the btree key and need no second lookup to read.
+func (table *Table) primaryKeyIsRowAccess(constrained []int) bool {
+	if !table.IsWithoutRowid() {
+		return false
+	}
+	for _, iKey := range table.primaryKeyColumns() {
+		present := false
+		for _, iColumn := range constrained {
+			if iColumn == iKey {
+				present = true
+				break
+			}
+		}
+		if !present {
+			return false
+		}
+	}
+	return true
+}